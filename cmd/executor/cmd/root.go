@@ -18,6 +18,7 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -27,8 +28,12 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/buildcontext"
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/creds"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	"github.com/GoogleContainerTools/kaniko/pkg/executor"
+	"github.com/GoogleContainerTools/kaniko/pkg/image/remote"
 	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/GoogleContainerTools/kaniko/pkg/metrics"
 	"github.com/GoogleContainerTools/kaniko/pkg/timing"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/genuinetools/bpfd/proc"
@@ -67,19 +72,53 @@ var RootCmd = &cobra.Command{
 			if err := logging.Configure(logLevel, logFormat, logTimestamp); err != nil {
 				return err
 			}
+			logging.SetStrict(opts.Strict)
+			maskSecrets()
+			// Check before anything is written to the filesystem.
+			if err := checkContainedOrForced(); err != nil {
+				return err
+			}
 
-			if !opts.NoPush && len(opts.Destinations) == 0 {
+			if !opts.NoPush && !opts.PrintDockerfile && len(opts.Destinations) == 0 && len(opts.DestinationTemplates) == 0 {
 				return errors.New("You must provide --destination, or use --no-push")
 			}
+			if opts.CustomPlatform != "" {
+				if _, err := remote.ParsePlatform(opts.CustomPlatform); err != nil {
+					return err
+				}
+			}
+			// Checked before the build context and the base images are fetched.
+			if err := snapshotModeValid(); err != nil {
+				return err
+			}
+			if err := modeFlagsValid(); err != nil {
+				return err
+			}
+			if err := skipSnapshotForValid(); err != nil {
+				return err
+			}
 			if err := cacheFlagsValid(); err != nil {
 				return errors.Wrap(err, "cache flags invalid")
 			}
+			if err := resolveKanikoDir(); err != nil {
+				return errors.Wrap(err, "error resolving kaniko directory")
+			}
 			if err := resolveSourceContext(); err != nil {
 				return errors.Wrap(err, "error resolving source context")
 			}
-			if err := resolveDockerfilePath(); err != nil {
+			if opts.DockerfileFromImage != "" {
+				if err := resolveDockerfileFromImage(); err != nil {
+					return errors.Wrap(err, "error reading dockerfile from image")
+				}
+			} else if err := resolveDockerfilePath(); err != nil {
 				return errors.Wrap(err, "error resolving dockerfile path")
 			}
+			// The templates may use the commit of the build context.
+			destinations, err := executor.ExpandDestinationTemplates(opts)
+			if err != nil {
+				return errors.Wrap(err, "error expanding destination templates")
+			}
+			opts.Destinations = append(opts.Destinations, destinations...)
 			if len(opts.Destinations) == 0 && opts.ImageNameDigestFile != "" {
 				return errors.New("You must provide --destination if setting ImageNameDigestFile")
 			}
@@ -94,15 +133,31 @@ var RootCmd = &cobra.Command{
 					PrefixMatchOnly: false,
 				})
 			}
+			for _, p := range opts.RemoveIgnorePaths {
+				if err := util.RemoveFromBaseIgnoreList(p); err != nil {
+					return err
+				}
+			}
+			if opts.FailOnUnreadable && !opts.Rootless {
+				return errors.New("--fail-on-unreadable can only be set with --rootless")
+			}
+			util.ConfigureRootless(opts.Rootless, opts.FailOnUnreadable)
+			util.ConfigurePreserveFileCapabilities(opts.PreserveFileCaps)
+			if opts.ExtractBufferSize <= 0 {
+				return fmt.Errorf("--extract-buffer-size must be positive, not %d", opts.ExtractBufferSize)
+			}
+			util.ConfigureExtractBufferSize(opts.ExtractBufferSize)
 		}
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		if !checkContained() {
-			if !force {
-				exit(errors.New("kaniko should only be run inside of a container, run with the --force flag if you are sure you want to continue"))
+		if opts.PrintDockerfile {
+			dockerfile, err := executor.ResolveDockerfile(opts)
+			if err != nil {
+				exit(errors.Wrap(err, "error resolving dockerfile"))
 			}
-			logrus.Warn("kaniko is being run outside of a container. This can have dangerous effects on your system")
+			fmt.Print(dockerfile)
+			return
 		}
 		if !opts.NoPush || opts.CacheRepo != "" {
 			if err := executor.CheckPushPermissions(opts); err != nil {
@@ -112,9 +167,21 @@ var RootCmd = &cobra.Command{
 		if err := resolveRelativePaths(); err != nil {
 			exit(errors.Wrap(err, "error resolving relative paths to absolute paths"))
 		}
+		if opts.StageDigestDir != "" {
+			// Keep the digests of the stages built so far when the filesystem is deleted between stages.
+			util.AddToBaseIgnoreList(util.IgnoreListEntry{Path: opts.StageDigestDir})
+		}
+		if opts.ContextCacheDir != "" {
+			util.AddToBaseIgnoreList(util.IgnoreListEntry{Path: opts.ContextCacheDir})
+		}
 		if err := os.Chdir("/"); err != nil {
 			exit(errors.Wrap(err, "error changing to root dir"))
 		}
+		if opts.MetricsAddr != "" {
+			if _, err := metrics.Listen(opts.MetricsAddr); err != nil {
+				exit(errors.Wrap(err, "error serving metrics"))
+			}
+		}
 		image, err := executor.DoBuild(opts)
 		if err != nil {
 			exit(errors.Wrap(err, "error building image"))
@@ -122,13 +189,28 @@ var RootCmd = &cobra.Command{
 		if err := executor.DoPush(image, opts); err != nil {
 			exit(errors.Wrap(err, "error pushing image"))
 		}
+		if err := executor.PushCache(image, opts); err != nil {
+			exit(errors.Wrap(err, "error exporting cache"))
+		}
+		// The build already failed on its own warnings with --strict. The
+		// ones about the push don't fail kaniko, as the image is already
+		// pushed, and are only listed in the summary.
+		logging.LogSummary()
+		util.RemoveTempFiles()
+		if opts.TimingFile != "" {
+			if err := writeTimingFile(opts.TimingFile); err != nil {
+				logging.Warnf("Unable to write timing file %s: %s", opts.TimingFile, err)
+			} else {
+				logrus.Infof("timing file written at %s", opts.TimingFile)
+			}
+		}
 
 		benchmarkFile := os.Getenv("BENCHMARK_FILE")
 		// false is a keyword for integration tests to turn off benchmarking
 		if benchmarkFile != "" && benchmarkFile != "false" {
 			s, err := timing.JSON()
 			if err != nil {
-				logrus.Warnf("Unable to write benchmark file: %s", err)
+				logging.Warnf("Unable to write benchmark file: %s", err)
 				return
 			}
 			if strings.HasPrefix(benchmarkFile, "gs://") {
@@ -140,7 +222,7 @@ var RootCmd = &cobra.Command{
 			} else {
 				f, err := os.Create(benchmarkFile)
 				if err != nil {
-					logrus.Warnf("Unable to create benchmarking file %s: %s", benchmarkFile, err)
+					logging.Warnf("Unable to create benchmarking file %s: %s", benchmarkFile, err)
 					return
 				}
 				defer f.Close()
@@ -154,44 +236,106 @@ var RootCmd = &cobra.Command{
 // addKanikoOptionsFlags configures opts
 func addKanikoOptionsFlags() {
 	RootCmd.PersistentFlags().StringVarP(&opts.DockerfilePath, "dockerfile", "f", "Dockerfile", "Path to the dockerfile to be built.")
+	RootCmd.PersistentFlags().StringVarP(&opts.DockerfileFromImage, "dockerfile-from-image", "", "", "Image to read the Dockerfile from, either from its "+constants.DockerfileLabel+" label or from the --dockerfile path inside the image.")
 	RootCmd.PersistentFlags().StringVarP(&opts.SrcContext, "context", "c", "/workspace/", "Path to the dockerfile build context.")
+	RootCmd.PersistentFlags().StringVarP(&opts.ContextCacheDir, "context-cache-dir", "", "", "Directory to cache the build contexts downloaded from GCS and S3 buckets in. They're only downloaded again once the object in the bucket changes.")
 	RootCmd.PersistentFlags().StringVarP(&ctxSubPath, "context-sub-path", "", "", "Sub path within the given context.")
 	RootCmd.PersistentFlags().StringVarP(&opts.Bucket, "bucket", "b", "", "Name of the GCS bucket from which to access build context as tarball.")
 	RootCmd.PersistentFlags().VarP(&opts.Destinations, "destination", "d", "Registry the final image should be pushed to. Set it repeatedly for multiple destinations.")
+	RootCmd.PersistentFlags().VarP(&opts.DestinationTemplates, "destination-template", "", "Template of a destination, with placeholders such as {{.Arch}}, {{.GitSha}} or {{.Env.NAME}} resolved from the metadata of the build. Set it repeatedly for multiple destinations.")
+	RootCmd.PersistentFlags().StringVarP(&opts.SignKey, "sign-key", "", "", "Path to an unencrypted PEM encoded ECDSA private key to sign the pushed image with, in the format used by cosign")
+	RootCmd.PersistentFlags().BoolVarP(&opts.PushReferrers, "push-referrers", "", false, "Attach the signature of the image to it as an OCI referrer, instead of pushing it to the cosign signature tag. Registries without the referrers API list it in the referrers tag of the image.")
+	opts.BuildContexts = make(map[string]string)
+	RootCmd.PersistentFlags().VarP(&opts.BuildContexts, "build-context", "", "Additional build context COPY --from can copy from by name, as name=path for a local directory or name=docker-image://image for an image. Set it repeatedly for multiple contexts.")
+	opts.PublishStages = make(map[string]string)
+	RootCmd.PersistentFlags().VarP(&opts.PublishStages, "publish-stage", "", "Push an intermediate stage, given by name or index, to a registry, as stage=registry/repository:tag. Set it repeatedly for multiple stages.")
+	RootCmd.PersistentFlags().VarP(&opts.AlsoTags, "also-tag", "", "Extra tag to push the image to in the repository of each destination. Set it repeatedly for multiple tags.")
 	RootCmd.PersistentFlags().StringVarP(&opts.SnapshotMode, "snapshotMode", "", "full", "Change the file attributes inspected during snapshotting")
-	RootCmd.PersistentFlags().StringVarP(&opts.CustomPlatform, "customPlatform", "", "", "Specify the build platform if different from the current host")
+	RootCmd.PersistentFlags().StringVarP(&opts.CustomPlatform, "customPlatform", "", "", "Specify the build platform if different from the current host, as os/arch or os/arch/variant. The matching image is pulled from multi-platform base images.")
 	RootCmd.PersistentFlags().VarP(&opts.BuildArgs, "build-arg", "", "This flag allows you to pass in ARG values at build time. Set it repeatedly for multiple values.")
+	RootCmd.PersistentFlags().VarP(&opts.SecretBuildArgs, "secret-build-arg", "", "Name of a build arg whose value, set with --build-arg, is kept out of the logs, the cache keys and the image. Set it repeatedly for multiple build args.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Insecure, "insecure", "", false, "Push to insecure registry using plain HTTP")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SkipTLSVerify, "skip-tls-verify", "", false, "Push to insecure registry ignoring TLS verify")
 	RootCmd.PersistentFlags().BoolVarP(&opts.InsecurePull, "insecure-pull", "", false, "Pull from insecure registry using plain HTTP")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SkipTLSVerifyPull, "skip-tls-verify-pull", "", false, "Pull from insecure registry ignoring TLS verify")
+	RootCmd.PersistentFlags().BoolVarP(&opts.SkipTLSVerifyCache, "skip-tls-verify-cache", "", false, "Read and write cached layers in insecure registry ignoring TLS verify")
 	RootCmd.PersistentFlags().IntVar(&opts.PushRetry, "push-retry", 0, "Number of retries for the push operation")
+	RootCmd.PersistentFlags().IntVar(&opts.ImageDownloadRetry, "image-download-retry", 0, "Number of retries for downloading base images and cached layers after network errors or server errors")
+	RootCmd.PersistentFlags().IntVar(&opts.LayerFetchParallelism, "layer-fetch-parallelism", 1, "Number of layers of the base image and of images copied from to download in parallel, ahead of their extraction")
+	RootCmd.PersistentFlags().IntVar(&opts.ExtractBufferSize, "extract-buffer-size", util.DefaultExtractBufferSize, "Size in bytes of the buffer the content of files is copied through when extracting layers. Files are streamed to disk, whatever their size.")
+	RootCmd.PersistentFlags().IntVar(&opts.LayerPushParallelism, "layer-push-parallelism", 4, "Number of layers of the image to upload in parallel when pushing it")
 	RootCmd.PersistentFlags().StringVarP(&opts.TarPath, "tarPath", "", "", "Path to save the image in as a tarball instead of pushing")
+	RootCmd.PersistentFlags().StringVarP(&opts.TarCompression, "tar-compression", "", constants.TarCompressionGzip, "Compression of the layers in the tarball saved with --tarPath: gzip, or none for a tarball which loads faster")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SingleSnapshot, "single-snapshot", "", false, "Take a single snapshot at the end of the build.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.SingleSnapshotPerStage, "single-snapshot-per-stage", "", false, "Take a single snapshot at the end of each intermediate stage. The final stage is still snapshotted per command unless --single-snapshot is set.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Reproducible, "reproducible", "", false, "Strip timestamps out of the image to make it reproducible")
+	RootCmd.PersistentFlags().BoolVarP(&opts.FlattenHistory, "flatten-history", "", false, "Remove the history entries of the image that didn't create a layer")
+	RootCmd.PersistentFlags().BoolVarP(&opts.HistoryBuildArgs, "history-build-args", "", false, "Record the build args in scope of RUN commands in their history entries, like docker does. The values of --secret-build-arg are never recorded.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.ErrorOnUnusedBuildArgs, "error-on-unused-build-args", "", false, "Fail the build if a build arg isn't declared by an ARG instruction of the Dockerfile, instead of warning about it")
+	RootCmd.PersistentFlags().BoolVarP(&opts.Strict, "strict", "", false, "Fail the build if there are warnings about it, such as unused build args or deprecated instructions, once it's done.")
+	RootCmd.PersistentFlags().IntVar(&opts.MaxLayers, "max-layers", 0, "Maximum number of layers of the image, including those of the base image. The last layers are merged to stay under it. Set to 0 for no limit.")
+	RootCmd.PersistentFlags().VarP(&opts.MaxImageSize, "max-image-size", "", "Maximum compressed size of the image, including the base image, as a number of bytes or with a unit such as 500MB or 2GiB. The build fails as soon as it's exceeded, listing the largest layers. Set to 0 for no limit.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.PreserveBaseLayers, "preserve-base-layers", "", false, "Keep the layers of the base image as they are, with their digests, when --reproducible or --max-layers change the layers of the image")
+	RootCmd.PersistentFlags().StringVarP(&opts.Created, "created", "", "", "Set the creation timestamp of the image, in RFC 3339 format. Defaults to the time of the build.")
 	RootCmd.PersistentFlags().StringVarP(&opts.Target, "target", "", "", "Set the target build stage to build")
 	RootCmd.PersistentFlags().BoolVarP(&opts.NoPush, "no-push", "", false, "Do not push the image to the registry")
 	RootCmd.PersistentFlags().StringVarP(&opts.CacheRepo, "cache-repo", "", "", "Specify a repository to use as a cache, otherwise one will be inferred from the destination provided")
+	RootCmd.PersistentFlags().BoolVarP(&opts.CacheRepoPerStage, "cache-repo-per-stage", "", false, "Prefix the tags of cached layers with the name or index of their stage, so that stages don't share cached layers")
+	RootCmd.PersistentFlags().VarP(&opts.LayerCacheFrom, "layer-cache-from", "", "Image built by kaniko with the cache enabled to reuse the layers of. Set it repeatedly for multiple images.")
+	RootCmd.PersistentFlags().StringVarP(&opts.CacheTo, "cache-to", "", "", "Tag to push the image to after the build, along with the cache keys of its layers, to import the cache from with --layer-cache-from")
+	RootCmd.PersistentFlags().BoolVarP(&opts.InlineCache, "inline-cache", "", false, "Embed the cache keys of the layers in the image, so that it can be used with --layer-cache-from by later builds")
+	RootCmd.PersistentFlags().StringVarP(&opts.CacheCompression, "cache-compression", "", constants.CacheCompressionGzip, "Compression of the layers pushed to the cache repo: gzip, or none to push them faster at the cost of registry storage")
 	RootCmd.PersistentFlags().StringVarP(&opts.CacheDir, "cache-dir", "", "/cache", "Specify a local directory to use as a cache.")
+	RootCmd.PersistentFlags().StringVarP(&opts.KanikoDir, "kaniko-dir", "", defaultKanikoDir(), "Directory to keep the intermediate files of the build in, such as the build context, the stages saved for later stages and the snapshots. Defaults to $KANIKO_DIR, or /kaniko.")
+	RootCmd.PersistentFlags().StringVarP(&opts.SnapshotIndexDir, "snapshot-index-dir", "", "", "Directory to persist the file hashes of the initial snapshot to, per base image, so that later builds from the same base image don't hash the files again")
+	RootCmd.PersistentFlags().VarP(&opts.SkipSnapshotFor, "skip-snapshot-for", "", "Regular expression matching the RUN commands, such as 'RUN apt-get update', whose changes aren't snapshotted into a layer of their own. Set it repeatedly for multiple expressions.")
+	RootCmd.PersistentFlags().DurationVarP(&opts.SnapshotWarnAfter, "snapshot-warn-after", "", 0, "Log a warning when snapshotting the filesystem takes longer than this duration. Defaults to no warning.")
+	RootCmd.PersistentFlags().StringVarP(&opts.DebugContext, "debug-context", "", "", "Path of a tarball to write the filesystem to if a stage fails to build, for debugging")
+	RootCmd.PersistentFlags().BoolVarP(&opts.DebugOnFailure, "debug-on-failure", "", false, "Start a shell to inspect the filesystem when a RUN command fails, if kaniko is run with a TTY")
 	RootCmd.PersistentFlags().StringVarP(&opts.DigestFile, "digest-file", "", "", "Specify a file to save the digest of the built image to.")
 	RootCmd.PersistentFlags().StringVarP(&opts.ImageNameDigestFile, "image-name-with-digest-file", "", "", "Specify a file to save the image name w/ digest of the built image to.")
 	RootCmd.PersistentFlags().StringVarP(&opts.ImageNameTagDigestFile, "image-name-tag-with-digest-file", "", "", "Specify a file to save the image name w/ image tag w/ digest of the built image to.")
+	RootCmd.PersistentFlags().StringVarP(&opts.ConfigFile, "config-file", "", "", "Specify a file to save the config of the built image to, as JSON.")
+	RootCmd.PersistentFlags().StringVarP(&opts.ExportFSDiff, "export-fs-diff", "", "", "Path of a tarball to write the changes made by the final stage to the filesystem of its base image to, as a single layer with whiteouts for the deleted files.")
+	RootCmd.PersistentFlags().StringVarP(&opts.StageDigestDir, "stage-digest-dir", "", "", "Specify a directory to save the digest of each intermediate stage used as the base image of another stage to, in files named after the index and the name of the stage.")
 	RootCmd.PersistentFlags().StringVarP(&opts.OCILayoutPath, "oci-layout-path", "", "", "Path to save the OCI image layout of the built image.")
+	RootCmd.PersistentFlags().StringVarP(&opts.TimingFile, "timing-file", "", "", "Specify a file to save the duration of each build step to, as JSON.")
+	RootCmd.PersistentFlags().StringVarP(&opts.MetricsAddr, "metrics-addr", "", "", "Address to serve Prometheus metrics on at /metrics, e.g. :9090. Disabled if empty.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Cache, "cache", "", false, "Use cache when building image")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Cleanup, "cleanup", "", false, "Clean the filesystem at the end")
+	RootCmd.PersistentFlags().StringVarP(&opts.CleanupRun, "cleanup-run", "", "", "Shell command to run at the end of the final stage, such as to remove package caches. Only the files it deletes are kept, as whiteouts in a layer without any file.")
+	RootCmd.PersistentFlags().DurationVarP(&opts.BuildTimeout, "build-timeout", "", 0, "Abort the build, killing any running RUN command, if it takes longer than this duration. Defaults to no timeout.")
+	RootCmd.PersistentFlags().DurationVarP(&opts.RunTimeout, "run-timeout", "", 0, "Kill each RUN command that takes longer than this duration, failing the build. Defaults to no timeout.")
+	RootCmd.PersistentFlags().StringVarP(&opts.RunNetwork, "network", "", constants.RunNetworkDefault, "Network mode of RUN commands: default, or none to run them without network")
 	RootCmd.PersistentFlags().DurationVarP(&opts.CacheTTL, "cache-ttl", "", time.Hour*336, "Cache timeout in hours. Defaults to two weeks.")
 	RootCmd.PersistentFlags().VarP(&opts.InsecureRegistries, "insecure-registry", "", "Insecure registry using plain HTTP to push and pull. Set it repeatedly for multiple registries.")
 	RootCmd.PersistentFlags().VarP(&opts.SkipTLSVerifyRegistries, "skip-tls-verify-registry", "", "Insecure registry ignoring TLS verify to push and pull. Set it repeatedly for multiple registries.")
 	opts.RegistriesCertificates = make(map[string]string)
 	RootCmd.PersistentFlags().VarP(&opts.RegistriesCertificates, "registry-certificate", "", "Use the provided certificate for TLS communication with the given registry. Expected format is 'my.registry.url=/path/to/the/server/certificate'.")
 	RootCmd.PersistentFlags().VarP(&opts.RegistryMirrors, "registry-mirror", "", "Registry mirror to use as pull-through cache instead of docker.io. Set it repeatedly for multiple mirrors.")
+	RootCmd.PersistentFlags().StringVarP(&opts.HTTPProxy, "http-proxy", "", "", "Proxy to use for plain HTTP registry requests, overriding HTTP_PROXY")
+	RootCmd.PersistentFlags().StringVarP(&opts.HTTPSProxy, "https-proxy", "", "", "Proxy to use for HTTPS registry requests, overriding HTTPS_PROXY")
+	RootCmd.PersistentFlags().StringVarP(&opts.NoProxy, "no-proxy", "", "", "Comma-separated list of registries that shouldn't be proxied, overriding NO_PROXY")
 	RootCmd.PersistentFlags().BoolVarP(&opts.IgnoreVarRun, "whitelist-var-run", "", true, "Ignore /var/run directory when taking image snapshot. Set it to false to preserve /var/run/ in destination image. (Default true).")
 	RootCmd.PersistentFlags().VarP(&opts.Labels, "label", "", "Set metadata for an image. Set it repeatedly for multiple labels.")
+	RootCmd.PersistentFlags().VarP(&opts.Env, "env", "", "Set an environment variable in the final image, overriding ENV instructions. Use KEY= to remove a variable. Set it repeatedly for multiple variables.")
+	RootCmd.PersistentFlags().VarP(&opts.ScratchEnv, "scratch-env", "", "Set a default environment variable for stages built FROM scratch, in addition to PATH. Use KEY= to remove a variable. Set it repeatedly for multiple variables.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.ResetEntrypoint, "reset-entrypoint", "", false, "Drop the ENTRYPOINT inherited from the base image if the final stage doesn't set one")
+	RootCmd.PersistentFlags().BoolVarP(&opts.ResetEnv, "reset-env", "", false, "Drop the environment variables inherited from the base image which the final stage doesn't set")
+	RootCmd.PersistentFlags().BoolVarP(&opts.ResetLabels, "reset-labels", "", false, "Drop the labels inherited from the base image which the final stage or --label don't set")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SkipUnusedStages, "skip-unused-stages", "", false, "Build only used stages if defined to true. Otherwise it builds by default all stages, even the unnecessaries ones until it reaches the target stage / end of Dockerfile")
 	RootCmd.PersistentFlags().BoolVarP(&opts.RunV2, "use-new-run", "", false, "Use the experimental run implementation for detecting changes without requiring file system snapshots.")
 	RootCmd.PersistentFlags().Var(&opts.Git, "git", "Branch to clone if build context is a git repository")
-	RootCmd.PersistentFlags().BoolVarP(&opts.CacheCopyLayers, "cache-copy-layers", "", false, "Caches copy layers")
+	RootCmd.PersistentFlags().IntVar(&opts.CaptureOutputLines, "capture-output-lines", 10, "Number of lines of output of a failed RUN command to include in the error. Set to 0 to disable.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.NoRunPrefix, "no-run-prefix", "", false, "Write the output of RUN commands directly to stdout and stderr instead of logging it with the stage and step number")
+	RootCmd.PersistentFlags().BoolVarP(&opts.CacheCopyLayers, "cache-copy-layers", "", true, "Cache layers created by COPY commands when --cache is set. Set to false if the build context changes on every build.")
 	RootCmd.PersistentFlags().VarP(&opts.IgnorePaths, "ignore-path", "", "Ignore these paths when taking a snapshot. Set it repeatedly for multiple paths.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.SkipDiskSpaceCheck, "skip-disk-space-check", "", false, "Don't check that there is enough disk space to extract the base images before extracting them, nor warn when disk space gets low")
+	RootCmd.PersistentFlags().BoolVarP(&opts.Rootless, "rootless", "", false, "Run without root: skip the files that can't be read when taking snapshots, and own the files of the image by the user running kaniko")
+	RootCmd.PersistentFlags().BoolVarP(&opts.FailOnUnreadable, "fail-on-unreadable", "", false, "Fail the build instead of skipping the files that can't be read, when --rootless is set")
+	RootCmd.PersistentFlags().BoolVarP(&opts.PreserveFileCaps, "preserve-file-capabilities", "", true, "Restore the capabilities of the files of base images when extracting them, and keep the capabilities of files in snapshots. Set to false if the filesystem doesn't support them.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.PrintDockerfile, "print-resolved-dockerfile", "", false, "Print the Dockerfile kaniko would build, with its variables substituted, its base images pinned to their digest and their ONBUILD triggers expanded, and exit without building it")
+	RootCmd.PersistentFlags().VarP(&opts.RemoveIgnorePaths, "remove-ignore-path", "", "Snapshot these paths even though they are ignored by default or are mount points. Set it repeatedly for multiple paths.")
 }
 
 // addHiddenFlags marks certain flags as hidden from the executor help text
@@ -202,8 +346,79 @@ func addHiddenFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().MarkHidden("bucket")
 }
 
+// for testing
+var (
+	containerRuntime = func() proc.ContainerRuntime {
+		return proc.GetContainerRuntime(0, 0)
+	}
+	// containerEnvFiles are left at the root of their containers by docker and
+	// podman, which tells they are containers when their cgroups don't, as
+	// with cgroup namespaces.
+	containerEnvFiles = []string{"/.dockerenv", "/run/.containerenv"}
+)
+
 func checkContained() bool {
-	return proc.GetContainerRuntime(0, 0) != proc.RuntimeNotFound
+	if runtime := containerRuntime(); runtime != proc.RuntimeNotFound {
+		logrus.Debugf("Running in a %s container", runtime)
+		return true
+	}
+	for _, f := range containerEnvFiles {
+		if util.FilepathExists(f) {
+			logrus.Debugf("Running in a container, as %s exists", f)
+			return true
+		}
+	}
+	return false
+}
+
+// checkContainedOrForced returns an error if kaniko doesn't run in a
+// container, as it changes the root filesystem, unless --force is set.
+func checkContainedOrForced() error {
+	if checkContained() {
+		return nil
+	}
+	if !force {
+		return errors.New("kaniko should only be run inside of a container, run with the --force flag if you are sure you want to continue")
+	}
+	logging.Warnf("kaniko is being run outside of a container. This can have dangerous effects on your system")
+	return nil
+}
+
+// snapshotModeValid returns an error if --snapshotMode isn't set to one of the
+// snapshot modes.
+func snapshotModeValid() error {
+	for _, mode := range constants.SnapshotModes {
+		if opts.SnapshotMode == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("--snapshotMode must be one of %s, not %q", strings.Join(constants.SnapshotModes, ", "), opts.SnapshotMode)
+}
+
+// modeFlagsValid returns an error if --network, --tar-compression or
+// --cache-compression isn't set to one of its modes.
+func modeFlagsValid() error {
+	if opts.RunNetwork != constants.RunNetworkDefault && opts.RunNetwork != constants.RunNetworkNone {
+		return fmt.Errorf("--network must be %s or %s, not %q", constants.RunNetworkDefault, constants.RunNetworkNone, opts.RunNetwork)
+	}
+	if opts.TarCompression != constants.TarCompressionGzip && opts.TarCompression != constants.TarCompressionNone {
+		return fmt.Errorf("--tar-compression must be %s or %s, not %q", constants.TarCompressionGzip, constants.TarCompressionNone, opts.TarCompression)
+	}
+	if opts.CacheCompression != constants.CacheCompressionGzip && opts.CacheCompression != constants.CacheCompressionNone {
+		return fmt.Errorf("--cache-compression must be %s or %s, not %q", constants.CacheCompressionGzip, constants.CacheCompressionNone, opts.CacheCompression)
+	}
+	return nil
+}
+
+// skipSnapshotForValid returns an error if one of the --skip-snapshot-for
+// patterns isn't a valid regular expression.
+func skipSnapshotForValid() error {
+	for _, pattern := range opts.SkipSnapshotFor {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return errors.Wrapf(err, "invalid --skip-snapshot-for pattern %q", pattern)
+		}
+	}
+	return nil
 }
 
 // cacheFlagsValid makes sure the flags passed in related to caching are valid
@@ -222,7 +437,7 @@ func cacheFlagsValid() error {
 // resolveDockerfilePath resolves the Dockerfile path to an absolute path
 func resolveDockerfilePath() error {
 	if isURL(opts.DockerfilePath) {
-		return nil
+		return downloadDockerfile()
 	}
 	if util.FilepathExists(opts.DockerfilePath) {
 		abs, err := filepath.Abs(opts.DockerfilePath)
@@ -244,6 +459,75 @@ func resolveDockerfilePath() error {
 	return errors.New("please provide a valid path to a Dockerfile within the build context with --dockerfile")
 }
 
+// defaultKanikoDir returns the kaniko directory set with the KANIKO_DIR
+// environment variable, or /kaniko.
+func defaultKanikoDir() string {
+	if dir := os.Getenv(constants.KanikoDirEnv); dir != "" {
+		return dir
+	}
+	return constants.KanikoDir
+}
+
+// resolveKanikoDir makes kaniko keep its intermediate files in the directory
+// given with --kaniko-dir, once it made sure the directory can be written to,
+// and ignores the directory when taking snapshots.
+func resolveKanikoDir() error {
+	dir, err := filepath.Abs(opts.KanikoDir)
+	if err != nil {
+		return errors.Wrapf(err, "getting absolute path for %s", opts.KanikoDir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "creating %s", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".write-check")
+	if err != nil {
+		return errors.Wrapf(err, "%s isn't writable", dir)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	opts.KanikoDir = dir
+	if dir != filepath.Clean(config.KanikoDir) {
+		logrus.Infof("Using %s as the kaniko directory", dir)
+		config.KanikoDir = dir
+		util.AddToBaseIgnoreList(util.IgnoreListEntry{Path: dir})
+	}
+	return nil
+}
+
+// resolveDockerfileFromImage writes the Dockerfile embedded in the image given
+// with --dockerfile-from-image to the kaniko directory
+func resolveDockerfileFromImage() error {
+	image, err := remote.RetrieveRemoteImage(opts.DockerfileFromImage, opts.RegistryOptions, opts.CustomPlatform)
+	if err != nil {
+		return errors.Wrapf(err, "retrieving image %s", opts.DockerfileFromImage)
+	}
+	d, err := dockerfile.ExtractFromImage(image, opts.DockerfilePath)
+	if err != nil {
+		return err
+	}
+	dockerfilePath := filepath.Join(config.KanikoDir, constants.DockerfilePath)
+	if err := ioutil.WriteFile(dockerfilePath, d, 0644); err != nil {
+		return errors.Wrap(err, "writing dockerfile")
+	}
+	opts.DockerfilePath = dockerfilePath
+	return nil
+}
+
+// downloadDockerfile downloads the Dockerfile at the URL given with
+// --dockerfile to the kaniko directory, so that it's only fetched once.
+func downloadDockerfile() error {
+	d, err := dockerfile.Download(opts.DockerfilePath)
+	if err != nil {
+		return err
+	}
+	dockerfilePath := filepath.Join(config.KanikoDir, constants.DockerfilePath)
+	if err := ioutil.WriteFile(dockerfilePath, d, 0644); err != nil {
+		return errors.Wrap(err, "writing dockerfile")
+	}
+	opts.DockerfilePath = dockerfilePath
+	return nil
+}
+
 // resolveEnvironmentBuildArgs replace build args without value by the same named environment variable
 func resolveEnvironmentBuildArgs(arguments []string, resolver func(string) string) {
 	for index, argument := range arguments {
@@ -255,30 +539,48 @@ func resolveEnvironmentBuildArgs(arguments []string, resolver func(string) strin
 	}
 }
 
-// copy Dockerfile to /kaniko/Dockerfile so that if it's specified in the .dockerignore
+// maskSecrets keeps the values of the build args named by --secret-build-arg
+// and the registry password set with KANIKO_REGISTRY_PASS out of the logs.
+func maskSecrets() {
+	sensitive := dockerfile.SensitiveBuildArgs(opts.BuildArgs, opts.SecretBuildArgs)
+	var values []string
+	for _, name := range opts.SecretBuildArgs {
+		v, ok := sensitive[name]
+		if !ok {
+			logging.Warnf("Secret build arg %s has no value, set it with --build-arg", name)
+			continue
+		}
+		values = append(values, v)
+	}
+	logging.MaskValues(append(values, creds.SecretValues()...))
+}
+
+// copy Dockerfile to the kaniko directory so that if it's specified in the .dockerignore
 // it won't be copied into the image
 func copyDockerfile() error {
-	if _, err := util.CopyFile(opts.DockerfilePath, constants.DockerfilePath, util.FileContext{}, util.DoNotChangeUID, util.DoNotChangeGID); err != nil {
+	dockerfilePath := filepath.Join(config.KanikoDir, constants.DockerfilePath)
+	if _, err := util.CopyFile(opts.DockerfilePath, dockerfilePath, util.FileContext{}, util.DoNotChangeUID, util.DoNotChangeGID); err != nil {
 		return errors.Wrap(err, "copying dockerfile")
 	}
 	dockerignorePath := opts.DockerfilePath + ".dockerignore"
 	if util.FilepathExists(dockerignorePath) {
-		if _, err := util.CopyFile(dockerignorePath, constants.DockerfilePath+".dockerignore", util.FileContext{}, util.DoNotChangeUID, util.DoNotChangeGID); err != nil {
+		if _, err := util.CopyFile(dockerignorePath, dockerfilePath+".dockerignore", util.FileContext{}, util.DoNotChangeUID, util.DoNotChangeGID); err != nil {
 			return errors.Wrap(err, "copying Dockerfile.dockerignore")
 		}
 	}
-	opts.DockerfilePath = constants.DockerfilePath
+	opts.DockerfilePath = dockerfilePath
 	return nil
 }
 
 // resolveSourceContext unpacks the source context if it is a tar in a bucket or in kaniko container
-// it resets srcContext to be the path to the unpacked build context within the image
+// it resets srcContext to be the path to the unpacked build context within the image,
+// or to the --context-sub-path within it
 func resolveSourceContext() error {
 	if opts.SrcContext == "" && opts.Bucket == "" {
 		return errors.New("please specify a path to the build context with the --context flag or a bucket with the --bucket flag")
 	}
 	if opts.SrcContext != "" && !strings.Contains(opts.SrcContext, "://") {
-		return nil
+		return resolveContextSubPath()
 	}
 	if opts.Bucket != "" {
 		if !strings.Contains(opts.Bucket, "://") {
@@ -292,6 +594,7 @@ func resolveSourceContext() error {
 		GitBranch:            opts.Git.Branch,
 		GitSingleBranch:      opts.Git.SingleBranch,
 		GitRecurseSubmodules: opts.Git.RecurseSubmodules,
+		ContextCacheDir:      opts.ContextCacheDir,
 	})
 	if err != nil {
 		return err
@@ -301,16 +604,38 @@ func resolveSourceContext() error {
 	if err != nil {
 		return err
 	}
-	if ctxSubPath != "" {
-		opts.SrcContext = filepath.Join(opts.SrcContext, ctxSubPath)
-		if _, err := os.Stat(opts.SrcContext); os.IsNotExist(err) {
-			return err
-		}
+	if err := resolveContextSubPath(); err != nil {
+		return err
 	}
 	logrus.Debugf("Build context located at %s", opts.SrcContext)
 	return nil
 }
 
+// resolveContextSubPath resets srcContext to the --context-sub-path within it,
+// which must be a directory of the context
+func resolveContextSubPath() error {
+	if ctxSubPath == "" {
+		return nil
+	}
+	subPath := filepath.Join(opts.SrcContext, ctxSubPath)
+	rel, err := filepath.Rel(opts.SrcContext, subPath)
+	if err != nil {
+		return errors.Wrapf(err, "resolving context sub path %s", ctxSubPath)
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("context sub path %s is outside of the build context", ctxSubPath)
+	}
+	fi, err := os.Stat(subPath)
+	if err != nil {
+		return errors.Wrapf(err, "context sub path %s", ctxSubPath)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("context sub path %s is not a directory", ctxSubPath)
+	}
+	opts.SrcContext = subPath
+	return nil
+}
+
 func resolveRelativePaths() error {
 	optsPaths := []*string{
 		&opts.DockerfilePath,
@@ -320,6 +645,13 @@ func resolveRelativePaths() error {
 		&opts.DigestFile,
 		&opts.ImageNameDigestFile,
 		&opts.ImageNameTagDigestFile,
+		&opts.StageDigestDir,
+		&opts.ConfigFile,
+		&opts.ExportFSDiff,
+		&opts.ContextCacheDir,
+		&opts.TimingFile,
+		&opts.DebugContext,
+		&opts.SignKey,
 	}
 
 	for _, p := range optsPaths {
@@ -336,10 +668,33 @@ func resolveRelativePaths() error {
 		}
 		logrus.Debugf("Resolved relative path %s to %s", relp, *p)
 	}
+	for name, path := range opts.BuildContexts {
+		if shdSkip(path) {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return errors.Wrapf(err, "Couldn't resolve relative path %s to an absolute path", path)
+		}
+		opts.BuildContexts[name] = abs
+	}
 	return nil
 }
 
+// writeTimingFile writes the duration of every timed build and push step to path as JSON
+func writeTimingFile(path string) error {
+	s, err := timing.EntriesJSON()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(s), 0644)
+}
+
 func exit(err error) {
+	util.RemoveTempFiles()
 	fmt.Println(err)
 	os.Exit(1)
 }
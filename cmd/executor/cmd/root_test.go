@@ -17,9 +17,20 @@ limitations under the License.
 package cmd
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/timing"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/genuinetools/bpfd/proc"
 )
 
 func TestSkipPath(t *testing.T) {
@@ -149,3 +160,388 @@ func TestResolveEnvironmentBuildArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteTimingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	timing.DefaultRun.Stop(timing.Start("Command: RUN true"))
+	path := filepath.Join(dir, "out", "timings.json")
+	testutil.CheckNoError(t, writeTimingFile(path))
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Entries []timing.Entry `json:"entries"`
+	}
+	testutil.CheckNoError(t, json.Unmarshal(b, &got))
+	if len(got.Entries) == 0 || got.Entries[len(got.Entries)-1].Category != "Command: RUN true" {
+		t.Errorf("expected timing file to end with the command entry, got %s", b)
+	}
+}
+
+func TestResolveSourceContextSubPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "services", "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "services", "app", "Dockerfile"), []byte("FROM scratch"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	originalOpts, originalSubPath := *opts, ctxSubPath
+	defer func() {
+		*opts, ctxSubPath = originalOpts, originalSubPath
+	}()
+
+	tests := []struct {
+		description string
+		subPath     string
+		expected    string
+		shouldErr   bool
+	}{
+		{
+			description: "no sub path",
+			expected:    dir,
+		},
+		{
+			description: "nested sub path",
+			subPath:     "services/app",
+			expected:    filepath.Join(dir, "services", "app"),
+		},
+		{
+			description: "sub path staying in the context",
+			subPath:     "services/../services/app/",
+			expected:    filepath.Join(dir, "services", "app"),
+		},
+		{
+			description: "sub path outside of the context",
+			subPath:     "../",
+			shouldErr:   true,
+		},
+		{
+			description: "missing sub path",
+			subPath:     "services/missing",
+			shouldErr:   true,
+		},
+		{
+			description: "sub path is a file",
+			subPath:     "services/app/Dockerfile",
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			opts.SrcContext = dir
+			opts.Bucket = ""
+			ctxSubPath = test.subPath
+			err := resolveSourceContext()
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			testutil.CheckDeepEqual(t, test.expected, opts.SrcContext)
+		})
+	}
+}
+
+func TestContextSubPathDockerignore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for path, contents := range map[string]string{
+		".dockerignore":     "top-level-ignored",
+		"app/.dockerignore": "sub-path-ignored",
+		"app/Dockerfile":    "FROM scratch\nCOPY . .",
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	originalOpts, originalSubPath := *opts, ctxSubPath
+	defer func() {
+		*opts, ctxSubPath = originalOpts, originalSubPath
+	}()
+	opts.SrcContext = dir
+	opts.Bucket = ""
+	ctxSubPath = "app"
+	testutil.CheckNoError(t, resolveSourceContext())
+
+	fileContext, err := util.NewFileContextFromDockerfile(filepath.Join(opts.SrcContext, "Dockerfile"), opts.SrcContext)
+	testutil.CheckNoError(t, err)
+	if !fileContext.ExcludesFile("sub-path-ignored") {
+		t.Error("expected the .dockerignore of the context sub path to be used")
+	}
+	if fileContext.ExcludesFile("top-level-ignored") {
+		t.Error("expected the .dockerignore of the top level context not to be used")
+	}
+}
+
+func TestResolveKanikoDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kaniko-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	originalOpts, originalKanikoDir := *opts, config.KanikoDir
+	defer func() {
+		*opts, config.KanikoDir = originalOpts, originalKanikoDir
+		util.RemoveFromBaseIgnoreList(filepath.Join(dir, "kaniko"))
+		util.DetectFilesystemIgnoreList(config.IgnoreListPath)
+	}()
+
+	tests := []struct {
+		description string
+		kanikoDir   string
+		expected    string
+		shouldErr   bool
+	}{
+		{
+			description: "directory to create",
+			kanikoDir:   filepath.Join(dir, "kaniko", "..", "kaniko"),
+			expected:    filepath.Join(dir, "kaniko"),
+		},
+		{
+			description: "directory below a file",
+			kanikoDir:   filepath.Join(dir, "file", "kaniko"),
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			config.KanikoDir = originalKanikoDir
+			opts.KanikoDir = test.kanikoDir
+			err := resolveKanikoDir()
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				testutil.CheckDeepEqual(t, originalKanikoDir, config.KanikoDir)
+				return
+			}
+			testutil.CheckDeepEqual(t, test.expected, config.KanikoDir)
+			testutil.CheckNoError(t, util.DetectFilesystemIgnoreList(config.IgnoreListPath))
+			testutil.CheckDeepEqual(t, true, util.CheckIgnoreList(filepath.Join(test.expected, "file")))
+
+			// The Dockerfile is copied to the kaniko directory.
+			opts.DockerfilePath = filepath.Join(dir, "Dockerfile")
+			testutil.CheckNoError(t, resolveDockerfilePath())
+			testutil.CheckDeepEqual(t, filepath.Join(test.expected, constants.DockerfilePath), opts.DockerfilePath)
+			if !util.FilepathExists(opts.DockerfilePath) {
+				t.Errorf("expected the Dockerfile to be copied to %s", opts.DockerfilePath)
+			}
+		})
+	}
+}
+
+func TestCheckContainedOrForced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, ".dockerenv")
+	if err := ioutil.WriteFile(envFile, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	originalRuntime, originalEnvFiles, originalForce := containerRuntime, containerEnvFiles, force
+	defer func() {
+		containerRuntime, containerEnvFiles, force = originalRuntime, originalEnvFiles, originalForce
+	}()
+
+	tests := []struct {
+		description string
+		runtime     proc.ContainerRuntime
+		envFile     string
+		force       bool
+		shouldErr   bool
+	}{
+		{
+			description: "container runtime detected",
+			runtime:     proc.RuntimeDocker,
+			envFile:     filepath.Join(dir, "missing"),
+		},
+		{
+			description: "container env file",
+			runtime:     proc.RuntimeNotFound,
+			envFile:     envFile,
+		},
+		{
+			description: "not in a container",
+			runtime:     proc.RuntimeNotFound,
+			envFile:     filepath.Join(dir, "missing"),
+			shouldErr:   true,
+		},
+		{
+			description: "not in a container with --force",
+			runtime:     proc.RuntimeNotFound,
+			envFile:     filepath.Join(dir, "missing"),
+			force:       true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			containerRuntime = func() proc.ContainerRuntime { return test.runtime }
+			containerEnvFiles = []string{test.envFile}
+			force = test.force
+			testutil.CheckError(t, test.shouldErr, checkContainedOrForced())
+		})
+	}
+}
+
+func TestResolveDockerfilePathURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("FROM scratch"))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "kaniko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	originalOpts, originalKanikoDir := *opts, config.KanikoDir
+	defer func() {
+		*opts, config.KanikoDir = originalOpts, originalKanikoDir
+	}()
+	config.KanikoDir = dir
+	opts.DockerfilePath = server.URL + "/Dockerfile"
+
+	testutil.CheckNoError(t, resolveDockerfilePath())
+	testutil.CheckDeepEqual(t, filepath.Join(dir, constants.DockerfilePath), opts.DockerfilePath)
+	d, err := ioutil.ReadFile(opts.DockerfilePath)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "FROM scratch", string(d))
+}
+
+func TestSnapshotModeValidatedAtStartup(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("FROM scratch"))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "kaniko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	originalOpts, originalKanikoDir, originalForce := *opts, config.KanikoDir, force
+	defer func() {
+		*opts, config.KanikoDir, force = originalOpts, originalKanikoDir, originalForce
+	}()
+	force = true
+
+	tests := []struct {
+		snapshotMode string
+		shouldErr    bool
+	}{
+		{snapshotMode: constants.SnapshotModeFull},
+		{snapshotMode: constants.SnapshotModeRedo},
+		{snapshotMode: "bogus", shouldErr: true},
+		{snapshotMode: "", shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.snapshotMode, func(t *testing.T) {
+			requests = 0
+			*opts = originalOpts
+			opts.SnapshotMode = test.snapshotMode
+			opts.NoPush = true
+			opts.KanikoDir = dir
+			opts.SrcContext = dir
+			opts.DockerfilePath = server.URL + "/Dockerfile"
+
+			err := RootCmd.PersistentPreRunE(RootCmd, nil)
+			testutil.CheckError(t, test.shouldErr, err)
+			if !test.shouldErr {
+				testutil.CheckDeepEqual(t, 1, requests)
+				return
+			}
+			testutil.CheckDeepEqual(t, `--snapshotMode must be one of full, redo, time, changed, not "`+test.snapshotMode+`"`, err.Error())
+			// The Dockerfile isn't downloaded.
+			testutil.CheckDeepEqual(t, 0, requests)
+		})
+	}
+}
+
+func TestModeFlagsValidatedAtStartup(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("FROM scratch"))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "kaniko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	originalOpts, originalKanikoDir, originalForce := *opts, config.KanikoDir, force
+	defer func() {
+		*opts, config.KanikoDir, force = originalOpts, originalKanikoDir, originalForce
+	}()
+	force = true
+
+	tests := []struct {
+		description string
+		setFlag     func()
+		expectedErr string
+	}{
+		{
+			description: "network",
+			setFlag:     func() { opts.RunNetwork = "host" },
+			expectedErr: `--network must be default or none, not "host"`,
+		},
+		{
+			description: "tar compression",
+			setFlag:     func() { opts.TarCompression = "zstd" },
+			expectedErr: `--tar-compression must be gzip or none, not "zstd"`,
+		},
+		{
+			description: "cache compression",
+			setFlag:     func() { opts.CacheCompression = "zstd" },
+			expectedErr: `--cache-compression must be gzip or none, not "zstd"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			requests = 0
+			*opts = originalOpts
+			opts.NoPush = true
+			opts.KanikoDir = dir
+			opts.SrcContext = dir
+			opts.DockerfilePath = server.URL + "/Dockerfile"
+			test.setFlag()
+
+			err := RootCmd.PersistentPreRunE(RootCmd, nil)
+			testutil.CheckError(t, true, err)
+			testutil.CheckDeepEqual(t, test.expectedErr, err.Error())
+			// The Dockerfile isn't downloaded.
+			testutil.CheckDeepEqual(t, 0, requests)
+		})
+	}
+}
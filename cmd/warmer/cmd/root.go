@@ -17,6 +17,7 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -24,6 +25,7 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/cache"
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/GoogleContainerTools/kaniko/pkg/metrics"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
@@ -54,15 +56,33 @@ var RootCmd = &cobra.Command{
 		if len(opts.Images) == 0 {
 			return errors.New("You must select at least one image to cache")
 		}
+		if opts.HealthAddr != "" && opts.WarmInterval <= 0 {
+			return errors.New("--health-addr requires --warm-interval, to run the warmer as a service")
+		}
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
+		if opts.MetricsAddr != "" {
+			if _, err := metrics.Listen(opts.MetricsAddr); err != nil {
+				exit(errors.Wrap(err, "Failed to serve metrics"))
+			}
+		}
 		if _, err := os.Stat(opts.CacheDir); os.IsNotExist(err) {
 			err = os.MkdirAll(opts.CacheDir, 0755)
 			if err != nil {
 				exit(errors.Wrap(err, "Failed to create cache directory"))
 			}
 		}
+		if opts.WarmInterval > 0 {
+			service := cache.NewWarmService(opts)
+			if opts.HealthAddr != "" {
+				if _, err := service.Listen(opts.HealthAddr); err != nil {
+					exit(errors.Wrap(err, "Failed to serve health"))
+				}
+			}
+			service.Run(context.Background(), opts.WarmInterval)
+			return
+		}
 		if err := cache.WarmCache(opts); err != nil {
 			exit(errors.Wrap(err, "Failed warming cache"))
 		}
@@ -74,6 +94,7 @@ func addKanikoOptionsFlags() {
 	RootCmd.PersistentFlags().VarP(&opts.Images, "image", "i", "Image to cache. Set it repeatedly for multiple images.")
 	RootCmd.PersistentFlags().StringVarP(&opts.CacheDir, "cache-dir", "c", "/cache", "Directory of the cache.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Force, "force", "f", false, "Force cache overwriting.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.CacheLayers, "cache-layers", "", false, "Also cache each layer of the images, so that builds from images sharing layers with them read those layers from the cache.")
 	RootCmd.PersistentFlags().DurationVarP(&opts.CacheTTL, "cache-ttl", "", time.Hour*336, "Cache timeout in hours. Defaults to two weeks.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.InsecurePull, "insecure-pull", "", false, "Pull from insecure registry using plain HTTP")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SkipTLSVerifyPull, "skip-tls-verify-pull", "", false, "Pull from insecure registry ignoring TLS verify")
@@ -82,7 +103,13 @@ func addKanikoOptionsFlags() {
 	opts.RegistriesCertificates = make(map[string]string)
 	RootCmd.PersistentFlags().VarP(&opts.RegistriesCertificates, "registry-certificate", "", "Use the provided certificate for TLS communication with the given registry. Expected format is 'my.registry.url=/path/to/the/server/certificate'.")
 	RootCmd.PersistentFlags().VarP(&opts.RegistryMirrors, "registry-mirror", "", "Registry mirror to use as pull-through cache instead of docker.io. Set it repeatedly for multiple mirrors.")
+	RootCmd.PersistentFlags().StringVarP(&opts.HTTPProxy, "http-proxy", "", "", "Proxy to use for plain HTTP registry requests, overriding HTTP_PROXY")
+	RootCmd.PersistentFlags().StringVarP(&opts.HTTPSProxy, "https-proxy", "", "", "Proxy to use for HTTPS registry requests, overriding HTTPS_PROXY")
+	RootCmd.PersistentFlags().StringVarP(&opts.NoProxy, "no-proxy", "", "", "Comma-separated list of registries that shouldn't be proxied, overriding NO_PROXY")
 	RootCmd.PersistentFlags().StringVarP(&opts.CustomPlatform, "customPlatform", "", "", "Specify the build platform if different from the current host")
+	RootCmd.PersistentFlags().StringVarP(&opts.MetricsAddr, "metrics-addr", "", "", "Address to serve Prometheus metrics on at /metrics, e.g. :9090. Disabled if empty.")
+	RootCmd.PersistentFlags().DurationVarP(&opts.WarmInterval, "warm-interval", "", 0, "Run the warmer as a service warming the cache again at this interval, such as 1h, to cache new versions of the images. Images already cached are skipped. Disabled if 0.")
+	RootCmd.PersistentFlags().StringVarP(&opts.HealthAddr, "health-addr", "", "", "Address to serve the health of the warmer service on at /healthz and /readyz, e.g. :8080. Requires --warm-interval. Disabled if empty.")
 }
 
 // addHiddenFlags marks certain flags as hidden from the executor help text
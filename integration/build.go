@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package integration
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// BuildResult is the outcome of building an image with docker or kaniko.
+type BuildResult struct {
+	// Image is the name the image was built as.
+	Image string
+	// Digest is the digest of the image pushed by kaniko, or the ID of the image
+	// built by docker. It's empty if the build failed.
+	Digest string
+	// Duration is the time the build took.
+	Duration time.Duration
+	// Output is the combined stdout and stderr of the build.
+	Output []byte
+}
+
+// BuildResults are the outcomes of building a Dockerfile with both docker and
+// kaniko.
+type BuildResults struct {
+	Docker *BuildResult
+	Kaniko *BuildResult
+}
+
+// runBuild runs cmd, which builds image and writes its digest to digestFile,
+// and returns the outcome of the build. The result is returned along with the
+// error if the build fails, so that its output can be inspected.
+func runBuild(image, digestFile string, cmd *exec.Cmd) (*BuildResult, error) {
+	start := time.Now()
+	out, err := RunCommandWithoutTest(cmd)
+	result := &BuildResult{
+		Image:    image,
+		Duration: time.Since(start),
+		Output:   out,
+	}
+	if err != nil {
+		return result, err
+	}
+	digest, err := ioutil.ReadFile(digestFile)
+	if err != nil {
+		return result, err
+	}
+	result.Digest = strings.TrimSpace(string(digest))
+	return result, nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package integration
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func Test_runBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	digestFile := filepath.Join(dir, "digest")
+
+	tests := []struct {
+		name           string
+		script         string
+		expectedDigest string
+		expectedOutput string
+		shouldErr      bool
+	}{
+		{
+			name:           "successful build",
+			script:         "echo built; echo 'sha256:0123456789abcdef' > " + digestFile,
+			expectedDigest: "sha256:0123456789abcdef",
+			expectedOutput: "built\n",
+		},
+		{
+			name:           "failed build",
+			script:         "echo failed >&2; exit 1",
+			expectedOutput: "failed\n",
+			shouldErr:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(digestFile)
+			result, err := runBuild("image", digestFile, exec.Command("sh", "-c", test.script))
+			testutil.CheckError(t, test.shouldErr, err)
+			testutil.CheckDeepEqual(t, "image", result.Image)
+			testutil.CheckDeepEqual(t, test.expectedDigest, result.Digest)
+			testutil.CheckDeepEqual(t, test.expectedOutput, string(result.Output))
+			if result.Duration <= 0 {
+				t.Errorf("expected the duration of the build to be recorded, got %s", result.Duration)
+			}
+		})
+	}
+}
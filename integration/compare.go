@@ -0,0 +1,232 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package integration
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+)
+
+// daemonPrefix marks the references of images in the docker daemon.
+const daemonPrefix = "daemon://"
+
+// FileInfo is the metadata and the digest of the contents of a file in the
+// filesystem of an image. Modification times are left out, as they differ
+// between builds.
+type FileInfo struct {
+	Mode     os.FileMode
+	UID      int
+	GID      int
+	Linkname string
+	Size     int64
+	Digest   string
+}
+
+// FileDiff is a file in the filesystems of both images which differs.
+type FileDiff struct {
+	Path   string
+	Image1 FileInfo
+	Image2 FileInfo
+}
+
+// ConfigDiff is a field of the config which differs between the images.
+type ConfigDiff struct {
+	Field  string
+	Image1 interface{}
+	Image2 interface{}
+}
+
+// ImageDiff is the difference between the filesystems and configs of two
+// images.
+type ImageDiff struct {
+	// Added are the files only in the second image.
+	Added []string
+	// Deleted are the files only in the first image.
+	Deleted  []string
+	Modified []FileDiff
+	Config   []ConfigDiff
+}
+
+// Empty returns true if the images don't differ.
+func (d *ImageDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Deleted) == 0 && len(d.Modified) == 0 && len(d.Config) == 0
+}
+
+func (d *ImageDiff) String() string {
+	var b strings.Builder
+	for _, p := range d.Added {
+		fmt.Fprintf(&b, "added %s\n", p)
+	}
+	for _, p := range d.Deleted {
+		fmt.Fprintf(&b, "deleted %s\n", p)
+	}
+	for _, f := range d.Modified {
+		fmt.Fprintf(&b, "modified %s: %+v != %+v\n", f.Path, f.Image1, f.Image2)
+	}
+	for _, c := range d.Config {
+		fmt.Fprintf(&b, "config %s: %v != %v\n", c.Field, c.Image1, c.Image2)
+	}
+	return b.String()
+}
+
+// CompareImages compares the filesystems and configs of the images image1 and
+// image2. Images in the docker daemon are referred to with daemonPrefix, the
+// others are pulled from their registry.
+func CompareImages(image1, image2 string) (*ImageDiff, error) {
+	img1, err := pullImage(image1)
+	if err != nil {
+		return nil, err
+	}
+	img2, err := pullImage(image2)
+	if err != nil {
+		return nil, err
+	}
+	return diffImages(img1, img2)
+}
+
+func pullImage(image string) (v1.Image, error) {
+	ref, err := name.ParseReference(strings.TrimPrefix(image, daemonPrefix), name.WeakValidation)
+	if err != nil {
+		return nil, err
+	}
+	var img v1.Image
+	if strings.HasPrefix(image, daemonPrefix) {
+		img, err = daemon.Image(ref)
+	} else {
+		img, err = remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "pulling %s", image)
+	}
+	return img, nil
+}
+
+// diffImages returns the difference between img1 and img2.
+func diffImages(img1, img2 v1.Image) (*ImageDiff, error) {
+	files1, err := imageFiles(img1)
+	if err != nil {
+		return nil, err
+	}
+	files2, err := imageFiles(img2)
+	if err != nil {
+		return nil, err
+	}
+	cfg1, err := img1.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg2, err := img2.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &ImageDiff{Config: diffConfigs(cfg1.Config, cfg2.Config)}
+	for p, f1 := range files1 {
+		f2, ok := files2[p]
+		switch {
+		case !ok:
+			diff.Deleted = append(diff.Deleted, p)
+		case f1 != f2:
+			diff.Modified = append(diff.Modified, FileDiff{Path: p, Image1: f1, Image2: f2})
+		}
+	}
+	for p := range files2 {
+		if _, ok := files1[p]; !ok {
+			diff.Added = append(diff.Added, p)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Deleted)
+	sort.Slice(diff.Modified, func(i, j int) bool { return diff.Modified[i].Path < diff.Modified[j].Path })
+	return diff, nil
+}
+
+// imageFiles returns the files in the filesystem of img by their absolute
+// path.
+func imageFiles(img v1.Image) (map[string]FileInfo, error) {
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	files := map[string]FileInfo{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading the filesystem of the image")
+		}
+		f := FileInfo{
+			Mode:     hdr.FileInfo().Mode(),
+			UID:      hdr.Uid,
+			GID:      hdr.Gid,
+			Linkname: hdr.Linkname,
+			Size:     hdr.Size,
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, errors.Wrapf(err, "reading %s", hdr.Name)
+			}
+			f.Digest = fmt.Sprintf("sha256:%x", h.Sum(nil))
+		}
+		files[path.Clean("/"+hdr.Name)] = f
+	}
+}
+
+// diffConfigs returns the fields of the configs which affect how containers
+// run and differ between cfg1 and cfg2. Empty and missing values are equal.
+func diffConfigs(cfg1, cfg2 v1.Config) []ConfigDiff {
+	fields := []ConfigDiff{
+		{"Env", cfg1.Env, cfg2.Env},
+		{"Entrypoint", cfg1.Entrypoint, cfg2.Entrypoint},
+		{"Cmd", cfg1.Cmd, cfg2.Cmd},
+		{"WorkingDir", cfg1.WorkingDir, cfg2.WorkingDir},
+		{"User", cfg1.User, cfg2.User},
+		{"ExposedPorts", cfg1.ExposedPorts, cfg2.ExposedPorts},
+		{"Volumes", cfg1.Volumes, cfg2.Volumes},
+		{"Labels", cfg1.Labels, cfg2.Labels},
+		{"OnBuild", cfg1.OnBuild, cfg2.OnBuild},
+		{"StopSignal", cfg1.StopSignal, cfg2.StopSignal},
+	}
+	var diffs []ConfigDiff
+	for _, f := range fields {
+		a, b := reflect.ValueOf(f.Image1), reflect.ValueOf(f.Image2)
+		if a.Len() == 0 && b.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(f.Image1, f.Image2) {
+			diffs = append(diffs, f)
+		}
+	}
+	return diffs
+}
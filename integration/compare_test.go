@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package integration
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// testImage returns an image with cfg and a single layer with files, by
+// their path.
+func testImage(t *testing.T, cfg v1.Config, files map[string]string) v1.Image {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for p, contents := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: p, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = mutate.Config(img, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func Test_diffImages(t *testing.T) {
+	cfg := v1.Config{Env: []string{"PATH=/bin"}, Entrypoint: []string{"/bin/sh"}}
+	files := map[string]string{"etc/foo": "foo", "etc/bar": "bar"}
+
+	tests := []struct {
+		name     string
+		cfg      v1.Config
+		files    map[string]string
+		expected *ImageDiff
+	}{
+		{
+			name:     "identical images",
+			cfg:      cfg,
+			files:    files,
+			expected: &ImageDiff{},
+		},
+		{
+			name: "differing images",
+			cfg:  v1.Config{Env: []string{"PATH=/usr/bin"}, Entrypoint: []string{"/bin/sh"}, Cmd: []string{"-c"}},
+			files: map[string]string{
+				"etc/foo": "foo2",
+				"etc/baz": "baz",
+			},
+			expected: &ImageDiff{
+				Added:   []string{"/etc/baz"},
+				Deleted: []string{"/etc/bar"},
+				Modified: []FileDiff{
+					{
+						Path: "/etc/foo",
+						Image1: FileInfo{
+							Mode:   0644,
+							Size:   3,
+							Digest: "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+						},
+						Image2: FileInfo{
+							Mode:   0644,
+							Size:   4,
+							Digest: "sha256:4963bd713a7eb1bce458868b0c8472bdc8bc5929a7892a92dd24344aea92093d",
+						},
+					},
+				},
+				Config: []ConfigDiff{
+					{Field: "Env", Image1: []string{"PATH=/bin"}, Image2: []string{"PATH=/usr/bin"}},
+					{Field: "Cmd", Image1: []string(nil), Image2: []string{"-c"}},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff, err := diffImages(testImage(t, cfg, files), testImage(t, test.cfg, test.files))
+			testutil.CheckError(t, false, err)
+			testutil.CheckDeepEqual(t, test.expected, diff)
+		})
+	}
+}
@@ -41,6 +41,7 @@ const (
 	dockerPrefix     = "docker-"
 	kanikoPrefix     = "kaniko-"
 	buildContextPath = "/workspace"
+	kanikoDigestDir  = "/kaniko/digest"
 	cacheDir         = "/workspace/cache"
 	baseImageToCache = "gcr.io/google-appengine/debian9@sha256:1d6a9a6d106bd795098f60f4abb7083626354fa6735e81743c7f8cfca11259f0"
 )
@@ -156,8 +157,8 @@ func FindDockerFiles(dockerfilesPath string) ([]string, error) {
 // DockerFileBuilder knows how to build docker files using both Kaniko and Docker and
 // keeps track of which files have been built.
 type DockerFileBuilder struct {
-	// Holds all available docker files and whether or not they've been built
-	filesBuilt           map[string]struct{}
+	// Holds the results of the docker files which have been built
+	filesBuilt           map[string]*BuildResults
 	DockerfilesToIgnore  map[string]struct{}
 	TestCacheDockerfiles map[string]struct{}
 }
@@ -165,7 +166,7 @@ type DockerFileBuilder struct {
 // NewDockerFileBuilder will create a DockerFileBuilder initialized with dockerfiles, which
 // it will assume are all as yet unbuilt.
 func NewDockerFileBuilder() *DockerFileBuilder {
-	d := DockerFileBuilder{filesBuilt: map[string]struct{}{}}
+	d := DockerFileBuilder{filesBuilt: map[string]*BuildResults{}}
 	d.DockerfilesToIgnore = map[string]struct{}{
 		"Dockerfile_test_add_404": {},
 		// TODO: remove test_user_run from this when https://github.com/GoogleContainerTools/container-diff/issues/237 is fixed
@@ -191,9 +192,18 @@ func addServiceAccountFlags(flags []string, serviceAccount string) []string {
 	return flags
 }
 
-func (d *DockerFileBuilder) BuildDockerImage(imageRepo, dockerfilesPath, dockerfile, contextDir string) error {
+// BuildDockerImage builds dockerfile (located at dockerfilesPath) with docker, using
+// contextDir as the build context. The resulting image is tagged with imageRepo.
+func (d *DockerFileBuilder) BuildDockerImage(imageRepo, dockerfilesPath, dockerfile, contextDir string) (*BuildResult, error) {
 	fmt.Printf("Building image for Dockerfile %s\n", dockerfile)
 
+	iidDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(iidDir)
+	iidFile := filepath.Join(iidDir, "iid")
+
 	var buildArgs []string
 	buildArgFlag := "--build-arg"
 	for _, arg := range argsMap[dockerfile] {
@@ -207,6 +217,7 @@ func (d *DockerFileBuilder) BuildDockerImage(imageRepo, dockerfilesPath, dockerf
 	dockerArgs := []string{
 		"build",
 		"-t", dockerImage,
+		"--iidfile", iidFile,
 	}
 
 	if dockerfilesPath != "" {
@@ -221,27 +232,30 @@ func (d *DockerFileBuilder) BuildDockerImage(imageRepo, dockerfilesPath, dockerf
 		dockerCmd.Env = append(dockerCmd.Env, env...)
 	}
 
-	out, err := RunCommandWithoutTest(dockerCmd)
+	result, err := runBuild(dockerImage, iidFile, dockerCmd)
 	if err != nil {
-		return fmt.Errorf("Failed to build image %s with docker command \"%s\": %s %s", dockerImage, dockerCmd.Args, err, string(out))
+		return result, fmt.Errorf("Failed to build image %s with docker command \"%s\": %s %s", dockerImage, dockerCmd.Args, err, string(result.Output))
 	}
-	fmt.Printf("Build image for Dockerfile %s as %s. docker build output: %s \n", dockerfile, dockerImage, out)
-	return nil
+	fmt.Printf("Build image for Dockerfile %s as %s. docker build output: %s \n", dockerfile, dockerImage, result.Output)
+	return result, nil
 }
 
 // BuildImage will build dockerfile (located at dockerfilesPath) using both kaniko and docker.
 // The resulting image will be tagged with imageRepo. If the dockerfile will be built with
 // context (i.e. it is in `buildContextTests`) the context will be pulled from gcsBucket.
-func (d *DockerFileBuilder) BuildImage(config *integrationTestConfig, dockerfilesPath, dockerfile string) error {
+func (d *DockerFileBuilder) BuildImage(config *integrationTestConfig, dockerfilesPath, dockerfile string) (*BuildResults, error) {
 	_, ex, _, _ := runtime.Caller(0)
 	cwd := filepath.Dir(ex)
 
 	return d.BuildImageWithContext(config, dockerfilesPath, dockerfile, cwd)
 }
 
-func (d *DockerFileBuilder) BuildImageWithContext(config *integrationTestConfig, dockerfilesPath, dockerfile, contextDir string) error {
-	if _, present := d.filesBuilt[dockerfile]; present {
-		return nil
+// BuildImageWithContext builds dockerfile like BuildImage, using contextDir as the
+// build context. The results of dockerfiles which were already built are returned
+// without building them again.
+func (d *DockerFileBuilder) BuildImageWithContext(config *integrationTestConfig, dockerfilesPath, dockerfile, contextDir string) (*BuildResults, error) {
+	if results, present := d.filesBuilt[dockerfile]; present {
+		return results, nil
 	}
 	gcsBucket, serviceAccount, imageRepo := config.gcsBucket, config.serviceAccount, config.imageRepo
 
@@ -252,7 +266,7 @@ func (d *DockerFileBuilder) BuildImageWithContext(config *integrationTestConfig,
 	}
 
 	timer := timing.Start(dockerfile + "_docker")
-	d.BuildDockerImage(imageRepo, dockerfilesPath, dockerfile, contextDir)
+	dockerResult, _ := d.BuildDockerImage(imageRepo, dockerfilesPath, dockerfile, contextDir)
 	timing.DefaultRun.Stop(timer)
 
 	contextFlag := "-c"
@@ -275,15 +289,17 @@ func (d *DockerFileBuilder) BuildImageWithContext(config *integrationTestConfig,
 
 	kanikoImage := GetKanikoImage(imageRepo, dockerfile)
 	timer = timing.Start(dockerfile + "_kaniko")
-	if _, err := buildKanikoImage(dockerfilesPath, dockerfile, buildArgs, additionalKanikoFlags, kanikoImage,
-		contextDir, gcsBucket, serviceAccount, true); err != nil {
-		return err
+	_, kanikoResult, err := buildKanikoImage(dockerfilesPath, dockerfile, buildArgs, additionalKanikoFlags, kanikoImage,
+		contextDir, gcsBucket, serviceAccount, true)
+	results := &BuildResults{Docker: dockerResult, Kaniko: kanikoResult}
+	if err != nil {
+		return results, err
 	}
 	timing.DefaultRun.Stop(timer)
 
-	d.filesBuilt[dockerfile] = struct{}{}
+	d.filesBuilt[dockerfile] = results
 
-	return nil
+	return results, nil
 }
 
 func populateVolumeCache() error {
@@ -308,13 +324,20 @@ func populateVolumeCache() error {
 }
 
 // buildCachedImages builds the images for testing caching via kaniko where version is the nth time this image has been built
-func (d *DockerFileBuilder) buildCachedImages(config *integrationTestConfig, cacheRepo, dockerfilesPath string, version int, args []string) error {
+func (d *DockerFileBuilder) buildCachedImages(config *integrationTestConfig, cacheRepo, dockerfilesPath string, version int, args []string) ([]*BuildResult, error) {
 	imageRepo, serviceAccount := config.imageRepo, config.serviceAccount
 	_, ex, _, _ := runtime.Caller(0)
 	cwd := filepath.Dir(ex)
 
 	cacheFlag := "--cache=true"
 
+	digestDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(digestDir)
+
+	var results []*BuildResult
 	for dockerfile := range d.TestCacheDockerfiles {
 		benchmarkEnv := "BENCHMARK_FILE=false"
 		if b, err := strconv.ParseBool(os.Getenv("BENCHMARK")); err == nil && b {
@@ -325,12 +348,14 @@ func (d *DockerFileBuilder) buildCachedImages(config *integrationTestConfig, cac
 
 		dockerRunFlags := []string{"run", "--net=host",
 			"-v", cwd + ":/workspace",
+			"-v", digestDir + ":" + kanikoDigestDir,
 			"-e", benchmarkEnv}
 		dockerRunFlags = addServiceAccountFlags(dockerRunFlags, serviceAccount)
 		dockerRunFlags = append(dockerRunFlags, ExecutorImage,
 			"-f", path.Join(buildContextPath, dockerfilesPath, dockerfile),
 			"-d", kanikoImage,
 			"-c", buildContextPath,
+			"--digest-file", path.Join(kanikoDigestDir, dockerfile),
 			cacheFlag,
 			"--cache-repo", cacheRepo,
 			"--cache-dir", cacheDir)
@@ -339,57 +364,69 @@ func (d *DockerFileBuilder) buildCachedImages(config *integrationTestConfig, cac
 		}
 		kanikoCmd := exec.Command("docker", dockerRunFlags...)
 
-		_, err := RunCommandWithoutTest(kanikoCmd)
+		result, err := runBuild(kanikoImage, filepath.Join(digestDir, dockerfile), kanikoCmd)
+		results = append(results, result)
 		if err != nil {
-			return fmt.Errorf("Failed to build cached image %s with kaniko command \"%s\": %s", kanikoImage, kanikoCmd.Args, err)
+			return results, fmt.Errorf("Failed to build cached image %s with kaniko command \"%s\": %s", kanikoImage, kanikoCmd.Args, err)
 		}
 	}
-	return nil
+	return results, nil
 }
 
 // buildRelativePathsImage builds the images for testing passing relatives paths to Kaniko
-func (d *DockerFileBuilder) buildRelativePathsImage(imageRepo, dockerfile, serviceAccount, buildContextPath string) error {
+func (d *DockerFileBuilder) buildRelativePathsImage(imageRepo, dockerfile, serviceAccount, buildContextPath string) (*BuildResults, error) {
 	_, ex, _, _ := runtime.Caller(0)
 	cwd := filepath.Dir(ex)
 
 	dockerImage := GetDockerImage(imageRepo, "test_relative_"+dockerfile)
 	kanikoImage := GetKanikoImage(imageRepo, "test_relative_"+dockerfile)
 
+	digestDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(digestDir)
+
 	dockerCmd := exec.Command("docker",
 		append([]string{"build",
 			"-t", dockerImage,
 			"-f", dockerfile,
+			"--iidfile", filepath.Join(digestDir, "iid"),
 			"./context"},
 		)...,
 	)
 
+	results := &BuildResults{}
 	timer := timing.Start(dockerfile + "_docker")
-	out, err := RunCommandWithoutTest(dockerCmd)
+	results.Docker, err = runBuild(dockerImage, filepath.Join(digestDir, "iid"), dockerCmd)
 	timing.DefaultRun.Stop(timer)
 	if err != nil {
-		return fmt.Errorf("Failed to build image %s with docker command \"%s\": %s %s", dockerImage, dockerCmd.Args, err, string(out))
+		return results, fmt.Errorf("Failed to build image %s with docker command \"%s\": %s %s", dockerImage, dockerCmd.Args, err, string(results.Docker.Output))
 	}
 
-	dockerRunFlags := []string{"run", "--net=host", "-v", cwd + ":/workspace"}
+	dockerRunFlags := []string{"run", "--net=host",
+		"-v", cwd + ":/workspace",
+		"-v", digestDir + ":" + kanikoDigestDir}
 	dockerRunFlags = addServiceAccountFlags(dockerRunFlags, serviceAccount)
 	dockerRunFlags = append(dockerRunFlags, ExecutorImage,
 		"-f", dockerfile,
 		"-d", kanikoImage,
-		"-c", buildContextPath)
+		"-c", buildContextPath,
+		"--digest-file", path.Join(kanikoDigestDir, "digest"))
 
 	kanikoCmd := exec.Command("docker", dockerRunFlags...)
 
 	timer = timing.Start(dockerfile + "_kaniko_relative_paths")
-	out, err = RunCommandWithoutTest(kanikoCmd)
+	results.Kaniko, err = runBuild(kanikoImage, filepath.Join(digestDir, "digest"), kanikoCmd)
 	timing.DefaultRun.Stop(timer)
 
 	if err != nil {
-		return fmt.Errorf(
+		return results, fmt.Errorf(
 			"Failed to build relative path image %s with kaniko command \"%s\": %s\n%s",
-			kanikoImage, kanikoCmd.Args, err, string(out))
+			kanikoImage, kanikoCmd.Args, err, string(results.Kaniko.Output))
 	}
 
-	return nil
+	return results, nil
 }
 
 func buildKanikoImage(
@@ -402,12 +439,17 @@ func buildKanikoImage(
 	gcsBucket string,
 	serviceAccount string,
 	shdUpload bool,
-) (string, error) {
+) (string, *BuildResult, error) {
 	benchmarkEnv := "BENCHMARK_FILE=false"
 	benchmarkDir, err := ioutil.TempDir("", "")
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	digestDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return "", nil, err
 	}
+	defer os.RemoveAll(digestDir)
 	if b, err := strconv.ParseBool(os.Getenv("BENCHMARK")); err == nil && b {
 		benchmarkEnv = "BENCHMARK_FILE=/kaniko/benchmarks/" + dockerfile
 		if shdUpload {
@@ -426,6 +468,7 @@ func buildKanikoImage(
 		"-e", benchmarkEnv,
 		"-v", contextDir + ":/workspace",
 		"-v", benchmarkDir + ":/kaniko/benchmarks",
+		"-v", digestDir + ":" + kanikoDigestDir,
 	}
 
 	if env, ok := envsMap[dockerfile]; ok {
@@ -443,19 +486,20 @@ func buildKanikoImage(
 
 	dockerRunFlags = append(dockerRunFlags, ExecutorImage,
 		"-f", kanikoDockerfilePath,
-		"-d", kanikoImage)
+		"-d", kanikoImage,
+		"--digest-file", path.Join(kanikoDigestDir, "digest"))
 	dockerRunFlags = append(dockerRunFlags, additionalFlags...)
 
 	kanikoCmd := exec.Command("docker", dockerRunFlags...)
 
-	out, err := RunCommandWithoutTest(kanikoCmd)
+	result, err := runBuild(kanikoImage, filepath.Join(digestDir, "digest"), kanikoCmd)
 	if err != nil {
-		return "", fmt.Errorf("Failed to build image %s with kaniko command \"%s\": %s %s", kanikoImage, kanikoCmd.Args, err, string(out))
+		return "", result, fmt.Errorf("Failed to build image %s with kaniko command \"%s\": %s %s", kanikoImage, kanikoCmd.Args, err, string(result.Output))
 	}
 	if outputCheck := outputChecks[dockerfile]; outputCheck != nil {
-		if err := outputCheck(dockerfile, out); err != nil {
-			return "", fmt.Errorf("Output check failed for image %s with kaniko command : %s %s", kanikoImage, err, string(out))
+		if err := outputCheck(dockerfile, result.Output); err != nil {
+			return "", result, fmt.Errorf("Output check failed for image %s with kaniko command : %s %s", kanikoImage, err, string(result.Output))
 		}
 	}
-	return benchmarkDir, nil
+	return benchmarkDir, result, nil
 }
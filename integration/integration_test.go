@@ -20,11 +20,13 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -44,7 +46,6 @@ var imageBuilder *DockerFileBuilder
 var allDockerfiles []string
 
 const (
-	daemonPrefix       = "daemon://"
 	integrationPath    = "integration"
 	dockerfilesPath    = "dockerfiles"
 	emptyContainerDiff = `[
@@ -387,6 +388,38 @@ func TestBuildWithLabels(t *testing.T) {
 	checkContainerDiffOutput(t, diff, expected)
 }
 
+// TestBuildWithEmulation builds an arm64 image with a RUN instruction on an amd64 host.
+// It needs QEMU binfmt_misc handlers registered on the host, so it only runs if EMULATION is set.
+func TestBuildWithEmulation(t *testing.T) {
+	if b, err := strconv.ParseBool(os.Getenv("EMULATION")); err != nil || !b {
+		t.SkipNow()
+	}
+	if runtime.GOARCH != "amd64" {
+		t.Skipf("emulation test only runs on amd64, not %s", runtime.GOARCH)
+	}
+	contextDir, err := ioutil.TempDir("", "emulation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(contextDir)
+	dockerfile := "FROM busybox\nRUN uname -m > /arch\n"
+	if err := ioutil.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	kanikoImage := GetKanikoImage(config.imageRepo, "Dockerfile_test_emulation")
+	if _, _, err := buildKanikoImage("", "Dockerfile", nil, []string{"--customPlatform=linux/arm64"},
+		kanikoImage, contextDir, config.gcsBucket, config.serviceAccount, false); err != nil {
+		t.Fatal(err)
+	}
+
+	runCmd := exec.Command("docker", "run", "--rm", "--platform=linux/arm64", kanikoImage, "cat", "/arch")
+	out := RunCommand(runCmd, t)
+	if arch := strings.TrimSpace(string(out)); arch != "aarch64" {
+		t.Errorf("expected the RUN instruction to run as aarch64, got %q", arch)
+	}
+}
+
 func TestBuildWithHTTPError(t *testing.T) {
 	repo := getGitRepo()
 	dockerfile := fmt.Sprintf("%s/%s/Dockerfile_test_add_404", integrationPath, dockerfilesPath)
@@ -453,7 +486,7 @@ func TestLayers(t *testing.T) {
 }
 
 func buildImage(t *testing.T, dockerfile string, imageBuilder *DockerFileBuilder) {
-	if err := imageBuilder.BuildImage(config, dockerfilesPath, dockerfile); err != nil {
+	if _, err := imageBuilder.BuildImage(config, dockerfilesPath, dockerfile); err != nil {
 		t.Errorf("Error building image: %s", err)
 		t.FailNow()
 	}
@@ -474,11 +507,11 @@ func TestCache(t *testing.T) {
 
 			cache := filepath.Join(config.imageRepo, "cache", fmt.Sprintf("%v", time.Now().UnixNano()))
 			// Build the initial image which will cache layers
-			if err := imageBuilder.buildCachedImages(config, cache, dockerfilesPath, 0, args); err != nil {
+			if _, err := imageBuilder.buildCachedImages(config, cache, dockerfilesPath, 0, args); err != nil {
 				t.Fatalf("error building cached image for the first time: %v", err)
 			}
 			// Build the second image which should pull from the cache
-			if err := imageBuilder.buildCachedImages(config, cache, dockerfilesPath, 1, args); err != nil {
+			if _, err := imageBuilder.buildCachedImages(config, cache, dockerfilesPath, 1, args); err != nil {
 				t.Fatalf("error building cached image for the first time: %v", err)
 			}
 			// Make sure both images are the same
@@ -508,7 +541,7 @@ func TestRelativePaths(t *testing.T) {
 
 		contextPath := "./context"
 
-		err := imageBuilder.buildRelativePathsImage(
+		_, err := imageBuilder.buildRelativePathsImage(
 			config.imageRepo,
 			dockerfile,
 			config.serviceAccount,
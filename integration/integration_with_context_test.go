@@ -46,7 +46,7 @@ func TestWithContext(t *testing.T) {
 		t.Run("test_with_context_"+name, func(t *testing.T) {
 			t.Parallel()
 
-			if err := builder.BuildImageWithContext(
+			if _, err := builder.BuildImageWithContext(
 				config, "", name, testDir,
 			); err != nil {
 				t.Fatal(err)
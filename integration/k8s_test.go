@@ -55,7 +55,7 @@ func TestK8s(t *testing.T) {
 		t.Run("test_k8s_with_context_"+name, func(t *testing.T) {
 			t.Parallel()
 
-			if err := builder.BuildDockerImage(
+			if _, err := builder.BuildDockerImage(
 				config.imageRepo, "", name, testDir,
 			); err != nil {
 				t.Fatal(err)
@@ -0,0 +1,126 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// bucketObject is the tarball of a build context kept in a bucket.
+type bucketObject interface {
+	// name returns the URL of the object.
+	name() string
+	// version returns an identifier of the content of the object, which
+	// changes whenever it's overwritten, such as its generation or ETag.
+	version() (string, error)
+	// download writes the content of the object to f.
+	download(f *os.File) error
+}
+
+// unpackBucketObject unpacks the build context tarball obj into directory.
+// With a cacheDir, the tarball is kept there keyed on the version of obj, and
+// is only downloaded again once obj changes.
+func unpackBucketObject(obj bucketObject, cacheDir, directory string) error {
+	if err := os.MkdirAll(directory, 0750); err != nil {
+		return err
+	}
+	if cacheDir == "" {
+		tarPath := filepath.Join(directory, constants.ContextTar)
+		if err := downloadBucketObject(obj, tarPath); err != nil {
+			return err
+		}
+		if err := util.UnpackCompressedTar(tarPath, directory); err != nil {
+			return err
+		}
+		// Remove the tar so it doesn't interfere with subsequent commands
+		return os.Remove(tarPath)
+	}
+
+	tarPath, err := cachedBucketObject(obj, cacheDir)
+	if err != nil {
+		return err
+	}
+	return util.UnpackCompressedTar(tarPath, directory)
+}
+
+// cachedBucketObject returns the path of the tarball of the current version of
+// obj in cacheDir, downloading it if it isn't there. The tarballs of its
+// previous versions are removed.
+func cachedBucketObject(obj bucketObject, cacheDir string) (string, error) {
+	version, err := obj.version()
+	if err != nil {
+		return "", errors.Wrapf(err, "getting the version of %s", obj.name())
+	}
+	objectDir := filepath.Join(cacheDir, cacheKey(obj.name()))
+	tarPath := filepath.Join(objectDir, cacheKey(version)+".tar.gz")
+	if _, err := os.Stat(tarPath); err == nil {
+		logrus.Infof("Using the build context cached in %s, %s is unchanged", tarPath, obj.name())
+		return tarPath, nil
+	}
+
+	if err := os.RemoveAll(objectDir); err != nil {
+		return "", errors.Wrapf(err, "removing the previous versions of %s from the cache", obj.name())
+	}
+	if err := os.MkdirAll(objectDir, 0750); err != nil {
+		return "", err
+	}
+	// Downloaded next to the cached tarball and renamed once complete, so that
+	// an interrupted download isn't mistaken for it.
+	tmp, err := ioutil.TempFile(objectDir, "download")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := downloadBucketObject(obj, tmp.Name()); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), tarPath); err != nil {
+		return "", err
+	}
+	logrus.Debugf("Cached the build context %s in %s", obj.name(), tarPath)
+	return tarPath, nil
+}
+
+// downloadBucketObject downloads obj to path.
+func downloadBucketObject(obj bucketObject, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	logrus.Infof("Downloading the build context %s", obj.name())
+	if err := obj.download(f); err != nil {
+		return errors.Wrapf(err, "downloading %s", obj.name())
+	}
+	return f.Close()
+}
+
+// cacheKey returns s as the name of a file of the cache.
+func cacheKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// fakeObject is a bucket object with a single file in its tarball, counting
+// the times it's downloaded.
+type fakeObject struct {
+	etag      string
+	content   string
+	downloads int
+}
+
+func (o *fakeObject) name() string {
+	return "gs://bucket/context.tar.gz"
+}
+
+func (o *fakeObject) version() (string, error) {
+	return o.etag, nil
+}
+
+func (o *fakeObject) download(f *os.File) error {
+	o.downloads++
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(o.content)), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	if _, err := tw.Write([]byte(o.content)); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	_, err := f.Write(buf.Bytes())
+	return err
+}
+
+func Test_unpackBucketObject(t *testing.T) {
+	tests := []struct {
+		description       string
+		cache             bool
+		versions          []string
+		expectedDownloads int
+	}{
+		{
+			description:       "without cache",
+			versions:          []string{"1", "1"},
+			expectedDownloads: 2,
+		},
+		{
+			description:       "cached",
+			cache:             true,
+			versions:          []string{"1", "1", "1"},
+			expectedDownloads: 1,
+		},
+		{
+			description:       "changed",
+			cache:             true,
+			versions:          []string{"1", "2", "2", "1"},
+			expectedDownloads: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bucket-cache")
+			testutil.CheckNoError(t, err)
+			defer os.RemoveAll(dir)
+			cacheDir := ""
+			if test.cache {
+				cacheDir = filepath.Join(dir, "cache")
+			}
+
+			obj := &fakeObject{}
+			for i, version := range test.versions {
+				obj.etag = version
+				obj.content = "FROM scratch # " + version
+				directory := filepath.Join(dir, "context", strconv.Itoa(i))
+				testutil.CheckNoError(t, unpackBucketObject(obj, cacheDir, directory))
+
+				content, err := ioutil.ReadFile(filepath.Join(directory, "Dockerfile"))
+				testutil.CheckErrorAndDeepEqual(t, false, err, obj.content, string(content))
+				files, err := ioutil.ReadDir(directory)
+				testutil.CheckErrorAndDeepEqual(t, false, err, 1, len(files))
+			}
+			testutil.CheckDeepEqual(t, test.expectedDownloads, obj.downloads)
+
+			if test.cache {
+				// Only the last version is kept.
+				objects, err := ioutil.ReadDir(cacheDir)
+				testutil.CheckErrorAndDeepEqual(t, false, err, 1, len(objects))
+				cached, err := ioutil.ReadDir(filepath.Join(cacheDir, objects[0].Name()))
+				testutil.CheckErrorAndDeepEqual(t, false, err, 1, len(cached))
+			}
+		})
+	}
+}
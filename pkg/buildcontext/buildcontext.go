@@ -32,6 +32,9 @@ type BuildOptions struct {
 	GitBranch            string
 	GitSingleBranch      bool
 	GitRecurseSubmodules bool
+	// ContextCacheDir is the directory the contexts downloaded from buckets
+	// are cached in, if any.
+	ContextCacheDir string
 }
 
 // BuildContext unifies calls to download and unpack the build context.
@@ -50,9 +53,9 @@ func GetBuildContext(srcContext string, opts BuildOptions) (BuildContext, error)
 
 		switch prefix {
 		case constants.GCSBuildContextPrefix:
-			return &GCS{context: context}, nil
+			return &GCS{context: context, cacheDir: opts.ContextCacheDir}, nil
 		case constants.S3BuildContextPrefix:
-			return &S3{context: context}, nil
+			return &S3{context: context, cacheDir: opts.ContextCacheDir}, nil
 		case constants.LocalDirBuildContextPrefix:
 			return &Dir{context: context}, nil
 		case constants.GitBuildContextPrefix:
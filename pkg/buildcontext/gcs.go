@@ -20,23 +20,31 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"cloud.google.com/go/storage"
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
-	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 )
 
 // GCS struct for Google Cloud Storage processing
 type GCS struct {
-	context string
+	context  string
+	cacheDir string
 }
 
 func (g *GCS) UnpackTarFromBuildContext() (string, error) {
 	bucket, item := util.GetBucketAndItem(g.context)
-	return constants.BuildContextDir, unpackTarFromGCSBucket(bucket, item, constants.BuildContextDir)
+	directory := filepath.Join(config.KanikoDir, constants.BuildContextDir)
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return directory, err
+	}
+	obj := &gcsObject{bucket: bucket, item: item, handle: client.Bucket(bucket).Object(item)}
+	return directory, unpackBucketObject(obj, g.cacheDir, directory)
 }
 
 func UploadToBucket(r io.Reader, dest string) error {
@@ -58,41 +66,38 @@ func UploadToBucket(r io.Reader, dest string) error {
 	return nil
 }
 
-// unpackTarFromGCSBucket unpacks the context.tar.gz file in the given bucket to the given directory
-func unpackTarFromGCSBucket(bucketName, item, directory string) error {
-	// Get the tar from the bucket
-	tarPath, err := getTarFromBucket(bucketName, item, directory)
-	if err != nil {
-		return err
-	}
-	logrus.Debug("Unpacking source context tar...")
-	if err := util.UnpackCompressedTar(tarPath, directory); err != nil {
-		return err
-	}
-	// Remove the tar so it doesn't interfere with subsequent commands
-	logrus.Debugf("Deleting %s", tarPath)
-	return os.Remove(tarPath)
+// gcsObject is a build context tarball in a GCS bucket.
+type gcsObject struct {
+	bucket, item string
+	handle       *storage.ObjectHandle
+	generation   int64
 }
 
-// getTarFromBucket gets context.tar.gz from the GCS bucket and saves it to the filesystem
-// It returns the path to the tar file
-func getTarFromBucket(bucketName, item, directory string) (string, error) {
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+func (o *gcsObject) name() string {
+	return constants.GCSBuildContextPrefix + o.bucket + "/" + o.item
+}
+
+func (o *gcsObject) version() (string, error) {
+	attrs, err := o.handle.Attrs(context.Background())
 	if err != nil {
 		return "", err
 	}
-	bucket := client.Bucket(bucketName)
-	// Get the tarfile context.tar.gz from the GCS bucket, and save it to a tar object
-	reader, err := bucket.Object(item).NewReader(ctx)
+	o.generation = attrs.Generation
+	return strconv.FormatInt(attrs.Generation, 10), nil
+}
+
+func (o *gcsObject) download(f *os.File) error {
+	handle := o.handle
+	// The generation the cache is keyed on is downloaded, even if the object
+	// has been overwritten since.
+	if o.generation != 0 {
+		handle = handle.Generation(o.generation)
+	}
+	reader, err := handle.NewReader(context.Background())
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer reader.Close()
-	tarPath := filepath.Join(directory, constants.ContextTar)
-	if err := util.CreateFile(tarPath, reader, 0600, 0, 0); err != nil {
-		return "", err
-	}
-	logrus.Debugf("Copied tarball %s from GCS bucket %s to %s", constants.ContextTar, bucketName, tarPath)
-	return tarPath, nil
+	_, err = io.Copy(f, reader)
+	return err
 }
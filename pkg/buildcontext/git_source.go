@@ -0,0 +1,168 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/sirupsen/logrus"
+)
+
+// gitURLPath matches the URLs of git repositories, optionally followed by a
+// ref and a subdirectory, as in https://example.com/repo.git#ref:subdir.
+var gitURLPath = regexp.MustCompile(`\.git(?:#.+)?$`)
+
+// IsGitSource returns true if src, a source of an ADD instruction, is a git
+// repository, following the rules of BuildKit.
+func IsGitSource(src string) bool {
+	for _, prefix := range []string{"git://", "ssh://", "git@", "github.com/"} {
+		if strings.HasPrefix(src, prefix) {
+			return true
+		}
+	}
+	for _, scheme := range []string{"http://", "https://", "file://"} {
+		if strings.HasPrefix(src, scheme) && gitURLPath.MatchString(src) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGitSource splits src, a git repository source, into the URL of the
+// repository, the ref to check out and the subdirectory to add, if any.
+func parseGitSource(src string) (string, string, string) {
+	parts := strings.SplitN(src, "#", 2)
+	url := parts[0]
+	if strings.HasPrefix(url, "github.com/") {
+		url = "https://" + url
+	}
+	if len(parts) == 1 {
+		return url, "", ""
+	}
+	fragment := strings.SplitN(parts[1], ":", 2)
+	if len(fragment) == 1 {
+		return url, fragment[0], ""
+	}
+	return url, fragment[0], fragment[1]
+}
+
+// CloneGitSource clones src, a git repository source of an ADD instruction,
+// into dir, at the branch, tag or commit given in its fragment. The .git
+// directory is removed unless keepGitDir is set. It returns the subdirectory of
+// dir to add, as given in the fragment.
+func CloneGitSource(src, dir string, keepGitDir bool) (string, error) {
+	url, ref, subdir := parseGitSource(src)
+	options := git.CloneOptions{
+		URL: url,
+	}
+	// SSH repositories are authenticated with the SSH agent.
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		options.Auth = getGitAuth()
+	}
+	var hash plumbing.Hash
+	if ref != "" {
+		name, err := getGitReferenceName(dir, url, ref)
+		switch {
+		case err == nil:
+			options.ReferenceName = name
+			options.SingleBranch = true
+		case plumbing.IsHash(ref):
+			hash = plumbing.NewHash(ref)
+		default:
+			return "", err
+		}
+	}
+
+	logrus.Debugf("Cloning %s at %s", url, ref)
+	r, err := git.PlainClone(dir, false, &options)
+	if err != nil {
+		return "", err
+	}
+	if !hash.IsZero() {
+		w, err := r.Worktree()
+		if err != nil {
+			return "", err
+		}
+		if err := w.Checkout(&git.CheckoutOptions{Hash: hash}); err != nil {
+			return "", err
+		}
+	}
+	if !keepGitDir {
+		if err := os.RemoveAll(filepath.Join(dir, git.GitDirName)); err != nil {
+			return "", err
+		}
+	}
+
+	// The subdirectory is relative to the root of the repository.
+	subdir, err = filepath.Rel("/", filepath.Join("/", subdir))
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Stat(filepath.Join(dir, subdir)); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory of %s", subdir, url)
+	}
+	return subdir, nil
+}
+
+// ResolveGitSource returns the commit of src, a git repository source of an
+// ADD instruction, at the branch, tag or commit given in its fragment, or at
+// the default branch. The refs of the repository are listed without cloning
+// it.
+func ResolveGitSource(src string) (string, error) {
+	url, ref, _ := parseGitSource(src)
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		URLs: []string{url},
+	})
+	options := git.ListOptions{}
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		options.Auth = getGitAuth()
+	}
+	refs, err := remote.List(&options)
+	if err != nil {
+		return "", err
+	}
+	byName := map[plumbing.ReferenceName]*plumbing.Reference{}
+	for _, r := range refs {
+		byName[r.Name()] = r
+	}
+	names := []plumbing.ReferenceName{plumbing.HEAD}
+	if ref != "" {
+		names = []plumbing.ReferenceName{plumbing.NewBranchReferenceName(ref), plumbing.NewTagReferenceName(ref)}
+	}
+	for _, name := range names {
+		r, ok := byName[name]
+		// HEAD is a symbolic reference to the default branch.
+		for ok && r.Type() == plumbing.SymbolicReference {
+			r, ok = byName[r.Target()]
+		}
+		if ok {
+			return r.Hash().String(), nil
+		}
+	}
+	if plumbing.IsHash(ref) {
+		return ref, nil
+	}
+	return "", fmt.Errorf("invalid ref %s of %s", ref, url)
+}
@@ -17,10 +17,16 @@ limitations under the License.
 package buildcontext
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 )
@@ -189,3 +195,113 @@ func clearTestAuthEnv() {
 	_ = os.Unsetenv(gitAuthUsernameEnvKey)
 	_ = os.Unsetenv(gitAuthPasswordEnvKey)
 }
+
+func TestIsGitSource(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected bool
+	}{
+		{src: "https://github.com/GoogleContainerTools/kaniko.git", expected: true},
+		{src: "https://github.com/GoogleContainerTools/kaniko.git#v1.0.0:docs", expected: true},
+		{src: "git@github.com:GoogleContainerTools/kaniko.git", expected: true},
+		{src: "github.com/GoogleContainerTools/kaniko", expected: true},
+		{src: "file:///srv/repo.git", expected: true},
+		{src: "https://example.com/archive.tar.gz", expected: false},
+		{src: "repo.git", expected: false},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			testutil.CheckDeepEqual(t, test.expected, IsGitSource(test.src))
+		})
+	}
+}
+
+func TestParseGitSource(t *testing.T) {
+	url, ref, subdir := parseGitSource("github.com/GoogleContainerTools/kaniko#main:docs")
+	testutil.CheckDeepEqual(t, []string{"https://github.com/GoogleContainerTools/kaniko", "main", "docs"}, []string{url, ref, subdir})
+	url, ref, subdir = parseGitSource("file:///srv/repo.git")
+	testutil.CheckDeepEqual(t, []string{"file:///srv/repo.git", "", ""}, []string{url, ref, subdir})
+}
+
+func TestResolveGitSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The repository is served over file://, from a bare clone of a work tree.
+	work := filepath.Join(dir, "work")
+	repo, err := git.PlainInit(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(file string) plumbing.Hash {
+		if err := testutil.SetupFiles(work, map[string]string{file: file}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Add(file); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := w.Commit("add "+file, &git.CommitOptions{
+			Author: &object.Signature{Name: "kaniko", Email: "kaniko@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	first := commit("first")
+	if _, err := repo.CreateTag("v1", first, nil); err != nil {
+		t.Fatal(err)
+	}
+	second := commit("second")
+	bare := filepath.Join(dir, "repo.git")
+	if _, err := git.PlainClone(bare, true, &git.CloneOptions{URL: work}); err != nil {
+		t.Fatal(err)
+	}
+	url := "file://" + bare
+
+	tests := []struct {
+		description string
+		src         string
+		expected    string
+		shouldErr   bool
+	}{
+		{
+			description: "default branch",
+			src:         url,
+			expected:    second.String(),
+		},
+		{
+			description: "branch",
+			src:         url + "#master:docs",
+			expected:    second.String(),
+		},
+		{
+			description: "tag",
+			src:         url + "#v1",
+			expected:    first.String(),
+		},
+		{
+			description: "commit",
+			src:         url + "#" + first.String(),
+			expected:    first.String(),
+		},
+		{
+			description: "missing ref",
+			src:         url + "#missing",
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			commit, err := ResolveGitSource(test.src)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, commit)
+		})
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/aws/aws-sdk-go/aws"
@@ -31,7 +32,8 @@ import (
 
 // S3 unifies calls to download and unpack the build context.
 type S3 struct {
-	context string
+	context  string
+	cacheDir string
 }
 
 // UnpackTarFromBuildContext download and untar a file from s3
@@ -55,24 +57,44 @@ func (s *S3) UnpackTarFromBuildContext() (string, error) {
 	if err != nil {
 		return bucket, err
 	}
-	downloader := s3manager.NewDownloader(sess)
-	directory := constants.BuildContextDir
-	tarPath := filepath.Join(directory, constants.ContextTar)
-	if err := os.MkdirAll(directory, 0750); err != nil {
-		return directory, err
-	}
-	file, err := os.Create(tarPath)
-	if err != nil {
-		return directory, err
-	}
-	_, err = downloader.Download(file,
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(item),
-		})
+	directory := filepath.Join(config.KanikoDir, constants.BuildContextDir)
+	obj := &s3Object{sess: sess, bucket: bucket, item: item}
+	return directory, unpackBucketObject(obj, s.cacheDir, directory)
+}
+
+// s3Object is a build context tarball in an S3 bucket.
+type s3Object struct {
+	sess         *session.Session
+	bucket, item string
+	etag         string
+}
+
+func (o *s3Object) name() string {
+	return constants.S3BuildContextPrefix + o.bucket + "/" + o.item
+}
+
+func (o *s3Object) version() (string, error) {
+	head, err := s3.New(o.sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(o.bucket),
+		Key:    aws.String(o.item),
+	})
 	if err != nil {
-		return directory, err
+		return "", err
 	}
+	o.etag = aws.StringValue(head.ETag)
+	return o.etag, nil
+}
 
-	return directory, util.UnpackCompressedTar(tarPath, directory)
+func (o *s3Object) download(f *os.File) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(o.bucket),
+		Key:    aws.String(o.item),
+	}
+	// The version the cache is keyed on is downloaded, or none if the object
+	// has been overwritten since.
+	if o.etag != "" {
+		input.IfMatch = aws.String(o.etag)
+	}
+	_, err := s3manager.NewDownloader(o.sess).Download(f, input)
+	return err
 }
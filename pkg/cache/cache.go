@@ -18,6 +18,8 @@ package cache
 
 import (
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
@@ -28,12 +30,19 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// for testing
+var retryDelayMilliseconds = 1000
+
 // LayerCache is the layer cache
 type LayerCache interface {
 	RetrieveLayer(string) (v1.Image, error)
@@ -52,7 +61,7 @@ func (rc *RegistryCache) RetrieveLayer(ck string) (v1.Image, error) {
 	}
 	logrus.Infof("Checking for cached layer %s...", cache)
 
-	cacheRef, err := name.NewTag(cache, name.WeakValidation)
+	cacheRef, err := util.ParseTag(cache)
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("getting reference for %s", cache))
 	}
@@ -66,9 +75,19 @@ func (rc *RegistryCache) RetrieveLayer(ck string) (v1.Image, error) {
 		cacheRef.Repository.Registry = newReg
 	}
 
-	tr := util.MakeTransport(rc.Opts.RegistryOptions, registryName)
+	registryOpts := rc.Opts.RegistryOptions
+	registryOpts.SkipTLSVerify = rc.Opts.SkipTLSVerifyCache
+	tr := util.MakeTransport(registryOpts, registryName)
 
-	img, err := remote.Image(cacheRef, remote.WithTransport(tr), remote.WithAuthFromKeychain(creds.GetKeychain()))
+	var img v1.Image
+	err = util.RetryIf(func() error {
+		var err error
+		img, err = remote.Image(cacheRef, remote.WithTransport(tr), remote.WithAuthFromKeychain(creds.GetKeychain()))
+		return err
+	}, rc.Opts.ImageDownloadRetry, retryDelayMilliseconds, util.IsTransientError)
+	if isNotFound(err) {
+		return nil, errors.Wrapf(ErrCacheMiss, "no cached layer %s", cache)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -82,29 +101,111 @@ func (rc *RegistryCache) RetrieveLayer(ck string) (v1.Image, error) {
 	// Layer is stale, rebuild it.
 	if expiry.Before(time.Now()) {
 		logrus.Infof("Cache entry expired: %s", cache)
-		return nil, fmt.Errorf("Cache entry expired: %s", cache)
+		return nil, errors.Wrapf(ErrCacheMiss, "Cache entry expired: %s", cache)
 	}
 
 	// Force the manifest to be populated
 	if _, err := img.RawManifest(); err != nil {
 		return nil, err
 	}
-	return img, nil
+	return compressedLayers(img)
+}
+
+// isNotFound returns true if err is a registry response with status 404.
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
+
+// compressedLayers returns img with its uncompressed layers, pushed to the
+// cache with --cache-compression=none, compressed like the other layers of the
+// image built with them. They're downloaded once to the kaniko directory, as
+// both extracting and compressing them reads them.
+func compressedLayers(img v1.Image) (v1.Image, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	compressed := false
+	addenda := make([]mutate.Addendum, len(layers))
+	for i, l := range layers {
+		addenda[i] = mutate.Addendum{Layer: l}
+		mt, err := l.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		if mt != types.DockerUncompressedLayer && mt != types.OCIUncompressedLayer {
+			continue
+		}
+		if addenda[i].Layer, err = downloadUncompressedLayer(l); err != nil {
+			return nil, errors.Wrap(err, "downloading uncompressed cached layer")
+		}
+		compressed = true
+	}
+	if !compressed {
+		return img, nil
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	withLayers, err := mutate.Append(empty.Image, addenda...)
+	if err != nil {
+		return nil, err
+	}
+	return mutate.ConfigFile(withLayers, cf)
+}
+
+// downloadUncompressedLayer downloads the uncompressed layer l to the kaniko
+// directory, and returns it as a compressed layer. The file is kept until the
+// build is over, as the layer is read again when the image is pushed.
+func downloadUncompressedLayer(l v1.Layer) (v1.Layer, error) {
+	// The blob of an uncompressed layer is its content, it isn't decompressed.
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	f, err := util.TempFile(config.KanikoDir, "cached-layer")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return tarball.LayerFromFile(f.Name(), tarball.WithCompressedCaching)
 }
 
 // Destination returns the repo where the layer should be stored
 // If no cache is specified, one is inferred from the destination provided
 func Destination(opts *config.KanikoOptions, cacheKey string) (string, error) {
-	cache := opts.CacheRepo
-	if cache == "" {
-		destination := opts.Destinations[0]
-		destRef, err := name.NewTag(destination, name.WeakValidation)
-		if err != nil {
-			return "", errors.Wrap(err, "getting tag for destination")
-		}
-		return fmt.Sprintf("%s/cache:%s", destRef.Context(), cacheKey), nil
+	repo, err := Repository(opts)
+	if err != nil {
+		return "", err
+	}
+	return repo.Tag(cacheKey).String(), nil
+}
+
+// Repository returns the repository layers are cached in, which is inferred
+// from the destination provided if no cache is specified
+func Repository(opts *config.KanikoOptions) (name.Repository, error) {
+	if opts.CacheRepo != "" {
+		return util.ParseRepository(opts.CacheRepo)
+	}
+	if len(opts.Destinations) == 0 {
+		return name.Repository{}, errors.New("no cache repository or destination specified")
+	}
+	// The destination may be a tag or a digest, only its repository matters.
+	destRef, err := util.ParseReference(opts.Destinations[0])
+	if err != nil {
+		return name.Repository{}, errors.Wrap(err, "getting reference for destination")
 	}
-	return fmt.Sprintf("%s:%s", cache, cacheKey), nil
+	return util.ParseRepository(destRef.Context().String() + "/cache")
 }
 
 // LocalSource retrieves a source image from a local cache given cacheKey
@@ -0,0 +1,207 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestDestination(t *testing.T) {
+	tests := []struct {
+		description  string
+		cacheRepo    string
+		destinations []string
+		expected     string
+		shouldErr    bool
+	}{
+		{
+			description:  "inferred from a destination with a port and nested path",
+			destinations: []string{"localhost:5000/a/b/c:tag"},
+			expected:     "localhost:5000/a/b/c/cache:key",
+		},
+		{
+			description:  "inferred from a localhost destination",
+			destinations: []string{"localhost/a/b"},
+			expected:     "localhost/a/b/cache:key",
+		},
+		{
+			description:  "inferred from a destination without a tag",
+			destinations: []string{"gcr.io/foo/bar"},
+			expected:     "gcr.io/foo/bar/cache:key",
+		},
+		{
+			description:  "inferred from a destination with a digest",
+			destinations: []string{"gcr.io/foo/bar@sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+			expected:     "gcr.io/foo/bar/cache:key",
+		},
+		{
+			description:  "inferred from a localhost destination with a digest",
+			destinations: []string{"localhost:5000/a/b@sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+			expected:     "localhost:5000/a/b/cache:key",
+		},
+		{
+			description: "cache repo with a port and nested path",
+			cacheRepo:   "localhost:5000/a/b/cache",
+			expected:    "localhost:5000/a/b/cache:key",
+		},
+		{
+			description: "cache repo with a tag",
+			cacheRepo:   "localhost:5000/a/b/cache:tag",
+			shouldErr:   true,
+		},
+		{
+			description: "no cache repo or destination",
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			opts := &config.KanikoOptions{CacheRepo: test.cacheRepo, Destinations: test.destinations}
+			destination, err := Destination(opts, "key")
+			testutil.CheckError(t, test.shouldErr, err)
+			if !test.shouldErr {
+				testutil.CheckDeepEqual(t, test.expected, destination)
+			}
+		})
+	}
+}
+
+// failingLayer is a layer whose blob can't be read to the end.
+type failingLayer struct {
+	v1.Layer
+}
+
+func (l failingLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(io.MultiReader(io.LimitReader(rc, 16), failingReader{})), nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestDownloadUncompressedLayer(t *testing.T) {
+	kanikoDir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(kanikoDir)
+	config.KanikoDir = kanikoDir
+	defer func() { config.KanikoDir = constants.KanikoDir }()
+	layer, err := random.Layer(512, types.DockerUncompressedLayer)
+	testutil.CheckNoError(t, err)
+	tempFiles := func() int {
+		files, err := ioutil.ReadDir(kanikoDir)
+		testutil.CheckNoError(t, err)
+		return len(files)
+	}
+
+	// A layer that fails to download isn't kept.
+	_, err = downloadUncompressedLayer(failingLayer{layer})
+	testutil.CheckError(t, true, err)
+	testutil.CheckDeepEqual(t, 0, tempFiles())
+
+	// A downloaded layer is kept until the build is over.
+	downloaded, err := downloadUncompressedLayer(layer)
+	testutil.CheckNoError(t, err)
+	want, err := layer.DiffID()
+	testutil.CheckNoError(t, err)
+	got, err := downloaded.DiffID()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, want, got)
+	testutil.CheckDeepEqual(t, 1, tempFiles())
+	util.RemoveTempFiles()
+	testutil.CheckDeepEqual(t, 0, tempFiles())
+}
+
+func TestRetrieveLayerCacheMiss(t *testing.T) {
+	tests := []struct {
+		description string
+		status      int
+		miss        bool
+	}{
+		{
+			description: "missing layer",
+			status:      http.StatusNotFound,
+			miss:        true,
+		},
+		{
+			description: "registry error",
+			status:      http.StatusInternalServerError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/" {
+					return
+				}
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+			rc := &RegistryCache{Opts: &config.KanikoOptions{
+				CacheRepo: strings.TrimPrefix(server.URL, "http://") + "/cache",
+				RegistryOptions: config.RegistryOptions{
+					InsecureRegistries: []string{strings.TrimPrefix(server.URL, "http://")},
+				},
+			}}
+
+			_, err := rc.RetrieveLayer("key")
+			testutil.CheckError(t, true, err)
+			if errors.Is(err, ErrCacheMiss) != test.miss {
+				t.Errorf("expected the error to be a cache miss: %t, got %v", test.miss, err)
+			}
+		})
+	}
+}
+
+func TestLocalSourceCacheMiss(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+	expired := dir + "/expired"
+	testutil.CheckNoError(t, ioutil.WriteFile(expired, nil, 0644))
+	old := time.Now().Add(-2 * time.Hour)
+	testutil.CheckNoError(t, os.Chtimes(expired, old, old))
+	opts := &config.CacheOptions{CacheDir: dir, CacheTTL: time.Hour}
+
+	for _, key := range []string{"missing", "expired"} {
+		_, err := LocalSource(opts, key)
+		if !errors.Is(err, ErrCacheMiss) {
+			t.Errorf("expected a cache miss for %s, got %v", key, err)
+		}
+	}
+}
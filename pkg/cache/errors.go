@@ -16,6 +16,12 @@ limitations under the License.
 
 package cache
 
+import "errors"
+
+// ErrCacheMiss is returned, usually wrapped, when a cache has no usable entry
+// for a key, as it's missing or has expired. Check for it with errors.Is.
+var ErrCacheMiss = errors.New("cache miss")
+
 // IsAlreadyCached returns true if the supplied error is of the type AlreadyCachedErr
 // otherwise it returns false.
 func IsAlreadyCached(err error) bool {
@@ -57,6 +63,11 @@ func (e NotFoundErr) Error() string {
 	return e.msg
 }
 
+// Is returns true for ErrCacheMiss.
+func (e NotFoundErr) Is(target error) bool {
+	return target == ErrCacheMiss
+}
+
 // IsExpired returns true if the supplied error is of the type ExpiredErr
 // otherwise it returns false.
 func IsExpired(e error) bool {
@@ -77,3 +88,8 @@ type ExpiredErr struct {
 func (e ExpiredErr) Error() string {
 	return e.msg
 }
+
+// Is returns true for ErrCacheMiss.
+func (e ExpiredErr) Is(target error) bool {
+	return target == ErrCacheMiss
+}
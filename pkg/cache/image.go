@@ -0,0 +1,167 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/pkg/errors"
+)
+
+// cacheKeyCommentPrefix starts the history comment of the layers built by
+// kaniko with the cache enabled, followed by the cache key of the layer.
+const cacheKeyCommentPrefix = "kaniko cache key: "
+
+// HistoryComment returns the history comment recording the cache key ck of a layer.
+func HistoryComment(ck string) string {
+	return cacheKeyCommentPrefix + ck
+}
+
+// ImageCache is a layer cache reading the layers of images built by kaniko,
+// which record the cache key of each layer in their history.
+type ImageCache struct {
+	layers map[string]v1.Layer
+}
+
+// NewImageCache returns a layer cache of the layers of images. The cache keys
+// of the layers are read from the constants.LayerCacheLabel label of the
+// images exported with --cache-to, or else from their history.
+func NewImageCache(images ...v1.Image) (*ImageCache, error) {
+	c := &ImageCache{layers: map[string]v1.Layer{}}
+	for _, img := range images {
+		cf, err := img.ConfigFile()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting config file")
+		}
+		if label, ok := cf.Config.Labels[constants.LayerCacheLabel]; ok {
+			diffIDs := map[string]string{}
+			if err := json.Unmarshal([]byte(label), &diffIDs); err != nil {
+				return nil, errors.Wrapf(err, "parsing label %s", constants.LayerCacheLabel)
+			}
+			for ck, diffID := range diffIDs {
+				h, err := v1.NewHash(diffID)
+				if err != nil {
+					return nil, errors.Wrapf(err, "parsing label %s", constants.LayerCacheLabel)
+				}
+				layer, err := img.LayerByDiffID(h)
+				if err != nil {
+					return nil, errors.Wrapf(err, "getting layer %s", diffID)
+				}
+				c.layers[ck] = layer
+			}
+			continue
+		}
+		layers, err := layersByCacheKey(img, cf)
+		if err != nil {
+			return nil, err
+		}
+		for ck, layer := range layers {
+			c.layers[ck] = layer
+		}
+	}
+	return c, nil
+}
+
+// layersByCacheKey returns the layers of img whose cache key is recorded in
+// the history of cf, the config file of img, keyed by cache key.
+func layersByCacheKey(img v1.Image, cf *v1.ConfigFile) (map[string]v1.Layer, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting layers")
+	}
+	var history []v1.History
+	for _, h := range cf.History {
+		if !h.EmptyLayer {
+			history = append(history, h)
+		}
+	}
+	byCacheKey := map[string]v1.Layer{}
+	// Base images may lack the history of their layers, so the history
+	// is matched with the last layers, which are the ones kaniko built.
+	if len(history) > len(layers) {
+		return byCacheKey, nil
+	}
+	layers = layers[len(layers)-len(history):]
+	for i, h := range history {
+		if ck := strings.TrimPrefix(h.Comment, cacheKeyCommentPrefix); ck != h.Comment {
+			byCacheKey[ck] = layers[i]
+		}
+	}
+	return byCacheKey, nil
+}
+
+// WithCacheMetadata returns img with the constants.LayerCacheLabel label set
+// to the diffIDs of its layers keyed by cache key, for img to be exported as a
+// cache with --cache-to.
+func WithCacheMetadata(img v1.Image) (v1.Image, error) {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting config file")
+	}
+	layers, err := layersByCacheKey(img, cf)
+	if err != nil {
+		return nil, err
+	}
+	diffIDs := map[string]string{}
+	for ck, layer := range layers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting layer diffID")
+		}
+		diffIDs[ck] = diffID.String()
+	}
+	label, err := json.Marshal(diffIDs)
+	if err != nil {
+		return nil, err
+	}
+	cfg := cf.Config.DeepCopy()
+	if cfg.Labels == nil {
+		cfg.Labels = map[string]string{}
+	}
+	cfg.Labels[constants.LayerCacheLabel] = string(label)
+	return mutate.Config(img, *cfg)
+}
+
+// RetrieveLayer returns an image made of the layer with the cache key ck.
+func (c *ImageCache) RetrieveLayer(ck string) (v1.Image, error) {
+	layer, ok := c.layers[ck]
+	if !ok {
+		return nil, errors.Wrapf(ErrCacheMiss, "no layer with cache key %s in the images to import the cache from", ck)
+	}
+	return mutate.AppendLayers(empty.Image, layer)
+}
+
+// MultiCache is a layer cache reading layers from the first of its caches
+// which has them.
+type MultiCache []LayerCache
+
+// RetrieveLayer retrieves the layer with the cache key ck from the caches.
+func (m MultiCache) RetrieveLayer(ck string) (v1.Image, error) {
+	err := ErrCacheMiss
+	for _, c := range m {
+		var img v1.Image
+		if img, err = c.RetrieveLayer(ck); err == nil {
+			return img, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestImageCache(t *testing.T) {
+	// The base image has layers without history.
+	base, err := random.Image(1024, 2)
+	testutil.CheckNoError(t, err)
+	built, err := random.Layer(1024, "")
+	testutil.CheckNoError(t, err)
+	img, err := mutate.Append(base, mutate.Addendum{
+		Layer:   built,
+		History: v1.History{Comment: HistoryComment("key")},
+	})
+	testutil.CheckNoError(t, err)
+
+	c, err := NewImageCache(img)
+	testutil.CheckNoError(t, err)
+	cached, err := MultiCache{c}.RetrieveLayer("key")
+	testutil.CheckNoError(t, err)
+	layers, err := cached.Layers()
+	testutil.CheckNoError(t, err)
+	if len(layers) != 1 {
+		t.Fatalf("expected 1 layer, got %d", len(layers))
+	}
+	expected, err := built.Digest()
+	testutil.CheckNoError(t, err)
+	actual, err := layers[0].Digest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, expected, actual)
+
+	_, err = MultiCache{c}.RetrieveLayer("missing")
+	if !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+	_, err = MultiCache{}.RetrieveLayer("key")
+	if !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected a cache miss without caches, got %v", err)
+	}
+}
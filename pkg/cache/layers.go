@@ -0,0 +1,211 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// layersDir is the directory of the cache dir that layers are cached in.
+const layersDir = "layers"
+
+// LayerPath returns the path the compressed layer with digest is cached at in cacheDir.
+func LayerPath(cacheDir string, digest v1.Hash) string {
+	return filepath.Join(cacheDir, layersDir, digest.String())
+}
+
+// WriteLayers caches the compressed layers of img in cacheDir, so that images
+// sharing layers with img can read them from the cache. Layers that are
+// already cached, or that aren't gzip compressed, are skipped.
+func WriteLayers(cacheDir string, img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return errors.Wrap(err, "getting layers")
+	}
+	if err := os.MkdirAll(filepath.Join(cacheDir, layersDir), 0755); err != nil {
+		return err
+	}
+	for _, l := range layers {
+		if !isGzipLayer(l) {
+			continue
+		}
+		d, err := l.Digest()
+		if err != nil {
+			return errors.Wrap(err, "getting layer digest")
+		}
+		path := LayerPath(cacheDir, d)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := writeLayer(path, d, l); err != nil {
+			return errors.Wrapf(err, "caching layer %s", d)
+		}
+		logrus.Debugf("Wrote layer %s to cache", d)
+	}
+	return nil
+}
+
+// writeLayer writes the compressed contents of l to path, checking they match digest.
+func writeLayer(path string, digest v1.Hash, l v1.Layer) error {
+	rc, err := l.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "layer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), rc)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != digest.Hex {
+		return errors.Errorf("layer has digest sha256:%s, expected %s", got, digest)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// CachedLayers returns img with the layers found in the local cache read from
+// the cache rather than from the source of img. Layers that aren't cached, or
+// whose cache entry expired, are read from the source as usual.
+func CachedLayers(opts *config.CacheOptions, img v1.Image) (v1.Image, error) {
+	if _, err := os.Stat(filepath.Join(opts.CacheDir, layersDir)); err != nil {
+		return img, nil
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting layers")
+	}
+	cached := make([]v1.Layer, len(layers))
+	hits := 0
+	for i, l := range layers {
+		cached[i] = l
+		if !isGzipLayer(l) {
+			continue
+		}
+		d, err := l.Digest()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting layer digest")
+		}
+		path := LayerPath(opts.CacheDir, d)
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().Add(opts.CacheTTL).Before(time.Now()) {
+			continue
+		}
+		logrus.Debugf("Found layer %s in local cache", d)
+		hits++
+		// Keep layers mountable, so that pushes can still mount them from their source.
+		if ml, ok := l.(*remote.MountableLayer); ok {
+			cached[i] = &remote.MountableLayer{Layer: &cachedLayer{Layer: ml.Layer, path: path}, Reference: ml.Reference}
+		} else {
+			cached[i] = &cachedLayer{Layer: l, path: path}
+		}
+	}
+	if hits == 0 {
+		return img, nil
+	}
+	logrus.Infof("Found %d of %d layers in local cache", hits, len(layers))
+	return &cachedLayersImage{Image: img, layers: cached}, nil
+}
+
+func isGzipLayer(l v1.Layer) bool {
+	mt, err := l.MediaType()
+	if err != nil {
+		return false
+	}
+	return mt == types.DockerLayer || mt == types.OCILayer
+}
+
+// cachedLayer is a layer whose contents are read from the local cache.
+type cachedLayer struct {
+	v1.Layer
+	path string
+}
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(l.path)
+}
+
+func (l *cachedLayer) Uncompressed() (io.ReadCloser, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: zr, f: f}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// cachedLayersImage is an image whose layers are partly read from the local cache.
+type cachedLayersImage struct {
+	v1.Image
+	layers []v1.Layer
+}
+
+func (i *cachedLayersImage) Layers() ([]v1.Layer, error) {
+	return i.layers, nil
+}
+
+func (i *cachedLayersImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		if d, err := l.Digest(); err == nil && d == h {
+			return l, nil
+		}
+	}
+	return i.Image.LayerByDigest(h)
+}
+
+func (i *cachedLayersImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		if d, err := l.DiffID(); err == nil && d == h {
+			return l, nil
+		}
+	}
+	return i.Image.LayerByDiffID(h)
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func Test_CachedLayers(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		ttl         time.Duration
+		cached      bool
+	}{
+		{
+			description: "cached layers",
+			ttl:         time.Hour,
+			cached:      true,
+		},
+		{
+			description: "expired layers",
+			ttl:         -time.Hour,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cacheDir, err := ioutil.TempDir("", "cache")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(cacheDir)
+			testutil.CheckNoError(t, WriteLayers(cacheDir, img))
+
+			actual, err := CachedLayers(&config.CacheOptions{CacheDir: cacheDir, CacheTTL: test.ttl}, img)
+			testutil.CheckNoError(t, err)
+			actualLayers, err := actual.Layers()
+			testutil.CheckNoError(t, err)
+			for i, l := range actualLayers {
+				_, cached := l.(*cachedLayer)
+				testutil.CheckDeepEqual(t, test.cached, cached)
+				d, err := l.Digest()
+				testutil.CheckNoError(t, err)
+				expected, err := layers[i].Digest()
+				testutil.CheckErrorAndDeepEqual(t, false, err, expected, d)
+			}
+		})
+	}
+}
@@ -25,6 +25,7 @@ import (
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/image/remote"
+	"github.com/GoogleContainerTools/kaniko/pkg/metrics"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
@@ -40,33 +41,43 @@ func WarmCache(opts *config.WarmerOptions) error {
 	logrus.Debugf("%s\n", images)
 
 	for _, img := range images {
-		tarBuf := new(bytes.Buffer)
-		manifestBuf := new(bytes.Buffer)
-
-		cw := &Warmer{
-			Remote:         remote.RetrieveRemoteImage,
-			Local:          LocalSource,
-			TarWriter:      tarBuf,
-			ManifestWriter: manifestBuf,
+		if err := WarmImage(img, opts); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		digest, err := cw.Warm(img, opts)
-		if err != nil {
-			if !IsAlreadyCached(err) {
-				return err
-			}
+// WarmImage populates the cache in opts.CacheDir with image, unless it is
+// already cached. If opts.CacheLayers is set, the layers of the image are
+// also cached one by one, so that builds from other images sharing them,
+// such as newer versions of image, read them from the cache.
+func WarmImage(image string, opts *config.WarmerOptions) error {
+	tarBuf := new(bytes.Buffer)
+	manifestBuf := new(bytes.Buffer)
+
+	cw := &Warmer{
+		Remote:         remote.RetrieveRemoteImage,
+		Local:          LocalSource,
+		TarWriter:      tarBuf,
+		ManifestWriter: manifestBuf,
+	}
 
-			continue
+	digest, err := cw.Warm(image, opts)
+	if err != nil {
+		if IsAlreadyCached(err) {
+			return nil
 		}
+		return err
+	}
 
-		cachePath := path.Join(cacheDir, digest.String())
+	cachePath := path.Join(opts.CacheDir, digest.String())
 
-		if err := writeBufsToFile(cachePath, tarBuf, manifestBuf); err != nil {
-			return err
-		}
-
-		logrus.Debugf("Wrote %s to cache", img)
+	if err := writeBufsToFile(cachePath, tarBuf, manifestBuf); err != nil {
+		return err
 	}
+
+	logrus.Debugf("Wrote %s to cache", image)
 	return nil
 }
 
@@ -128,14 +139,27 @@ func (w *Warmer) Warm(image string, opts *config.WarmerOptions) (v1.Hash, error)
 	if !opts.Force {
 		_, err := w.Local(&opts.CacheOptions, digest.String())
 		if err == nil || IsExpired(err) {
+			metrics.CacheHits.Inc()
 			return v1.Hash{}, AlreadyCachedErr{}
 		}
 	}
+	metrics.CacheMisses.Inc()
+
+	if opts.CacheLayers {
+		if err := WriteLayers(opts.CacheDir, img); err != nil {
+			return v1.Hash{}, errors.Wrapf(err, "Failed to cache layers of %s", image)
+		}
+		// Read the layers from the cache rather than downloading them again.
+		if img, err = CachedLayers(&opts.CacheOptions, img); err != nil {
+			return v1.Hash{}, errors.Wrapf(err, "Failed to read cached layers of %s", image)
+		}
+	}
 
 	err = tarball.Write(cacheRef, img, w.TarWriter)
 	if err != nil {
 		return v1.Hash{}, errors.Wrapf(err, "Failed to write %s to tar buffer", image)
 	}
+	metrics.AddImageBytes(metrics.BytesPulled, img)
 
 	mfst, err := img.RawManifest()
 	if err != nil {
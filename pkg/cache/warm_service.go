@@ -0,0 +1,123 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// WarmService keeps the cache warm when the warmer runs as a service: the
+// images are warmed again every interval, so that new versions of their tags
+// are cached. Images whose digest is already cached are skipped.
+type WarmService struct {
+	opts *config.WarmerOptions
+	// warmImage warms the cache with an image, for testing.
+	warmImage func(image string, opts *config.WarmerOptions) error
+
+	mu       sync.Mutex
+	warmed   bool
+	lastWarm time.Time
+	failed   []string
+}
+
+// NewWarmService returns a service warming the cache with the images of opts.
+func NewWarmService(opts *config.WarmerOptions) *WarmService {
+	return &WarmService{opts: opts, warmImage: WarmImage}
+}
+
+// Run warms the cache right away, and then every interval until ctx is done.
+// The images that fail to be warmed are tried again at the next interval.
+func (s *WarmService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.warm()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// warm warms the cache with each image once.
+func (s *WarmService) warm() {
+	logrus.Infof("Warming the cache with %d images", len(s.opts.Images))
+	var failed []string
+	for _, image := range s.opts.Images {
+		if err := s.warmImage(image, s.opts); err != nil {
+			logrus.Errorf("Failed warming the cache with %s: %s", image, err)
+			failed = append(failed, image)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastWarm = time.Now()
+	s.failed = failed
+	if len(failed) == 0 {
+		s.warmed = true
+	}
+}
+
+// Handler serves the health of the service: /healthz responds as long as the
+// service runs, and /readyz once every image was warmed at least once.
+func (s *WarmService) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.lastWarm.IsZero() {
+			fmt.Fprintln(w, "ok, warming the cache")
+			return
+		}
+		fmt.Fprintf(w, "ok, last warmed at %s, failed images: %d\n", s.lastWarm.Format(time.RFC3339), len(s.failed))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.warmed {
+			http.Error(w, "the cache isn't warmed yet", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// Listen serves the health of the service at /healthz and /readyz on addr in
+// the background. The returned listener can be closed to stop serving.
+func (s *WarmService) Listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := http.Serve(l, s.Handler()); err != nil {
+			logrus.Debugf("Health server stopped: %s", err)
+		}
+	}()
+	logrus.Infof("Serving the health of the warmer on %s/healthz and %s/readyz", l.Addr(), l.Addr())
+	return l, nil
+}
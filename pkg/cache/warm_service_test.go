@@ -0,0 +1,99 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func getStatus(t *testing.T, url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func Test_WarmService_Run(t *testing.T) {
+	opts := &config.WarmerOptions{Images: []string{"foo:latest", "bar:latest"}}
+	s := NewWarmService(opts)
+	calls := make(chan string, 100)
+	s.warmImage = func(image string, _ *config.WarmerOptions) error {
+		calls <- image
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	// The images are warmed again at each interval.
+	var warmed []string
+	for len(warmed) < 6 {
+		select {
+		case image := <-calls:
+			warmed = append(warmed, image)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the images to be warmed 3 times, got %v", warmed)
+		}
+	}
+	cancel()
+	<-done
+	testutil.CheckDeepEqual(t, []string{"foo:latest", "bar:latest", "foo:latest", "bar:latest", "foo:latest", "bar:latest"}, warmed)
+}
+
+func Test_WarmService_Health(t *testing.T) {
+	opts := &config.WarmerOptions{Images: []string{"foo:latest", "bar:latest"}}
+	s := NewWarmService(opts)
+	fail := true
+	s.warmImage = func(image string, _ *config.WarmerOptions) error {
+		if fail && image == "bar:latest" {
+			return errors.New("unauthorized")
+		}
+		return nil
+	}
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	testutil.CheckDeepEqual(t, http.StatusOK, getStatus(t, server.URL+"/healthz"))
+	testutil.CheckDeepEqual(t, http.StatusServiceUnavailable, getStatus(t, server.URL+"/readyz"))
+
+	// Not ready until every image is warmed.
+	s.warm()
+	testutil.CheckDeepEqual(t, http.StatusOK, getStatus(t, server.URL+"/healthz"))
+	testutil.CheckDeepEqual(t, http.StatusServiceUnavailable, getStatus(t, server.URL+"/readyz"))
+
+	fail = false
+	s.warm()
+	testutil.CheckDeepEqual(t, http.StatusOK, getStatus(t, server.URL+"/readyz"))
+
+	// Still ready if warming fails later on, as the cache has the images.
+	fail = true
+	s.warm()
+	testutil.CheckDeepEqual(t, http.StatusOK, getStatus(t, server.URL+"/readyz"))
+}
@@ -17,12 +17,16 @@ limitations under the License.
 package commands
 
 import (
+	"io/ioutil"
+	"os"
 	"path/filepath"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/pkg/errors"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/buildcontext"
+	kConfig "github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
@@ -32,6 +36,8 @@ import (
 type AddCommand struct {
 	BaseCommand
 	cmd           *instructions.AddCommand
+	checksum      string
+	keepGitDir    bool
 	fileContext   util.FileContext
 	snapshotFiles []string
 }
@@ -44,6 +50,11 @@ type AddCommand struct {
 // 		- If dest doesn't end with a slash, the filepath is inferred to be <dest>/<filename>
 // 	2. If <src> is a local tar archive:
 // 		- it is unpacked at the dest, as 'tar -x' would
+// 		- this only applies to contexts on the host filesystem
+// 	3. If it's given --checksum, <src> must be an HTTP or HTTPS URL whose contents have it
+// 	4. If <src> is a git repository:
+// 		- it is cloned at the ref given in its fragment, and its tree is copied to dest
+// 		- the .git directory is only kept with --keep-git-dir
 func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
 
@@ -52,6 +63,12 @@ func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 		return errors.Wrap(err, "getting user group from chown")
 	}
 
+	if src, ok, err := a.gitSource(replacementEnvs); err != nil {
+		return err
+	} else if ok {
+		return a.addGitSource(src, config, buildArgs)
+	}
+
 	srcs, dest, err := util.ResolveEnvAndWildcards(a.cmd.SourcesAndDest, a.fileContext, replacementEnvs)
 	if err != nil {
 		return err
@@ -65,17 +82,20 @@ func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 	// Else, add to the list of unresolved sources
 	for _, src := range srcs {
 		fullPath := filepath.Join(a.fileContext.Root, src)
+		if a.checksum != "" && !util.IsSrcRemoteFileURL(src) {
+			return errors.Errorf("ADD --checksum is only supported for HTTP and HTTPS sources, not %s", src)
+		}
 		if util.IsSrcRemoteFileURL(src) {
 			urlDest, err := util.URLDestinationFilepath(src, dest, config.WorkingDir, replacementEnvs)
 			if err != nil {
 				return err
 			}
 			logrus.Infof("Adding remote URL %s to %s", src, urlDest)
-			if err := util.DownloadFileToDest(src, urlDest, uid, gid); err != nil {
+			if err := util.DownloadFileToDest(src, urlDest, uid, gid, a.checksum); err != nil {
 				return errors.Wrap(err, "downloading remote source file")
 			}
 			a.snapshotFiles = append(a.snapshotFiles, urlDest)
-		} else if util.IsFileLocalTarArchive(fullPath) {
+		} else if a.fileContext.FS == nil && util.IsFileLocalTarArchive(fullPath) {
 			tarDest, err := util.DestinationFilepath("", dest, config.WorkingDir)
 			if err != nil {
 				return errors.Wrap(err, "determining dest for tar")
@@ -111,6 +131,63 @@ func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 	return nil
 }
 
+// gitSource returns the source of the instruction if it's a git repository,
+// which must then be its only source.
+func (a *AddCommand) gitSource(replacementEnvs []string) (string, bool, error) {
+	if len(a.cmd.SourcesAndDest) != 2 {
+		return "", false, nil
+	}
+	src, err := util.ResolveEnvironmentReplacement(a.cmd.SourcesAndDest[0], replacementEnvs, false)
+	if err != nil {
+		return "", false, err
+	}
+	return src, buildcontext.IsGitSource(src), nil
+}
+
+// GitCommit returns the commit the git repository source of the instruction
+// is at, or an empty string if its source isn't a git repository.
+func (a *AddCommand) GitCommit(config *v1.Config, buildArgs *dockerfile.BuildArgs) (string, error) {
+	src, ok, err := a.gitSource(buildArgs.ReplacementEnvs(config.Env))
+	if err != nil || !ok {
+		return "", err
+	}
+	commit, err := buildcontext.ResolveGitSource(src)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving %s", src)
+	}
+	return commit, nil
+}
+
+// addGitSource clones the git repository src and copies its tree to the
+// destination, as COPY would copy a directory.
+func (a *AddCommand) addGitSource(src string, config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
+	if a.checksum != "" {
+		return errors.Errorf("ADD --checksum is only supported for HTTP and HTTPS sources, not the git repository %s", src)
+	}
+	dir, err := ioutil.TempDir(kConfig.KanikoDir, "git-source")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	logrus.Infof("Adding git repository %s", src)
+	subdir, err := buildcontext.CloneGitSource(src, dir, a.keepGitDir)
+	if err != nil {
+		return errors.Wrapf(err, "cloning %s", src)
+	}
+	copyCmd := CopyCommand{
+		cmd: &instructions.CopyCommand{
+			SourcesAndDest: []string{subdir, a.cmd.SourcesAndDest[1]},
+			Chown:          a.cmd.Chown,
+		},
+		fileContext: util.FileContext{Root: dir},
+	}
+	if err := copyCmd.ExecuteCommand(config, buildArgs); err != nil {
+		return errors.Wrap(err, "copying git repository")
+	}
+	a.snapshotFiles = append(a.snapshotFiles, copyCmd.snapshotFiles...)
+	return nil
+}
+
 // FilesToSnapshot should return an empty array if still nil; no files were changed
 func (a *AddCommand) FilesToSnapshot() []string {
 	return a.snapshotFiles
@@ -124,6 +201,9 @@ func (a *AddCommand) String() string {
 func (a *AddCommand) FilesUsedFromContext(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
 
+	if _, ok, err := a.gitSource(replacementEnvs); err != nil || ok {
+		return nil, err
+	}
 	srcs, _, err := util.ResolveEnvAndWildcards(a.cmd.SourcesAndDest, a.fileContext, replacementEnvs)
 	if err != nil {
 		return nil, err
@@ -134,7 +214,7 @@ func (a *AddCommand) FilesUsedFromContext(config *v1.Config, buildArgs *dockerfi
 		if util.IsSrcRemoteFileURL(src) {
 			continue
 		}
-		if util.IsFileLocalTarArchive(src) {
+		if a.fileContext.FS == nil && util.IsFileLocalTarArchive(src) {
 			continue
 		}
 		fullPath := filepath.Join(a.fileContext.Root, src)
@@ -0,0 +1,206 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+
+	kConfig "github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestAddCommand_Checksum(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello\n"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		description string
+		src         string
+		checksum    string
+		shouldErr   bool
+	}{
+		{
+			description: "downloaded file with a matching checksum",
+			src:         server.URL + "/file",
+			checksum:    "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+		},
+		{
+			description: "downloaded file with a mismatching checksum",
+			src:         server.URL + "/file",
+			checksum:    "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			shouldErr:   true,
+		},
+		{
+			description: "local file set with a variable",
+			src:         "$FILE",
+			checksum:    "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			context, err := ioutil.TempDir("", "context")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(context)
+			if err := ioutil.WriteFile(filepath.Join(context, "file"), []byte("hello\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			root, err := ioutil.TempDir("", "root")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			dest := filepath.Join(root, "dest")
+			cmd := &AddCommand{
+				cmd: &instructions.AddCommand{
+					SourcesAndDest: []string{test.src, dest},
+				},
+				checksum:    test.checksum,
+				fileContext: util.FileContext{Root: context},
+			}
+			err = cmd.ExecuteCommand(&v1.Config{Env: []string{"FILE=file"}}, dockerfile.NewBuildArgs(nil))
+			testutil.CheckError(t, test.shouldErr, err)
+			_, statErr := os.Stat(dest)
+			testutil.CheckDeepEqual(t, !test.shouldErr, statErr == nil)
+		})
+	}
+}
+
+func TestAddCommand_GitSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	original := kConfig.KanikoDir
+	defer func() { kConfig.KanikoDir = original }()
+	kConfig.KanikoDir = dir
+
+	// The repository is served over file://, from a bare clone of a work tree.
+	work := filepath.Join(dir, "work")
+	repo, err := git.PlainInit(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(file, content string) plumbing.Hash {
+		if err := testutil.SetupFiles(work, map[string]string{file: content}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Add(file); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := w.Commit("add "+file, &git.CommitOptions{
+			Author: &object.Signature{Name: "kaniko", Email: "kaniko@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	first := commit("README", "first")
+	if _, err := repo.CreateTag("v1", first, nil); err != nil {
+		t.Fatal(err)
+	}
+	commit("docs/guide", "second")
+	bare := filepath.Join(dir, "repo.git")
+	if _, err := git.PlainClone(bare, true, &git.CloneOptions{URL: work}); err != nil {
+		t.Fatal(err)
+	}
+	url := "file://" + bare
+
+	tests := []struct {
+		description string
+		src         string
+		keepGitDir  bool
+		expected    map[string]string
+		gitDir      bool
+	}{
+		{
+			description: "default branch",
+			src:         url,
+			expected:    map[string]string{"README": "first", "docs/guide": "second"},
+		},
+		{
+			description: "keep git dir",
+			src:         url,
+			keepGitDir:  true,
+			expected:    map[string]string{"README": "first", "docs/guide": "second"},
+			gitDir:      true,
+		},
+		{
+			description: "tag",
+			src:         url + "#v1",
+			expected:    map[string]string{"README": "first"},
+		},
+		{
+			description: "commit",
+			src:         url + "#" + first.String(),
+			expected:    map[string]string{"README": "first"},
+		},
+		{
+			description: "subdirectory",
+			src:         url + "#:docs",
+			expected:    map[string]string{"guide": "second"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "root")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			dest := filepath.Join(root, "src") + "/"
+			cmd := &AddCommand{
+				cmd: &instructions.AddCommand{
+					SourcesAndDest: []string{test.src, dest},
+				},
+				keepGitDir: test.keepGitDir,
+			}
+			testutil.CheckNoError(t, cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)))
+			for file, content := range test.expected {
+				b, err := ioutil.ReadFile(filepath.Join(dest, file))
+				testutil.CheckNoError(t, err)
+				testutil.CheckDeepEqual(t, content, string(b))
+			}
+			_, err = os.Stat(filepath.Join(dest, ".git"))
+			testutil.CheckDeepEqual(t, test.gitDir, err == nil)
+		})
+	}
+}
@@ -17,12 +17,13 @@ limitations under the License.
 package commands
 
 import (
+	"time"
+
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 type CurrentCacheKey func() (string, error)
@@ -60,13 +61,23 @@ type DockerCommand interface {
 	ShouldDetectDeletedFiles() bool
 }
 
-func GetCommand(cmd instructions.Command, fileContext util.FileContext, useNewRun bool, cacheCopy bool) (DockerCommand, error) {
+// GetCommand returns the DockerCommand for cmd. outputLines is the number of
+// lines of output a failed RUN command includes in its error, runTimeout is
+// the time after which a RUN command is killed, if it is set, and runNetwork
+// is the network mode of RUN commands.
+func GetCommand(cmd instructions.Command, fileContext util.FileContext, useNewRun bool, cacheCopy bool, outputLines int, runTimeout time.Duration, runNetwork string) (DockerCommand, error) {
+	runOpts := runOptions{outputLines: outputLines, timeout: runTimeout, network: runNetwork}
 	switch c := cmd.(type) {
 	case *instructions.RunCommand:
 		if useNewRun {
-			return &RunMarkerCommand{cmd: c}, nil
+			return &RunMarkerCommand{cmd: c, opts: runOpts}, nil
+		}
+		return &RunCommand{cmd: c, opts: runOpts}, nil
+	case *dockerfile.RunCommand:
+		if useNewRun {
+			return &RunMarkerCommand{cmd: c.RunCommand, opts: runOpts, noSnapshot: c.NoSnapshot}, nil
 		}
-		return &RunCommand{cmd: c}, nil
+		return &RunCommand{cmd: c.RunCommand, opts: runOpts, noSnapshot: c.NoSnapshot}, nil
 	case *instructions.CopyCommand:
 		return &CopyCommand{cmd: c, fileContext: fileContext, shdCache: cacheCopy}, nil
 	case *instructions.ExposeCommand:
@@ -77,6 +88,8 @@ func GetCommand(cmd instructions.Command, fileContext util.FileContext, useNewRu
 		return &WorkdirCommand{cmd: c}, nil
 	case *instructions.AddCommand:
 		return &AddCommand{cmd: c, fileContext: fileContext}, nil
+	case *dockerfile.AddCommand:
+		return &AddCommand{cmd: c.AddCommand, checksum: c.Checksum, keepGitDir: c.KeepGitDir, fileContext: fileContext}, nil
 	case *instructions.CmdCommand:
 		return &CmdCommand{cmd: c}, nil
 	case *instructions.EntrypointCommand:
@@ -98,8 +111,11 @@ func GetCommand(cmd instructions.Command, fileContext util.FileContext, useNewRu
 	case *instructions.HealthCheckCommand:
 		return &HealthCheckCommand{cmd: c}, nil
 	case *instructions.MaintainerCommand:
-		logrus.Warnf("%s is deprecated, skipping", cmd.Name())
-		return nil, nil
+		return &MaintainerCommand{cmd: c}, nil
+	case *dockerfile.CustomCommand:
+		if handler, ok := instructionHandlers[c.Keyword]; ok {
+			return &CustomCommand{cmd: c, handler: handler}, nil
+		}
 	}
 	return nil, errors.Errorf("%s is not a supported command", cmd.Name())
 }
@@ -37,6 +37,26 @@ var (
 	getUserGroup = util.GetUserGroup
 )
 
+// buildContexts are the additional build contexts COPY --from can copy from,
+// by lowercased name.
+var buildContexts = map[string]util.FileContext{}
+
+// ConfigureBuildContexts sets the additional build contexts, by name, that
+// COPY --from can copy from instead of a stage or an image.
+func ConfigureBuildContexts(contexts map[string]util.FileContext) {
+	buildContexts = map[string]util.FileContext{}
+	for name, c := range contexts {
+		buildContexts[strings.ToLower(name)] = c
+	}
+}
+
+// BuildContext returns the additional build context named name, if there is
+// one.
+func BuildContext(name string) (util.FileContext, bool) {
+	c, ok := buildContexts[strings.ToLower(name)]
+	return c, ok
+}
+
 type CopyCommand struct {
 	BaseCommand
 	cmd           *instructions.CopyCommand
@@ -48,7 +68,11 @@ type CopyCommand struct {
 func (c *CopyCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
 	// Resolve from
 	if c.cmd.From != "" {
-		c.fileContext = util.FileContext{Root: filepath.Join(kConfig.KanikoDir, c.cmd.From)}
+		if context, ok := BuildContext(c.cmd.From); ok {
+			c.fileContext = context
+		} else {
+			c.fileContext = util.FileContext{Root: filepath.Join(kConfig.KanikoDir, c.cmd.From)}
+		}
 	}
 
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
@@ -66,7 +90,7 @@ func (c *CopyCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bu
 	for _, src := range srcs {
 		fullPath := filepath.Join(c.fileContext.Root, src)
 
-		fi, err := os.Lstat(fullPath)
+		fi, err := c.fileContext.Lstat(fullPath)
 		if err != nil {
 			return errors.Wrap(err, "could not copy source")
 		}
@@ -226,52 +250,34 @@ func (cr *CachingCopyCommand) From() string {
 	return cr.cmd.From
 }
 
+// resolveIfSymlink resolves the symlinks in destPath within the filesystem of
+// the image, see util.ResolveDestination.
 func resolveIfSymlink(destPath string) (string, error) {
 	if !filepath.IsAbs(destPath) {
 		return "", errors.New("dest path must be abs")
 	}
-
-	var nonexistentPaths []string
-
-	newPath := destPath
-	for newPath != "/" {
-		_, err := os.Lstat(newPath)
-		if err != nil {
-			if os.IsNotExist(err) {
-				dir, file := filepath.Split(newPath)
-				newPath = filepath.Clean(dir)
-				nonexistentPaths = append(nonexistentPaths, file)
-				continue
-			} else {
-				return "", errors.Wrap(err, "failed to lstat")
-			}
-		}
-
-		newPath, err = filepath.EvalSymlinks(newPath)
-		if err != nil {
-			return "", errors.Wrap(err, "failed to eval symlinks")
-		}
-		break
-	}
-
-	for i := len(nonexistentPaths) - 1; i >= 0; i-- {
-		newPath = filepath.Join(newPath, nonexistentPaths[i])
+	newPath, err := util.ResolveDestination(destPath)
+	if err != nil {
+		return "", err
 	}
-
 	if destPath != newPath {
 		logrus.Tracef("Updating destination path from %v to %v due to symlink", destPath, newPath)
 	}
-
-	return filepath.Clean(newPath), nil
+	return newPath, nil
 }
 
 func copyCmdFilesUsedFromContext(
 	config *v1.Config, buildArgs *dockerfile.BuildArgs, cmd *instructions.CopyCommand,
 	fileContext util.FileContext,
 ) ([]string, error) {
-	// We don't use the context if we're performing a copy --from.
+	// We don't use the context if we're performing a copy --from, unless it
+	// copies from an additional build context.
 	if cmd.From != "" {
-		return nil, nil
+		context, ok := BuildContext(cmd.From)
+		if !ok {
+			return nil, nil
+		}
+		fileContext = context
 	}
 
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
@@ -26,6 +26,8 @@ import (
 	"syscall"
 	"testing"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/GoogleContainerTools/kaniko/testutil"
@@ -959,4 +961,78 @@ func TestCopyCommand_ExecuteCommand_Extended(t *testing.T) {
 		}
 		testutil.CheckDeepEqual(t, "../bam.txt", linkName)
 	})
+
+	t.Run("copy src dir to a dest dir which is a symlink in the image", func(t *testing.T) {
+		testDir, srcDir := setupDirs(t)
+		defer os.RemoveAll(testDir)
+		config.RootDir = testDir
+		defer func() { config.RootDir = constants.RootDir }()
+
+		// Absolute symlinks point into the filesystem of the image.
+		if err := os.MkdirAll(filepath.Join(testDir, "real"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("/real", filepath.Join(testDir, "app")); err != nil {
+			t.Fatal(err)
+		}
+		cmd := CopyCommand{
+			cmd: &instructions.CopyCommand{
+				SourcesAndDest: []string{srcDir, "app/"},
+			},
+			fileContext: util.FileContext{Root: testDir},
+		}
+		cfg := &v1.Config{
+			Env:        []string{},
+			WorkingDir: testDir,
+		}
+		err := cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{}))
+		testutil.CheckNoError(t, err)
+		b, err := ioutil.ReadFile(filepath.Join(testDir, "real", "bam.txt"))
+		testutil.CheckErrorAndDeepEqual(t, false, err, "meow", string(b))
+	})
+
+	t.Run("copy src dirs can't escape the image through a symlink", func(t *testing.T) {
+		testDir, _ := setupDirs(t)
+		defer os.RemoveAll(testDir)
+		config.RootDir = testDir
+		defer func() { config.RootDir = constants.RootDir }()
+		outside, err := ioutil.TempDir("", "outside")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(outside)
+
+		// The first source copies a symlink leading outside of the image, which
+		// the second one tries to copy a file through.
+		if err := os.MkdirAll(filepath.Join(testDir, "first"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(outside, filepath.Join(testDir, "first", "link")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(testDir, "second", "link"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(testDir, "second", "link", "escaped.txt"), []byte("meow"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cmd := CopyCommand{
+			cmd: &instructions.CopyCommand{
+				SourcesAndDest: []string{"first", "second", "app/"},
+			},
+			fileContext: util.FileContext{Root: testDir},
+		}
+		cfg := &v1.Config{
+			Env:        []string{},
+			WorkingDir: testDir,
+		}
+		err = cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{}))
+		testutil.CheckNoError(t, err)
+		if _, err := os.Stat(filepath.Join(outside, "escaped.txt")); !os.IsNotExist(err) {
+			t.Errorf("expected the file not to be copied outside of the image, got %v", err)
+		}
+		// The symlink is followed within the image instead.
+		b, err := ioutil.ReadFile(filepath.Join(testDir, outside, "escaped.txt"))
+		testutil.CheckErrorAndDeepEqual(t, false, err, "meow", string(b))
+	})
 }
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// InstructionHandler executes a custom instruction, with the config of the
+// image and the build args in scope. It returns the files it changed, which
+// the snapshotter adds to the layer of the instruction: nil if they aren't
+// known, for the whole filesystem to be snapshotted, or an empty list if the
+// instruction only changed the config.
+type InstructionHandler func(cmd *dockerfile.CustomCommand, config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error)
+
+var instructionHandlers = map[string]InstructionHandler{}
+
+// RegisterInstruction makes builds execute the Dockerfile instructions
+// starting with keyword with handler, so that kaniko can be extended with
+// custom instructions when it's used as a library. It must be called before
+// Dockerfiles are parsed.
+func RegisterInstruction(keyword string, handler InstructionHandler) error {
+	if err := dockerfile.RegisterInstruction(keyword); err != nil {
+		return errors.Wrap(err, "registering instruction")
+	}
+	instructionHandlers[strings.ToLower(keyword)] = handler
+	return nil
+}
+
+// CustomCommand executes a custom instruction with its registered handler.
+type CustomCommand struct {
+	BaseCommand
+	cmd     *dockerfile.CustomCommand
+	handler InstructionHandler
+	files   []string
+}
+
+func (c *CustomCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
+	logrus.Infof("cmd: %s", c.cmd.Keyword)
+	files, err := c.handler(c.cmd, config, buildArgs)
+	if err != nil {
+		return err
+	}
+	c.files = files
+	return nil
+}
+
+func (c *CustomCommand) String() string {
+	return c.cmd.String()
+}
+
+func (c *CustomCommand) FilesToSnapshot() []string {
+	return c.files
+}
+
+// ProvidesFilesToSnapshot returns false, as the files changed by the handler
+// are only known once it ran.
+func (c *CustomCommand) ProvidesFilesToSnapshot() bool {
+	return false
+}
+
+func (c *CustomCommand) MetadataOnly() bool {
+	return c.files != nil && len(c.files) == 0
+}
+
+func (c *CustomCommand) RequiresUnpackedFS() bool {
+	return true
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+type MaintainerCommand struct {
+	BaseCommand
+	cmd *instructions.MaintainerCommand
+}
+
+// ExecuteCommand only warns that MAINTAINER is deprecated. The maintainer is
+// set as the author of the image by the executor, as it isn't part of the config.
+func (m *MaintainerCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
+	logging.Warnf("%s is deprecated, use a LABEL instead", m.cmd.Name())
+	return nil
+}
+
+// Maintainer returns the author of the image
+func (m *MaintainerCommand) Maintainer() string {
+	return m.cmd.Maintainer
+}
+
+// String returns some information about the command for the image config history
+func (m *MaintainerCommand) String() string {
+	return m.cmd.String()
+}
@@ -17,12 +17,17 @@ limitations under the License.
 package commands
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	kConfig "github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
@@ -36,7 +41,53 @@ import (
 
 type RunCommand struct {
 	BaseCommand
-	cmd *instructions.RunCommand
+	cmd        *instructions.RunCommand
+	opts       runOptions
+	noSnapshot bool
+}
+
+// runOptions configure how runCommandInExec runs a command.
+type runOptions struct {
+	// ctx kills the command when it is done, if set.
+	ctx context.Context
+	// outputLines is the number of lines of output included in the error if the command fails.
+	outputLines int
+	// outputPrefix is logged before each line of output, if set.
+	outputPrefix string
+	// timeout kills the command if it runs for longer, if set.
+	timeout time.Duration
+	// network is the network mode of the command. The command can't reach any
+	// network with constants.RunNetworkNone.
+	network string
+	// fromScratch is set if the base image of the stage is scratch.
+	fromScratch bool
+}
+
+// OutputPrefixer is implemented by commands that can log their output line by
+// line with a prefix, instead of writing it directly to stdout and stderr.
+type OutputPrefixer interface {
+	SetOutputPrefix(prefix string)
+}
+
+// SnapshotSkipper is implemented by commands that can be marked to not be
+// snapshotted.
+type SnapshotSkipper interface {
+	// SkipsSnapshot returns true if the files changed by the command aren't
+	// snapshotted into a layer of their own.
+	SkipsSnapshot() bool
+}
+
+// Interruptible is implemented by commands that can be interrupted while they run.
+type Interruptible interface {
+	// SetContext makes the command stop when ctx is done.
+	SetContext(ctx context.Context)
+}
+
+// ScratchAware is implemented by commands whose errors can point out that
+// their stage is built FROM scratch.
+type ScratchAware interface {
+	// SetFromScratch tells the command that the base image of its stage is scratch.
+	SetFromScratch()
 }
 
 // for testing
@@ -46,10 +97,49 @@ var (
 )
 
 func (r *RunCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	return runCommandInExec(config, buildArgs, r.cmd)
+	return runCommandInExec(config, buildArgs, r.cmd, r.opts)
 }
 
-func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun *instructions.RunCommand) error {
+// SetOutputPrefix logs each line of output of the command with prefix.
+func (r *RunCommand) SetOutputPrefix(prefix string) {
+	r.opts.outputPrefix = prefix
+}
+
+// SetContext kills the command and every process it started when ctx is done.
+func (r *RunCommand) SetContext(ctx context.Context) {
+	r.opts.ctx = ctx
+}
+
+// SetFromScratch points out that images built FROM scratch have no shell when
+// the command can't be started.
+func (r *RunCommand) SetFromScratch() {
+	r.opts.fromScratch = true
+}
+
+// SkipsSnapshot returns true if the command is marked with a
+// '# kaniko:no-snapshot' comment.
+func (r *RunCommand) SkipsSnapshot() bool {
+	return r.noSnapshot
+}
+
+// runCommandInExec runs cmdRun. If it fails, up to opts.outputLines of the last
+// lines it wrote to stdout and stderr are included in the error.
+// If opts.outputPrefix is set, the output is logged line by line with the prefix.
+func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun *instructions.RunCommand, opts runOptions) error {
+	ctx := opts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	buildCtx := ctx
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
 	var newCommand []string
 	if cmdRun.PrependShell {
 		// This is the default shell on Linux
@@ -86,10 +176,28 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 	cmd := exec.Command(newCommand[0], newCommand[1:]...)
 
 	cmd.Dir = setWorkDirIfExists(config.WorkingDir)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if opts.outputPrefix != "" {
+		stdoutLog, stderrLog := newPrefixWriter(opts.outputPrefix), newPrefixWriter(opts.outputPrefix)
+		defer stdoutLog.Flush()
+		defer stderrLog.Flush()
+		stdout, stderr = stdoutLog, stderrLog
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	var output *tailWriter
+	if opts.outputLines > 0 {
+		output = newTailWriter(opts.outputLines)
+		cmd.Stdout = io.MultiWriter(stdout, output)
+		cmd.Stderr = io.MultiWriter(stderr, output)
+	}
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if opts.network == constants.RunNetworkNone {
+		if err := disableNetwork(cmd.SysProcAttr); err != nil {
+			return err
+		}
+	}
 
 	u := config.User
 	userAndGroup := strings.Split(u, ":")
@@ -98,9 +206,18 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 		return errors.Wrapf(err, "resolving user %s", userAndGroup[0])
 	}
 
-	// If specified, run the command as a specific user
+	credentialsStr := userStr
+	if len(userAndGroup) > 1 {
+		groupStr, err := util.ResolveEnvironmentReplacement(userAndGroup[1], replacementEnvs, false)
+		if err != nil {
+			return errors.Wrapf(err, "resolving group %s", userAndGroup[1])
+		}
+		credentialsStr = userStr + ":" + groupStr
+	}
+
+	// If specified, run the command as a specific user, dropping the privileges of root
 	if userStr != "" {
-		cmd.SysProcAttr.Credential, err = util.SyscallCredentials(userStr)
+		cmd.SysProcAttr.Credential, err = util.SyscallCredentials(credentialsStr)
 		if err != nil {
 			return errors.Wrap(err, "credentials")
 		}
@@ -115,6 +232,12 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 
 	logrus.Infof("Running: %s", cmd.Args)
 	if err := cmd.Start(); err != nil {
+		if opts.network == constants.RunNetworkNone && errors.Is(err, syscall.EPERM) {
+			return errors.Wrap(err, "starting command without network, which requires the CAP_SYS_ADMIN capability")
+		}
+		if opts.fromScratch && (errors.Is(err, os.ErrNotExist) || errors.Is(err, exec.ErrNotFound)) {
+			return errors.Wrapf(err, "starting command: %s doesn't exist, images built FROM scratch have no shell unless one is added before RUN", newCommand[0])
+		}
 		return errors.Wrap(err, "starting command")
 	}
 
@@ -122,8 +245,33 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 	if err != nil {
 		return errors.Wrap(err, "getting group id for process")
 	}
+	// Kill the whole process group, as the shell may have started other processes.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
 	if err := cmd.Wait(); err != nil {
-		return errors.Wrap(err, "waiting for process to exit")
+		if ctxErr := buildCtx.Err(); ctxErr != nil {
+			return errors.Wrap(ctxErr, "command was interrupted")
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return errors.Wrapf(ctxErr, "command timed out after %s", opts.timeout)
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = errors.Wrapf(err, "command exited with code %d", exitErr.ExitCode())
+		} else {
+			err = errors.Wrap(err, "waiting for process to exit")
+		}
+		if output != nil && len(output.Lines()) > 0 {
+			return outputErr{err: err, lines: output.Lines()}
+		}
+		return err
 	}
 
 	//it's not an error if there are no grandchildren
@@ -262,3 +410,107 @@ func setWorkDirIfExists(workdir string) string {
 	}
 	return ""
 }
+
+// outputErr adds the last lines of output of a failed command to its error.
+type outputErr struct {
+	err   error
+	lines []string
+}
+
+func (e outputErr) Error() string {
+	return fmt.Sprintf("%s\nlast %d lines of output:\n%s", e.err, len(e.lines), strings.Join(e.lines, "\n"))
+}
+
+func (e outputErr) Unwrap() error {
+	return e.err
+}
+
+// maxLineLength is the length at which the output of a command is split into
+// lines if it has no newlines, so as not to hold on to unbounded output.
+const maxLineLength = 4096
+
+// tailWriter keeps the last n lines written to it.
+type tailWriter struct {
+	mu      sync.Mutex
+	n       int
+	lines   []string
+	partial []byte
+}
+
+func newTailWriter(n int) *tailWriter {
+	return &tailWriter{n: n}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.add(string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+	if len(t.partial) > maxLineLength {
+		t.partial = t.partial[len(t.partial)-maxLineLength:]
+	}
+	return len(p), nil
+}
+
+func (t *tailWriter) add(line string) {
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.n {
+		t.lines = t.lines[len(t.lines)-t.n:]
+	}
+}
+
+// Lines returns the last lines written, including a final line without a newline.
+func (t *tailWriter) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := append([]string{}, t.lines...)
+	if len(t.partial) > 0 {
+		lines = append(lines, string(t.partial))
+		if len(lines) > t.n {
+			lines = lines[len(lines)-t.n:]
+		}
+	}
+	return lines
+}
+
+// prefixWriter logs each line written to it with a prefix.
+type prefixWriter struct {
+	prefix  string
+	partial []byte
+}
+
+func newPrefixWriter(prefix string) *prefixWriter {
+	return &prefixWriter{prefix: prefix}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		logrus.Info(w.prefix + string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	for len(w.partial) > maxLineLength {
+		logrus.Info(w.prefix + string(w.partial[:maxLineLength]))
+		w.partial = w.partial[maxLineLength:]
+	}
+	return len(p), nil
+}
+
+// Flush logs the last line if it wasn't terminated by a newline.
+func (w *prefixWriter) Flush() {
+	if len(w.partial) > 0 {
+		logrus.Info(w.prefix + string(w.partial))
+		w.partial = nil
+	}
+}
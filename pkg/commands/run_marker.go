@@ -17,6 +17,7 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"os"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
@@ -28,15 +29,17 @@ import (
 
 type RunMarkerCommand struct {
 	BaseCommand
-	cmd   *instructions.RunCommand
-	Files []string
+	cmd        *instructions.RunCommand
+	opts       runOptions
+	noSnapshot bool
+	Files      []string
 }
 
 func (r *RunMarkerCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
 	// run command `touch filemarker`
 	logrus.Debugf("using new RunMarker command")
 	prevFilesMap, _ := util.GetFSInfoMap("/", map[string]os.FileInfo{})
-	if err := runCommandInExec(config, buildArgs, r.cmd); err != nil {
+	if err := runCommandInExec(config, buildArgs, r.cmd, r.opts); err != nil {
 		return err
 	}
 	_, r.Files = util.GetFSInfoMap("/", prevFilesMap)
@@ -45,6 +48,28 @@ func (r *RunMarkerCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfi
 	return nil
 }
 
+// SetOutputPrefix logs each line of output of the command with prefix.
+func (r *RunMarkerCommand) SetOutputPrefix(prefix string) {
+	r.opts.outputPrefix = prefix
+}
+
+// SetContext kills the command and every process it started when ctx is done.
+func (r *RunMarkerCommand) SetContext(ctx context.Context) {
+	r.opts.ctx = ctx
+}
+
+// SetFromScratch points out that images built FROM scratch have no shell when
+// the command can't be started.
+func (r *RunMarkerCommand) SetFromScratch() {
+	r.opts.fromScratch = true
+}
+
+// SkipsSnapshot returns true if the command is marked with a
+// '# kaniko:no-snapshot' comment.
+func (r *RunMarkerCommand) SkipsSnapshot() bool {
+	return r.noSnapshot
+}
+
 // String returns some information about the command for the image config
 func (r *RunMarkerCommand) String() string {
 	return r.cmd.String()
@@ -22,14 +22,21 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	"github.com/GoogleContainerTools/kaniko/testutil"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/sirupsen/logrus"
 )
 
 func Test_addDefaultHOME(t *testing.T) {
@@ -325,3 +332,280 @@ func TestSetWorkDirIfExists(t *testing.T) {
 	testutil.CheckDeepEqual(t, testDir, setWorkDirIfExists(testDir))
 	testutil.CheckDeepEqual(t, "", setWorkDirIfExists("doesnot-exists"))
 }
+
+func Test_runCommandInExec_CapturesOutput(t *testing.T) {
+	tests := []struct {
+		description string
+		outputLines int
+		contains    []string
+		notContains []string
+	}{
+		{
+			description: "last lines of output",
+			outputLines: 2,
+			contains:    []string{"command exited with code 3", "last 2 lines of output:\ntwo\nthree"},
+			notContains: []string{"one"},
+		},
+		{
+			description: "output not captured",
+			outputLines: 0,
+			contains:    []string{"command exited with code 3"},
+			notContains: []string{"output", "three"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cmd := &instructions.RunCommand{
+				ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+					CmdLine:      []string{"echo one; echo two; echo three; exit 3"},
+					PrependShell: true,
+				},
+			}
+			err := runCommandInExec(&v1.Config{}, dockerfile.NewBuildArgs(nil), cmd, runOptions{outputLines: test.outputLines})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, s := range test.contains {
+				if !strings.Contains(err.Error(), s) {
+					t.Errorf("expected error to contain %q, got %q", s, err)
+				}
+			}
+			for _, s := range test.notContains {
+				if strings.Contains(err.Error(), s) {
+					t.Errorf("expected error not to contain %q, got %q", s, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_tailWriter(t *testing.T) {
+	w := newTailWriter(2)
+	for _, s := range []string{"a\nb", "\nc\n", "d"} {
+		w.Write([]byte(s))
+	}
+	testutil.CheckDeepEqual(t, []string{"c", "d"}, w.Lines())
+}
+
+func Test_prefixWriter_SplitsLongLines(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+
+	w := newPrefixWriter("> ")
+	long := strings.Repeat("a", maxLineLength)
+	for i := 0; i < 3; i++ {
+		w.Write([]byte(long))
+	}
+	w.Write([]byte("b"))
+	if len(w.partial) > maxLineLength {
+		t.Errorf("expected at most %d bytes to be buffered, got %d", maxLineLength, len(w.partial))
+	}
+	w.Flush()
+	testutil.CheckDeepEqual(t, 3, strings.Count(buf.String(), `msg="> `+long+`"`))
+	if !strings.Contains(buf.String(), `msg="> b"`) {
+		t.Errorf("expected the rest of the output to be logged on flush, got:\n%s", buf.String())
+	}
+}
+
+func Test_runCommandInExec_PrefixesOutput(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+
+	cmd := &instructions.RunCommand{
+		ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+			CmdLine:      []string{"echo one; echo two >&2; printf three"},
+			PrependShell: true,
+		},
+	}
+	err := runCommandInExec(&v1.Config{}, dockerfile.NewBuildArgs(nil), cmd, runOptions{outputPrefix: "[stage 1] [2/3] "})
+	testutil.CheckNoError(t, err)
+	for _, line := range []string{"[stage 1] [2/3] one", "[stage 1] [2/3] two", "[stage 1] [2/3] three"} {
+		if !strings.Contains(buf.String(), `msg="`+line+`"`) {
+			t.Errorf("expected log to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+}
+
+func Test_runCommandInExec_MissingShell(t *testing.T) {
+	tests := []struct {
+		description string
+		fromScratch bool
+		hint        bool
+	}{
+		{
+			description: "FROM scratch",
+			fromScratch: true,
+			hint:        true,
+		},
+		{
+			description: "FROM an image",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cmd := &instructions.RunCommand{
+				ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+					CmdLine:      []string{"true"},
+					PrependShell: true,
+				},
+			}
+			err := runCommandInExec(&v1.Config{Shell: []string{"/missing/sh", "-c"}}, dockerfile.NewBuildArgs(nil), cmd, runOptions{fromScratch: test.fromScratch})
+			testutil.CheckError(t, true, err)
+			hint := strings.Contains(err.Error(), "/missing/sh doesn't exist, images built FROM scratch have no shell")
+			if hint != test.hint {
+				t.Errorf("expected the FROM scratch hint: %t, got %v", test.hint, err)
+			}
+		})
+	}
+}
+
+func Test_runCommandInExec_Timeout(t *testing.T) {
+	tests := []struct {
+		description string
+		command     string
+		shouldErr   bool
+	}{
+		{
+			description: "fast command finishes",
+			command:     "true",
+		},
+		{
+			description: "slow command is killed",
+			command:     "sleep 30",
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cmd := &instructions.RunCommand{
+				ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+					CmdLine:      []string{test.command},
+					PrependShell: true,
+				},
+			}
+			start := time.Now()
+			err := runCommandInExec(&v1.Config{}, dockerfile.NewBuildArgs(nil), cmd, runOptions{timeout: time.Second})
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr && !strings.Contains(err.Error(), "command timed out after 1s") {
+				t.Errorf("expected a timeout error, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 20*time.Second {
+				t.Errorf("expected the command to be killed, but it took %s", elapsed)
+			}
+		})
+	}
+}
+
+func Test_runCommandInExec_Network(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.CheckNoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	tests := []struct {
+		description string
+		network     string
+		shouldErr   bool
+	}{
+		{
+			description: "default network",
+			network:     constants.RunNetworkDefault,
+		},
+		{
+			description: "no network",
+			network:     constants.RunNetworkNone,
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			// The test binary itself tries to reach the listener.
+			cmd := &instructions.RunCommand{
+				ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+					CmdLine: []string{os.Args[0], "-test.run=TestDialHelper"},
+				},
+			}
+			config := &v1.Config{Env: []string{"KANIKO_TEST_DIAL_ADDR=" + l.Addr().String()}}
+			err := runCommandInExec(config, dockerfile.NewBuildArgs(nil), cmd, runOptions{network: test.network})
+			if err != nil && strings.Contains(err.Error(), "CAP_SYS_ADMIN") {
+				t.Skipf("network namespaces can't be created: %s", err)
+			}
+			testutil.CheckError(t, test.shouldErr, err)
+		})
+	}
+}
+
+// TestDialHelper is run by Test_runCommandInExec_Network as a RUN command
+// which fails if it can't reach the address it's given.
+func TestDialHelper(t *testing.T) {
+	addr := os.Getenv("KANIKO_TEST_DIAL_ADDR")
+	if addr == "" {
+		t.Skip("only run by Test_runCommandInExec_Network")
+	}
+	c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func Test_runCommandInExec_User(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("dropping privileges requires root")
+	}
+	tests := []struct {
+		user        string
+		expectedUID string
+		expectedGID string
+	}{
+		{
+			user:        "1000",
+			expectedUID: "1000",
+		},
+		{
+			user:        "1000:2000",
+			expectedUID: "1000",
+			expectedGID: "2000",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.user, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			testutil.CheckNoError(t, err)
+			defer os.RemoveAll(dir)
+			testutil.CheckNoError(t, os.Chmod(dir, 0777))
+
+			cmd := &instructions.RunCommand{
+				ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+					CmdLine:      []string{"id -u > uid; id -g > gid"},
+					PrependShell: true,
+				},
+			}
+			config := &v1.Config{User: test.user, WorkingDir: dir}
+			err = runCommandInExec(config, dockerfile.NewBuildArgs(nil), cmd, runOptions{})
+			testutil.CheckNoError(t, err)
+
+			uid, err := ioutil.ReadFile(filepath.Join(dir, "uid"))
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, test.expectedUID, strings.TrimSpace(string(uid)))
+			fi, err := os.Stat(filepath.Join(dir, "uid"))
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, uint32(1000), fi.Sys().(*syscall.Stat_t).Uid)
+			if test.expectedGID != "" {
+				gid, err := ioutil.ReadFile(filepath.Join(dir, "gid"))
+				testutil.CheckNoError(t, err)
+				testutil.CheckDeepEqual(t, test.expectedGID, strings.TrimSpace(string(gid)))
+			}
+		})
+	}
+}
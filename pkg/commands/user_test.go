@@ -16,13 +16,9 @@ limitations under the License.
 package commands
 
 import (
-	"fmt"
-	"os/user"
 	"testing"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
-	"github.com/GoogleContainerTools/kaniko/pkg/util"
-
 	"github.com/GoogleContainerTools/kaniko/testutil"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
@@ -30,64 +26,52 @@ import (
 
 var userTests = []struct {
 	user        string
-	userObj     *user.User
 	expectedUID string
 	expectedGID string
 }{
 	{
 		user:        "root",
-		userObj:     &user.User{Uid: "root", Gid: "root"},
 		expectedUID: "root",
 	},
 	{
 		user:        "root-add",
-		userObj:     &user.User{Uid: "root-add", Gid: "root"},
 		expectedUID: "root-add",
 	},
 	{
 		user:        "0",
-		userObj:     &user.User{Uid: "0", Gid: "0"},
 		expectedUID: "0",
 	},
 	{
 		user:        "fakeUser",
-		userObj:     &user.User{Uid: "fakeUser", Gid: "fakeUser"},
 		expectedUID: "fakeUser",
 	},
 	{
 		user:        "root",
-		userObj:     &user.User{Uid: "root", Gid: "some"},
 		expectedUID: "root",
 	},
 	{
 		user:        "0",
-		userObj:     &user.User{Uid: "0"},
 		expectedUID: "0",
 	},
 	{
 		user:        "root",
-		userObj:     &user.User{Uid: "root"},
 		expectedUID: "root",
 		expectedGID: "f0",
 	},
 	{
 		user:        "0",
-		userObj:     &user.User{Uid: "0"},
 		expectedUID: "0",
 	},
 	{
 		user:        "$envuser",
-		userObj:     &user.User{Uid: "root", Gid: "root"},
 		expectedUID: "root",
 	},
 	{
 		user:        "root",
-		userObj:     &user.User{Uid: "root"},
 		expectedUID: "root",
 	},
 	{
 		user:        "some",
-		userObj:     &user.User{Uid: "some"},
 		expectedUID: "some",
 	},
 	{
@@ -109,13 +93,6 @@ func TestUpdateUser(t *testing.T) {
 				User: test.user,
 			},
 		}
-		Lookup = func(_ string) (*user.User, error) {
-			if test.userObj != nil {
-				return test.userObj, nil
-			}
-			return nil, fmt.Errorf("error while looking up user")
-		}
-		defer func() { Lookup = util.Lookup }()
 		buildArgs := dockerfile.NewBuildArgs([]string{})
 		err := cmd.ExecuteCommand(cfg, buildArgs)
 		testutil.CheckErrorAndDeepEqual(t, false, err, test.expectedUID, cfg.User)
@@ -19,7 +19,9 @@ package commands
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
+	kConfig "github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
@@ -30,7 +32,8 @@ import (
 
 type VolumeCommand struct {
 	BaseCommand
-	cmd *instructions.VolumeCommand
+	cmd           *instructions.VolumeCommand
+	snapshotFiles []string
 }
 
 func (v *VolumeCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
@@ -45,17 +48,21 @@ func (v *VolumeCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.
 	if existingVolumes == nil {
 		existingVolumes = map[string]struct{}{}
 	}
+	v.snapshotFiles = []string{}
 	for _, volume := range resolvedVolumes {
 		var x struct{}
 		existingVolumes[volume] = x
-		util.AddVolumePathToIgnoreList(volume)
+		// Files written to the volume later aren't snapshotted, but the directory itself is.
+		path := filepath.Join(kConfig.RootDir, volume)
+		util.AddVolumePathToIgnoreList(path)
 
 		// Only create and snapshot the dir if it didn't exist already
-		if _, err := os.Stat(volume); os.IsNotExist(err) {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
 			logrus.Infof("Creating directory %s", volume)
-			if err := os.MkdirAll(volume, 0755); err != nil {
+			if err := os.MkdirAll(path, 0755); err != nil {
 				return fmt.Errorf("could not create directory for volume %s: %s", volume, err)
 			}
+			v.snapshotFiles = append(v.snapshotFiles, path)
 		}
 	}
 	config.Volumes = existingVolumes
@@ -63,10 +70,17 @@ func (v *VolumeCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.
 	return nil
 }
 
+// FilesToSnapshot returns the volume directories, which should have been created if they didn't already exist
 func (v *VolumeCommand) FilesToSnapshot() []string {
-	return []string{}
+	return v.snapshotFiles
 }
 
 func (v *VolumeCommand) String() string {
 	return v.cmd.String()
 }
+
+// MetadataOnly returns false, so that the created volume directories are
+// snapshotted even when no later command writes to them
+func (v *VolumeCommand) MetadataOnly() bool {
+	return false
+}
@@ -18,6 +18,8 @@ package config
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -82,3 +84,42 @@ func (a *keyValueArg) Set(value string) error {
 func (a *keyValueArg) Type() string {
 	return "key-value-arg type"
 }
+
+// This type is used to supported passing in sizes, as a number of bytes with
+// an optional unit such as 500MB or 2GiB
+type byteSizeArg int64
+
+var byteSizeRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([kmgt]i?)?b?$`)
+
+var byteSizeUnits = map[string]float64{
+	"":   1,
+	"k":  1e3,
+	"m":  1e6,
+	"g":  1e9,
+	"t":  1e12,
+	"ki": 1 << 10,
+	"mi": 1 << 20,
+	"gi": 1 << 30,
+	"ti": 1 << 40,
+}
+
+func (a *byteSizeArg) String() string {
+	return strconv.FormatInt(int64(*a), 10)
+}
+
+func (a *byteSizeArg) Set(value string) error {
+	m := byteSizeRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(value)))
+	if m == nil {
+		return fmt.Errorf("invalid size %s, expected a number of bytes with an optional unit such as 500MB or 2GiB", value)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return err
+	}
+	*a = byteSizeArg(n * byteSizeUnits[m[2]])
+	return nil
+}
+
+func (a *byteSizeArg) Type() string {
+	return "size"
+}
@@ -16,7 +16,11 @@ limitations under the License.
 
 package config
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
 
 func TestMultiArg_Set_shouldAppendValue(t *testing.T) {
 	var arg multiArg
@@ -45,3 +49,28 @@ func Test_KeyValueArg_Set_shouldAcceptEqualAsValue(t *testing.T) {
 		t.Error("Invalid split. key=value=something should be split to key=>value=something")
 	}
 }
+
+func Test_ByteSizeArg_Set(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    byteSizeArg
+		shouldError bool
+	}{
+		{value: "1024", expected: 1024},
+		{value: "10b", expected: 10},
+		{value: "500MB", expected: 500 * 1000 * 1000},
+		{value: "2GiB", expected: 2 << 30},
+		{value: "1.5k", expected: 1500},
+		{value: "3 Mi", expected: 3 << 20},
+		{value: "10XB", shouldError: true},
+		{value: "-1", shouldError: true},
+		{value: "", shouldError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			var arg byteSizeArg
+			err := arg.Set(test.value)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldError, err, test.expected, arg)
+		})
+	}
+}
@@ -40,7 +40,12 @@ type RegistryOptions struct {
 	SkipTLSVerify           bool
 	InsecurePull            bool
 	SkipTLSVerifyPull       bool
+	SkipTLSVerifyCache      bool
 	PushRetry               int
+	ImageDownloadRetry      int
+	HTTPProxy               string
+	HTTPSProxy              string
+	NoProxy                 string
 }
 
 // KanikoOptions are options that are set by command line arguments
@@ -48,22 +53,66 @@ type KanikoOptions struct {
 	CacheOptions
 	RegistryOptions
 	DockerfilePath         string
+	DockerfileFromImage    string
 	SrcContext             string
 	SnapshotMode           string
 	CustomPlatform         string
 	Bucket                 string
 	TarPath                string
+	TarCompression         string
+	CacheCompression       string
 	Target                 string
 	CacheRepo              string
+	CacheTo                string
+	CleanupRun             string
 	DigestFile             string
 	ImageNameDigestFile    string
 	ImageNameTagDigestFile string
+	StageDigestDir         string
+	ConfigFile             string
+	ExportFSDiff           string
+	ContextCacheDir        string
 	OCILayoutPath          string
+	TimingFile             string
+	MetricsAddr            string
+	Created                string
+	DebugContext           string
+	SignKey                string
+	SnapshotIndexDir       string
+	KanikoDir              string
+	RunNetwork             string
+	CaptureOutputLines     int
+	MaxLayers              int
+	LayerFetchParallelism  int
+	LayerPushParallelism   int
+	ExtractBufferSize      int
+	MaxImageSize           byteSizeArg
+	BuildTimeout           time.Duration
+	RunTimeout             time.Duration
+	SnapshotWarnAfter      time.Duration
 	Destinations           multiArg
+	DestinationTemplates   multiArg
+	AlsoTags               multiArg
+	LayerCacheFrom         multiArg
 	BuildArgs              multiArg
+	PublishStages          keyValueArg
+	BuildContexts          keyValueArg
+	SecretBuildArgs        multiArg
 	Labels                 multiArg
+	SkipSnapshotFor        multiArg
+	Env                    multiArg
+	ScratchEnv             multiArg
 	SingleSnapshot         bool
+	SingleSnapshotPerStage bool
 	Reproducible           bool
+	FlattenHistory         bool
+	ResetEntrypoint        bool
+	ResetEnv               bool
+	ResetLabels            bool
+	HistoryBuildArgs       bool
+	ErrorOnUnusedBuildArgs bool
+	Strict                 bool
+	PreserveBaseLayers     bool
 	NoPush                 bool
 	Cache                  bool
 	Cleanup                bool
@@ -71,8 +120,19 @@ type KanikoOptions struct {
 	SkipUnusedStages       bool
 	RunV2                  bool
 	CacheCopyLayers        bool
+	CacheRepoPerStage      bool
+	InlineCache            bool
+	NoRunPrefix            bool
+	DebugOnFailure         bool
+	SkipDiskSpaceCheck     bool
+	Rootless               bool
+	FailOnUnreadable       bool
+	PreserveFileCaps       bool
+	PrintDockerfile        bool
+	PushReferrers          bool
 	Git                    KanikoGitOptions
 	IgnorePaths            multiArg
+	RemoveIgnorePaths      multiArg
 }
 
 type KanikoGitOptions struct {
@@ -122,4 +182,8 @@ type WarmerOptions struct {
 	CustomPlatform string
 	Images         multiArg
 	Force          bool
+	CacheLayers    bool
+	MetricsAddr    string
+	HealthAddr     string
+	WarmInterval   time.Duration
 }
@@ -23,28 +23,54 @@ const (
 	//KanikoDir is the path to the Kaniko directory
 	KanikoDir = "/kaniko"
 
+	// KanikoDirEnv is the environment variable setting the default of --kaniko-dir
+	KanikoDirEnv = "KANIKO_DIR"
+
 	IgnoreListPath = "/proc/self/mountinfo"
 
 	Author = "kaniko"
 
-	// DockerfilePath is the path the Dockerfile is copied to
-	DockerfilePath = "/kaniko/Dockerfile"
+	// DockerfilePath is the path the Dockerfile is copied to, relative to the
+	// kaniko directory
+	DockerfilePath = "Dockerfile"
+
+	// DockerfileLabel is the image label a Dockerfile is read from with --dockerfile-from-image
+	DockerfileLabel = "io.kaniko.dockerfile"
+
+	// LayerCacheLabel is the image label the diffIDs of the layers of images
+	// exported with --cache-to are kept in, keyed by cache key
+	LayerCacheLabel = "io.kaniko.layer-cache"
 
 	// ContextTar is the default name of the tar uploaded to GCS buckets
 	ContextTar = "context.tar.gz"
 
 	// BuildContextDir is the directory a build context will be unpacked into,
-	// for example, a tarball from a GCS bucket will be unpacked here
-	BuildContextDir = "/kaniko/buildcontext/"
+	// for example, a tarball from a GCS bucket will be unpacked here, relative
+	// to the kaniko directory
+	BuildContextDir = "buildcontext"
 
 	// KanikoIntermediateStagesDir is where we will store intermediate stages
-	// as tarballs in case they are needed later on
-	KanikoIntermediateStagesDir = "/kaniko/stages"
+	// as tarballs in case they are needed later on, relative to the kaniko
+	// directory
+	KanikoIntermediateStagesDir = "stages"
 
 	// Various snapshot modes:
-	SnapshotModeTime = "time"
-	SnapshotModeFull = "full"
-	SnapshotModeRedo = "redo"
+	SnapshotModeTime    = "time"
+	SnapshotModeFull    = "full"
+	SnapshotModeRedo    = "redo"
+	SnapshotModeChanged = "changed"
+
+	// Network modes of RUN commands:
+	RunNetworkDefault = "default"
+	RunNetworkNone    = "none"
+
+	// Compressions of the layers of the tarball written with --tarPath:
+	TarCompressionGzip = "gzip"
+	TarCompressionNone = "none"
+
+	// Compressions of the layers pushed to the cache with --cache-compression:
+	CacheCompressionGzip = "gzip"
+	CacheCompressionNone = "none"
 
 	// NoBaseImage is the scratch image
 	NoBaseImage = "scratch"
@@ -72,6 +98,9 @@ const (
 	S3ForcePathStyle = "S3_FORCE_PATH_STYLE"
 )
 
+// SnapshotModes are the snapshot modes that can be set with --snapshotMode.
+var SnapshotModes = []string{SnapshotModeFull, SnapshotModeRedo, SnapshotModeTime, SnapshotModeChanged}
+
 // ScratchEnvVars are the default environment variables needed for a scratch image.
 var ScratchEnvVars = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
 
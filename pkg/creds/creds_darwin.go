@@ -27,10 +27,12 @@ var (
 	keyChain          authn.Keychain
 )
 
-// GetKeychain returns a keychain for accessing container registries.
+// GetKeychain returns a keychain for accessing container registries. The
+// credentials set with environment variables take precedence over the docker
+// config file.
 func GetKeychain() authn.Keychain {
 	setupKeyChainOnce.Do(func() {
-		keyChain = authn.NewMultiKeychain(authn.DefaultKeychain)
+		keyChain = authn.NewMultiKeychain(envKeychain{}, authn.DefaultKeychain)
 	})
 	return keyChain
 }
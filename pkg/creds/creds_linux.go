@@ -20,10 +20,10 @@ import (
 	"context"
 	"sync"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
 	"github.com/genuinetools/bpfd/proc"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/authn/k8schain"
-	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -31,16 +31,18 @@ var (
 	keyChain          authn.Keychain
 )
 
-// GetKeychain returns a keychain for accessing container registries.
+// GetKeychain returns a keychain for accessing container registries. The
+// credentials set with environment variables take precedence over the docker
+// config file.
 func GetKeychain() authn.Keychain {
 	setupKeyChainOnce.Do(func() {
-		keyChain = authn.NewMultiKeychain(authn.DefaultKeychain)
+		keyChain = authn.NewMultiKeychain(envKeychain{}, authn.DefaultKeychain)
 
 		// Add the Kubernetes keychain if we're on Kubernetes
 		if proc.GetContainerRuntime(0, 0) == proc.RuntimeKubernetes {
 			k8sc, err := k8schain.NewNoClient(context.Background())
 			if err != nil {
-				logrus.Warnf("Error setting up k8schain. Using default keychain %s", err)
+				logging.Warnf("Error setting up k8schain. Using default keychain %s", err)
 				return
 			}
 			keyChain = authn.NewMultiKeychain(keyChain, k8sc)
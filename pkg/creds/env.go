@@ -0,0 +1,137 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package creds
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RegistryAuthFileEnv is the path of an auth file, in the format of the
+	// auth files of podman and skopeo.
+	RegistryAuthFileEnv = "REGISTRY_AUTH_FILE"
+	// RegistryEnv is the registry the credentials set with RegistryUserEnv
+	// and RegistryPassEnv are for, Docker Hub if it's not set.
+	RegistryEnv = "KANIKO_REGISTRY"
+	// RegistryUserEnv is the user name to authenticate to RegistryEnv with.
+	RegistryUserEnv = "KANIKO_REGISTRY_USER"
+	// RegistryPassEnv is the password to authenticate to RegistryEnv with.
+	RegistryPassEnv = "KANIKO_REGISTRY_PASS"
+
+	dockerHub = "docker.io"
+)
+
+// envKeychain resolves the credentials set with environment variables. The
+// ones set with RegistryUserEnv and RegistryPassEnv take precedence over the
+// ones in the RegistryAuthFileEnv file.
+type envKeychain struct{}
+
+// Resolve implements authn.Keychain.
+func (envKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if user := os.Getenv(RegistryUserEnv); user != "" {
+		registry := os.Getenv(RegistryEnv)
+		if registry == "" {
+			registry = dockerHub
+		}
+		creds := map[string]authn.AuthConfig{
+			normalizeAuthKey(registry): {Username: user, Password: os.Getenv(RegistryPassEnv)},
+		}
+		if cfg, ok := lookupAuth(creds, target); ok {
+			return authn.FromConfig(cfg), nil
+		}
+	}
+	if file := os.Getenv(RegistryAuthFileEnv); file != "" {
+		auths, err := readAuthFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if cfg, ok := lookupAuth(auths, target); ok {
+			return authn.FromConfig(cfg), nil
+		}
+	}
+	return authn.Anonymous, nil
+}
+
+// readAuthFile returns the credentials in the auth file at path, by their
+// normalized key.
+func readAuthFile(path string) (map[string]authn.AuthConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s set with %s", path, RegistryAuthFileEnv)
+	}
+	var file struct {
+		Auths map[string]authn.AuthConfig `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s set with %s", path, RegistryAuthFileEnv)
+	}
+	auths := map[string]authn.AuthConfig{}
+	for key, cfg := range file.Auths {
+		auths[normalizeAuthKey(key)] = cfg
+	}
+	return auths, nil
+}
+
+// lookupAuth returns the credentials of auths for target. Like with podman,
+// the credentials of a repository take precedence over the ones of its
+// namespaces and of its registry.
+func lookupAuth(auths map[string]authn.AuthConfig, target authn.Resource) (authn.AuthConfig, bool) {
+	key := normalizeAuthKey(target.String())
+	registry := normalizeAuthKey(target.RegistryStr())
+	for {
+		if cfg, ok := auths[key]; ok {
+			return cfg, true
+		}
+		if key == registry || !strings.Contains(key, "/") {
+			return authn.AuthConfig{}, false
+		}
+		key = path.Dir(key)
+	}
+}
+
+// normalizeAuthKey returns key, a registry or a repository, without scheme
+// and with docker.io as the registry of Docker Hub, as it's written in
+// different ways by docker and podman.
+func normalizeAuthKey(key string) string {
+	if key == authn.DefaultAuthKey {
+		return dockerHub
+	}
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key = strings.TrimSuffix(key, "/")
+	host, repo := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		host, repo = key[:i], key[i:]
+	}
+	if host == name.DefaultRegistry || host == "registry-1.docker.io" {
+		host = dockerHub
+	}
+	return host + repo
+}
+
+// SecretValues returns the secrets set with environment variables, which are
+// kept out of the logs.
+func SecretValues() []string {
+	return []string{os.Getenv(RegistryPassEnv)}
+}
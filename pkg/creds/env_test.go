@@ -0,0 +1,153 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package creds
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// setRegistryEnv sets the environment variables read by envKeychain to env,
+// unsetting the others, and returns a function restoring them.
+func setRegistryEnv(env map[string]string) func() {
+	var restore []func()
+	for _, key := range []string{RegistryAuthFileEnv, RegistryEnv, RegistryUserEnv, RegistryPassEnv} {
+		key := key
+		original, ok := os.LookupEnv(key)
+		if value, set := env[key]; set {
+			os.Setenv(key, value)
+		} else {
+			os.Unsetenv(key)
+		}
+		restore = append(restore, func() {
+			if ok {
+				os.Setenv(key, original)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+	return func() {
+		for _, r := range restore {
+			r()
+		}
+	}
+}
+
+func basicAuth(user, pass string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+}
+
+func Test_envKeychain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authFile := filepath.Join(dir, "auth.json")
+	testutil.CheckNoError(t, ioutil.WriteFile(authFile, []byte(`{"auths": {
+	"registry.example.com": {"auth": "`+basicAuth("registry", "secret")+`"},
+	"https://registry.example.com/team/app/": {"auth": "`+basicAuth("app", "secret")+`"},
+	"https://index.docker.io/v1/": {"auth": "`+basicAuth("hub", "secret")+`"}
+}}`), 0600))
+	invalidFile := filepath.Join(dir, "invalid.json")
+	testutil.CheckNoError(t, ioutil.WriteFile(invalidFile, []byte("{"), 0600))
+
+	tests := []struct {
+		description string
+		env         map[string]string
+		destination string
+		expected    *authn.AuthConfig
+		shouldErr   bool
+	}{
+		{
+			description: "no credentials",
+			destination: "registry.example.com/app:latest",
+			expected:    &authn.AuthConfig{},
+		},
+		{
+			description: "user for Docker Hub",
+			env:         map[string]string{RegistryUserEnv: "user", RegistryPassEnv: "pass"},
+			destination: "user/app:latest",
+			expected:    &authn.AuthConfig{Username: "user", Password: "pass"},
+		},
+		{
+			description: "user for another registry",
+			env:         map[string]string{RegistryUserEnv: "user", RegistryPassEnv: "pass"},
+			destination: "registry.example.com/app:latest",
+			expected:    &authn.AuthConfig{},
+		},
+		{
+			description: "user for the registry",
+			env:         map[string]string{RegistryEnv: "https://registry.example.com", RegistryUserEnv: "user", RegistryPassEnv: "pass"},
+			destination: "registry.example.com/app:latest",
+			expected:    &authn.AuthConfig{Username: "user", Password: "pass"},
+		},
+		{
+			description: "auth file for the registry",
+			env:         map[string]string{RegistryAuthFileEnv: authFile},
+			destination: "registry.example.com/team/other:latest",
+			expected:    &authn.AuthConfig{Auth: basicAuth("registry", "secret")},
+		},
+		{
+			description: "auth file for the repository",
+			env:         map[string]string{RegistryAuthFileEnv: authFile},
+			destination: "registry.example.com/team/app:latest",
+			expected:    &authn.AuthConfig{Auth: basicAuth("app", "secret")},
+		},
+		{
+			description: "auth file for Docker Hub",
+			env:         map[string]string{RegistryAuthFileEnv: authFile},
+			destination: "docker.io/library/app:latest",
+			expected:    &authn.AuthConfig{Auth: basicAuth("hub", "secret")},
+		},
+		{
+			description: "user takes precedence over the auth file",
+			env:         map[string]string{RegistryAuthFileEnv: authFile, RegistryEnv: "registry.example.com", RegistryUserEnv: "user", RegistryPassEnv: "pass"},
+			destination: "registry.example.com/team/app:latest",
+			expected:    &authn.AuthConfig{Username: "user", Password: "pass"},
+		},
+		{
+			description: "invalid auth file",
+			env:         map[string]string{RegistryAuthFileEnv: invalidFile},
+			destination: "registry.example.com/app:latest",
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			defer setRegistryEnv(test.env)()
+			// Pushes resolve the credentials of the repository of the destination.
+			ref, err := name.NewTag(test.destination)
+			testutil.CheckNoError(t, err)
+			auth, err := envKeychain{}.Resolve(ref.Context())
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			cfg, err := auth.Authorization()
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expected, cfg)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+const (
+	checksumFlag   = "--checksum="
+	keepGitDirFlag = "--keep-git-dir"
+)
+
+// AddCommand is an ADD instruction given the flags the vendored parser doesn't
+// support: --checksum and --keep-git-dir.
+type AddCommand struct {
+	*instructions.AddCommand
+	// Checksum is the digest the source must have, such as sha256:<hex>.
+	Checksum string
+	// KeepGitDir keeps the .git directory of a git repository source.
+	KeepGitDir bool
+}
+
+// addFlags are the values of the flags of an ADD instruction the vendored
+// parser doesn't support.
+type addFlags struct {
+	checksum   string
+	keepGitDir bool
+}
+
+// stripAddFlags removes the flags the parser doesn't support from n, an ADD
+// instruction, so that the parser accepts it, and returns their validated
+// values.
+func stripAddFlags(n *parser.Node) (addFlags, error) {
+	var add addFlags
+	if n.Value != command.Add {
+		return add, nil
+	}
+	var flags []string
+	for _, f := range n.Flags {
+		switch {
+		case strings.HasPrefix(f, checksumFlag):
+			add.checksum = strings.TrimPrefix(f, checksumFlag)
+			if err := util.ValidateChecksum(add.checksum); err != nil {
+				return add, errors.Wrapf(err, "dockerfile parse error line %d", n.StartLine)
+			}
+		case f == keepGitDirFlag:
+			add.keepGitDir = true
+		case strings.HasPrefix(f, keepGitDirFlag+"="):
+			keep, err := strconv.ParseBool(strings.TrimPrefix(f, keepGitDirFlag+"="))
+			if err != nil {
+				return add, errors.Wrapf(err, "dockerfile parse error line %d: invalid %s", n.StartLine, keepGitDirFlag)
+			}
+			add.keepGitDir = keep
+		default:
+			flags = append(flags, f)
+		}
+	}
+	n.Flags = flags
+	return add, nil
+}
+
+// withAddFlags returns cmd, an ADD instruction, with the values of the flags
+// the parser doesn't support, if it was given any.
+func withAddFlags(cmd instructions.Command, flags addFlags) (instructions.Command, error) {
+	if flags == (addFlags{}) {
+		return cmd, nil
+	}
+	add, ok := cmd.(*instructions.AddCommand)
+	if !ok {
+		return cmd, nil
+	}
+	if flags.checksum != "" && len(add.SourcesAndDest) != 2 {
+		return nil, errors.Errorf("ADD --checksum requires a single source, got %d", len(add.SourcesAndDest)-1)
+	}
+	// Sources set with variables are only known once they are resolved.
+	if src := add.SourcesAndDest[0]; flags.checksum != "" && !isHTTPSource(src) && !strings.Contains(src, "$") {
+		return nil, errors.Errorf("ADD --checksum is only supported for HTTP and HTTPS sources, not %s", src)
+	}
+	return &AddCommand{AddCommand: add, Checksum: flags.checksum, KeepGitDir: flags.keepGitDir}, nil
+}
+
+// isHTTPSource returns true if the ADD source src is downloaded over HTTP.
+func isHTTPSource(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
@@ -17,6 +17,9 @@ limitations under the License.
 package dockerfile
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
 	"strings"
 
 	d "github.com/docker/docker/builder/dockerfile"
@@ -49,7 +52,8 @@ func (b *BuildArgs) Clone() *BuildArgs {
 	}
 }
 
-// ReplacementEnvs returns a list of filtered environment variables
+// ReplacementEnvs returns envs followed by the build args in scope which
+// aren't set in envs, as ENV takes precedence over ARG.
 func (b *BuildArgs) ReplacementEnvs(envs []string) []string {
 	filtered := b.FilterAllowed(envs)
 	return append(envs, filtered...)
@@ -62,3 +66,79 @@ func (b *BuildArgs) AddMetaArgs(metaArgs []instructions.ArgCommand) {
 		b.AddMetaArg(arg.Key, v)
 	}
 }
+
+// SensitiveBuildArgs returns the values given in args, in the form of
+// --build-arg flags, to the build args named in names, keyed by name. Empty
+// values are left out, as there is nothing to hide.
+func SensitiveBuildArgs(args []string, names []string) map[string]string {
+	sensitive := map[string]string{}
+	for _, a := range args {
+		s := strings.SplitN(a, "=", 2)
+		if len(s) < 2 || s[1] == "" {
+			continue
+		}
+		for _, name := range names {
+			if s[0] == name {
+				sensitive[name] = s[1]
+			}
+		}
+	}
+	return sensitive
+}
+
+// UnusedBuildArgs returns the names of the build args given in args, in the
+// form of --build-arg flags, which aren't declared by an ARG instruction of
+// stages or before the first FROM. Like docker, the proxy build args, which
+// are used without being declared, aren't reported.
+func UnusedBuildArgs(args []string, stages []instructions.Stage, metaArgs []instructions.ArgCommand) []string {
+	declared := map[string]bool{}
+	for _, arg := range metaArgs {
+		declared[arg.Key] = true
+	}
+	for _, stage := range stages {
+		for _, cmd := range stage.Commands {
+			if arg, ok := cmd.(*instructions.ArgCommand); ok {
+				declared[arg.Key] = true
+			}
+		}
+	}
+	builtin := d.NewBuildArgs(nil)
+	var unused []string
+	for _, a := range args {
+		key := strings.SplitN(a, "=", 2)[0]
+		// Without referenced args, IsReferencedOrNotBuiltin is only false for the builtin ones.
+		if declared[key] || !builtin.IsReferencedOrNotBuiltin(key) {
+			continue
+		}
+		declared[key] = true
+		unused = append(unused, key)
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// HashSensitiveValues replaces the values of sensitive in s with their sha256
+// hash, so that s still changes with the values without containing them.
+func HashSensitiveValues(s string, sensitive map[string]string) string {
+	return replaceSensitiveValues(s, sensitive, func(v string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(v)))
+	})
+}
+
+// MaskSensitiveValues replaces the values of sensitive in s with ****.
+func MaskSensitiveValues(s string, sensitive map[string]string) string {
+	return replaceSensitiveValues(s, sensitive, func(string) string { return "****" })
+}
+
+func replaceSensitiveValues(s string, sensitive map[string]string, replace func(string) string) string {
+	var values []string
+	for _, v := range sensitive {
+		values = append(values, v)
+	}
+	// Longer values are replaced first, in case they contain shorter ones.
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, v := range values {
+		s = strings.ReplaceAll(s, v, replace(v))
+	}
+	return s
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// customInstructions are the keywords of the custom instructions, lowercased.
+var customInstructions = map[string]bool{}
+
+// RegisterInstruction makes Dockerfiles parse the instructions starting with
+// keyword into a CustomCommand. Keywords are case insensitive, like the ones
+// of the Dockerfile instructions, which can't be registered.
+func RegisterInstruction(keyword string) error {
+	keyword = strings.ToLower(keyword)
+	if keyword == "" || strings.ContainsAny(keyword, " \t\n") {
+		return fmt.Errorf("invalid instruction keyword %q", keyword)
+	}
+	if _, ok := command.Commands[keyword]; ok {
+		return fmt.Errorf("%s is a Dockerfile instruction", strings.ToUpper(keyword))
+	}
+	customInstructions[keyword] = true
+	return nil
+}
+
+// CustomCommand is an instruction whose keyword was registered with
+// RegisterInstruction.
+type CustomCommand struct {
+	// Keyword is the lowercased keyword of the instruction.
+	Keyword string
+	// Flags are the flags given to the instruction, such as --from=builder.
+	Flags []string
+	// Args are the whitespace separated arguments given after the flags.
+	Args []string
+	// Original is the instruction as it was written.
+	Original string
+}
+
+// Name returns the keyword of the instruction.
+func (c *CustomCommand) Name() string {
+	return c.Keyword
+}
+
+func (c *CustomCommand) String() string {
+	return c.Original
+}
+
+func newCustomCommand(n *parser.Node) *CustomCommand {
+	// The parser doesn't split the arguments of instructions it doesn't know.
+	args := strings.Fields(n.Original)[1:]
+	return &CustomCommand{
+		Keyword:  n.Value,
+		Flags:    n.Flags,
+		Args:     args[len(n.Flags):],
+		Original: n.Original,
+	}
+}
+
+// parseInstructions is like instructions.Parse, which fails on unknown
+// instructions, but also parses the custom instructions into CustomCommands.
+// The RUN instructions starting at one of the noSnapshot lines are parsed into
+// RunCommands.
+func parseInstructions(ast *parser.Node, noSnapshot map[int]bool) ([]instructions.Stage, []instructions.ArgCommand, error) {
+	type position struct {
+		stage int
+		index int
+	}
+	var customs []*CustomCommand
+	var positions []position
+	unsupportedFlags := map[position]addFlags{}
+	notSnapshotted := map[position]bool{}
+	known := &parser.Node{}
+	stage, index := -1, 0
+	for _, n := range ast.Children {
+		switch {
+		case customInstructions[n.Value]:
+			if stage < 0 {
+				return nil, nil, errors.Errorf("dockerfile parse error line %d: %s must come after FROM", n.StartLine, strings.ToUpper(n.Value))
+			}
+			customs = append(customs, newCustomCommand(n))
+			positions = append(positions, position{stage: stage, index: index})
+			continue
+		case n.Value == command.From:
+			stage++
+			index = 0
+		case stage >= 0:
+			flags, err := stripAddFlags(n)
+			if err != nil {
+				return nil, nil, err
+			}
+			if flags != (addFlags{}) {
+				unsupportedFlags[position{stage: stage, index: index}] = flags
+			}
+			if markNoSnapshot(n, noSnapshot) {
+				notSnapshotted[position{stage: stage, index: index}] = true
+			}
+			index++
+		}
+		known.Children = append(known.Children, n)
+	}
+
+	stages, metaArgs, err := instructions.Parse(known)
+	if err != nil {
+		return nil, nil, err
+	}
+	for p, flags := range unsupportedFlags {
+		cmd, err := withAddFlags(stages[p.stage].Commands[p.index], flags)
+		if err != nil {
+			return nil, nil, err
+		}
+		stages[p.stage].Commands[p.index] = cmd
+	}
+	for p := range notSnapshotted {
+		stages[p.stage].Commands[p.index] = withNoSnapshot(stages[p.stage].Commands[p.index])
+	}
+	// Each custom instruction shifts the ones after it in its stage.
+	inserted := map[int]int{}
+	for i, c := range customs {
+		p := positions[i]
+		at := p.index + inserted[p.stage]
+		cmds := stages[p.stage].Commands
+		stages[p.stage].Commands = append(cmds[:at], append([]instructions.Command{c}, cmds[at:]...)...)
+		inserted[p.stage]++
+	}
+	return stages, metaArgs, nil
+}
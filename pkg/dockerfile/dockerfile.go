@@ -17,18 +17,24 @@ limitations under the License.
 package dockerfile
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"net/http"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/sirupsen/logrus"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
@@ -38,13 +44,8 @@ import (
 func ParseStages(opts *config.KanikoOptions) ([]instructions.Stage, []instructions.ArgCommand, error) {
 	var err error
 	var d []uint8
-	match, _ := regexp.MatchString("^https?://", opts.DockerfilePath)
-	if match {
-		response, e := http.Get(opts.DockerfilePath)
-		if e != nil {
-			return nil, nil, e
-		}
-		d, err = ioutil.ReadAll(response.Body)
+	if IsURL(opts.DockerfilePath) {
+		d, err = Download(opts.DockerfilePath)
 	} else {
 		d, err = ioutil.ReadFile(opts.DockerfilePath)
 	}
@@ -66,6 +67,43 @@ func ParseStages(opts *config.KanikoOptions) ([]instructions.Stage, []instructio
 	return stages, metaArgs, nil
 }
 
+// ExtractFromImage returns the Dockerfile embedded in img. It is read from the
+// constants.DockerfileLabel label if it is set, or else from the file at path
+// in the image filesystem.
+func ExtractFromImage(img v1.Image, path string) ([]byte, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting image config")
+	}
+	if d, ok := cfg.Config.Labels[constants.DockerfileLabel]; ok {
+		logrus.Infof("Using Dockerfile from label %s", constants.DockerfileLabel)
+		return []byte(d), nil
+	}
+
+	target := strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading image filesystem")
+		}
+		if strings.TrimPrefix(filepath.Clean("/"+hdr.Name), "/") != target {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%s in the image is not a regular file", path)
+		}
+		logrus.Infof("Using Dockerfile from %s in the image", path)
+		return ioutil.ReadAll(tr)
+	}
+	return nil, fmt.Errorf("image has no %s label and no file at %s", constants.DockerfileLabel, path)
+}
+
 // baseImageIndex returns the index of the stage the current stage is built off
 // returns -1 if the current stage isn't built off a previous stage
 func baseImageIndex(currentStage int, stages []instructions.Stage) int {
@@ -83,13 +121,20 @@ func baseImageIndex(currentStage int, stages []instructions.Stage) int {
 	return -1
 }
 
+// parserDirective matches a parser directive line, eg '# escape=`'
+var parserDirective = regexp.MustCompile(`^#[ \t]*([a-zA-Z][a-zA-Z0-9]*)[ \t]*=[ \t]*(.+?)[ \t]*$`)
+
 // Parse parses the contents of a Dockerfile and returns a list of commands
 func Parse(b []byte) ([]instructions.Stage, []instructions.ArgCommand, error) {
+	b, err := normalizeParserDirectives(b)
+	if err != nil {
+		return nil, nil, err
+	}
 	p, err := parser.Parse(bytes.NewReader(b))
 	if err != nil {
 		return nil, nil, err
 	}
-	stages, metaArgs, err := instructions.Parse(p.AST)
+	stages, metaArgs, err := parseInstructions(p.AST, noSnapshotLines(b))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -102,6 +147,56 @@ func Parse(b []byte) ([]instructions.Stage, []instructions.ArgCommand, error) {
 	return stages, metaArgs, nil
 }
 
+// normalizeParserDirectives processes the block of parser directives at the top of a Dockerfile.
+// The vendored parser stops looking for the escape directive as soon as it sees any other
+// directive, so the escape directive is moved to the first line and all other directives
+// are blanked out. Unknown directives are ignored with a warning.
+// The number of lines is preserved so that line numbers in parse errors stay correct.
+func normalizeParserDirectives(b []byte) ([]byte, error) {
+	b = bytes.TrimPrefix(b, []byte{0xEF, 0xBB, 0xBF})
+	seen := map[string]bool{}
+	escape := ""
+	directiveLines := 0
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		match := parserDirective.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			break
+		}
+		key := strings.ToLower(match[1])
+		if seen[key] {
+			return nil, fmt.Errorf("only one %s parser directive can be used", key)
+		}
+		seen[key] = true
+		directiveLines++
+		switch key {
+		case "escape":
+			escape = match[2]
+		case "syntax":
+			logrus.Debugf("Ignoring syntax parser directive %s", match[2])
+		default:
+			logging.Warnf("Ignoring unknown parser directive %s", key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if directiveLines == 0 {
+		return b, nil
+	}
+
+	lines := bytes.SplitN(b, []byte("\n"), directiveLines+1)
+	var normalized bytes.Buffer
+	if escape != "" {
+		normalized.WriteString("# escape=" + escape)
+	}
+	normalized.WriteString(strings.Repeat("\n", directiveLines))
+	if len(lines) > directiveLines {
+		normalized.Write(lines[directiveLines])
+	}
+	return normalized.Bytes(), nil
+}
+
 // expandNestedArgs tries to resolve nested ARG value against the previously defined ARGs
 func expandNested(metaArgs []instructions.ArgCommand, buildArgs []string) ([]instructions.ArgCommand, error) {
 	prevArgs := make([]string, 0)
@@ -211,10 +306,17 @@ func ParseCommands(cmdArray []string) ([]instructions.Command, error) {
 		return nil, err
 	}
 	for _, child := range ast.AST.Children {
+		flags, err := stripAddFlags(child)
+		if err != nil {
+			return nil, err
+		}
 		cmd, err := instructions.ParseCommand(child)
 		if err != nil {
 			return nil, err
 		}
+		if cmd, err = withAddFlags(cmd, flags); err != nil {
+			return nil, err
+		}
 		cmds = append(cmds, cmd)
 	}
 	return cmds, nil
@@ -17,15 +17,22 @@ limitations under the License.
 package dockerfile
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/testutil"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 )
 
@@ -79,6 +86,76 @@ func Test_ParseStages_ArgValueWithQuotes(t *testing.T) {
 	}
 }
 
+func Test_Parse_ParserDirectives(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		expCmd     string
+		shdErr     bool
+	}{
+		{
+			name: "syntax and escape directives",
+			dockerfile: "# syntax=docker/dockerfile:1.2\n" +
+				"# escape=`\n" +
+				"FROM scratch\n" +
+				"RUN echo foo `\n" +
+				"  bar\n",
+			expCmd: "echo foo   bar",
+		},
+		{
+			name: "escape directive before syntax directive",
+			dockerfile: "#escape = `\n" +
+				"#syntax = docker/dockerfile:experimental\n" +
+				"FROM scratch\n" +
+				"RUN echo foo `\n" +
+				"  bar\n",
+			expCmd: "echo foo   bar",
+		},
+		{
+			name: "unknown directive is ignored",
+			dockerfile: "# foo=bar\n" +
+				"# escape=`\n" +
+				"FROM scratch\n" +
+				"RUN echo foo `\n" +
+				"  bar\n",
+			expCmd: "echo foo   bar",
+		},
+		{
+			name: "directive after a comment is treated as a comment",
+			dockerfile: "# a comment\n" +
+				"# escape=`\n" +
+				"FROM scratch\n" +
+				"RUN echo foo \\\n" +
+				"  bar\n",
+			expCmd: "echo foo   bar",
+		},
+		{
+			name: "repeated directive",
+			dockerfile: "# escape=`\n" +
+				"# escape=\\\n" +
+				"FROM scratch\n",
+			shdErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stages, _, err := Parse([]byte(test.dockerfile))
+			testutil.CheckError(t, test.shdErr, err)
+			if test.shdErr {
+				return
+			}
+			if len(stages) != 1 || len(stages[0].Commands) != 1 {
+				t.Fatalf("expected a single stage with one command, got %v", stages)
+			}
+			run, ok := stages[0].Commands[0].(*instructions.RunCommand)
+			if !ok {
+				t.Fatalf("expected a run command, got %v", stages[0].Commands[0])
+			}
+			testutil.CheckDeepEqual(t, test.expCmd, strings.Join(run.CmdLine, " "))
+		})
+	}
+}
+
 func Test_stripEnclosingQuotes(t *testing.T) {
 	type testCase struct {
 		name     string
@@ -649,3 +726,301 @@ func Test_SkipingUnusedStages(t *testing.T) {
 		}
 	}
 }
+
+func Test_ExtractFromImage(t *testing.T) {
+	labeled, err := mutate.Config(empty.Image, v1.Config{
+		Labels: map[string]string{constants.DockerfileLabel: "FROM scratch\nLABEL from=label"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	contents := "FROM scratch\nLABEL from=file"
+	tw.WriteHeader(&tar.Header{Name: "build/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "build/Dockerfile", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+	tw.Write([]byte(contents))
+	tw.Close()
+	layer, err := tarball.LayerFromReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withFile, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		image       v1.Image
+		path        string
+		expected    string
+		shouldErr   bool
+	}{
+		{
+			description: "dockerfile from label",
+			image:       labeled,
+			path:        "/build/Dockerfile",
+			expected:    "FROM scratch\nLABEL from=label",
+		},
+		{
+			description: "dockerfile from file",
+			image:       withFile,
+			path:        "/build/Dockerfile",
+			expected:    "FROM scratch\nLABEL from=file",
+		},
+		{
+			description: "dockerfile from relative path",
+			image:       withFile,
+			path:        "build/Dockerfile",
+			expected:    "FROM scratch\nLABEL from=file",
+		},
+		{
+			description: "path is a directory",
+			image:       withFile,
+			path:        "/build",
+			shouldErr:   true,
+		},
+		{
+			description: "no dockerfile",
+			image:       empty.Image,
+			path:        "Dockerfile",
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d, err := ExtractFromImage(test.image, test.path)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, string(d))
+		})
+	}
+}
+
+func Test_SensitiveBuildArgs(t *testing.T) {
+	sensitive := SensitiveBuildArgs([]string{"TOKEN=s3cr3t", "KEY=s3cr3t-key", "USER=me", "EMPTY="}, []string{"TOKEN", "KEY", "EMPTY"})
+	testutil.CheckDeepEqual(t, map[string]string{"TOKEN": "s3cr3t", "KEY": "s3cr3t-key"}, sensitive)
+
+	s := "curl -u $USER:s3cr3t-key -H s3cr3t"
+	testutil.CheckDeepEqual(t, "curl -u $USER:**** -H ****", MaskSensitiveValues(s, sensitive))
+	hashed := HashSensitiveValues(s, sensitive)
+	if strings.Contains(hashed, "s3cr3t") {
+		t.Errorf("expected the hashed string not to contain the values, got %s", hashed)
+	}
+	if hashed == HashSensitiveValues(s, map[string]string{"TOKEN": "s3cr3t", "KEY": "0th3r"}) {
+		t.Error("expected the hashed string to change with the values")
+	}
+}
+
+func Test_UnusedBuildArgs(t *testing.T) {
+	dockerfile := `ARG BASE=scratch
+FROM $BASE
+ARG VERSION
+FROM scratch
+ARG TARGET=prod
+`
+	stages, metaArgs, err := Parse([]byte(dockerfile))
+	testutil.CheckNoError(t, err)
+	tests := []struct {
+		description string
+		args        []string
+		expected    []string
+	}{
+		{
+			description: "declared args",
+			args:        []string{"BASE=busybox", "VERSION=1.0", "TARGET"},
+		},
+		{
+			description: "undeclared args",
+			args:        []string{"VERSIN=1.0", "VERSION=1.0", "DEBUG", "VERSIN=2.0"},
+			expected:    []string{"DEBUG", "VERSIN"},
+		},
+		{
+			description: "proxy args",
+			args:        []string{"HTTP_PROXY=http://proxy", "no_proxy=localhost"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			testutil.CheckDeepEqual(t, test.expected, UnusedBuildArgs(test.args, stages, metaArgs))
+		})
+	}
+}
+
+func Test_ParseCustomInstructions(t *testing.T) {
+	testutil.CheckNoError(t, RegisterInstruction("NOTIFY"))
+	testutil.CheckError(t, true, RegisterInstruction("run"))
+
+	dockerfile := `FROM scratch AS builder
+notify --channel=builds start
+RUN echo build
+NOTIFY done
+NOTIFY again
+
+FROM scratch
+COPY --from=builder /out /out
+NOTIFY final
+`
+	stages, _, err := Parse([]byte(dockerfile))
+	testutil.CheckNoError(t, err)
+	var names [][]string
+	for _, stage := range stages {
+		var stageNames []string
+		for _, cmd := range stage.Commands {
+			stageNames = append(stageNames, cmd.Name())
+		}
+		names = append(names, stageNames)
+	}
+	testutil.CheckDeepEqual(t, [][]string{{"notify", "run", "notify", "notify"}, {"copy", "notify"}}, names)
+	testutil.CheckDeepEqual(t, &CustomCommand{
+		Keyword:  "notify",
+		Flags:    []string{"--channel=builds"},
+		Args:     []string{"start"},
+		Original: "notify --channel=builds start",
+	}, stages[0].Commands[0])
+
+	_, _, err = Parse([]byte("NOTIFY start\nFROM scratch"))
+	testutil.CheckError(t, true, err)
+}
+
+func Test_ParseAddChecksum(t *testing.T) {
+	const checksum = "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	tests := []struct {
+		description string
+		dockerfile  string
+		expected    string
+		rendered    string
+		shouldErr   bool
+	}{
+		{
+			description: "checksum",
+			dockerfile:  "FROM scratch\nADD --chown=1 --checksum=" + checksum + " https://example.com/file /file",
+			expected:    checksum,
+			rendered:    "ADD --chown=1 --checksum=" + checksum + " https://example.com/file /file",
+		},
+		{
+			description: "no checksum",
+			dockerfile:  "FROM scratch\nADD https://example.com/file /file",
+		},
+		{
+			description: "invalid checksum",
+			dockerfile:  "FROM scratch\nADD --checksum=md5:abc https://example.com/file /file",
+			shouldErr:   true,
+		},
+		{
+			description: "several sources",
+			dockerfile:  "FROM scratch\nADD --checksum=" + checksum + " a b /dir/",
+			shouldErr:   true,
+		},
+		{
+			description: "local file",
+			dockerfile:  "FROM scratch\nADD --checksum=" + checksum + " file /file",
+			shouldErr:   true,
+		},
+		{
+			description: "git repository",
+			dockerfile:  "FROM scratch\nADD --checksum=" + checksum + " git@github.com:GoogleContainerTools/kaniko.git /src",
+			shouldErr:   true,
+		},
+		{
+			description: "source set with a variable",
+			dockerfile:  "FROM scratch\nADD --chown=1 --checksum=" + checksum + " $URL /file",
+			expected:    checksum,
+			rendered:    "ADD --chown=1 --checksum=" + checksum + ` ["$URL","/file"]`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			stages, _, err := Parse([]byte(test.dockerfile))
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			cmd := stages[0].Commands[0]
+			if test.expected == "" {
+				if _, ok := cmd.(*instructions.AddCommand); !ok {
+					t.Errorf("expected an ADD instruction, got %T", cmd)
+				}
+				return
+			}
+			add, ok := cmd.(*AddCommand)
+			if !ok {
+				t.Fatalf("expected an ADD instruction with a checksum, got %T", cmd)
+			}
+			testutil.CheckDeepEqual(t, test.expected, add.Checksum)
+			testutil.CheckDeepEqual(t, "1", add.Chown)
+			testutil.CheckDeepEqual(t, test.rendered, renderCommand(add))
+		})
+	}
+}
+
+func Test_ParseAddKeepGitDir(t *testing.T) {
+	for flag, expected := range map[string]bool{
+		"--keep-git-dir":       true,
+		"--keep-git-dir=true":  true,
+		"--keep-git-dir=false": false,
+	} {
+		t.Run(flag, func(t *testing.T) {
+			stages, _, err := Parse([]byte("FROM scratch\nADD " + flag + " https://example.com/repo.git /src"))
+			testutil.CheckNoError(t, err)
+			keepGitDir := false
+			if add, ok := stages[0].Commands[0].(*AddCommand); ok {
+				keepGitDir = add.KeepGitDir
+			}
+			testutil.CheckDeepEqual(t, expected, keepGitDir)
+		})
+	}
+	_, _, err := Parse([]byte("FROM scratch\nADD --keep-git-dir=maybe https://example.com/repo.git /src"))
+	testutil.CheckError(t, true, err)
+}
+
+func Test_ParseNoSnapshot(t *testing.T) {
+	tests := []struct {
+		description string
+		dockerfile  string
+		expected    []bool
+	}{
+		{
+			description: "marked",
+			dockerfile:  "FROM scratch\n# kaniko:no-snapshot\nRUN apt-get update\nRUN make",
+			expected:    []bool{true, false},
+		},
+		{
+			description: "among other comments",
+			dockerfile:  "FROM scratch\n  #kaniko:no-snapshot \n# refresh the package lists\nRUN apt-get update",
+			expected:    []bool{true},
+		},
+		{
+			description: "after a parser directive",
+			dockerfile:  "# escape=`\nFROM scratch\n# kaniko:no-snapshot\nRUN apt-get update `\n  && apt-get check",
+			expected:    []bool{true},
+		},
+		{
+			description: "separated by a blank line",
+			dockerfile:  "FROM scratch\n# kaniko:no-snapshot\n\nRUN apt-get update",
+			expected:    []bool{false},
+		},
+		{
+			description: "above another instruction",
+			dockerfile:  "FROM scratch\n# kaniko:no-snapshot\nENV A=b\nRUN apt-get update",
+			expected:    []bool{false, false},
+		},
+		{
+			description: "other comment",
+			dockerfile:  "FROM scratch\n# kaniko:no-snapshot please\nRUN apt-get update",
+			expected:    []bool{false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			stages, _, err := Parse([]byte(test.dockerfile))
+			testutil.CheckNoError(t, err)
+			var noSnapshot []bool
+			for _, cmd := range stages[0].Commands {
+				run, ok := cmd.(*RunCommand)
+				noSnapshot = append(noSnapshot, ok && run.NoSnapshot)
+			}
+			testutil.CheckDeepEqual(t, test.expected, noSnapshot)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+// for testing
+var (
+	maxDownloadSize int64 = 10 << 20
+	downloadTimeout       = time.Minute
+)
+
+// IsURL returns true if path is an http(s) URL.
+func IsURL(path string) bool {
+	match, _ := regexp.MatchString("^https?://", path)
+	return match
+}
+
+// Download returns the Dockerfile at the http(s) URL rawurl. Redirects are
+// followed, and Dockerfiles larger than 10MiB or taking more than a minute to
+// download are rejected.
+func Download(rawurl string) ([]byte, error) {
+	client := &http.Client{Timeout: downloadTimeout}
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "downloading dockerfile from %s", rawurl)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading dockerfile from %s: bad status from server: %s", rawurl, resp.Status)
+	}
+	// Servers rarely know the type of Dockerfiles, so any type is accepted,
+	// but HTML is likely a web page showing the Dockerfile rather than the
+	// Dockerfile itself.
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" {
+		logging.Warnf("The dockerfile at %s is served as %s, make sure the URL points to the raw file", rawurl, mediaType)
+	}
+	if resp.ContentLength > maxDownloadSize {
+		return nil, fmt.Errorf("dockerfile at %s is larger than %d bytes", rawurl, maxDownloadSize)
+	}
+	d, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "downloading dockerfile from %s", rawurl)
+	}
+	if int64(len(d)) > maxDownloadSize {
+		return nil, fmt.Errorf("dockerfile at %s is larger than %d bytes", rawurl, maxDownloadSize)
+	}
+	return d, nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestDownload(t *testing.T) {
+	const dockerfile = "FROM scratch\nCOPY foo /foo\n"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Dockerfile", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte(dockerfile))
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dockerfile))
+	})
+	mux.Handle("/redirect", http.RedirectHandler("/Dockerfile", http.StatusFound))
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("#", 2048)))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	originalSize, originalTimeout := maxDownloadSize, downloadTimeout
+	defer func() { maxDownloadSize, downloadTimeout = originalSize, originalTimeout }()
+	maxDownloadSize, downloadTimeout = 1024, 100*time.Millisecond
+
+	tests := []struct {
+		description string
+		path        string
+		shouldErr   bool
+	}{
+		{
+			description: "dockerfile",
+			path:        "/Dockerfile",
+		},
+		{
+			description: "dockerfile served as html",
+			path:        "/page",
+		},
+		{
+			description: "redirect",
+			path:        "/redirect",
+		},
+		{
+			description: "missing",
+			path:        "/missing",
+			shouldErr:   true,
+		},
+		{
+			description: "too large",
+			path:        "/large",
+			shouldErr:   true,
+		},
+		{
+			description: "timeout",
+			path:        "/slow",
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d, err := Download(server.URL + test.path)
+			testutil.CheckError(t, test.shouldErr, err)
+			if !test.shouldErr {
+				testutil.CheckDeepEqual(t, dockerfile, string(d))
+			}
+		})
+	}
+}
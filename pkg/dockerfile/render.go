@@ -0,0 +1,135 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+// Render returns the Dockerfile of stages. The instructions whose variables
+// can be substituted are rendered from their arguments, so that substituted
+// values show up, while the others are rendered as they were written.
+func Render(stages []config.KanikoStage) string {
+	var b strings.Builder
+	for i, stage := range stages {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString("FROM ")
+		if stage.Platform != "" {
+			fmt.Fprintf(&b, "--platform=%s ", stage.Platform)
+		}
+		b.WriteString(stage.BaseName)
+		if stage.Name != "" {
+			fmt.Fprintf(&b, " AS %s", stage.Name)
+		}
+		b.WriteString("\n")
+		for _, cmd := range stage.Commands {
+			b.WriteString(renderCommand(cmd))
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+func renderCommand(cmd instructions.Command) string {
+	switch c := cmd.(type) {
+	case *instructions.ArgCommand:
+		if c.Value == nil {
+			return "ARG " + c.Key
+		}
+		return fmt.Sprintf("ARG %s=%s", c.Key, quoteWord(*c.Value))
+	case *instructions.EnvCommand:
+		return "ENV " + renderKeyValuePairs(c.Env)
+	case *instructions.LabelCommand:
+		return "LABEL " + renderKeyValuePairs(c.Labels)
+	case *instructions.CopyCommand:
+		var flags []string
+		if c.From != "" {
+			flags = append(flags, "--from="+c.From)
+		}
+		if c.Chown != "" {
+			flags = append(flags, "--chown="+c.Chown)
+		}
+		return renderWithArgs("COPY", flags, c.SourcesAndDest)
+	case *instructions.AddCommand:
+		return renderAdd(&AddCommand{AddCommand: c})
+	case *AddCommand:
+		return renderAdd(c)
+	case *instructions.VolumeCommand:
+		return renderWithArgs("VOLUME", nil, c.Volumes)
+	case *instructions.WorkdirCommand:
+		return "WORKDIR " + c.Path
+	case *instructions.UserCommand:
+		return "USER " + c.User
+	case *instructions.StopSignalCommand:
+		return "STOPSIGNAL " + c.Signal
+	case fmt.Stringer:
+		return c.String()
+	}
+	return strings.ToUpper(cmd.Name())
+}
+
+func renderAdd(c *AddCommand) string {
+	var flags []string
+	if c.Chown != "" {
+		flags = append(flags, "--chown="+c.Chown)
+	}
+	if c.Checksum != "" {
+		flags = append(flags, checksumFlag+c.Checksum)
+	}
+	if c.KeepGitDir {
+		flags = append(flags, keepGitDirFlag)
+	}
+	return renderWithArgs("ADD", flags, c.SourcesAndDest)
+}
+
+func renderKeyValuePairs(kvps instructions.KeyValuePairs) string {
+	var pairs []string
+	for _, kvp := range kvps {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", kvp.Key, quoteWord(kvp.Value)))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// renderWithArgs renders args in the JSON form if one of them would otherwise
+// be split or substituted again.
+func renderWithArgs(instruction string, flags []string, args []string) string {
+	words := append([]string{instruction}, flags...)
+	for _, arg := range args {
+		if quoteWord(arg) != arg {
+			b, _ := json.Marshal(args)
+			return strings.Join(append(words, string(b)), " ")
+		}
+	}
+	return strings.Join(append(words, args...), " ")
+}
+
+// quoteWord quotes s if it contains characters which would otherwise be
+// interpreted when it's parsed again.
+func quoteWord(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n\"'\\$") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+)
+
+// noSnapshotComment matches the comment marking the RUN instruction below it
+// as not snapshotted, eg '# kaniko:no-snapshot'.
+var noSnapshotComment = regexp.MustCompile(`^#[ \t]*kaniko:no-snapshot[ \t]*$`)
+
+// RunCommand is a RUN instruction marked with a '# kaniko:no-snapshot'
+// comment, which the parser doesn't keep.
+type RunCommand struct {
+	*instructions.RunCommand
+	// NoSnapshot skips the snapshot of the files changed by the command.
+	NoSnapshot bool
+}
+
+// noSnapshotLines returns the lines of the Dockerfile b where the instructions
+// marked with a '# kaniko:no-snapshot' comment start. The comment has to be
+// one of the comment lines right above the instruction.
+func noSnapshotLines(b []byte) map[int]bool {
+	lines := map[int]bool{}
+	marked := false
+	for i, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		switch {
+		case noSnapshotComment.Match(line):
+			marked = true
+		case len(line) > 0 && line[0] == '#':
+		case len(line) > 0 && marked:
+			lines[i+1] = true
+			marked = false
+		default:
+			marked = false
+		}
+	}
+	return lines
+}
+
+// markNoSnapshot reports whether n, an instruction starting at one of the
+// noSnapshot lines, is a RUN instruction whose snapshot is skipped. Other
+// instructions can't be marked.
+func markNoSnapshot(n *parser.Node, noSnapshot map[int]bool) bool {
+	if !noSnapshot[n.StartLine] {
+		return false
+	}
+	if n.Value != command.Run {
+		logging.Warnf("Ignoring the kaniko:no-snapshot comment above %s on line %d, only RUN instructions can be marked with it", strings.ToUpper(n.Value), n.StartLine)
+		return false
+	}
+	return true
+}
+
+// withNoSnapshot returns cmd, a RUN instruction, marked as not snapshotted.
+func withNoSnapshot(cmd instructions.Command) instructions.Command {
+	run, ok := cmd.(*instructions.RunCommand)
+	if !ok {
+		return cmd
+	}
+	return &RunCommand{RunCommand: run, NoSnapshot: true}
+}
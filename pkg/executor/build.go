@@ -17,10 +17,16 @@ limitations under the License.
 package executor
 
 import (
+	"archive/tar"
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -33,6 +39,7 @@ import (
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/cache"
@@ -42,6 +49,8 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	image_util "github.com/GoogleContainerTools/kaniko/pkg/image"
 	"github.com/GoogleContainerTools/kaniko/pkg/image/remote"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/GoogleContainerTools/kaniko/pkg/metrics"
 	"github.com/GoogleContainerTools/kaniko/pkg/snapshot"
 	"github.com/GoogleContainerTools/kaniko/pkg/timing"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
@@ -53,7 +62,11 @@ const emptyTarSize = 1024
 
 // for testing
 var (
-	initializeConfig = initConfig
+	initializeConfig    = initConfig
+	retrieveRemoteImage = remote.RetrieveRemoteImage
+	debugShell          = runDebugShell
+	getFSFromImage      = util.GetFSFromImage
+	stdinIsTerminal     = func() bool { return isCharDevice(os.Stdin) }
 )
 
 type cachePusher func(*config.KanikoOptions, string, string, string) error
@@ -69,24 +82,30 @@ type stageBuilder struct {
 	image            v1.Image
 	cf               *v1.ConfigFile
 	baseImageDigest  string
+	baseLayers       int
 	finalCacheKey    string
 	opts             *config.KanikoOptions
 	fileContext      util.FileContext
 	cmds             []commands.DockerCommand
 	args             *dockerfile.BuildArgs
+	sensitiveArgs    map[string]string
 	crossStageDeps   map[int][]string
 	digestToCacheKey map[string]string
 	stageIdxToDigest map[string]string
 	snapshotter      snapShotter
 	layerCache       cache.LayerCache
 	pushLayerToCache cachePusher
+	skipSnapshotFor  []*regexp.Regexp
+	// unpackedFS is true if the filesystem holds the files of the base image,
+	// which are then not extracted again.
+	unpackedFS bool
 }
 
 // newStageBuilder returns a new type stageBuilder which contains all the information required to build the stage
 func newStageBuilder(opts *config.KanikoOptions, stage config.KanikoStage, crossStageDeps map[int][]string, dcm map[string]string, sid map[string]string, stageNameToIdx map[string]string, fileContext util.FileContext) (*stageBuilder, error) {
 	sourceImage, err := image_util.RetrieveSourceImage(stage, opts)
 	if err != nil {
-		return nil, err
+		return nil, BaseImagePullErr{Image: stage.BaseName, Err: err}
 	}
 
 	imageConfig, err := initializeConfig(sourceImage, opts)
@@ -102,19 +121,41 @@ func newStageBuilder(opts *config.KanikoOptions, stage config.KanikoStage, cross
 	if err != nil {
 		return nil, err
 	}
-	l := snapshot.NewLayeredMap(hasher, util.CacheHasher())
+	l := snapshot.NewLayeredMap(hasher, util.MemoizedHasher(util.CacheHasher()))
 	snapshotter := snapshot.NewSnapshotter(l, config.RootDir)
+	snapshotter.SetWarnAfter(opts.SnapshotWarnAfter)
+	if opts.SnapshotMode == constants.SnapshotModeChanged {
+		if j, ok := snapshot.NewChangeJournal(config.RootDir); ok {
+			snapshotter.SetChangeJournal(j)
+		} else {
+			logrus.Info("No change journal available, the whole filesystem will be walked when snapshotting")
+		}
+	}
 
 	digest, err := sourceImage.Digest()
 	if err != nil {
 		return nil, err
 	}
+	if opts.SnapshotIndexDir != "" {
+		snapshotter.SetIndex(snapshotIndexPath(opts.SnapshotIndexDir, digest, opts.SnapshotMode))
+	}
+	// The layers of the base image are kept as they are in the final image, if
+	// they are preserved.
+	baseLayers := 0
+	if opts.PreserveBaseLayers {
+		layers, err := sourceImage.Layers()
+		if err != nil {
+			return nil, err
+		}
+		baseLayers = len(layers)
+	}
 	s := &stageBuilder{
 		stage:            stage,
 		image:            sourceImage,
 		cf:               imageConfig,
 		snapshotter:      snapshotter,
 		baseImageDigest:  digest.String(),
+		baseLayers:       baseLayers,
 		opts:             opts,
 		fileContext:      fileContext,
 		crossStageDeps:   crossStageDeps,
@@ -125,9 +166,16 @@ func newStageBuilder(opts *config.KanikoOptions, stage config.KanikoStage, cross
 		},
 		pushLayerToCache: pushLayerToCache,
 	}
+	for _, pattern := range opts.SkipSnapshotFor {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid --skip-snapshot-for pattern %q", pattern)
+		}
+		s.skipSnapshotFor = append(s.skipSnapshotFor, re)
+	}
 
 	for _, cmd := range s.stage.Commands {
-		command, err := commands.GetCommand(cmd, fileContext, opts.RunV2, opts.CacheCopyLayers)
+		command, err := commands.GetCommand(cmd, fileContext, opts.RunV2, opts.CacheCopyLayers, opts.CaptureOutputLines, opts.RunTimeout, opts.RunNetwork)
 		if err != nil {
 			return nil, err
 		}
@@ -137,8 +185,12 @@ func newStageBuilder(opts *config.KanikoOptions, stage config.KanikoStage, cross
 		s.cmds = append(s.cmds, command)
 	}
 
+	// Like with Docker, ARGs are scoped to the stage they're declared in: each
+	// stage starts over from the --build-arg values and the ARGs declared
+	// before the first FROM, which it must declare again to use.
 	s.args = dockerfile.NewBuildArgs(s.opts.BuildArgs)
 	s.args.AddMetaArgs(s.stage.MetaArgs)
+	s.sensitiveArgs = dockerfile.SensitiveBuildArgs(s.opts.BuildArgs, s.opts.SecretBuildArgs)
 	return s, nil
 }
 
@@ -148,8 +200,15 @@ func initConfig(img partial.WithConfigFile, opts *config.KanikoOptions) (*v1.Con
 		return nil, err
 	}
 
+	// Images built FROM scratch have no environment, give them a PATH so that
+	// commands can be found.
 	if imageConfig.Config.Env == nil {
-		imageConfig.Config.Env = constants.ScratchEnvVars
+		imageConfig.Config.Env = append([]string{}, constants.ScratchEnvVars...)
+		if opts != nil {
+			if err := applyEnvOverrides(&imageConfig.Config, opts.ScratchEnv); err != nil {
+				return nil, errors.Wrap(err, "applying --scratch-env")
+			}
+		}
 	}
 
 	if opts == nil {
@@ -180,16 +239,32 @@ func (s *stageBuilder) populateCompositeKey(command fmt.Stringer, files []string
 	if err != nil {
 		return compositeKey, err
 	}
-	// Add the next command to the cache key.
-	compositeKey.AddKey(resolvedCmd)
+	// Add the next command to the cache key, without the values of sensitive build args.
+	compositeKey.AddKey(dockerfile.HashSensitiveValues(resolvedCmd, s.sensitiveArgs))
 	switch v := command.(type) {
 	case *commands.CopyCommand:
 	case *commands.CachingCopyCommand:
 		compositeKey = s.populateCopyCmdCompositeKey(command, v.From(), compositeKey)
+	case *commands.AddCommand:
+		// A git repository source is added at the commit its ref is at.
+		commit, err := v.GitCommit(&v1.Config{Env: env}, args)
+		if err != nil {
+			return compositeKey, err
+		}
+		if commit != "" {
+			compositeKey.AddKey(commit)
+		}
 	}
 
+	// The files COPY --from uses from an additional build context are in it.
+	fileContext := s.fileContext
+	if c, ok := command.(interface{ From() string }); ok {
+		if buildContext, ok := commands.BuildContext(c.From()); ok {
+			fileContext = buildContext
+		}
+	}
 	for _, f := range files {
-		if err := compositeKey.AddPath(f, s.fileContext); err != nil {
+		if err := compositeKey.AddPath(f, fileContext); err != nil {
 			return compositeKey, err
 		}
 	}
@@ -213,7 +288,7 @@ func (s *stageBuilder) populateCopyCmdCompositeKey(command fmt.Stringer, from st
 }
 
 func (s *stageBuilder) optimize(compositeKey CompositeCache, cfg v1.Config) error {
-	if !s.opts.Cache {
+	if !s.cacheEnabled() {
 		return nil
 	}
 
@@ -245,22 +320,29 @@ func (s *stageBuilder) optimize(compositeKey CompositeCache, cfg v1.Config) erro
 		logrus.Debugf("optimize: cache key for command %v %v", command.String(), ck)
 		s.finalCacheKey = ck
 
-		if command.ShouldCacheOutput() && !stopCache {
-			img, err := s.layerCache.RetrieveLayer(ck)
+		if s.shouldCacheOutput(command) && !stopCache {
+			img, err := s.layerCache.RetrieveLayer(s.cacheTag(ck))
 
 			if err != nil {
+				metrics.CacheMisses.Inc()
 				logrus.Debugf("Failed to retrieve layer: %s", err)
 				logrus.Infof("No cached layer found for cmd %s", command.String())
 				logrus.Debugf("Key missing was: %s", compositeKey.Key())
 				stopCache = true
 				continue
 			}
+			metrics.CacheHits.Inc()
 
 			if cacheCmd := command.CacheCommand(img); cacheCmd != nil {
 				logrus.Infof("Using caching version of cmd: %s", command.String())
 				s.cmds[i] = cacheCmd
 			}
 		}
+		// The changes of a command whose snapshot is skipped are only in the
+		// next snapshot, so the layers of the next commands can't be cached.
+		if s.skipsSnapshot(command) {
+			stopCache = true
+		}
 
 		// Mutate the config for any commands that require it.
 		if command.MetadataOnly() {
@@ -272,7 +354,107 @@ func (s *stageBuilder) optimize(compositeKey CompositeCache, cfg v1.Config) erro
 	return nil
 }
 
-func (s *stageBuilder) build() error {
+// layerCacheFrom returns a layer cache of the images given with
+// --layer-cache-from, or nil if there are none.
+func layerCacheFrom(opts *config.KanikoOptions) (cache.LayerCache, error) {
+	if len(opts.LayerCacheFrom) == 0 {
+		return nil, nil
+	}
+	var images []v1.Image
+	for _, ref := range opts.LayerCacheFrom {
+		logrus.Infof("Importing the layer cache from %s", ref)
+		img, err := image_util.RetrieveRemoteImage(ref, opts.RegistryOptions, opts.CustomPlatform)
+		if err != nil {
+			return nil, errors.Wrapf(err, "retrieving image %s to import the layer cache from", ref)
+		}
+		images = append(images, img)
+	}
+	imageCache, err := cache.NewImageCache(images...)
+	if err != nil {
+		return nil, err
+	}
+	return imageCache, nil
+}
+
+// cacheEnabled returns true if cache keys are computed for the commands, to
+// look up their layers in the cache repository or in the images given with
+// --layer-cache-from, or to export them with --cache-to or --inline-cache.
+func (s *stageBuilder) cacheEnabled() bool {
+	return s.opts.Cache || len(s.opts.LayerCacheFrom) > 0 || s.opts.CacheTo != "" || s.opts.InlineCache
+}
+
+// exportsCacheKeys returns true if the cache keys of the layers are recorded
+// in the built image, for later builds to import the cache from it with
+// --layer-cache-from. They aren't with only --cache, as they would change the
+// digest of the image.
+func exportsCacheKeys(opts *config.KanikoOptions) bool {
+	return len(opts.LayerCacheFrom) > 0 || opts.CacheTo != "" || opts.InlineCache
+}
+
+// cacheTag returns the tag the layer with the cache key ck is cached with. With
+// --cache-repo-per-stage, it's prefixed with the name of the stage, or with
+// stage-<index> for unnamed stages, so that stages don't share cached layers.
+func (s *stageBuilder) cacheTag(ck string) string {
+	if !s.opts.CacheRepoPerStage {
+		return ck
+	}
+	prefix := fmt.Sprintf("stage-%d", s.stage.Index)
+	if s.stage.Name != "" {
+		prefix = s.stage.Name
+	}
+	// Tags are at most 128 characters long, and cache keys take 64 of them.
+	if len(prefix) > 63 {
+		prefix = prefix[:63]
+	}
+	return prefix + "-" + ck
+}
+
+// shouldCacheOutput returns true if the layer created by command should be
+// read from and pushed to the cache. The layers of the commands whose snapshot
+// is skipped are folded into a later one, so they aren't cached on their own.
+func (s *stageBuilder) shouldCacheOutput(command commands.DockerCommand) bool {
+	if s.skipsSnapshot(command) {
+		return false
+	}
+	return command.ShouldCacheOutput()
+}
+
+// skipsSnapshot returns true if command is a RUN command marked with a
+// '# kaniko:no-snapshot' comment or matching a --skip-snapshot-for pattern,
+// whose changes aren't snapshotted into a layer of their own. They are added
+// to the image by the next snapshot, which is then taken of the whole
+// filesystem, or by a snapshot taken after the last command of the stage.
+// Snapshots aren't skipped with a single snapshot, as it's taken after the
+// last command.
+func (s *stageBuilder) skipsSnapshot(command commands.DockerCommand) bool {
+	if !isRunCommand(command) || s.singleSnapshot() {
+		return false
+	}
+	if c, ok := command.(commands.SnapshotSkipper); ok && c.SkipsSnapshot() {
+		return true
+	}
+	for _, re := range s.skipSnapshotFor {
+		if re.MatchString(command.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stageBuilder) build(ctx context.Context) (err error) {
+	if s.opts.DebugContext != "" {
+		defer func() {
+			if err == nil {
+				return
+			}
+			if derr := writeDebugContext(s.opts.DebugContext); derr != nil {
+				logging.Warnf("Failed to write debug context to %s: %s", s.opts.DebugContext, derr)
+				return
+			}
+			logrus.Infof("Wrote the filesystem at the time of the failure to %s", s.opts.DebugContext)
+		}()
+	}
+
 	// Set the initial cache key to be the base image digest, the build args and the SrcContext.
 	var compositeKey *CompositeCache
 	if cacheKey, ok := s.digestToCacheKey[s.baseImageDigest]; ok {
@@ -298,13 +480,25 @@ func (s *stageBuilder) build() error {
 	if len(s.crossStageDeps[s.stage.Index]) > 0 {
 		shouldUnpack = true
 	}
+	if s.runsCleanup() {
+		shouldUnpack = true
+	}
 
-	if shouldUnpack {
+	if shouldUnpack && s.unpackedFS {
+		logrus.Infof("Reusing the filesystem of stage %d, which this stage is built from.", s.stage.BaseImageIndex)
+	} else if shouldUnpack {
 		t := timing.Start("FS Unpacking")
 
-		if _, err := util.GetFSFromImage(config.RootDir, s.image, util.ExtractFile); err != nil {
+		if !s.opts.SkipDiskSpaceCheck {
+			if err := checkImageDiskSpace(config.RootDir, s.image); err != nil {
+				return err
+			}
+		}
+		if _, err := getFSFromImage(config.RootDir, s.image, util.ExtractFile, util.FetchParallelism(s.opts.LayerFetchParallelism)); err != nil {
 			return errors.Wrap(err, "failed to get filesystem from image")
 		}
+		metrics.AddImageBytes(metrics.BytesPulled, s.image)
+		s.unpackedFS = true
 
 		timing.DefaultRun.Stop(t)
 	} else {
@@ -316,7 +510,7 @@ func (s *stageBuilder) build() error {
 	}
 
 	initSnapshotTaken := false
-	if s.opts.SingleSnapshot || s.opts.RunV2 {
+	if s.singleSnapshot() || s.opts.RunV2 {
 		if err := s.initSnapshotWithTimings(); err != nil {
 			return err
 		}
@@ -324,6 +518,9 @@ func (s *stageBuilder) build() error {
 	}
 
 	cacheGroup := errgroup.Group{}
+	// pendingChanges is true when the changes of a command whose snapshot was
+	// skipped haven't been snapshotted yet.
+	pendingChanges := false
 	for index, command := range s.cmds {
 		if command == nil {
 			continue
@@ -337,11 +534,17 @@ func (s *stageBuilder) build() error {
 			return errors.Wrap(err, "failed to get files used from context")
 		}
 
-		if s.opts.Cache {
+		var ck string
+		if s.cacheEnabled() {
 			*compositeKey, err = s.populateCompositeKey(command, files, *compositeKey, s.args, s.cf.Config.Env)
-			if err != nil && s.opts.Cache {
+			if err != nil {
 				return err
 			}
+			logrus.Debugf("build: composite key for command %v %v", command.String(), compositeKey)
+			if ck, err = compositeKey.Hash(); err != nil {
+				return errors.Wrap(err, "failed to hash composite key")
+			}
+			logrus.Debugf("build: cache key for command %v %v", command.String(), ck)
 		}
 
 		logrus.Info(command.String())
@@ -363,19 +566,65 @@ func (s *stageBuilder) build() error {
 			initSnapshotTaken = true
 		}
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if i, ok := command.(commands.Interruptible); ok {
+			i.SetContext(ctx)
+		}
+		if p, ok := command.(commands.OutputPrefixer); ok && !s.opts.NoRunPrefix {
+			p.SetOutputPrefix(fmt.Sprintf("[stage %d] [%d/%d] ", s.stage.Index, index+1, len(s.cmds)))
+		}
+		if sa, ok := command.(commands.ScratchAware); ok && s.stage.BaseName == constants.NoBaseImage {
+			sa.SetFromScratch()
+		}
+		var configBefore map[string]bool
+		if len(s.sensitiveArgs) > 0 {
+			configBefore = configValues(&s.cf.Config)
+		}
 		if err := command.ExecuteCommand(&s.cf.Config, s.args); err != nil {
-			return errors.Wrap(err, "failed to execute command")
+			if s.opts.DebugOnFailure && isRunCommand(command) {
+				debugOnFailure(command.String(), &s.cf.Config)
+			}
+			return newCommandFailedErr(command.String(), err)
+		}
+		if err := checkSensitiveBuildArgs(configBefore, &s.cf.Config, s.sensitiveArgs); err != nil {
+			return newCommandFailedErr(command.String(), err)
+		}
+		if m, ok := command.(*commands.MaintainerCommand); ok {
+			s.cf.Author = m.Maintainer()
 		}
 		files = command.FilesToSnapshot()
-		timing.DefaultRun.Stop(t)
+		logrus.Infof("Command %s took %s", command.String(), timing.DefaultRun.Stop(t))
 
-		if !s.shouldTakeSnapshot(index, command.MetadataOnly()) {
+		isLastCommand := index == len(s.cmds)-1
+		if s.skipsSnapshot(command) && !isLastCommand {
+			logrus.Infof("Skipping the snapshot of %s, its changes are added to the next snapshot", command.String())
+			pendingChanges = true
+			continue
+		}
+		if !s.shouldTakeSnapshot(index, command.MetadataOnly()) && !(pendingChanges && isLastCommand) {
 			continue
 		}
+		if pendingChanges {
+			// The files changed by the skipped commands aren't known.
+			files = nil
+			pendingChanges = false
+		}
 		if isCacheCommand {
 			v := command.(commands.Cached)
 			layer := v.Layer()
-			if err := s.saveLayerToImage(layer, command.String()); err != nil {
+			// Commands that didn't change any file have an empty cached layer,
+			// which isn't added to the image, like when the command is run.
+			empty, err := isEmptyLayer(layer)
+			if err != nil {
+				return errors.Wrap(err, "failed to read cached layer")
+			}
+			if empty {
+				logrus.Info("No files were changed in cached layer. No layer added to image.")
+				continue
+			}
+			if err := s.saveLayerToImage(layer, s.createdBy(command), ck); err != nil {
 				return errors.Wrap(err, "failed to save layer")
 			}
 		} else {
@@ -384,56 +633,61 @@ func (s *stageBuilder) build() error {
 				return errors.Wrap(err, "failed to take snapshot")
 			}
 
-			if s.opts.Cache {
-				logrus.Debugf("build: composite key for command %v %v", command.String(), compositeKey)
-				ck, err := compositeKey.Hash()
-				if err != nil {
-					return errors.Wrap(err, "failed to hash composite key")
-				}
-
-				logrus.Debugf("build: cache key for command %v %v", command.String(), ck)
-
-				// Push layer to cache (in parallel) now along with new config file
-				if command.ShouldCacheOutput() {
-					cacheGroup.Go(func() error {
-						return s.pushLayerToCache(s.opts, ck, tarPath, command.String())
-					})
-				}
+			// Push layer to cache (in parallel) now along with new config file
+			if s.opts.Cache && s.shouldCacheOutput(command) {
+				cacheGroup.Go(func() error {
+					return s.pushLayerToCache(s.opts, s.cacheTag(ck), tarPath, command.String())
+				})
 			}
-			if err := s.saveSnapshotToImage(command.String(), tarPath); err != nil {
+			if err := s.saveSnapshotToImage(s.createdBy(command), ck, tarPath); err != nil {
 				return errors.Wrap(err, "failed to save snapshot to image")
 			}
 		}
 	}
 
 	if err := cacheGroup.Wait(); err != nil {
-		logrus.Warnf("error uploading layer to cache: %s", err)
+		logging.Warnf("error uploading layer to cache: %s", err)
 	}
 
+	if s.runsCleanup() {
+		if err := s.runCleanup(initSnapshotTaken); err != nil {
+			return errors.Wrap(err, "failed to run cleanup command")
+		}
+	}
 	return nil
 }
 
+// runsCleanup returns true if the --cleanup-run command runs at the end of the stage.
+func (s *stageBuilder) runsCleanup() bool {
+	return s.stage.Final && s.opts.CleanupRun != ""
+}
+
 func (s *stageBuilder) takeSnapshot(files []string, shdDelete bool) (string, error) {
 	var snapshot string
 	var err error
 
 	t := timing.Start("Snapshotting FS")
-	if files == nil || s.opts.SingleSnapshot {
+	if files == nil || s.singleSnapshot() {
 		snapshot, err = s.snapshotter.TakeSnapshotFS()
 	} else {
 		// Volumes are very weird. They get snapshotted in the next command.
 		files = append(files, util.Volumes()...)
 		snapshot, err = s.snapshotter.TakeSnapshot(files, shdDelete)
 	}
-	timing.DefaultRun.Stop(t)
+	logrus.Infof("Taking snapshot took %s", timing.DefaultRun.Stop(t))
 	return snapshot, err
 }
 
+// singleSnapshot returns true if only one snapshot should be taken at the end of the stage.
+func (s *stageBuilder) singleSnapshot() bool {
+	return s.opts.SingleSnapshot || (s.opts.SingleSnapshotPerStage && !s.stage.Final)
+}
+
 func (s *stageBuilder) shouldTakeSnapshot(index int, isMetadatCmd bool) bool {
 	isLastCommand := index == len(s.cmds)-1
 
 	// We only snapshot the very end with single snapshot mode on.
-	if s.opts.SingleSnapshot {
+	if s.singleSnapshot() {
 		return isLastCommand
 	}
 
@@ -446,7 +700,7 @@ func (s *stageBuilder) shouldTakeSnapshot(index int, isMetadatCmd bool) bool {
 	return !isMetadatCmd
 }
 
-func (s *stageBuilder) saveSnapshotToImage(createdBy string, tarPath string) error {
+func (s *stageBuilder) saveSnapshotToImage(createdBy, ck string, tarPath string) error {
 	layer, err := s.saveSnapshotToLayer(tarPath)
 	if err != nil {
 		return err
@@ -456,7 +710,7 @@ func (s *stageBuilder) saveSnapshotToImage(createdBy string, tarPath string) err
 		return nil
 	}
 
-	return s.saveLayerToImage(layer, createdBy)
+	return s.saveLayerToImage(layer, createdBy, ck)
 }
 
 func (s *stageBuilder) saveSnapshotToLayer(tarPath string) (v1.Layer, error) {
@@ -468,7 +722,7 @@ func (s *stageBuilder) saveSnapshotToLayer(tarPath string) (v1.Layer, error) {
 		return nil, errors.Wrap(err, "tar file path does not exist")
 	}
 	if fi.Size() <= emptyTarSize {
-		logrus.Info("No files were changed, appending empty layer to config. No layer added to image.")
+		logrus.Info("No files were changed. No layer added to image.")
 		return nil, nil
 	}
 
@@ -479,18 +733,88 @@ func (s *stageBuilder) saveSnapshotToLayer(tarPath string) (v1.Layer, error) {
 
 	return layer, nil
 }
-func (s *stageBuilder) saveLayerToImage(layer v1.Layer, createdBy string) error {
+
+// isEmptyLayer returns true if layer doesn't contain any file. Only small
+// layers are read, as empty layers compress to a few bytes.
+func isEmptyLayer(layer v1.Layer) (bool, error) {
+	size, err := layer.Size()
+	if err != nil {
+		return false, err
+	}
+	if size > emptyTarSize {
+		return false, nil
+	}
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	if _, err := tar.NewReader(rc).Next(); err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// createdBy returns the history entry of the layer created by command. It's
+// the command as written in the Dockerfile, so that the values of the build
+// args don't end up in the image. With --history-build-args, the build args
+// in scope of RUN commands are recorded before it the way docker does, except
+// for the sensitive ones.
+func (s *stageBuilder) createdBy(command commands.DockerCommand) string {
+	if !s.opts.HistoryBuildArgs || s.args == nil {
+		return command.String()
+	}
+	switch command.(type) {
+	case *commands.RunCommand, *commands.RunMarkerCommand, *commands.CachingRunCommand:
+	default:
+		return command.String()
+	}
+	secret := map[string]bool{}
+	for _, name := range s.opts.SecretBuildArgs {
+		secret[name] = true
+	}
+	var args []string
+	for _, arg := range s.args.FilterAllowed(s.cf.Config.Env) {
+		if !secret[strings.SplitN(arg, "=", 2)[0]] {
+			args = append(args, arg)
+		}
+	}
+	if len(args) == 0 {
+		return command.String()
+	}
+	sort.Strings(args)
+	return fmt.Sprintf("|%d %s %s", len(args), strings.Join(args, " "), command.String())
+}
+
+// saveLayerToImage appends layer to the image. The cache key ck of the layer
+// is recorded in its history if the cache keys are exported, so that later
+// builds can import the cache from the image with --layer-cache-from.
+func (s *stageBuilder) saveLayerToImage(layer v1.Layer, createdBy, ck string) error {
+	history := v1.History{
+		Author:    constants.Author,
+		CreatedBy: createdBy,
+	}
+	if ck != "" && exportsCacheKeys(s.opts) {
+		history.Comment = cache.HistoryComment(s.cacheTag(ck))
+	}
 	var err error
 	s.image, err = mutate.Append(s.image,
 		mutate.Addendum{
-			Layer: layer,
-			History: v1.History{
-				Author:    constants.Author,
-				CreatedBy: createdBy,
-			},
+			Layer:   layer,
+			History: history,
 		},
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	// Fail as soon as the image is too big, rather than once it's built.
+	if s.stage.Final && s.opts.MaxImageSize > 0 {
+		return checkImageSize(s.image, int64(s.opts.MaxImageSize))
+	}
+	return nil
 }
 
 func CalculateDependencies(stages []config.KanikoStage, opts *config.KanikoOptions, stageNameToIdx map[string]string) (map[int][]string, error) {
@@ -508,7 +832,7 @@ func CalculateDependencies(stages []config.KanikoStage, opts *config.KanikoOptio
 		} else {
 			image, err = image_util.RetrieveSourceImage(s, opts)
 			if err != nil {
-				return nil, err
+				return nil, BaseImagePullErr{Image: s.BaseName, Err: err}
 			}
 		}
 		cfg, err := initializeConfig(image, opts)
@@ -517,7 +841,12 @@ func CalculateDependencies(stages []config.KanikoStage, opts *config.KanikoOptio
 		}
 
 		cmds, err := dockerfile.GetOnBuildInstructions(&cfg.Config, stageNameToIdx)
+		if err != nil {
+			return nil, err
+		}
 		cmds = append(cmds, s.Commands...)
+		// Triggers only fire once, stages built from this one only see its own ONBUILD instructions.
+		cfg.Config.OnBuild = nil
 
 		for _, c := range cmds {
 			switch cmd := c.(type) {
@@ -537,10 +866,8 @@ func CalculateDependencies(stages []config.KanikoStage, opts *config.KanikoOptio
 				if err := util.UpdateConfigEnv(cmd.Env, &cfg.Config, ba.ReplacementEnvs(cfg.Config.Env)); err != nil {
 					return nil, err
 				}
-				image, err = mutate.Config(image, cfg.Config)
-				if err != nil {
-					return nil, err
-				}
+			case *instructions.OnbuildCommand:
+				cfg.Config.OnBuild = append(cfg.Config.OnBuild, cmd.Expression)
 			case *instructions.ArgCommand:
 				k, v, err := commands.ParseArg(cmd.Key, cmd.Value, cfg.Config.Env, ba)
 				if err != nil {
@@ -549,35 +876,180 @@ func CalculateDependencies(stages []config.KanikoStage, opts *config.KanikoOptio
 				ba.AddArg(k, v)
 			}
 		}
+		image, err = mutate.Config(image, cfg.Config)
+		if err != nil {
+			return nil, err
+		}
 		images = append(images, image)
 	}
 	return depGraph, nil
 }
 
+// checkRunEmulation makes sure RUN instructions can be executed when building
+// for a platform whose binaries can't run natively on the host.
+func checkRunEmulation(stages []config.KanikoStage, opts *config.KanikoOptions) error {
+	if opts.CustomPlatform == "" {
+		return nil
+	}
+	platform, err := remote.ParsePlatform(opts.CustomPlatform)
+	if err != nil {
+		return err
+	}
+	if !util.NeedsEmulation(platform.Architecture) {
+		return nil
+	}
+	for _, stage := range stages {
+		for _, cmd := range stage.Commands {
+			switch cmd.(type) {
+			case *instructions.RunCommand, *dockerfile.RunCommand:
+				return errors.Wrapf(util.CheckEmulation(platform.Architecture), "unable to execute RUN instructions for %s", opts.CustomPlatform)
+			}
+		}
+	}
+	return nil
+}
+
+// stagesToPublish returns the references the intermediate stages are pushed
+// to with --publish-stage, by the index of the stage. Stages are given by name
+// or by index.
+func stagesToPublish(stages []config.KanikoStage, publish map[string]string) (map[int]string, error) {
+	refs := map[int]string{}
+	for key, ref := range publish {
+		index := -1
+		for i, stage := range stages {
+			if stage.Name == strings.ToLower(key) || strconv.Itoa(i) == key {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			return nil, fmt.Errorf("--publish-stage %s=%s doesn't match a stage of the Dockerfile", key, ref)
+		}
+		if stages[index].Final {
+			return nil, fmt.Errorf("--publish-stage %s=%s matches the final stage, which is pushed to --destination", key, ref)
+		}
+		refs[index] = ref
+	}
+	return refs, nil
+}
+
+// checkUnusedBuildArgs warns about the build args which aren't declared by the
+// Dockerfile, likely because of a typo, or fails with
+// --error-on-unused-build-args.
+func checkUnusedBuildArgs(stages []instructions.Stage, metaArgs []instructions.ArgCommand, opts *config.KanikoOptions) error {
+	unused := dockerfile.UnusedBuildArgs(opts.BuildArgs, stages, metaArgs)
+	if len(unused) == 0 {
+		return nil
+	}
+	if opts.ErrorOnUnusedBuildArgs {
+		return errors.Errorf("build args %v were not consumed", unused)
+	}
+	logging.Warnf("One or more build args %v were not consumed", unused)
+	return nil
+}
+
+// createdTime returns the creation time to set on the final image.
+func createdTime(opts *config.KanikoOptions) (time.Time, error) {
+	if opts.Created == "" {
+		return time.Now(), nil
+	}
+	created, err := time.Parse(time.RFC3339, opts.Created)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid --created timestamp %q, expected RFC 3339 format such as 2020-01-02T15:04:05Z", opts.Created)
+	}
+	return created, nil
+}
+
 // DoBuild executes building the Dockerfile
 func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
+	return doBuild(context.Background(), opts, nil)
+}
+
+// doBuild builds the Dockerfile, reading the build context from contextFS if
+// it is set, or else from opts.SrcContext. The build is interrupted when ctx
+// is done, or once opts.BuildTimeout has passed.
+func doBuild(ctx context.Context, opts *config.KanikoOptions, contextFS afero.Fs) (image v1.Image, err error) {
+	defer func(start time.Time) { metrics.ObserveBuild(start, err) }(time.Now())
+	defer func() {
+		// The layers kept in temporary files are only needed to push the image.
+		if err != nil {
+			util.RemoveTempFiles()
+		}
+	}()
+	defer func() {
+		// With --strict, the build fails once it's done, so that every warning is reported.
+		if err == nil {
+			if err = logging.Warnings(); err != nil {
+				image = nil
+			}
+		}
+	}()
+	if opts.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.BuildTimeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if opts.MaxLayers > 0 && exportsCacheKeys(opts) {
+		logging.Warnf("The cache keys of the layers merged by --max-layers are discarded, so these layers can't be imported with --layer-cache-from")
+	}
+	if !opts.SkipDiskSpaceCheck {
+		defer util.MonitorDiskSpace([]string{config.RootDir, config.KanikoDir}, lowDiskSpace, diskSpaceCheckInterval)()
+	}
 	t := timing.Start("Total Build Time")
 	digestToCacheKey := make(map[string]string)
 	stageIdxToDigest := make(map[string]string)
 
+	created, err := createdTime(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	stages, metaArgs, err := dockerfile.ParseStages(opts)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := checkUnusedBuildArgs(stages, metaArgs, opts); err != nil {
+		return nil, err
+	}
+
 	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
 	if err != nil {
 		return nil, err
 	}
 	stageNameToIdx := ResolveCrossStageInstructions(kanikoStages)
+	if err := validateCrossStageInstructions(kanikoStages); err != nil {
+		return nil, err
+	}
+	if err := checkRunEmulation(kanikoStages, opts); err != nil {
+		return nil, err
+	}
+	publishedStages, err := stagesToPublish(kanikoStages, opts.PublishStages)
+	if err != nil {
+		return nil, err
+	}
 
-	fileContext, err := util.NewFileContextFromDockerfile(opts.DockerfilePath, opts.SrcContext)
+	var fileContext util.FileContext
+	if contextFS != nil {
+		fileContext, err = util.NewFileContextFromFS(opts.DockerfilePath, contextFS)
+	} else {
+		fileContext, err = util.NewFileContextFromDockerfile(opts.DockerfilePath, opts.SrcContext)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	localContexts, imageContexts, err := parseBuildContexts(opts.BuildContexts)
+	if err != nil {
+		return nil, err
+	}
+	commands.ConfigureBuildContexts(localContexts)
+
 	// Some stages may refer to other random images, not previous stages
-	if err := fetchExtraStages(kanikoStages, opts); err != nil {
+	if err := fetchExtraStages(kanikoStages, imageContexts, opts); err != nil {
 		return nil, err
 	}
 	crossStageDependencies, err := CalculateDependencies(kanikoStages, opts, stageNameToIdx)
@@ -585,17 +1057,59 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 		return nil, err
 	}
 	logrus.Infof("Built cross stage deps: %v", crossStageDependencies)
+	imageCache, err := layerCacheFrom(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err == nil || ctx.Err() == nil {
+			return
+		}
+		cleanupStageFiles(kanikoStages)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errors.Wrapf(ctx.Err(), "build timed out after %s", opts.BuildTimeout)
+		}
+	}()
 
+	// unpackedFS is true if the filesystem left by the previous stage holds
+	// the files of its image.
+	unpackedFS := false
 	for index, stage := range kanikoStages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		sb, err := newStageBuilder(opts, stage, crossStageDependencies, digestToCacheKey, stageIdxToDigest, stageNameToIdx, fileContext)
 		if err != nil {
 			return nil, err
 		}
-		if err := sb.build(); err != nil {
+		sb.unpackedFS = unpackedFS
+		if imageCache != nil {
+			// Layers are looked up in the images first, as they are already pulled.
+			caches := cache.MultiCache{imageCache}
+			if opts.Cache {
+				caches = append(caches, sb.layerCache)
+			}
+			sb.layerCache = caches
+		}
+		// The layers of the base image are left out of the exported filesystem diff.
+		var baseLayers []v1.Layer
+		if stage.Final && opts.ExportFSDiff != "" {
+			if baseLayers, err = sb.image.Layers(); err != nil {
+				return nil, err
+			}
+		}
+		if err := sb.build(ctx); err != nil {
 			return nil, errors.Wrap(err, "error building stage")
 		}
 
 		reviewConfig(stage, &sb.cf.Config)
+		if stage.Final {
+			resetInheritedConfig(stage, &sb.cf.Config, opts)
+			if err := applyEnvOverrides(&sb.cf.Config, opts.Env); err != nil {
+				return nil, err
+			}
+		}
 
 		sourceImage, err := mutate.Config(sb.image, sb.cf.Config)
 		if err != nil {
@@ -606,12 +1120,19 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 		if err != nil {
 			return nil, err
 		}
+		if sb.cf.Author != "" {
+			configFile.Author = sb.cf.Author
+		}
 		if opts.CustomPlatform == "" {
 			configFile.OS = runtime.GOOS
 			configFile.Architecture = runtime.GOARCH
 		} else {
-			configFile.OS = strings.Split(opts.CustomPlatform, "/")[0]
-			configFile.Architecture = strings.Split(opts.CustomPlatform, "/")[1]
+			platform, err := remote.ParsePlatform(opts.CustomPlatform)
+			if err != nil {
+				return nil, err
+			}
+			configFile.OS = platform.OS
+			configFile.Architecture = platform.Architecture
 		}
 		sourceImage, err = mutate.ConfigFile(sourceImage, configFile)
 		if err != nil {
@@ -630,13 +1151,56 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 		logrus.Debugf("mapping digest %v to cachekey %v", d.String(), sb.finalCacheKey)
 
 		if stage.Final {
-			sourceImage, err = mutate.CreatedAt(sourceImage, v1.Time{Time: time.Now()})
+			sourceImage, err = mutate.CreatedAt(sourceImage, v1.Time{Time: created})
 			if err != nil {
 				return nil, err
 			}
+			if opts.ExportFSDiff != "" {
+				if err := exportFSDiff(opts.ExportFSDiff, sourceImage, len(baseLayers), opts.Reproducible); err != nil {
+					return nil, errors.Wrap(err, "exporting filesystem diff")
+				}
+			}
+			if opts.MaxLayers > 0 {
+				sourceImage, err = limitLayers(sourceImage, opts.MaxLayers, sb.baseLayers)
+				if err != nil {
+					return nil, errors.Wrap(err, "limiting layers")
+				}
+			}
 			if opts.Reproducible {
-				sourceImage, err = mutate.Canonical(sourceImage)
+				sourceImage, err = canonical(sourceImage, sb.baseLayers)
+				if err != nil {
+					return nil, err
+				}
+				// An explicit creation time is kept, as only the other timestamps are stripped.
+				if opts.Created != "" {
+					sourceImage, err = mutate.CreatedAt(sourceImage, v1.Time{Time: created})
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+			// The cache keys are read from the history, before it's flattened.
+			if opts.InlineCache {
+				sourceImage, err = cache.WithCacheMetadata(sourceImage)
+				if err != nil {
+					return nil, errors.Wrap(err, "adding inline cache metadata")
+				}
+			}
+			// Checked again once complete, as merging layers changes their size and
+			// the base image may be over the limit on its own.
+			if opts.MaxImageSize > 0 {
+				if err := checkImageSize(sourceImage, int64(opts.MaxImageSize)); err != nil {
+					return nil, err
+				}
+			}
+			if opts.FlattenHistory {
+				sourceImage, err = flattenHistory(sourceImage)
 				if err != nil {
+					return nil, errors.Wrap(err, "flattening history")
+				}
+			}
+			if opts.ConfigFile != "" {
+				if err := writeConfigFile(opts.ConfigFile, sourceImage); err != nil {
 					return nil, err
 				}
 			}
@@ -652,6 +1216,16 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 			if err := saveStageAsTarball(strconv.Itoa(index), sourceImage); err != nil {
 				return nil, err
 			}
+			if opts.StageDigestDir != "" {
+				if err := writeStageDigest(opts.StageDigestDir, index, stage.Name, sourceImage); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if ref, ok := publishedStages[index]; ok {
+			if err := pushStage(sourceImage, ref, opts); err != nil {
+				return nil, errors.Wrapf(err, "publishing stage %d", index)
+			}
 		}
 
 		filesToSave, err := filesToSave(crossStageDependencies[index])
@@ -672,6 +1246,10 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 			}
 		}
 
+		if unpackedFS = keepsFilesystem(opts, kanikoStages, index, sb.unpackedFS); unpackedFS {
+			logrus.Infof("Keeping the filesystem of stage %d for the next stage, which is built from it", index)
+			continue
+		}
 		// Delete the filesystem
 		if err := util.DeleteFilesystem(); err != nil {
 			return nil, errors.Wrap(err, fmt.Sprintf("deleting file system after stage %d", index))
@@ -681,6 +1259,23 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 	return nil, err
 }
 
+// keepsFilesystem returns true if the filesystem left by the stage at index,
+// which holds the files of its image if unpacked is true, is kept for the next
+// stage instead of being deleted and extracted again, as the next stage is built
+// from it. The filesystem only matches the image if every change to it was
+// snapshotted, so not with --rootless, which leaves unreadable files out, nor
+// with the snapshot modes which don't compare the content of files.
+func keepsFilesystem(opts *config.KanikoOptions, stages []config.KanikoStage, index int, unpacked bool) bool {
+	if !unpacked || index+1 >= len(stages) {
+		return false
+	}
+	next := stages[index+1]
+	if !next.BaseImageStoredLocally || next.BaseImageIndex != index {
+		return false
+	}
+	return opts.SnapshotMode == constants.SnapshotModeFull && !opts.Rootless
+}
+
 // fileToSave returns all the files matching the given pattern in deps.
 // If a file is a symlink, it also returns the target file.
 func filesToSave(deps []string) ([]string, error) {
@@ -717,11 +1312,90 @@ func filesToSave(deps []string) ([]string, error) {
 	return deduped, nil
 }
 
-func fetchExtraStages(stages []config.KanikoStage, opts *config.KanikoOptions) error {
+// flattenHistory removes the history entries of img that didn't create a
+// layer, such as those of ENV or LABEL commands. The entries of layers are
+// kept, so that the history still lines up with the layers: an image with a
+// single layer is left with a single history entry.
+func flattenHistory(img v1.Image) (v1.Image, error) {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	history := cf.History[:0]
+	for _, h := range cf.History {
+		if !h.EmptyLayer {
+			history = append(history, h)
+		}
+	}
+	cf.History = history
+	return mutate.ConfigFile(img, cf)
+}
+
+// snapshotIndexPath returns the path of the snapshot index of the filesystem
+// extracted from the base image with digest, in the given snapshot mode.
+func snapshotIndexPath(dir string, digest v1.Hash, snapshotMode string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.json", digest.Hex, snapshotMode))
+}
+
+// canonical strips the timestamps and host dependent settings out of img, to
+// make it reproducible. The first baseLayers layers are kept as they are, so
+// that they still have the digests of the base image layers; only the timestamps
+// of the files of the other layers are stripped.
+func canonical(img v1.Image, baseLayers int) (v1.Image, error) {
+	if baseLayers == 0 {
+		return mutate.Canonical(img)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	built, err := mutate.AppendLayers(empty.Image, layers[baseLayers:]...)
+	if err != nil {
+		return nil, err
+	}
+	built, err = mutate.Time(built, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	builtLayers, err := built.Layers()
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := mutate.AppendLayers(empty.Image, append(layers[:baseLayers:baseLayers], builtLayers...)...)
+	if err != nil {
+		return nil, err
+	}
+	canonicalCf, err := canonical.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	cf.RootFS = canonicalCf.RootFS
+	cf.Created = v1.Time{}
+	for i := range cf.History {
+		cf.History[i].Created = v1.Time{}
+	}
+	cf.Container = ""
+	cf.Config.Hostname = ""
+	cf.DockerVersion = ""
+	return mutate.ConfigFile(canonical, cf)
+}
+
+// fetchExtraStages fetches and extracts the images COPY --from refers to,
+// either by reference or by the name of an image build context in images.
+func fetchExtraStages(stages []config.KanikoStage, images map[string]string, opts *config.KanikoOptions) error {
 	t := timing.Start("Fetching Extra Stages")
 	defer timing.DefaultRun.Stop(t)
 
 	var names []string
+	// Images referenced by several COPY --from commands are only fetched and extracted once.
+	fetched := map[string]bool{}
 
 	for stageIndex, s := range stages {
 		for _, cmd := range s.Commands {
@@ -741,19 +1415,34 @@ func fetchExtraStages(stages []config.KanikoStage, opts *config.KanikoOptions) e
 			if fromPreviousStage(c, names) {
 				continue
 			}
+			// Local build contexts are copied from where they are.
+			if _, ok := commands.BuildContext(c.From); ok {
+				continue
+			}
 
 			// This must be an image name, fetch it.
-			logrus.Debugf("Found extra base image stage %s", c.From)
-			sourceImage, err := remote.RetrieveRemoteImage(c.From, opts.RegistryOptions, opts.CustomPlatform)
+			if fetched[c.From] {
+				continue
+			}
+			ref := c.From
+			if image, ok := images[strings.ToLower(c.From)]; ok {
+				ref = image
+			}
+			logrus.Debugf("Found extra base image stage %s", ref)
+			sourceImage, err := retrieveRemoteImage(ref, opts.RegistryOptions, opts.CustomPlatform)
 			if err != nil {
-				return err
+				return BaseImagePullErr{Image: ref, Err: err}
 			}
-			if err := saveStageAsTarball(c.From, sourceImage); err != nil {
-				return err
+			if !opts.SkipDiskSpaceCheck {
+				if err := checkImageDiskSpace(config.KanikoDir, sourceImage); err != nil {
+					return err
+				}
 			}
-			if err := extractImageToDependencyDir(c.From, sourceImage); err != nil {
+			// COPY --from only reads the extracted files, the image isn't saved.
+			if err := extractImageToDependencyDir(c.From, sourceImage, opts.LayerFetchParallelism); err != nil {
 				return err
 			}
+			fetched[c.From] = true
 		}
 		// Store the name of the current stage in the list with names, if applicable.
 		if s.Name != "" {
@@ -772,7 +1461,133 @@ func fromPreviousStage(copyCommand *instructions.CopyCommand, previousStageNames
 	return false
 }
 
-func extractImageToDependencyDir(name string, image v1.Image) error {
+func isRunCommand(command commands.DockerCommand) bool {
+	switch command.(type) {
+	case *commands.RunCommand, *commands.RunMarkerCommand:
+		return true
+	}
+	return false
+}
+
+// debugOnFailure starts a shell to inspect the filesystem after command failed,
+// if one is available and kaniko is run interactively.
+func debugOnFailure(command string, cfg *v1.Config) {
+	shell := filepath.Join(config.RootDir, "bin", "sh")
+	if _, err := os.Stat(shell); err != nil {
+		logging.Warnf("Not starting a debug shell after %s failed, as %s doesn't exist", command, shell)
+		return
+	}
+	if !stdinIsTerminal() {
+		logging.Warnf("Not starting a debug shell after %s failed, as stdin isn't a terminal. Run kaniko with a TTY, or use --debug-context instead.", command)
+		return
+	}
+	logrus.Infof("%s failed, starting %s to inspect the filesystem. Exit the shell to end the build.", command, shell)
+	if err := debugShell(shell, cfg); err != nil {
+		logging.Warnf("Debug shell exited with error: %s", err)
+	}
+}
+
+func runDebugShell(shell string, cfg *v1.Config) error {
+	cmd := exec.Command(shell)
+	cmd.Dir = cfg.WorkingDir
+	cmd.Env = cfg.Env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func isCharDevice(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// writeDebugContext writes the current state of the root directory, except
+// for ignored paths, to a tarball at path.
+func writeDebugContext(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	t := util.NewTar(f)
+	defer t.Close()
+	return filepath.Walk(config.RootDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files can disappear while the failed command's processes exit.
+			logrus.Debugf("Not adding %s to debug context: %s", p, err)
+			return nil
+		}
+		if p == path || util.CheckIgnoreList(p) {
+			if info.IsDir() && p != config.RootDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return t.AddFileToTar(p)
+	})
+}
+
+// cleanupStageFiles removes the stage tarballs and the files saved for later
+// stages by an interrupted build.
+func cleanupStageFiles(stages []config.KanikoStage) {
+	dirs := []string{filepath.Join(config.KanikoDir, constants.KanikoIntermediateStagesDir)}
+	for _, s := range stages {
+		dirs = append(dirs, filepath.Join(config.KanikoDir, strconv.Itoa(s.Index)))
+		for _, cmd := range s.Commands {
+			if c, ok := cmd.(*instructions.CopyCommand); ok && c.From != "" {
+				dirs = append(dirs, filepath.Join(config.KanikoDir, c.From))
+			}
+		}
+	}
+	for _, d := range dirs {
+		if err := os.RemoveAll(d); err != nil {
+			logging.Warnf("Failed to remove %s: %s", d, err)
+		}
+	}
+}
+
+const (
+	// lowDiskSpace is the available disk space under which the build warns.
+	lowDiskSpace = 512 << 20
+	// diskSpaceCheckInterval is how often the available disk space is checked.
+	diskSpaceCheckInterval = 30 * time.Second
+	// compressionRatio is the size of the files of a layer relative to the
+	// size of the compressed layer, used to estimate the disk space required
+	// to extract an image. It's conservative, as text files such as those of
+	// package managers often compress to less than a third of their size.
+	compressionRatio = 3
+)
+
+// checkImageDiskSpace returns an error if the filesystem of dir doesn't have
+// room to extract image. The space the files of image take is estimated from
+// the size of its compressed layers, as their uncompressed size isn't known
+// without downloading them.
+func checkImageDiskSpace(dir string, image v1.Image) error {
+	layers, err := image.Layers()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, l := range layers {
+		s, err := l.Size()
+		if err != nil {
+			logrus.Debugf("Unable to get layer size, not checking the disk space: %s", err)
+			return nil
+		}
+		size += s
+	}
+	required := uint64(size) * compressionRatio
+	if err := util.CheckDiskSpace(dir, required); err != nil {
+		return errors.Wrapf(err, "checking the disk space needed to extract the image, estimated as %d times the size of its compressed layers, set --skip-disk-space-check to skip this check", compressionRatio)
+	}
+	return nil
+}
+
+func extractImageToDependencyDir(name string, image v1.Image, fetchParallelism int) error {
 	t := timing.Start("Extracting Image to Dependency Dir")
 	defer timing.DefaultRun.Stop(t)
 	dependencyDir := filepath.Join(config.KanikoDir, name)
@@ -780,7 +1595,7 @@ func extractImageToDependencyDir(name string, image v1.Image) error {
 		return err
 	}
 	logrus.Debugf("trying to extract to %s", dependencyDir)
-	_, err := util.GetFSFromImage(dependencyDir, image, util.ExtractFile)
+	_, err := util.GetFSFromImage(dependencyDir, image, util.ExtractFile, util.FetchParallelism(fetchParallelism))
 	return err
 }
 
@@ -791,7 +1606,7 @@ func saveStageAsTarball(path string, image v1.Image) error {
 	if err != nil {
 		return err
 	}
-	tarPath := filepath.Join(constants.KanikoIntermediateStagesDir, path)
+	tarPath := filepath.Join(config.KanikoDir, constants.KanikoIntermediateStagesDir, path)
 	logrus.Infof("Storing source image from stage %s at path %s", path, tarPath)
 	if err := os.MkdirAll(filepath.Dir(tarPath), 0750); err != nil {
 		return err
@@ -799,20 +1614,107 @@ func saveStageAsTarball(path string, image v1.Image) error {
 	return tarball.WriteToFile(tarPath, destRef, image)
 }
 
+// writeStageDigest writes the digest of image, the image of the stage at
+// index, to the file named after the index of the stage in dir, and to the one
+// named after the stage if it has a name.
+func writeStageDigest(dir string, index int, stageName string, image v1.Image) error {
+	digest, err := image.Digest()
+	if err != nil {
+		return errors.Wrapf(err, "getting digest of stage %d", index)
+	}
+	files := []string{strconv.Itoa(index)}
+	if stageName != "" {
+		files = append(files, stageName)
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		logrus.Infof("Writing digest %s of stage %d to %s", digest, index, path)
+		if err := writeDigestFile(path, []byte(digest.String())); err != nil {
+			return errors.Wrapf(err, "writing digest of stage %d", index)
+		}
+	}
+	return nil
+}
+
+// writeConfigFile writes the config of image to path, as JSON.
+func writeConfigFile(path string, image v1.Image) error {
+	cfg, err := image.RawConfigFile()
+	if err != nil {
+		return errors.Wrap(err, "getting config of the image")
+	}
+	logrus.Infof("Writing the config of the image to %s", path)
+	if err := writeDigestFile(path, cfg); err != nil {
+		return errors.Wrap(err, "writing config of the image")
+	}
+	return nil
+}
+
 func getHasher(snapshotMode string) (func(string) (string, error), error) {
 	switch snapshotMode {
-	case constants.SnapshotModeTime:
+	case constants.SnapshotModeTime, constants.SnapshotModeChanged:
 		logrus.Info("Only file modification time will be considered when snapshotting")
 		return util.MtimeHasher(), nil
 	case constants.SnapshotModeFull:
-		return util.Hasher(), nil
+		return util.MemoizedHasher(util.Hasher()), nil
 	case constants.SnapshotModeRedo:
 		return util.RedoHasher(), nil
 	default:
-		return nil, fmt.Errorf("%s is not a valid snapshot mode", snapshotMode)
+		return nil, fmt.Errorf("%s is not a valid snapshot mode, it must be one of %s", snapshotMode, strings.Join(constants.SnapshotModes, ", "))
 	}
 }
 
+// checkSensitiveBuildArgs returns an error if the value of one of the
+// sensitive build args is set in cfg by the last command, as it would be
+// persisted in the image. before has the values of cfg before the command, so
+// that values inherited from the base image or set by earlier commands aren't
+// flagged, and only whole values are compared, so that short values like 1
+// don't match every value containing them.
+func checkSensitiveBuildArgs(before map[string]bool, cfg *v1.Config, sensitive map[string]string) error {
+	if len(sensitive) == 0 {
+		return nil
+	}
+	for v := range configValues(cfg) {
+		if before[v] {
+			continue
+		}
+		for name, secret := range sensitive {
+			if v == secret {
+				return fmt.Errorf("the value of the sensitive build arg %s would be persisted in the image config", name)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues returns the values set in cfg, with the environment variables
+// split from their names.
+func configValues(cfg *v1.Config) map[string]bool {
+	values := []string{cfg.User, cfg.WorkingDir, cfg.StopSignal}
+	for _, env := range cfg.Env {
+		if kv := strings.SplitN(env, "=", 2); len(kv) == 2 {
+			values = append(values, kv[1])
+		}
+	}
+	values = append(values, cfg.Cmd...)
+	values = append(values, cfg.Entrypoint...)
+	values = append(values, cfg.Shell...)
+	values = append(values, cfg.OnBuild...)
+	for k, v := range cfg.Labels {
+		values = append(values, k, v)
+	}
+	for v := range cfg.Volumes {
+		values = append(values, v)
+	}
+	if cfg.Healthcheck != nil {
+		values = append(values, cfg.Healthcheck.Test...)
+	}
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
 func resolveOnBuild(stage *config.KanikoStage, config *v1.Config, stageNameToIdx map[string]string) error {
 	cmds, err := dockerfile.GetOnBuildInstructions(config, stageNameToIdx)
 	if err != nil {
@@ -848,6 +1750,82 @@ func reviewConfig(stage config.KanikoStage, config *v1.Config) {
 	}
 }
 
+// resetInheritedConfig drops the ENTRYPOINT, environment variables and labels
+// of config which aren't set in stage, and so were inherited from its base
+// image, if --reset-entrypoint, --reset-env and --reset-labels are set.
+// Labels set with --label are kept.
+func resetInheritedConfig(stage config.KanikoStage, config *v1.Config, opts *config.KanikoOptions) {
+	entrypoint := false
+	envs := map[string]bool{}
+	labels := map[string]bool{}
+	for _, label := range opts.Labels {
+		labels[strings.SplitN(label, "=", 2)[0]] = true
+	}
+	for _, c := range stage.Commands {
+		switch c := c.(type) {
+		case *instructions.EntrypointCommand:
+			entrypoint = true
+		case *instructions.EnvCommand:
+			for _, kvp := range c.Env {
+				envs[kvp.Key] = true
+			}
+		case *instructions.LabelCommand:
+			for _, kvp := range c.Labels {
+				labels[kvp.Key] = true
+			}
+		}
+	}
+	if opts.ResetEntrypoint && !entrypoint {
+		config.Entrypoint = nil
+	}
+	if opts.ResetEnv {
+		env := []string{}
+		for _, e := range config.Env {
+			if envs[strings.SplitN(e, "=", 2)[0]] {
+				env = append(env, e)
+			}
+		}
+		config.Env = env
+	}
+	if opts.ResetLabels {
+		for k := range config.Labels {
+			if !labels[k] {
+				delete(config.Labels, k)
+			}
+		}
+	}
+}
+
+// applyEnvOverrides sets the environment variables passed in with --env on the config,
+// taking precedence over values set by ENV instructions. An override of the form KEY=
+// removes KEY from the environment.
+func applyEnvOverrides(config *v1.Config, overrides []string) error {
+	for _, override := range overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("env overrides must be of the form key=value, got %s", override)
+		}
+		key, value := parts[0], parts[1]
+		env := []string{}
+		replaced := false
+		for _, e := range config.Env {
+			if strings.SplitN(e, "=", 2)[0] != key {
+				env = append(env, e)
+				continue
+			}
+			if value != "" && !replaced {
+				env = append(env, override)
+				replaced = true
+			}
+		}
+		if value != "" && !replaced {
+			env = append(env, override)
+		}
+		config.Env = env
+	}
+	return nil
+}
+
 // iterates over a list of KanikoStage and resolves instructions referring to earlier stages
 // returns a mapping of stage name to stage id, f.e - ["first": "0", "second": "1", "target": "2"]
 func ResolveCrossStageInstructions(stages []config.KanikoStage) map[string]string {
@@ -864,6 +1842,36 @@ func ResolveCrossStageInstructions(stages []config.KanikoStage) map[string]strin
 	return nameToIndex
 }
 
+// validateCrossStageInstructions checks that every COPY --from resolved by
+// ResolveCrossStageInstructions refers to a previous stage. A --from which is
+// neither a stage index nor a stage name is left to be fetched as an image.
+func validateCrossStageInstructions(stages []config.KanikoStage) error {
+	names := map[string]int{}
+	for i, stage := range stages {
+		if stage.Name != "" {
+			names[stage.Name] = i
+		}
+	}
+	for i, stage := range stages {
+		for _, cmd := range stage.Commands {
+			c, ok := cmd.(*instructions.CopyCommand)
+			if !ok || c.From == "" {
+				continue
+			}
+			if from, err := strconv.Atoi(c.From); err == nil {
+				if from < 0 || from >= i {
+					return fmt.Errorf("%s in stage %d: --from=%d does not refer to a previous stage", c.String(), i, from)
+				}
+				continue
+			}
+			if from, ok := names[strings.ToLower(c.From)]; ok {
+				return fmt.Errorf("%s in stage %d: --from=%s refers to stage %d, which is not a previous stage", c.String(), i, c.From, from)
+			}
+		}
+	}
+	return nil
+}
+
 func (s stageBuilder) initSnapshotWithTimings() error {
 	t := timing.Start("Initial FS snapshot")
 	if err := s.snapshotter.Init(); err != nil {
@@ -0,0 +1,65 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// dockerImageContext prefixes the additional build contexts which are images.
+const dockerImageContext = "docker-image://"
+
+// parseBuildContexts returns the additional build contexts given with
+// --build-context as name=path or name=docker-image://image, by lowercased
+// name: the local directories as file contexts, and the references of the
+// images, which are fetched like the images COPY --from refers to.
+func parseBuildContexts(contexts map[string]string) (map[string]util.FileContext, map[string]string, error) {
+	local := map[string]util.FileContext{}
+	images := map[string]string{}
+	for name, value := range contexts {
+		name = strings.ToLower(name)
+		if name == "" {
+			return nil, nil, fmt.Errorf("build context %s has no name", value)
+		}
+		if strings.HasPrefix(value, dockerImageContext) {
+			image := strings.TrimPrefix(value, dockerImageContext)
+			if image == "" {
+				return nil, nil, fmt.Errorf("build context %s has no image", name)
+			}
+			images[name] = image
+			continue
+		}
+		if strings.Contains(value, "://") {
+			return nil, nil, fmt.Errorf("build context %s must be a local directory or a %s image, not %s", name, dockerImageContext, value)
+		}
+		fi, err := os.Stat(value)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "build context %s", name)
+		}
+		if !fi.IsDir() {
+			return nil, nil, fmt.Errorf("build context %s: %s is not a directory", name, value)
+		}
+		local[name] = util.FileContext{Root: value}
+	}
+	return local, images, nil
+}
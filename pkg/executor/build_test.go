@@ -19,26 +19,44 @@ package executor
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
 	"github.com/GoogleContainerTools/kaniko/pkg/commands"
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	image_util "github.com/GoogleContainerTools/kaniko/pkg/image"
+	"github.com/GoogleContainerTools/kaniko/pkg/image/remote"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/GoogleContainerTools/kaniko/pkg/timing"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/google/go-cmp/cmp"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 func Test_reviewConfig(t *testing.T) {
@@ -190,6 +208,56 @@ func Test_stageBuilder_shouldTakeSnapshot(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "single snapshot per stage intermediate stage not last command",
+			fields: fields{
+				opts: &config.KanikoOptions{SingleSnapshotPerStage: true},
+				cmds: cmds,
+			},
+			args: args{
+				index: 0,
+			},
+			want: false,
+		},
+		{
+			name: "single snapshot per stage intermediate stage last command",
+			fields: fields{
+				opts: &config.KanikoOptions{SingleSnapshotPerStage: true},
+				cmds: cmds,
+			},
+			args: args{
+				index: len(cmds) - 1,
+			},
+			want: true,
+		},
+		{
+			name: "single snapshot per stage final stage not last command",
+			fields: fields{
+				stage: config.KanikoStage{
+					Final: true,
+				},
+				opts: &config.KanikoOptions{SingleSnapshotPerStage: true},
+				cmds: cmds,
+			},
+			args: args{
+				index: 0,
+			},
+			want: true,
+		},
+		{
+			name: "single snapshot final stage not last command",
+			fields: fields{
+				stage: config.KanikoStage{
+					Final: true,
+				},
+				opts: &config.KanikoOptions{SingleSnapshot: true},
+				cmds: cmds,
+			},
+			args: args{
+				index: 0,
+			},
+			want: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -358,6 +426,23 @@ COPY --from=second /bar /bat
 				1: {"/bar"},
 			},
 		},
+		{
+			name: "onbuild instructions of a previous stage fire once",
+			args: args{
+				dockerfile: `
+FROM scratch as builder
+RUN foo
+FROM scratch as base
+ONBUILD COPY --from=builder /onbuild /onbuild
+FROM base as child
+FROM child
+COPY --from=builder /foo /bar
+`,
+			},
+			want: map[int][]string{
+				0: {"/onbuild", "/foo"},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -524,6 +609,54 @@ func TestInitializeConfig(t *testing.T) {
 	}
 }
 
+func Test_stageBuilder_skipsSnapshot(t *testing.T) {
+	stages, _, err := dockerfile.Parse([]byte(`FROM scratch
+# kaniko:no-snapshot
+RUN apt-get update
+RUN make
+COPY src dst
+`))
+	testutil.CheckNoError(t, err)
+	cmds := getCommands(util.FileContext{}, stages[0].Commands, true)
+	tests := []struct {
+		description string
+		opts        *config.KanikoOptions
+		expected    []bool
+	}{
+		{
+			description: "marked with a comment",
+			opts:        &config.KanikoOptions{},
+			expected:    []bool{true, false, false},
+		},
+		{
+			description: "matching --skip-snapshot-for",
+			opts:        &config.KanikoOptions{SkipSnapshotFor: []string{"make", "src"}},
+			expected:    []bool{true, true, false},
+		},
+		{
+			description: "single snapshot",
+			opts:        &config.KanikoOptions{SingleSnapshot: true, SkipSnapshotFor: []string{"make"}},
+			expected:    []bool{false, false, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			sb := &stageBuilder{opts: test.opts}
+			for _, pattern := range test.opts.SkipSnapshotFor {
+				sb.skipSnapshotFor = append(sb.skipSnapshotFor, regexp.MustCompile(pattern))
+			}
+			for i, command := range cmds {
+				skipped := sb.skipsSnapshot(command)
+				testutil.CheckDeepEqual(t, test.expected[i], skipped)
+				// Skipped commands are neither looked up in nor pushed to the cache.
+				if skipped && sb.shouldCacheOutput(command) {
+					t.Errorf("expected the output of %s not to be cached", command)
+				}
+			}
+		})
+	}
+}
+
 func Test_stageBuilder_optimize(t *testing.T) {
 	testCases := []struct {
 		opts     *config.KanikoOptions
@@ -712,9 +845,68 @@ func Test_stageBuilder_build(t *testing.T) {
 		rootDir           string
 		image             v1.Image
 		config            *v1.ConfigFile
+		stage             config.KanikoStage
 	}
 
 	testCases := []testcase{
+		func() testcase {
+			dir, files := tempDirAndFile(t)
+			filePath := filepath.Join(dir, files[0])
+			ch := NewCompositeCache("", "meow")
+			ch.AddPath(filePath, util.FileContext{})
+			hash, err := ch.Hash()
+			if err != nil {
+				t.Errorf("couldn't create hash %v", err)
+			}
+			command := MockDockerCommand{
+				command:      "meow",
+				contextFiles: []string{filePath},
+				cacheCommand: MockCachedDockerCommand{
+					contextFiles: []string{filePath},
+				},
+			}
+			return testcase{
+				description:       "cache repo per stage uses the stage name in cache tags",
+				config:            &v1.ConfigFile{Config: v1.Config{WorkingDir: dir}},
+				opts:              &config.KanikoOptions{Cache: true, CacheRepoPerStage: true},
+				stage:             config.KanikoStage{Stage: instructions.Stage{Name: "builder"}, Index: 1},
+				expectedCacheKeys: []string{"builder-" + hash},
+				pushedCacheKeys:   []string{"builder-" + hash},
+				commands:          []commands.DockerCommand{command},
+				rootDir:           dir,
+			}
+		}(),
+		func() testcase {
+			dir, files := tempDirAndFile(t)
+			filePath := filepath.Join(dir, files[0])
+			ch := NewCompositeCache("", "meow")
+			ch.AddPath(filePath, util.FileContext{})
+			hash, err := ch.Hash()
+			if err != nil {
+				t.Errorf("couldn't create hash %v", err)
+			}
+			command := MockDockerCommand{
+				command:      "meow",
+				contextFiles: []string{filePath},
+				cacheCommand: MockCachedDockerCommand{
+					contextFiles: []string{filePath},
+				},
+			}
+			return testcase{
+				description: "cache repo per stage looks up the stage index in cache tags",
+				config:      &v1.ConfigFile{Config: v1.Config{WorkingDir: dir}},
+				opts:        &config.KanikoOptions{Cache: true, CacheRepoPerStage: true},
+				stage:       config.KanikoStage{Index: 2},
+				layerCache: &fakeLayerCache{
+					img:         &fakeImage{ImageLayers: []v1.Layer{fakeLayer{}}},
+					keySequence: []string{"stage-2-" + hash},
+				},
+				expectedCacheKeys: []string{"stage-2-" + hash},
+				pushedCacheKeys:   []string{},
+				commands:          []commands.DockerCommand{command},
+				rootDir:           dir,
+			}
+		}(),
 		func() testcase {
 			dir, files := tempDirAndFile(t)
 			file := files[0]
@@ -924,6 +1116,58 @@ COPY %s foo.txt
 				fileName:          filename,
 			}
 		}(),
+		func() testcase {
+			dir, filenames := tempDirAndFile(t)
+			filename := filenames[0]
+			destDir, err := ioutil.TempDir("", "baz")
+			if err != nil {
+				t.Errorf("could not create temp dir %v", err)
+			}
+			dockerFile := fmt.Sprintf(`
+FROM ubuntu:16.04
+COPY %s foo.txt
+`, filename)
+			f, _ := ioutil.TempFile("", "")
+			ioutil.WriteFile(f.Name(), []byte(dockerFile), 0755)
+			opts := &config.KanikoOptions{
+				DockerfilePath:  f.Name(),
+				Cache:           true,
+				CacheCopyLayers: false,
+			}
+
+			testStages, metaArgs, err := dockerfile.ParseStages(opts)
+			if err != nil {
+				t.Errorf("Failed to parse test dockerfile to stages: %s", err)
+			}
+
+			kanikoStages, err := dockerfile.MakeKanikoStages(opts, testStages, metaArgs)
+			if err != nil {
+				t.Errorf("Failed to parse stages to Kaniko Stages: %s", err)
+			}
+			_ = ResolveCrossStageInstructions(kanikoStages)
+			stage := kanikoStages[0]
+
+			cmds := stage.Commands
+			return testcase{
+				description: "copy command cache disabled and key is not in cache",
+				opts:        opts,
+				config:      &v1.ConfigFile{Config: v1.Config{WorkingDir: destDir}},
+				layerCache:  &fakeLayerCache{},
+				image: fakeImage{
+					ImageLayers: []v1.Layer{
+						fakeLayer{
+							TarContent: []byte{},
+						},
+					},
+				},
+				rootDir: dir,
+				// The copy layer is neither read from nor pushed to the cache
+				expectedCacheKeys: []string{},
+				pushedCacheKeys:   []string{},
+				commands:          getCommands(util.FileContext{Root: dir}, cmds, opts.CacheCopyLayers),
+				fileName:          filename,
+			}
+		}(),
 		func() testcase {
 			dir, filenames := tempDirAndFile(t)
 			filename := filenames[0]
@@ -1228,6 +1472,7 @@ RUN foobar
 				args:        dockerfile.NewBuildArgs([]string{}), //required or code will panic
 				image:       tc.image,
 				opts:        tc.opts,
+				stage:       tc.stage,
 				cf:          cf,
 				snapshotter: snap,
 				layerCache:  lc,
@@ -1244,7 +1489,7 @@ RUN foobar
 			if tc.rootDir != "" {
 				config.RootDir = tc.rootDir
 			}
-			err := sb.build()
+			err := sb.build(context.Background())
 			if err != nil {
 				t.Errorf("Expected error to be nil but was %v", err)
 			}
@@ -1289,6 +1534,9 @@ func getCommands(fileContext util.FileContext, cmds []instructions.Command, cach
 			fileContext,
 			false,
 			cacheCopy,
+			0,
+			0,
+			"",
 		)
 		if err != nil {
 			panic(err)
@@ -1404,3 +1652,1829 @@ func Test_ResolveCrossStageInstructions(t *testing.T) {
 		testutil.CheckDeepEqual(t, expectedMap, stageToIdx)
 	}
 }
+
+func Test_applyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		description string
+		env         []string
+		overrides   []string
+		expected    []string
+		shdErr      bool
+	}{
+		{
+			description: "override replaces existing value in place",
+			env:         []string{"PATH=/bin", "FOO=dockerfile", "BAR=baz"},
+			overrides:   []string{"FOO=flag"},
+			expected:    []string{"PATH=/bin", "FOO=flag", "BAR=baz"},
+		},
+		{
+			description: "new variable is appended",
+			env:         []string{"PATH=/bin"},
+			overrides:   []string{"FOO=flag", "BAR=a=b"},
+			expected:    []string{"PATH=/bin", "FOO=flag", "BAR=a=b"},
+		},
+		{
+			description: "empty value removes the variable",
+			env:         []string{"PATH=/bin", "FOO=dockerfile"},
+			overrides:   []string{"FOO="},
+			expected:    []string{"PATH=/bin"},
+		},
+		{
+			description: "removing an unset variable is a no-op",
+			env:         []string{"PATH=/bin"},
+			overrides:   []string{"FOO="},
+			expected:    []string{"PATH=/bin"},
+		},
+		{
+			description: "last override wins",
+			env:         []string{"PATH=/bin"},
+			overrides:   []string{"FOO=1", "FOO=2"},
+			expected:    []string{"PATH=/bin", "FOO=2"},
+		},
+		{
+			description: "override without a value is invalid",
+			env:         []string{"PATH=/bin"},
+			overrides:   []string{"FOO"},
+			shdErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			cfg := &v1.Config{Env: tt.env}
+			err := applyEnvOverrides(cfg, tt.overrides)
+			testutil.CheckError(t, tt.shdErr, err)
+			if !tt.shdErr {
+				testutil.CheckDeepEqual(t, tt.expected, cfg.Env)
+			}
+		})
+	}
+}
+
+// TestDoBuild builds Dockerfiles in a root dir set up by setupMultistageTests.
+func TestDoBuild(t *testing.T) {
+	type testcase struct {
+		description string
+		// dockerfile is built with {root} replaced by the root dir.
+		dockerfile string
+		// context has the files of a build context outside of the root dir,
+		// which is cleaned between stages. The workspace of the root dir is the
+		// build context otherwise.
+		context map[string]string
+		opts    config.KanikoOptions
+		// baseImage is returned for the base images pulled by the build.
+		baseImage v1.Image
+		// setup is run with the root dir before the build.
+		setup     func(t *testing.T, testDir string, opts *config.KanikoOptions)
+		shouldErr bool
+		// expectedLayers are the regular files of each layer of the image.
+		expectedLayers []map[string]string
+		check          func(t *testing.T, testDir string, image v1.Image, err error)
+	}
+	granularityDockerfile := `FROM scratch AS base
+COPY foo/bam.txt bam.txt
+COPY foo/bam.txt bam2.txt
+FROM base
+COPY foo/bam.txt bam3.txt
+COPY foo/bam.txt bam4.txt`
+	// extractions counts the base images extracted by the build.
+	extractions := 0
+	countExtractions := func(t *testing.T, _ string, _ *config.KanikoOptions) {
+		extractions = 0
+		getFSFromImage = func(root string, img v1.Image, extract util.ExtractFunction, opts ...util.FSOpt) ([]string, error) {
+			extractions++
+			return util.GetFSFromImage(root, img, extract, opts...)
+		}
+		t.Cleanup(func() { getFSFromImage = util.GetFSFromImage })
+	}
+	// debugOnFailure returns a test case of --debug-on-failure, which counts
+	// the shells it starts.
+	debugOnFailure := func(description string, flag, terminal bool, dockerfile string, expectedShells int) testcase {
+		shells := 0
+		return testcase{
+			description: description,
+			dockerfile:  dockerfile,
+			opts:        config.KanikoOptions{DebugOnFailure: flag},
+			setup: func(t *testing.T, testDir string, _ *config.KanikoOptions) {
+				if err := testutil.SetupFiles(testDir, map[string]string{"bin/sh": ""}); err != nil {
+					t.Fatal(err)
+				}
+				debugShell = func(shell string, _ *v1.Config) error {
+					testutil.CheckDeepEqual(t, filepath.Join(testDir, "bin", "sh"), shell)
+					shells++
+					return nil
+				}
+				stdinIsTerminal = func() bool { return terminal }
+				t.Cleanup(func() {
+					debugShell = runDebugShell
+					stdinIsTerminal = func() bool { return isCharDevice(os.Stdin) }
+				})
+			},
+			shouldErr: true,
+			check: func(t *testing.T, _ string, _ v1.Image, _ error) {
+				testutil.CheckDeepEqual(t, expectedShells, shells)
+			},
+		}
+	}
+	checkVolume := func(t *testing.T, _ string, image v1.Image, _ error) {
+		testutil.CheckDeepEqual(t, map[string]struct{}{"/data/volume": {}}, imageConfig(t, image).Config.Volumes)
+		found := false
+		for _, layer := range imageLayers(t, image) {
+			rc, err := layer.Uncompressed()
+			testutil.CheckNoError(t, err)
+			tr := tar.NewReader(rc)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				testutil.CheckNoError(t, err)
+				if strings.TrimSuffix(hdr.Name, "/") == "data/volume" && hdr.Typeflag == tar.TypeDir {
+					found = true
+					testutil.CheckDeepEqual(t, int64(0755), hdr.Mode&0777)
+				}
+			}
+			rc.Close()
+		}
+		if !found {
+			t.Error("expected the volume directory to be in the image")
+		}
+	}
+	maxLayersDockerfile := `FROM scratch
+COPY foo/bam.txt a
+COPY foo/bam.txt b
+COPY exec c
+COPY foo foo
+COPY exec a
+COPY bin bin`
+	// maxLayers checks that the files of the image are the same as without a limit.
+	maxLayers := func(t *testing.T, image v1.Image, limit int) {
+		layers := imageLayers(t, image)
+		if len(layers) > limit {
+			t.Errorf("expected at most %d layers, got %d", limit, len(layers))
+		}
+		testutil.CheckDeepEqual(t, map[string]string{
+			"/":             "",
+			"a":             "woof",
+			"b":             "meow",
+			"c":             "woof",
+			"foo/":          "",
+			"foo/bam.txt":   "meow",
+			"foo/bam.link":  "",
+			"bin/":          "",
+			"bin/exec.link": "",
+		}, applyLayers(t, layers))
+	}
+	base, err := random.Image(1024, 2)
+	testutil.CheckNoError(t, err)
+	baseLayers, err := base.Layers()
+	testutil.CheckNoError(t, err)
+	// preserveBaseLayers returns a test case building on base that expects
+	// layers, starting with those of base if preserved.
+	preserveBaseLayers := func(description string, opts config.KanikoOptions, layers int) testcase {
+		return testcase{
+			description: description,
+			dockerfile:  "FROM gcr.io/foo/base\nCOPY foo/bam.txt a\nCOPY exec b\nCOPY bin bin",
+			opts:        opts,
+			baseImage:   base,
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				got := imageLayers(t, image)
+				testutil.CheckDeepEqual(t, layers, len(got))
+				sameBase := true
+				for i, l := range baseLayers {
+					want, err := l.Digest()
+					testutil.CheckNoError(t, err)
+					digest, err := got[i].Digest()
+					testutil.CheckNoError(t, err)
+					sameBase = sameBase && want == digest
+				}
+				testutil.CheckDeepEqual(t, opts.PreserveBaseLayers, sameBase)
+				if !opts.PreserveBaseLayers {
+					return
+				}
+				// The built layers are still in the layers after those of the base.
+				files := map[string]string{}
+				for _, l := range got[len(baseLayers):] {
+					for name, contents := range layerFileContents(t, l) {
+						files[name] = contents
+					}
+				}
+				testutil.CheckDeepEqual(t, map[string]string{"a": "meow", "b": "woof"}, files)
+			},
+		}
+	}
+	kanikoDir := ""
+	huge, err := random.Image(1024, 1)
+	testutil.CheckNoError(t, err)
+	checkDiskSpace := func(t *testing.T, testDir string, _ v1.Image, err error) {
+		if err == nil {
+			return
+		}
+		if !strings.Contains(err.Error(), "not enough disk space in "+testDir) {
+			t.Errorf("expected an error about the disk space, got %s", err)
+		}
+		if !strings.Contains(err.Error(), "estimated as 3 times the size of its compressed layers") {
+			t.Errorf("expected the error to say the required space is an estimate, got %s", err)
+		}
+	}
+	historyBuildArgs := func(t *testing.T, testDir string, image v1.Image, expected string) {
+		cf := imageConfig(t, image)
+		if len(cf.History) != 1 {
+			t.Fatalf("expected 1 history entry, got %v", cf.History)
+		}
+		out := filepath.Join(testDir, "workspace", "out")
+		testutil.CheckDeepEqual(t, fmt.Sprintf(expected, out), cf.History[0].CreatedBy)
+		content, err := ioutil.ReadFile(out)
+		testutil.CheckErrorAndDeepEqual(t, false, err, "2.0 s3cr3t\n", string(content))
+	}
+	// withPath is a base image setting PATH to values containing bin.
+	withPath, err := random.Image(1024, 1)
+	testutil.CheckNoError(t, err)
+	withPath, err = mutate.Config(withPath, v1.Config{Env: []string{"PATH=/usr/bin:/bin"}})
+	testutil.CheckNoError(t, err)
+	inherited, err := random.Image(1024, 1)
+	testutil.CheckNoError(t, err)
+	inherited, err = mutate.Config(inherited, v1.Config{
+		Entrypoint: []string{"/base-entrypoint"},
+		Env:        []string{"PATH=/bin", "BASE=yes", "KEPT=base"},
+		Labels:     map[string]string{"base": "yes", "kept": "base", "flag": "base"},
+	})
+	testutil.CheckNoError(t, err)
+	// resetInheritedConfig checks the config of the image built from inherited.
+	resetInheritedConfig := func(entrypoint, env []string, labels map[string]string) func(*testing.T, string, v1.Image, error) {
+		return func(t *testing.T, _ string, image v1.Image, _ error) {
+			cf := imageConfig(t, image)
+			testutil.CheckDeepEqual(t, entrypoint, cf.Config.Entrypoint)
+			testutil.CheckDeepEqual(t, env, cf.Config.Env)
+			testutil.CheckDeepEqual(t, labels, cf.Config.Labels)
+		}
+	}
+	// layerCacheFrom returns a test case building the image twice, the second
+	// time importing the cache from the first image.
+	layerCacheFrom := func(description string, opts config.KanikoOptions) testcase {
+		var cacheFrom v1.Image = empty.Image
+		dockerfile := "FROM scratch\nRUN date +%s%N > {root}/workspace/out"
+		return testcase{
+			description: description,
+			dockerfile:  dockerfile,
+			opts:        opts,
+			setup: func(t *testing.T, _ string, _ *config.KanikoOptions) {
+				original := image_util.RetrieveRemoteImage
+				image_util.RetrieveRemoteImage = func(string, config.RegistryOptions, string) (v1.Image, error) {
+					return cacheFrom, nil
+				}
+				t.Cleanup(func() { image_util.RetrieveRemoteImage = original })
+			},
+			check: func(t *testing.T, testDir string, first v1.Image, _ error) {
+				layerDigest := func(image v1.Image) v1.Hash {
+					layers := imageLayers(t, image)
+					if len(layers) != 1 {
+						t.Fatalf("expected 1 layer, got %d", len(layers))
+					}
+					digest, err := layers[0].Digest()
+					testutil.CheckNoError(t, err)
+					return digest
+				}
+				// Without a cached layer, the command runs and its cache key is recorded.
+				cf := imageConfig(t, first)
+				if !strings.HasPrefix(cf.History[0].Comment, "kaniko cache key: ") {
+					t.Errorf("expected the cache key to be recorded in the history, got %q", cf.History[0].Comment)
+				}
+				var err error
+				if opts.CacheTo != "" {
+					first, err = cache.WithCacheMetadata(first)
+					testutil.CheckNoError(t, err)
+					cf = imageConfig(t, first)
+				}
+				if opts.CacheTo != "" || opts.InlineCache {
+					if _, ok := cf.Config.Labels[constants.LayerCacheLabel]; !ok {
+						t.Errorf("expected the %s label, got %v", constants.LayerCacheLabel, cf.Config.Labels)
+					}
+					// The cache metadata doesn't depend on the history.
+					first, err = mutate.ConfigFile(first, &v1.ConfigFile{Config: cf.Config, RootFS: cf.RootFS})
+					testutil.CheckNoError(t, err)
+				}
+
+				// With the first image to import the cache from, its layer is reused.
+				testutil.CheckNoError(t, os.Remove(filepath.Join(testDir, "workspace", "out")))
+				cacheFrom = first
+				second, err := buildDockerfile(t, testDir, strings.ReplaceAll(dockerfile, "{root}", testDir), &config.KanikoOptions{
+					LayerCacheFrom: []string{"gcr.io/foo/cache-from"},
+				})
+				testutil.CheckNoError(t, err)
+				testutil.CheckDeepEqual(t, layerDigest(first), layerDigest(second))
+			},
+		}
+	}
+	// unusedBuildArgs returns a test case building with unused build args,
+	// which checks the warnings logged.
+	unusedBuildArgs := func(description string, errorOnUnused, strict bool, check func(*testing.T, v1.Image, error)) testcase {
+		var buf bytes.Buffer
+		return testcase{
+			description: description,
+			dockerfile:  "FROM scratch\nARG VERSION\nLABEL version=$VERSION",
+			opts: config.KanikoOptions{
+				BuildArgs:              []string{"VERSON=2.0", "HTTP_PROXY=http://proxy"},
+				ErrorOnUnusedBuildArgs: errorOnUnused,
+			},
+			setup: func(t *testing.T, _ string, _ *config.KanikoOptions) {
+				buf.Reset()
+				logrus.SetOutput(&buf)
+				logging.SetStrict(strict)
+				t.Cleanup(func() {
+					logrus.SetOutput(os.Stderr)
+					logging.SetStrict(false)
+				})
+			},
+			shouldErr: errorOnUnused || strict,
+			check: func(t *testing.T, _ string, image v1.Image, err error) {
+				if !errorOnUnused && !strings.Contains(buf.String(), "One or more build args [VERSON] were not consumed") {
+					t.Errorf("expected a warning about the unused build args, got %q", buf.String())
+				}
+				check(t, image, err)
+			},
+		}
+	}
+	reg, server := newFakeRegistry()
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "http://")
+	// publishStage returns a test case publishing stages, which checks the
+	// manifests pushed to the registry.
+	publishStage := func(description string, publish map[string]string, inlineCache, shouldErr bool) testcase {
+		return testcase{
+			description: description,
+			dockerfile: `FROM scratch AS builder
+RUN mkdir -p {root}/out && echo builder > {root}/out/builder
+FROM builder
+RUN echo final > {root}/out/final
+`,
+			opts: config.KanikoOptions{
+				PublishStages:   publish,
+				InlineCache:     inlineCache,
+				NoPush:          true,
+				RegistryOptions: config.RegistryOptions{Insecure: true},
+			},
+			setup: func(*testing.T, string, *config.KanikoOptions) {
+				reg.manifests = map[string]string{}
+			},
+			shouldErr: shouldErr,
+			check: func(t *testing.T, _ string, _ v1.Image, _ error) {
+				if shouldErr {
+					testutil.CheckDeepEqual(t, map[string]string{}, reg.manifests)
+					return
+				}
+				// Only the intermediate stage is pushed, the final image isn't pushed with --no-push.
+				saved, err := tarball.ImageFromPath(filepath.Join(config.KanikoDir, constants.KanikoIntermediateStagesDir, "0"), nil)
+				testutil.CheckNoError(t, err)
+				if inlineCache {
+					saved, err = cache.WithCacheMetadata(saved)
+					testutil.CheckNoError(t, err)
+				}
+				digest, err := saved.Digest()
+				testutil.CheckNoError(t, err)
+				testutil.CheckDeepEqual(t, map[string]string{"/v2/test/builder/manifests/v1": digest.String()}, reg.manifests)
+			},
+		}
+	}
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	testutil.CheckNoError(t, tw.WriteHeader(&tar.Header{Name: "data/file.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len("from image"))}))
+	_, err = tw.Write([]byte("from image"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, tw.Close())
+	l, err := tarball.LayerFromReader(bytes.NewReader(layer.Bytes()))
+	testutil.CheckNoError(t, err)
+	contextImage, err := mutate.AppendLayers(empty.Image, l)
+	testutil.CheckNoError(t, err)
+	// buildContext returns a test case copying from the build context named
+	// extra, set to the value returned by context for a directory with the file.
+	buildContext := func(description string, context func(dir string) string, retrieved []string, expected string) testcase {
+		var got []string
+		return testcase{
+			description: description,
+			dockerfile:  "FROM scratch\nCOPY --from=Extra data/file.txt copied.txt\n",
+			setup: func(t *testing.T, _ string, opts *config.KanikoOptions) {
+				got = nil
+				retrieveRemoteImage = func(image string, opts config.RegistryOptions, customPlatform string) (v1.Image, error) {
+					got = append(got, image)
+					return contextImage, nil
+				}
+				t.Cleanup(func() { retrieveRemoteImage = remote.RetrieveRemoteImage })
+				extra := contextOutsideRoot(t, map[string]string{"data/file.txt": "from directory"})
+				opts.BuildContexts = map[string]string{"extra": context(extra)}
+			},
+			shouldErr: expected == "",
+			expectedLayers: func() []map[string]string {
+				if expected == "" {
+					return nil
+				}
+				return []map[string]string{{"copied.txt": expected}}
+			}(),
+			check: func(t *testing.T, _ string, _ v1.Image, err error) {
+				if err == nil {
+					testutil.CheckDeepEqual(t, retrieved, got)
+				}
+			},
+		}
+	}
+	// The filesystem is deleted between stages, the outputs are kept in the kaniko dir.
+	makeOutDir := func(t *testing.T, testDir string, _ *config.KanikoOptions) {
+		testutil.CheckNoError(t, os.MkdirAll(filepath.Join(testDir, "kaniko", "out"), 0755))
+	}
+	scopedBuildArgsDockerfile := `ARG GLOBAL=global
+FROM scratch AS first
+ARG STAGE=one
+ARG GLOBAL
+RUN echo "[$STAGE] [$GLOBAL]" > {root}/kaniko/out/one
+FROM first
+RUN echo "[$STAGE] [$GLOBAL]" > {root}/kaniko/out/two
+ARG STAGE
+ARG GLOBAL
+RUN echo "[$STAGE] [$GLOBAL]" > {root}/kaniko/out/redeclared
+`
+	// checkOutput checks the files written to the out dir.
+	checkOutput := func(expected map[string]string) func(*testing.T, string, v1.Image, error) {
+		return func(t *testing.T, testDir string, _ v1.Image, _ error) {
+			for file, contents := range expected {
+				b, err := ioutil.ReadFile(filepath.Join(testDir, "kaniko", "out", file))
+				testutil.CheckErrorAndDeepEqual(t, false, err, contents, string(b))
+			}
+		}
+	}
+	copyFromDerivedStage := func(from string) testcase {
+		return testcase{
+			description: "copy from a stage built from a previous one, referred to as " + from,
+			dockerfile: fmt.Sprintf(`FROM scratch AS base
+COPY base.txt copied/base.txt
+FROM base AS Derived
+COPY derived.txt copied/derived.txt
+FROM derived AS unused
+COPY unused.txt copied/unused.txt
+FROM scratch
+COPY --from=%s copied output`, from),
+			context: map[string]string{
+				"base.txt":    "base",
+				"derived.txt": "derived",
+				"unused.txt":  "unused",
+			},
+			// The files of the derived stage include those of its base.
+			expectedLayers: []map[string]string{{"output/base.txt": "base", "output/derived.txt": "derived"}},
+		}
+	}
+	// buildArgPrecedence returns a test case checking the value of V, with
+	// metaArgs before FROM and instrs after it. V is set in the environment of
+	// kaniko, which only build args given without a value with --build-arg are
+	// resolved from, before the build.
+	buildArgPrecedence := func(description, metaArgs, instrs string, buildArgs []string, expected string) testcase {
+		expected = "[" + expected + "]"
+		return testcase{
+			description: description,
+			// The variable is resolved both by the shell of RUN and by the substitution in LABEL.
+			dockerfile: fmt.Sprintf("%s\nFROM scratch\n%s\nRUN echo \"[$V]\" > {root}/kaniko/out/v\nLABEL v=\"[$V]\"\n", metaArgs, instrs),
+			opts:       config.KanikoOptions{BuildArgs: buildArgs},
+			setup: func(t *testing.T, testDir string, opts *config.KanikoOptions) {
+				os.Setenv("V", "process")
+				t.Cleanup(func() { os.Unsetenv("V") })
+				makeOutDir(t, testDir, opts)
+			},
+			check: func(t *testing.T, testDir string, image v1.Image, err error) {
+				checkOutput(map[string]string{"v": expected + "\n"})(t, testDir, image, err)
+				testutil.CheckDeepEqual(t, expected, imageConfig(t, image).Config.Labels["v"])
+			},
+		}
+	}
+	// skipSnapshot returns a test case checking the commands creating the
+	// layers of the image, the last of which has the files in lastLayer.
+	skipSnapshot := func(description, dockerfile string, opts config.KanikoOptions, createdBy []string, lastLayer map[string]string) testcase {
+		return testcase{
+			description: description,
+			dockerfile:  "FROM scratch\n" + dockerfile,
+			opts:        opts,
+			check: func(t *testing.T, testDir string, image v1.Image, _ error) {
+				var got []string
+				for _, h := range imageConfig(t, image).History {
+					if !h.EmptyLayer {
+						got = append(got, h.CreatedBy)
+					}
+				}
+				var expected []string
+				for _, c := range createdBy {
+					expected = append(expected, strings.ReplaceAll(c, "{root}", testDir))
+				}
+				testutil.CheckDeepEqual(t, expected, got)
+				layers := imageLayers(t, image)
+				testutil.CheckDeepEqual(t, len(expected), len(layers))
+				// The files changed by a skipped RUN are in the next layer.
+				last := layerFileContents(t, layers[len(layers)-1])
+				for name, contents := range lastLayer {
+					testutil.CheckDeepEqual(t, contents, last[name])
+				}
+			},
+		}
+	}
+	modTime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	// copyKeepsModTimes returns a test case copying a directory whose files
+	// were modified at modTime, and expecting them to be modified at expected.
+	copyKeepsModTimes := func(reproducible bool, expected time.Time) testcase {
+		return testcase{
+			description: fmt.Sprintf("copy keeps modification times, reproducible %t", reproducible),
+			dockerfile:  "FROM scratch\nCOPY dir {root}/out/\n",
+			opts:        config.KanikoOptions{Reproducible: reproducible},
+			setup: func(t *testing.T, testDir string, _ *config.KanikoOptions) {
+				workspace := filepath.Join(testDir, "workspace")
+				testutil.CheckNoError(t, testutil.SetupFiles(workspace, map[string]string{"dir/sub/file": "file"}))
+				for _, path := range []string{"dir/sub/file", "dir/sub", "dir"} {
+					testutil.CheckNoError(t, os.Chtimes(filepath.Join(workspace, path), modTime, modTime))
+				}
+			},
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				layers := imageLayers(t, image)
+				rc, err := layers[len(layers)-1].Uncompressed()
+				testutil.CheckNoError(t, err)
+				defer rc.Close()
+				seen := map[string]bool{}
+				tr := tar.NewReader(rc)
+				for {
+					hdr, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					testutil.CheckNoError(t, err)
+					if hdr.Name != "out/sub/" && hdr.Name != "out/sub/file" {
+						continue
+					}
+					seen[hdr.Name] = true
+					if !hdr.ModTime.Equal(expected) {
+						t.Errorf("expected the modification time of %s to be %s, got %s", hdr.Name, expected, hdr.ModTime)
+					}
+				}
+				testutil.CheckDeepEqual(t, map[string]bool{"out/sub/": true, "out/sub/file": true}, seen)
+			},
+		}
+	}
+	testCases := []testcase{
+		{
+			description: "env overrides",
+			dockerfile:  "FROM scratch\nENV FOO=dockerfile REMOVED=yes KEPT=yes\nCOPY foo/bam.txt bam.txt",
+			opts:        config.KanikoOptions{Env: []string{"FOO=flag", "REMOVED=", "NEW=value"}},
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				expected := append(append([]string{}, constants.ScratchEnvVars...), "FOO=flag", "KEPT=yes", "NEW=value")
+				testutil.CheckDeepEqual(t, expected, imageConfig(t, image).Config.Env)
+			},
+		},
+		func() testcase {
+			before := 0
+			return testcase{
+				description: "command timings",
+				dockerfile:  "FROM scratch\nCOPY foo/bam.txt bam.txt\nENV FOO=bar\nLABEL foo=bar",
+				setup: func(*testing.T, string, *config.KanikoOptions) {
+					before = len(timing.DefaultRun.Entries())
+				},
+				check: func(t *testing.T, _ string, _ v1.Image, _ error) {
+					commands := map[string]bool{}
+					snapshots := 0
+					for _, e := range timing.DefaultRun.Entries()[before:] {
+						if e.Duration <= 0 {
+							t.Errorf("expected a nonzero duration for %s", e.Category)
+						}
+						if strings.HasPrefix(e.Category, "Command: ") {
+							commands[strings.TrimPrefix(e.Category, "Command: ")] = true
+						}
+						if e.Category == "Snapshotting FS" {
+							snapshots++
+						}
+					}
+					for _, cmd := range []string{"COPY foo/bam.txt bam.txt", "ENV FOO=bar", "LABEL foo=bar"} {
+						if !commands[cmd] {
+							t.Errorf("expected a timing entry for command %s, got %v", cmd, commands)
+						}
+					}
+					if snapshots == 0 {
+						t.Error("expected a timing entry for the snapshot")
+					}
+				},
+			}
+		}(),
+		{
+			description:    "snapshot per command in every stage",
+			dockerfile:     granularityDockerfile,
+			context:        map[string]string{"foo/bam.txt": "meow"},
+			expectedLayers: []map[string]string{{"bam.txt": "meow"}, {"bam2.txt": "meow"}, {"bam3.txt": "meow"}, {"bam4.txt": "meow"}},
+		},
+		{
+			description:    "single snapshot per intermediate stage",
+			dockerfile:     granularityDockerfile,
+			context:        map[string]string{"foo/bam.txt": "meow"},
+			opts:           config.KanikoOptions{SingleSnapshotPerStage: true},
+			expectedLayers: []map[string]string{{"bam.txt": "meow", "bam2.txt": "meow"}, {"bam3.txt": "meow"}, {"bam4.txt": "meow"}},
+		},
+		{
+			description:    "single snapshot in every stage",
+			dockerfile:     granularityDockerfile,
+			context:        map[string]string{"foo/bam.txt": "meow"},
+			opts:           config.KanikoOptions{SingleSnapshot: true},
+			expectedLayers: []map[string]string{{"bam.txt": "meow", "bam2.txt": "meow"}, {"bam3.txt": "meow", "bam4.txt": "meow"}},
+		},
+		{
+			description: "stage built from the previous one with full snapshots",
+			dockerfile:  "FROM scratch AS base\nCOPY base.txt base.txt\nFROM base\nCOPY derived.txt derived.txt\n",
+			context:     map[string]string{"base.txt": "base", "derived.txt": "derived"},
+			setup:       countExtractions,
+			// The filesystem of the first stage is kept for the second one.
+			expectedLayers: []map[string]string{{"base.txt": "base"}, {"derived.txt": "derived"}},
+			check: func(t *testing.T, _ string, _ v1.Image, _ error) {
+				testutil.CheckDeepEqual(t, 1, extractions)
+			},
+		},
+		{
+			description:    "stage built from the previous one with snapshots by modification time",
+			dockerfile:     "FROM scratch AS base\nCOPY base.txt base.txt\nFROM base\nCOPY derived.txt derived.txt\n",
+			context:        map[string]string{"base.txt": "base", "derived.txt": "derived"},
+			opts:           config.KanikoOptions{SnapshotMode: constants.SnapshotModeTime},
+			setup:          countExtractions,
+			expectedLayers: []map[string]string{{"base.txt": "base"}, {"derived.txt": "derived"}},
+			check: func(t *testing.T, _ string, _ v1.Image, _ error) {
+				testutil.CheckDeepEqual(t, 2, extractions)
+			},
+		},
+		{
+			description:    "copy from a stage by index",
+			dockerfile:     "FROM scratch AS builder\nCOPY foo/bam.txt bam.txt\nFROM scratch\nCOPY --from=0 bam.txt copied.txt",
+			context:        map[string]string{"foo/bam.txt": "meow"},
+			expectedLayers: []map[string]string{{"copied.txt": "meow"}},
+		},
+		{
+			description:    "copy from a stage by name",
+			dockerfile:     "FROM scratch AS builder\nCOPY foo/bam.txt bam.txt\nFROM scratch\nCOPY --from=builder bam.txt copied.txt",
+			context:        map[string]string{"foo/bam.txt": "meow"},
+			expectedLayers: []map[string]string{{"copied.txt": "meow"}},
+		},
+		{
+			description: "created timestamp kept when reproducible",
+			dockerfile:  "FROM scratch\nLABEL foo=bar",
+			opts:        config.KanikoOptions{Created: "2020-01-02T15:04:05Z", Reproducible: true},
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				expected := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+				if created := imageConfig(t, image).Created.Time; !created.Equal(expected) {
+					t.Errorf("expected created to be %s, got %s", expected, created)
+				}
+			},
+		},
+		{
+			description: "maintainer",
+			dockerfile:  "FROM scratch\nMAINTAINER Jane Doe <jane@example.com>\nLABEL foo=bar",
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				cf := imageConfig(t, image)
+				testutil.CheckDeepEqual(t, "Jane Doe <jane@example.com>", cf.Author)
+				testutil.CheckDeepEqual(t, map[string]string{"foo": "bar"}, cf.Config.Labels)
+			},
+		},
+		{
+			description: "onbuild triggers fire once",
+			dockerfile: `FROM scratch AS base
+ONBUILD ENV FIRED=${FIRED}base1
+ONBUILD ENV FIRED=${FIRED}base2
+FROM base AS child
+ONBUILD ENV FIRED=${FIRED}child
+FROM child AS grandchild
+FROM grandchild
+LABEL foo=bar`,
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				cf := imageConfig(t, image)
+				fired := ""
+				for _, env := range cf.Config.Env {
+					if strings.HasPrefix(env, "FIRED=") {
+						fired = strings.TrimPrefix(env, "FIRED=")
+					}
+				}
+				if fired != "base1base2child" {
+					t.Errorf("expected each trigger to fire once and in order, got env %v", cf.Config.Env)
+				}
+				if len(cf.Config.OnBuild) != 0 {
+					t.Errorf("expected no triggers left in the final image, got %v", cf.Config.OnBuild)
+				}
+			},
+		},
+		{
+			description: "failed command",
+			dockerfile:  "FROM scratch\nRUN exit 3",
+			shouldErr:   true,
+			check: func(t *testing.T, _ string, _ v1.Image, err error) {
+				var cmdErr CommandFailedErr
+				if !errors.As(err, &cmdErr) {
+					t.Fatalf("expected a CommandFailedErr, got %v", err)
+				}
+				testutil.CheckDeepEqual(t, "RUN exit 3", cmdErr.Command)
+				testutil.CheckDeepEqual(t, 3, cmdErr.ExitCode)
+				var pullErr BaseImagePullErr
+				if errors.As(err, &pullErr) {
+					t.Errorf("expected no BaseImagePullErr, got %v", err)
+				}
+			},
+		},
+		func() testcase {
+			var start time.Time
+			return testcase{
+				description: "build timeout",
+				dockerfile:  "FROM scratch AS first\nCOPY foo.txt foo.txt\nFROM scratch\nCOPY --from=first foo.txt foo.txt\nRUN sleep 30",
+				context:     map[string]string{"foo.txt": "foo"},
+				opts:        config.KanikoOptions{BuildTimeout: time.Second},
+				setup: func(*testing.T, string, *config.KanikoOptions) {
+					start = time.Now()
+				},
+				shouldErr: true,
+				check: func(t *testing.T, _ string, _ v1.Image, err error) {
+					if !errors.Is(err, context.DeadlineExceeded) {
+						t.Fatalf("expected the build to time out, got %v", err)
+					}
+					if !strings.Contains(err.Error(), "build timed out after 1s") {
+						t.Errorf("expected a timeout error, got %v", err)
+					}
+					if elapsed := time.Since(start); elapsed > 20*time.Second {
+						t.Errorf("expected the RUN command to be killed, but the build took %s", elapsed)
+					}
+					if _, err := os.Stat(filepath.Join(config.KanikoDir, "0")); !os.IsNotExist(err) {
+						t.Errorf("expected files saved for later stages to be removed, got %v", err)
+					}
+				},
+			}
+		}(),
+		func() testcase {
+			debugContext := ""
+			return testcase{
+				description: "debug context of a failed stage",
+				dockerfile:  "FROM scratch\nCOPY foo/bam.txt bam.txt\nRUN exit 1",
+				setup: func(t *testing.T, _ string, opts *config.KanikoOptions) {
+					debugContext = filepath.Join(contextOutsideRoot(t, nil), "debug.tar")
+					opts.DebugContext = debugContext
+				},
+				shouldErr: true,
+				check: func(t *testing.T, _ string, _ v1.Image, _ error) {
+					layer, err := tarball.LayerFromFile(debugContext)
+					if err != nil {
+						t.Fatalf("expected a debug context to be written: %s", err)
+					}
+					if contents := layerFileContents(t, layer)["bam.txt"]; contents != "meow" {
+						t.Errorf("expected the debug context to contain bam.txt, got %q", contents)
+					}
+				},
+			}
+		}(),
+		debugOnFailure("failed RUN starts a shell", true, true, "FROM scratch\nRUN exit 1", 1),
+		debugOnFailure("--debug-on-failure not set", false, true, "FROM scratch\nRUN exit 1", 0),
+		debugOnFailure("--debug-on-failure without a terminal", true, false, "FROM scratch\nRUN exit 1", 0),
+		debugOnFailure("--debug-on-failure with another command failing", true, true, "FROM scratch\nCOPY missing.txt missing.txt", 0),
+		{
+			description:    "no-op commands add no history",
+			dockerfile:     "FROM scratch\nCOPY foo/bam.txt bam.txt\nRUN true\nRUN true\nRUN true",
+			expectedLayers: []map[string]string{{"bam.txt": "meow"}},
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				history := imageConfig(t, image).History
+				testutil.CheckDeepEqual(t, 1, len(history))
+				testutil.CheckDeepEqual(t, "COPY foo/bam.txt bam.txt", history[0].CreatedBy)
+			},
+		},
+		{
+			description: "volume is the last command",
+			dockerfile:  "FROM scratch\nCOPY foo/bam.txt bam.txt\nVOLUME /data/volume",
+			check:       checkVolume,
+		},
+		{
+			description: "volume is followed by a metadata command",
+			dockerfile:  "FROM scratch\nVOLUME /data/volume\nENV A=b",
+			check:       checkVolume,
+		},
+		{
+			description: "max layers not set",
+			dockerfile:  maxLayersDockerfile,
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				maxLayers(t, image, 6)
+				testutil.CheckDeepEqual(t, 6, len(imageLayers(t, image)))
+			},
+		},
+		{
+			description: "max layers 1",
+			dockerfile:  maxLayersDockerfile,
+			opts:        config.KanikoOptions{MaxLayers: 1},
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				maxLayers(t, image, 1)
+			},
+		},
+		{
+			description: "max layers 3",
+			dockerfile:  maxLayersDockerfile,
+			opts:        config.KanikoOptions{MaxLayers: 3},
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				maxLayers(t, image, 3)
+			},
+		},
+		preserveBaseLayers("preserve base layers when reproducible", config.KanikoOptions{Reproducible: true, PreserveBaseLayers: true}, 5),
+		preserveBaseLayers("preserve base layers with more layers than the limit", config.KanikoOptions{MaxLayers: 1, PreserveBaseLayers: true}, 3),
+		preserveBaseLayers("preserve base layers when reproducible with fewer layers than the limit", config.KanikoOptions{Reproducible: true, MaxLayers: 4, PreserveBaseLayers: true}, 4),
+		preserveBaseLayers("base layers aren't preserved", config.KanikoOptions{Reproducible: true, MaxLayers: 2}, 2),
+		{
+			description: "kaniko dir outside of the root dir",
+			dockerfile:  "FROM scratch AS builder\nCOPY foo/bam.txt bam.txt\nFROM builder\nCOPY --from=builder bam.txt copied.txt",
+			context:     map[string]string{"foo/bam.txt": "meow"},
+			setup: func(t *testing.T, _ string, _ *config.KanikoOptions) {
+				kanikoDir = contextOutsideRoot(t, nil)
+				config.KanikoDir = kanikoDir
+			},
+			expectedLayers: []map[string]string{{"bam.txt": "meow"}, {"copied.txt": "meow"}},
+			check: func(t *testing.T, testDir string, _ v1.Image, _ error) {
+				// The stage the last stage is built from and the files copied from it
+				// were kept in the kaniko directory.
+				for _, p := range []string{
+					filepath.Join(kanikoDir, constants.KanikoIntermediateStagesDir, "0"),
+					filepath.Join(kanikoDir, "0", "bam.txt"),
+				} {
+					if !util.FilepathExists(p) {
+						t.Errorf("expected %s to be in the kaniko directory", p)
+					}
+				}
+				if util.FilepathExists(filepath.Join(testDir, "kaniko", constants.KanikoIntermediateStagesDir)) {
+					t.Errorf("expected no stages in the default kaniko directory")
+				}
+			},
+		},
+		{
+			description: "not enough disk space for the base image",
+			dockerfile:  "FROM gcr.io/foo/base\nRUN true",
+			baseImage:   hugeImage{huge},
+			shouldErr:   true,
+			check:       checkDiskSpace,
+		},
+		{
+			description: "disk space check skipped",
+			dockerfile:  "FROM gcr.io/foo/base\nRUN true",
+			opts:        config.KanikoOptions{SkipDiskSpaceCheck: true},
+			baseImage:   hugeImage{huge},
+			check:       checkDiskSpace,
+		},
+		{
+			description: "secret build arg used in the build",
+			dockerfile:  "FROM scratch\nARG TOKEN\nLABEL token=set\nCOPY foo/bam.txt bam-$TOKEN",
+			opts: config.KanikoOptions{
+				BuildArgs:       []string{"TOKEN=s3cr3t"},
+				SecretBuildArgs: []string{"TOKEN"},
+			},
+			check: func(t *testing.T, _ string, image v1.Image, _ error) {
+				cfg, err := image.RawConfigFile()
+				testutil.CheckNoError(t, err)
+				if strings.Contains(string(cfg), "s3cr3t") {
+					t.Errorf("expected the config and history not to contain the secret, got %s", cfg)
+				}
+			},
+		},
+		{
+			description: "secret build arg persisted in the config",
+			dockerfile:  "FROM scratch\nARG TOKEN\nENV TOKEN=$TOKEN",
+			opts: config.KanikoOptions{
+				BuildArgs:       []string{"TOKEN=s3cr3t"},
+				SecretBuildArgs: []string{"TOKEN"},
+			},
+			shouldErr: true,
+			check: func(t *testing.T, _ string, _ v1.Image, err error) {
+				if !strings.Contains(err.Error(), "sensitive build arg TOKEN") {
+					t.Errorf("expected the build to fail on the sensitive build arg, got %v", err)
+				}
+			},
+		},
+		{
+			description: "short secret build arg contained in inherited values",
+			dockerfile:  "FROM gcr.io/foo/base\nARG TOKEN\nENV BIN=/usr/local/bin\nLABEL version=1.0",
+			opts: config.KanikoOptions{
+				BuildArgs:       []string{"TOKEN=bin"},
+				SecretBuildArgs: []string{"TOKEN"},
+			},
+			baseImage: withPath,
+		},
+		{
+			description: "build args aren't recorded in the history",
+			dockerfile:  "FROM scratch\nARG VERSION\nARG TOKEN\nRUN echo $VERSION $TOKEN > {root}/workspace/out",
+			opts: config.KanikoOptions{
+				BuildArgs:       []string{"VERSION=2.0", "TOKEN=s3cr3t"},
+				SecretBuildArgs: []string{"TOKEN"},
+			},
+			check: func(t *testing.T, testDir string, image v1.Image, _ error) {
+				historyBuildArgs(t, testDir, image, "RUN echo $VERSION $TOKEN > %s")
+			},
+		},
+		{
+			description: "build args are recorded in the history except sensitive ones",
+			dockerfile:  "FROM scratch\nARG VERSION\nARG TOKEN\nRUN echo $VERSION $TOKEN > {root}/workspace/out",
+			opts: config.KanikoOptions{
+				BuildArgs:        []string{"VERSION=2.0", "TOKEN=s3cr3t"},
+				SecretBuildArgs:  []string{"TOKEN"},
+				HistoryBuildArgs: true,
+			},
+			check: func(t *testing.T, testDir string, image v1.Image, _ error) {
+				historyBuildArgs(t, testDir, image, "|1 VERSION=2.0 RUN echo $VERSION $TOKEN > %s")
+			},
+		},
+		{
+			description: "inherited config is kept",
+			dockerfile:  "FROM gcr.io/foo/base\nENV KEPT=dockerfile\nLABEL kept=dockerfile",
+			opts:        config.KanikoOptions{Labels: []string{"flag=flag"}},
+			baseImage:   inherited,
+			check: resetInheritedConfig([]string{"/base-entrypoint"}, []string{"PATH=/bin", "BASE=yes", "KEPT=dockerfile"},
+				map[string]string{"base": "yes", "kept": "dockerfile", "flag": "flag"}),
+		},
+		{
+			description: "inherited config is reset",
+			dockerfile:  "FROM gcr.io/foo/base\nENV KEPT=dockerfile\nLABEL kept=dockerfile",
+			opts: config.KanikoOptions{
+				Labels:          []string{"flag=flag"},
+				ResetEntrypoint: true,
+				ResetEnv:        true,
+				ResetLabels:     true,
+			},
+			baseImage: inherited,
+			check:     resetInheritedConfig(nil, []string{"KEPT=dockerfile"}, map[string]string{"kept": "dockerfile", "flag": "flag"}),
+		},
+		layerCacheFrom("cache keys in the history", config.KanikoOptions{LayerCacheFrom: []string{"gcr.io/foo/cache-from"}}),
+		layerCacheFrom("cache exported with --cache-to", config.KanikoOptions{CacheTo: "gcr.io/foo/cache-from"}),
+		layerCacheFrom("inline cache", config.KanikoOptions{InlineCache: true}),
+		unusedBuildArgs("unused build args are warned about", false, false, func(t *testing.T, _ v1.Image, err error) {
+			testutil.CheckNoError(t, err)
+		}),
+		unusedBuildArgs("unused build args fail the build", true, false, func(t *testing.T, _ v1.Image, err error) {
+			testutil.CheckDeepEqual(t, "build args [VERSON] were not consumed", err.Error())
+		}),
+		unusedBuildArgs("unused build args fail the build with --strict", false, true, func(t *testing.T, image v1.Image, err error) {
+			// The build still completes, so that all the warnings are reported.
+			testutil.CheckDeepEqual(t, "the build had warnings, which fail it with --strict:\nOne or more build args [VERSON] were not consumed", err.Error())
+			if image != nil {
+				t.Error("expected no image to be returned with --strict")
+			}
+		}),
+		func() testcase {
+			var executed []string
+			return testcase{
+				description: "custom instruction",
+				dockerfile:  "FROM scratch\nRECORD first\nLABEL name=value\nRECORD second",
+				setup: func(t *testing.T, _ string, _ *config.KanikoOptions) {
+					err := commands.RegisterInstruction("RECORD", func(cmd *dockerfile.CustomCommand, config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
+						executed = append(executed, strings.Join(cmd.Args, " "))
+						return []string{}, nil
+					})
+					testutil.CheckNoError(t, err)
+				},
+				check: func(t *testing.T, _ string, image v1.Image, _ error) {
+					testutil.CheckDeepEqual(t, []string{"first", "second"}, executed)
+					testutil.CheckDeepEqual(t, map[string]string{"name": "value"}, imageConfig(t, image).Config.Labels)
+				},
+			}
+		}(),
+		{
+			description: "cleanup run",
+			dockerfile:  "FROM scratch\nRUN mkdir -p {root}/workspace/cache && echo cached > {root}/workspace/cache/file && echo kept > {root}/workspace/kept",
+			setup: func(t *testing.T, testDir string, opts *config.KanikoOptions) {
+				opts.CleanupRun = fmt.Sprintf("rm -rf %[1]s/workspace/cache && echo added > %[1]s/workspace/added", testDir)
+			},
+			check: func(t *testing.T, testDir string, image v1.Image, _ error) {
+				layers := imageLayers(t, image)
+				if len(layers) != 2 {
+					t.Fatalf("expected 2 layers, got %d", len(layers))
+				}
+				// The cleanup layer only deletes the cache, without adding the files changed by the command.
+				whiteout := strings.TrimPrefix(filepath.Join(testDir, "workspace", ".wh.cache"), "/")
+				testutil.CheckDeepEqual(t, map[string]string{whiteout: ""}, layerFileContents(t, layers[1]))
+				history := imageConfig(t, image).History
+				cleanupRun := fmt.Sprintf("rm -rf %[1]s/workspace/cache && echo added > %[1]s/workspace/added", testDir)
+				testutil.CheckDeepEqual(t, "CLEANUP "+cleanupRun, history[len(history)-1].CreatedBy)
+			},
+		},
+		{
+			description: "stage digest dir",
+			dockerfile: `FROM scratch AS base
+RUN mkdir -p {root}/out && echo base > {root}/out/base
+FROM base AS builder
+RUN echo builder > {root}/out/builder
+FROM builder
+RUN echo final > {root}/out/final
+`,
+			setup: func(t *testing.T, _ string, opts *config.KanikoOptions) {
+				// The executor ignores the directory so that it is kept between stages, like the kaniko directory.
+				opts.StageDigestDir = filepath.Join(config.KanikoDir, "digests")
+			},
+			check: func(t *testing.T, _ string, _ v1.Image, _ error) {
+				digestDir := filepath.Join(config.KanikoDir, "digests")
+				files, err := ioutil.ReadDir(digestDir)
+				testutil.CheckNoError(t, err)
+				var names []string
+				for _, f := range files {
+					names = append(names, f.Name())
+				}
+				// The final stage isn't saved, its digest is written with --digest-file.
+				testutil.CheckDeepEqual(t, []string{"0", "1", "base", "builder"}, names)
+				for _, stage := range []struct{ index, name string }{{"0", "base"}, {"1", "builder"}} {
+					saved, err := tarball.ImageFromPath(filepath.Join(config.KanikoDir, constants.KanikoIntermediateStagesDir, stage.index), nil)
+					testutil.CheckNoError(t, err)
+					digest, err := saved.Digest()
+					testutil.CheckNoError(t, err)
+					for _, f := range []string{stage.index, stage.name} {
+						b, err := ioutil.ReadFile(filepath.Join(digestDir, f))
+						testutil.CheckErrorAndDeepEqual(t, false, err, digest.String(), string(b))
+					}
+				}
+			},
+		},
+		publishStage("publish stage by name", map[string]string{"Builder": registry + "/test/builder:v1"}, false, false),
+		publishStage("publish stage by index", map[string]string{"0": registry + "/test/builder:v1"}, false, false),
+		publishStage("publish stage with inline cache", map[string]string{"builder": registry + "/test/builder:v1"}, true, false),
+		publishStage("publish unknown stage", map[string]string{"missing": registry + "/test/builder:v1"}, false, true),
+		publishStage("publish final stage", map[string]string{"1": registry + "/test/builder:v1"}, false, true),
+		buildContext("build context in a local directory", func(dir string) string { return dir }, nil, "from directory"),
+		buildContext("build context in an image", func(string) string { return "docker-image://example.com/data:v1" }, []string{"example.com/data:v1"}, "from image"),
+		buildContext("build context in a missing directory", func(dir string) string { return filepath.Join(dir, "missing") }, nil, ""),
+		buildContext("build context with an unsupported scheme", func(string) string { return "https://example.com/context.tar.gz" }, nil, ""),
+		{
+			description: "build args scoped to the stage with defaults",
+			dockerfile:  scopedBuildArgsDockerfile,
+			setup:       makeOutDir,
+			check: checkOutput(map[string]string{
+				"one":        "[one] [global]\n",
+				"two":        "[] []\n",
+				"redeclared": "[] [global]\n",
+			}),
+		},
+		{
+			description: "build args scoped to the stage given with --build-arg",
+			dockerfile:  scopedBuildArgsDockerfile,
+			opts:        config.KanikoOptions{BuildArgs: []string{"STAGE=flag", "GLOBAL=flag"}},
+			setup:       makeOutDir,
+			check: checkOutput(map[string]string{
+				"one":        "[flag] [flag]\n",
+				"two":        "[] []\n",
+				"redeclared": "[flag] [flag]\n",
+			}),
+		},
+		{
+			description: "image under --max-image-size",
+			dockerfile:  "FROM scratch\nRUN echo small > {root}/small\nRUN head -c 2097152 /dev/urandom > {root}/big\nENV AFTER=big\n",
+			setup: func(t *testing.T, _ string, opts *config.KanikoOptions) {
+				testutil.CheckNoError(t, opts.MaxImageSize.Set(fmt.Sprint(10<<20)))
+			},
+		},
+		{
+			description: "image over --max-image-size",
+			// Random data doesn't compress, the layer of the RUN is about 2MiB.
+			dockerfile: "FROM scratch\nRUN echo small > {root}/small\nRUN head -c 2097152 /dev/urandom > {root}/big\nENV AFTER=big\n",
+			setup: func(t *testing.T, _ string, opts *config.KanikoOptions) {
+				testutil.CheckNoError(t, opts.MaxImageSize.Set(fmt.Sprint(1<<20)))
+			},
+			shouldErr: true,
+			check: func(t *testing.T, testDir string, _ v1.Image, err error) {
+				lines := strings.Split(err.Error(), "\n")
+				if !strings.Contains(lines[0], "over the limit of 1.0 MiB set with --max-image-size") {
+					t.Errorf("expected the limit in the error, got %s", lines[0])
+				}
+				if !strings.Contains(lines[1], fmt.Sprintf("RUN head -c 2097152 /dev/urandom > %s/big", testDir)) {
+					t.Errorf("expected the RUN creating the largest layer first in the error, got %s", err)
+				}
+			},
+		},
+		copyFromDerivedStage("derived"),
+		copyFromDerivedStage("DERIVED"),
+		copyFromDerivedStage("1"),
+		buildArgPrecedence("ARG default", "", "ARG V=default", nil, "default"),
+		buildArgPrecedence("--build-arg overrides the ARG default", "", "ARG V=default", []string{"V=flag"}, "flag"),
+		buildArgPrecedence("global ARG default", "ARG V=global", "ARG V", nil, "global"),
+		buildArgPrecedence("--build-arg overrides the global ARG default", "ARG V=global", "ARG V", []string{"V=flag"}, "flag"),
+		buildArgPrecedence("ARG without a value isn't taken from the environment", "", "ARG V", nil, ""),
+		buildArgPrecedence("--build-arg without ARG isn't in scope", "", "", []string{"V=flag"}, ""),
+		buildArgPrecedence("ENV overrides ARG", "", "ARG V=default\nENV V=env", []string{"V=flag"}, "env"),
+		buildArgPrecedence("ENV overrides ARG declared after it", "", "ENV V=env\nARG V=default", []string{"V=flag"}, "env"),
+		buildArgPrecedence("ARG default from ENV", "", "ENV E=env\nARG V=$E-default", nil, "env-default"),
+		buildArgPrecedence("ARG default from another ARG", "", "ARG A=a\nARG V=$A-default", []string{"A=flag"}, "flag-default"),
+		skipSnapshot("RUN snapshot not skipped",
+			"RUN echo skipped > {root}/skipped\nRUN echo kept > {root}/kept",
+			config.KanikoOptions{},
+			[]string{"RUN echo skipped > {root}/skipped", "RUN echo kept > {root}/kept"},
+			map[string]string{"kept": "kept\n"}),
+		skipSnapshot("RUN snapshot skipped with a comment",
+			"# kaniko:no-snapshot\nRUN echo skipped > {root}/skipped\nRUN echo kept > {root}/kept",
+			config.KanikoOptions{},
+			[]string{"RUN echo kept > {root}/kept"},
+			map[string]string{"skipped": "skipped\n", "kept": "kept\n"}),
+		skipSnapshot("RUN snapshot skipped matching --skip-snapshot-for",
+			"RUN echo skipped > {root}/skipped\nRUN echo kept > {root}/kept",
+			config.KanikoOptions{SkipSnapshotFor: []string{"^RUN echo skipped"}},
+			[]string{"RUN echo kept > {root}/kept"},
+			map[string]string{"skipped": "skipped\n", "kept": "kept\n"}),
+		skipSnapshot("RUN snapshot not matching --skip-snapshot-for",
+			"RUN echo skipped > {root}/skipped\nRUN echo kept > {root}/kept",
+			config.KanikoOptions{SkipSnapshotFor: []string{"^RUN echo other"}},
+			[]string{"RUN echo skipped > {root}/skipped", "RUN echo kept > {root}/kept"},
+			map[string]string{"kept": "kept\n"}),
+		skipSnapshot("RUN snapshot skipped for the last command",
+			"RUN echo kept > {root}/kept\n# kaniko:no-snapshot\nRUN echo skipped > {root}/skipped",
+			config.KanikoOptions{},
+			[]string{"RUN echo kept > {root}/kept", "RUN echo skipped > {root}/skipped"},
+			map[string]string{"skipped": "skipped\n"}),
+		skipSnapshot("RUN snapshot skipped followed by COPY",
+			"# kaniko:no-snapshot\nRUN echo skipped > {root}/skipped\nCOPY foo/bam.txt {root}/bam.txt",
+			config.KanikoOptions{},
+			[]string{"COPY foo/bam.txt {root}/bam.txt"},
+			map[string]string{"skipped": "skipped\n", "bam.txt": "meow"}),
+		skipSnapshot("RUN snapshot skipped followed by metadata commands",
+			"# kaniko:no-snapshot\nRUN echo skipped > {root}/skipped\nENV foo=bar\nLABEL foo=bar",
+			config.KanikoOptions{},
+			[]string{"LABEL foo=bar"},
+			map[string]string{"skipped": "skipped\n"}),
+		skipSnapshot("RUN snapshot skipped with --use-new-run",
+			"# kaniko:no-snapshot\nRUN echo skipped > {root}/skipped\nRUN echo kept > {root}/kept",
+			config.KanikoOptions{RunV2: true},
+			[]string{"RUN echo kept > {root}/kept"},
+			map[string]string{"skipped": "skipped\n", "kept": "kept\n"}),
+		copyKeepsModTimes(false, modTime),
+		copyKeepsModTimes(true, time.Unix(0, 0)),
+		func() testcase {
+			diffPath := ""
+			return testcase{
+				description: "export the filesystem diff",
+				dockerfile: `FROM scratch AS base
+RUN mkdir -p {root}/data && echo kept > {root}/data/kept && echo base > {root}/data/changed && echo base > {root}/data/deleted
+FROM base
+RUN echo changed > {root}/data/changed && echo added > {root}/data/added
+RUN rm {root}/data/deleted && echo again > {root}/data/added
+`,
+				setup: func(t *testing.T, _ string, opts *config.KanikoOptions) {
+					// The diff is written once the build is over, outside of the root dir.
+					diffPath = filepath.Join(contextOutsideRoot(t, nil), "out", "diff.tar")
+					opts.ExportFSDiff = diffPath
+				},
+				check: func(t *testing.T, testDir string, _ v1.Image, _ error) {
+					// The diff has the files changed by the final stage, merged into a single
+					// layer, and whiteouts for the ones it deleted from the base stage.
+					f, err := os.Open(diffPath)
+					testutil.CheckNoError(t, err)
+					defer f.Close()
+					layer, err := tarball.LayerFromReader(f)
+					testutil.CheckNoError(t, err)
+					testutil.CheckDeepEqual(t, map[string]string{
+						"data/changed": "changed\n",
+						"data/added":   "again\n",
+						strings.TrimPrefix(filepath.Join(testDir, "data", ".wh.deleted"), "/"): "",
+					}, layerFileContents(t, layer))
+				},
+			}
+		}(),
+	}
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			testDir, fn := setupMultistageTests(t)
+			defer fn()
+			defer os.RemoveAll(testDir)
+			opts := test.opts
+			if test.context != nil {
+				opts.SrcContext = contextOutsideRoot(t, test.context)
+			}
+			if test.baseImage != nil {
+				original := image_util.RetrieveRemoteImage
+				image_util.RetrieveRemoteImage = func(string, config.RegistryOptions, string) (v1.Image, error) {
+					return test.baseImage, nil
+				}
+				defer func() { image_util.RetrieveRemoteImage = original }()
+			}
+			if test.setup != nil {
+				test.setup(t, testDir, &opts)
+			}
+			image, err := buildDockerfile(t, testDir, strings.ReplaceAll(test.dockerfile, "{root}", testDir), &opts)
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.expectedLayers != nil && err == nil {
+				var files []map[string]string
+				for _, l := range imageLayers(t, image) {
+					files = append(files, layerFileContents(t, l))
+				}
+				testutil.CheckDeepEqual(t, test.expectedLayers, files)
+			}
+			if test.check != nil {
+				test.check(t, testDir, image, err)
+			}
+		})
+	}
+}
+
+// imageConfig returns the config file of image.
+func imageConfig(t *testing.T, image v1.Image) *v1.ConfigFile {
+	t.Helper()
+	cf, err := image.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cf
+}
+
+// imageLayers returns the layers of image.
+func imageLayers(t *testing.T, image v1.Image) []v1.Layer {
+	t.Helper()
+	layers, err := image.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layers
+}
+
+func Test_initConfig_ScratchEnv(t *testing.T) {
+	tests := []struct {
+		description string
+		scratchEnv  []string
+		expected    []string
+		shdErr      bool
+	}{
+		{
+			description: "default env",
+			expected:    constants.ScratchEnvVars,
+		},
+		{
+			description: "scratch env",
+			scratchEnv:  []string{"PATH=/bin", "LANG=C.UTF-8"},
+			expected:    []string{"PATH=/bin", "LANG=C.UTF-8"},
+		},
+		{
+			description: "invalid scratch env",
+			scratchEnv:  []string{"LANG"},
+			shdErr:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cf, err := initConfig(empty.Image, &config.KanikoOptions{ScratchEnv: test.scratchEnv})
+			testutil.CheckError(t, test.shdErr, err)
+			if test.shdErr {
+				return
+			}
+			testutil.CheckDeepEqual(t, test.expected, cf.Config.Env)
+		})
+	}
+}
+
+func Test_createdTime(t *testing.T) {
+	tests := []struct {
+		description string
+		created     string
+		expected    time.Time
+		shouldErr   bool
+	}{
+		{
+			description: "created timestamp",
+			created:     "2020-01-02T15:04:05Z",
+			expected:    time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC),
+		},
+		{
+			description: "created timestamp with offset",
+			created:     "2020-01-02T16:04:05+01:00",
+			expected:    time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC),
+		},
+		{
+			description: "invalid timestamp",
+			created:     "2020-01-02 15:04:05",
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			created, err := createdTime(&config.KanikoOptions{Created: test.created})
+			testutil.CheckError(t, test.shouldErr, err)
+			if !test.shouldErr && !created.Equal(test.expected) {
+				t.Errorf("expected created to be %s, got %s", test.expected, created)
+			}
+		})
+	}
+}
+
+func Test_fetchExtraStages_FetchesEachImageOnce(t *testing.T) {
+	kanikoDir, err := ioutil.TempDir("", "kaniko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(kanikoDir)
+	original := config.KanikoDir
+	config.KanikoDir = kanikoDir
+	defer func() { config.KanikoDir = original }()
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := 0
+	retrieveRemoteImage = func(image string, opts config.RegistryOptions, customPlatform string) (v1.Image, error) {
+		fetched++
+		return img, nil
+	}
+	defer func() { retrieveRemoteImage = remote.RetrieveRemoteImage }()
+
+	stages := []config.KanikoStage{
+		{
+			Stage: instructions.Stage{
+				Name: "first",
+				Commands: []instructions.Command{
+					&instructions.CopyCommand{From: "extra-image"},
+					&instructions.CopyCommand{From: "extra-image"},
+				},
+			},
+		},
+		{
+			Stage: instructions.Stage{
+				Commands: []instructions.Command{
+					&instructions.CopyCommand{From: "first"},
+					&instructions.CopyCommand{From: "extra-image"},
+				},
+			},
+		},
+	}
+	testutil.CheckNoError(t, fetchExtraStages(stages, nil, &config.KanikoOptions{}))
+	testutil.CheckDeepEqual(t, 1, fetched)
+	// The image is only extracted, not saved as a tarball too.
+	if util.FilepathExists(filepath.Join(kanikoDir, constants.KanikoIntermediateStagesDir, "extra-image")) {
+		t.Error("expected the image not to be saved as a tarball")
+	}
+
+	// The dependency dir holds the image filesystem.
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted, err := util.GetFSFromLayers(filepath.Join(kanikoDir, "expected"), layers, util.ExtractFunc(util.ExtractFile))
+	testutil.CheckNoError(t, err)
+	for _, f := range extracted {
+		rel, err := filepath.Rel(filepath.Join(kanikoDir, "expected"), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(filepath.Join(kanikoDir, "extra-image", rel)); err != nil {
+			t.Errorf("expected %s in the dependency dir: %s", rel, err)
+		}
+	}
+}
+
+func Test_validateCrossStageInstructions(t *testing.T) {
+	tests := []struct {
+		description string
+		dockerfile  string
+		shouldErr   bool
+	}{
+		{
+			description: "previous stage by index and by name",
+			dockerfile: `
+FROM scratch AS builder
+FROM scratch
+COPY --from=0 /a /a
+COPY --from=builder /a /b`,
+		},
+		{
+			description: "external image",
+			dockerfile: `
+FROM scratch
+COPY --from=busybox /bin/sh /sh`,
+		},
+		{
+			description: "index of the current stage",
+			dockerfile: `
+FROM scratch
+COPY --from=0 /a /a`,
+			shouldErr: true,
+		},
+		{
+			description: "index of a later stage",
+			dockerfile: `
+FROM scratch
+COPY --from=1 /a /a
+FROM scratch`,
+			shouldErr: true,
+		},
+		{
+			description: "name of a later stage",
+			dockerfile: `
+FROM scratch
+COPY --from=later /a /a
+FROM scratch AS later`,
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			stages, metaArgs, err := dockerfile.Parse([]byte(test.dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			kanikoStages, err := dockerfile.MakeKanikoStages(&config.KanikoOptions{}, stages, metaArgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ResolveCrossStageInstructions(kanikoStages)
+			testutil.CheckError(t, test.shouldErr, validateCrossStageInstructions(kanikoStages))
+		})
+	}
+}
+
+func Test_keepsFilesystem(t *testing.T) {
+	stages := []config.KanikoStage{
+		{},
+		{BaseImageStoredLocally: true, BaseImageIndex: 0},
+		{},
+		{BaseImageStoredLocally: true, BaseImageIndex: 1},
+	}
+	tests := []struct {
+		description string
+		opts        *config.KanikoOptions
+		index       int
+		unpacked    bool
+		expected    bool
+	}{
+		{
+			description: "next stage built from the stage",
+			opts:        &config.KanikoOptions{SnapshotMode: constants.SnapshotModeFull},
+			unpacked:    true,
+			expected:    true,
+		},
+		{
+			description: "filesystem not unpacked",
+			opts:        &config.KanikoOptions{SnapshotMode: constants.SnapshotModeFull},
+		},
+		{
+			description: "next stage built from another image",
+			opts:        &config.KanikoOptions{SnapshotMode: constants.SnapshotModeFull},
+			index:       1,
+			unpacked:    true,
+		},
+		{
+			description: "next stage built from an earlier stage",
+			opts:        &config.KanikoOptions{SnapshotMode: constants.SnapshotModeFull},
+			index:       2,
+			unpacked:    true,
+		},
+		{
+			description: "last stage",
+			opts:        &config.KanikoOptions{SnapshotMode: constants.SnapshotModeFull},
+			index:       3,
+			unpacked:    true,
+		},
+		{
+			description: "snapshots by modification time",
+			opts:        &config.KanikoOptions{SnapshotMode: constants.SnapshotModeTime},
+			unpacked:    true,
+		},
+		{
+			description: "rootless",
+			opts:        &config.KanikoOptions{SnapshotMode: constants.SnapshotModeFull, Rootless: true},
+			unpacked:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			testutil.CheckDeepEqual(t, test.expected, keepsFilesystem(test.opts, stages, test.index, test.unpacked))
+		})
+	}
+}
+
+// hugeImage is an image whose layers are reported to be too large to fit on disk.
+type hugeImage struct {
+	v1.Image
+}
+
+type hugeLayer struct {
+	v1.Layer
+}
+
+func (hugeLayer) Size() (int64, error) {
+	return 1 << 60, nil
+}
+
+func (i hugeImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	for j, l := range layers {
+		layers[j] = hugeLayer{l}
+	}
+	return layers, err
+}
+
+func TestSaveLayerToImage_CacheKeyComment(t *testing.T) {
+	tests := []struct {
+		description     string
+		opts            config.KanikoOptions
+		expectedComment string
+	}{
+		{
+			description: "cache only",
+			opts:        config.KanikoOptions{Cache: true},
+		},
+		{
+			description:     "layer cache from",
+			opts:            config.KanikoOptions{LayerCacheFrom: []string{"gcr.io/foo/cache-from"}},
+			expectedComment: "kaniko cache key: ck",
+		},
+		{
+			description:     "cache to",
+			opts:            config.KanikoOptions{Cache: true, CacheTo: "gcr.io/foo/cache"},
+			expectedComment: "kaniko cache key: ck",
+		},
+		{
+			description:     "inline cache",
+			opts:            config.KanikoOptions{InlineCache: true},
+			expectedComment: "kaniko cache key: ck",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			layer, err := random.Layer(512, types.DockerLayer)
+			testutil.CheckNoError(t, err)
+			s := &stageBuilder{opts: &test.opts, image: empty.Image}
+			testutil.CheckNoError(t, s.saveLayerToImage(layer, "RUN foo", "ck"))
+			cf, err := s.image.ConfigFile()
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, test.expectedComment, cf.History[0].Comment)
+
+			// The comment is kept when the history is flattened.
+			flattened, err := flattenHistory(s.image)
+			testutil.CheckNoError(t, err)
+			cf, err = flattened.ConfigFile()
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, test.expectedComment, cf.History[0].Comment)
+		})
+	}
+}
+
+// layerFileContents returns the contents of the regular files in layer, keyed by path.
+func layerFileContents(t *testing.T, layer v1.Layer) map[string]string {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	files := map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(b)
+	}
+	return files
+}
+
+func Test_flattenHistory(t *testing.T) {
+	tests := []struct {
+		description string
+		layers      int64
+		history     []v1.History
+		expected    []string
+	}{
+		{
+			description: "empty layer entries are removed",
+			layers:      2,
+			history: []v1.History{
+				{CreatedBy: "ADD rootfs.tar /"},
+				{CreatedBy: "ENV PATH=/bin", EmptyLayer: true},
+				{CreatedBy: "RUN make"},
+				{CreatedBy: "CMD [\"app\"]", EmptyLayer: true},
+			},
+			expected: []string{"ADD rootfs.tar /", "RUN make"},
+		},
+		{
+			description: "single layer image has a single entry",
+			layers:      1,
+			history: []v1.History{
+				{CreatedBy: "LABEL a=b", EmptyLayer: true},
+				{CreatedBy: "COPY . ."},
+				{CreatedBy: "USER app", EmptyLayer: true},
+			},
+			expected: []string{"COPY . ."},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			img, err := random.Image(1024, test.layers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cf, err := img.ConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cf = cf.DeepCopy()
+			cf.History = test.history
+			img, err = mutate.ConfigFile(img, cf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedLayers, err := img.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			flattened, err := flattenHistory(img)
+			testutil.CheckNoError(t, err)
+			cf, err = flattened.ConfigFile()
+			testutil.CheckNoError(t, err)
+			var createdBy []string
+			for _, h := range cf.History {
+				createdBy = append(createdBy, h.CreatedBy)
+			}
+			testutil.CheckDeepEqual(t, test.expected, createdBy)
+
+			layers, err := flattened.Layers()
+			testutil.CheckErrorAndDeepEqual(t, false, err, len(expectedLayers), len(layers))
+			for i, l := range layers {
+				d, err := l.Digest()
+				testutil.CheckNoError(t, err)
+				expected, err := expectedLayers[i].Digest()
+				testutil.CheckErrorAndDeepEqual(t, false, err, expected, d)
+			}
+		})
+	}
+}
+
+func Test_isEmptyLayer(t *testing.T) {
+	var emptyTar bytes.Buffer
+	if err := tar.NewWriter(&emptyTar).Close(); err != nil {
+		t.Fatal(err)
+	}
+	emptyLayer, err := tarball.LayerFromReader(bytes.NewReader(emptyTar.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := random.Layer(512, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		layer       v1.Layer
+		expected    bool
+	}{
+		{description: "empty layer", layer: emptyLayer, expected: true},
+		{description: "layer with a file", layer: layer},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			empty, err := isEmptyLayer(test.layer)
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expected, empty)
+		})
+	}
+}
+
+func Test_stageBuilder_populateCompositeKey_GitSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-source")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+	work := filepath.Join(dir, "work")
+	repo, err := git.PlainInit(work, false)
+	testutil.CheckNoError(t, err)
+	w, err := repo.Worktree()
+	testutil.CheckNoError(t, err)
+	// The repository is served over file://, from a bare clone of the work tree.
+	bare := filepath.Join(dir, "repo.git")
+	commit := func(file string) {
+		testutil.CheckNoError(t, testutil.SetupFiles(work, map[string]string{file: file}))
+		_, err := w.Add(file)
+		testutil.CheckNoError(t, err)
+		_, err = w.Commit("add "+file, &git.CommitOptions{
+			Author: &object.Signature{Name: "kaniko", Email: "kaniko@example.com", When: time.Now()},
+		})
+		testutil.CheckNoError(t, err)
+		testutil.CheckNoError(t, os.RemoveAll(bare))
+		_, err = git.PlainClone(bare, true, &git.CloneOptions{URL: work})
+		testutil.CheckNoError(t, err)
+	}
+	cmds := getCommands(util.FileContext{Root: dir}, []instructions.Command{
+		&instructions.AddCommand{SourcesAndDest: []string{"file://" + bare, "/src"}},
+	}, false)
+	sb := &stageBuilder{fileContext: util.FileContext{Root: dir}}
+	cacheKey := func() CompositeCache {
+		ck, err := sb.populateCompositeKey(cmds[0], nil, CompositeCache{}, dockerfile.NewBuildArgs(nil), nil)
+		testutil.CheckNoError(t, err)
+		return ck
+	}
+
+	commit("first")
+	first := cacheKey()
+	unchanged := cacheKey()
+	commit("second")
+	second := cacheKey()
+	key1, key2 := hashCompositeKeys(t, first, unchanged)
+	testutil.CheckDeepEqual(t, key1, key2)
+	key1, key2 = hashCompositeKeys(t, first, second)
+	if key1 == key2 {
+		t.Errorf("expected the cache key to change with the commit of the repository, got %s", key1)
+	}
+}
+
+func Test_stageBuilder_populateCompositeKey_SensitiveBuildArgs(t *testing.T) {
+	key := func(secret string) CompositeCache {
+		sb := &stageBuilder{
+			fileContext:   util.FileContext{Root: "workspace"},
+			sensitiveArgs: map[string]string{"TOKEN": secret},
+		}
+		cmd := newStageContext("RUN curl -H $TOKEN example.com", map[string]string{"TOKEN": secret}, nil)
+		ck, err := sb.populateCompositeKey(cmd.command, nil, CompositeCache{}, cmd.args, cmd.env)
+		testutil.CheckNoError(t, err)
+		return ck
+	}
+	ck1, ck2 := key("s3cr3t"), key("0th3r")
+	for _, k := range append(ck1.keys, ck2.keys...) {
+		if strings.Contains(k, "s3cr3t") || strings.Contains(k, "0th3r") {
+			t.Errorf("expected the composite key not to contain the secret, got %q", k)
+		}
+	}
+	key1, key2 := hashCompositeKeys(t, ck1, ck2)
+	if key1 == key2 {
+		t.Error("expected the cache key to change with the secret")
+	}
+}
+
+func Test_whiteoutsOnly(t *testing.T) {
+	kanikoDir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(kanikoDir)
+	config.KanikoDir = kanikoDir
+	defer func() { config.KanikoDir = constants.KanikoDir }()
+	// writeTarball writes the uncompressed layer of entries to a file of dir.
+	dir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+	writeTarball := func(entries ...string) string {
+		rc, err := testLayer(t, entries...).Uncompressed()
+		testutil.CheckNoError(t, err)
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		testutil.CheckNoError(t, err)
+		path := filepath.Join(dir, fmt.Sprintf("%d.tar", len(entries)))
+		testutil.CheckNoError(t, ioutil.WriteFile(path, b, 0644))
+		return path
+	}
+	notTar := filepath.Join(dir, "not-a-tarball")
+	testutil.CheckNoError(t, ioutil.WriteFile(notTar, []byte("not a tarball"), 0644))
+
+	tests := []struct {
+		description string
+		tarPath     string
+		expected    map[string]string
+		shouldErr   bool
+	}{
+		{
+			description: "whiteouts",
+			tarPath:     writeTarball("a=a", "b/.wh.c=", ".wh.d="),
+			expected:    map[string]string{"b/.wh.c": "", ".wh.d": ""},
+		},
+		{
+			description: "no whiteouts",
+			tarPath:     writeTarball("a=a"),
+		},
+		{
+			description: "invalid tarball",
+			tarPath:     notTar,
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			path, err := whiteoutsOnly(test.tarPath)
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.expected == nil {
+				testutil.CheckDeepEqual(t, "", path)
+			} else {
+				layer, err := tarball.LayerFromFile(path)
+				testutil.CheckNoError(t, err)
+				testutil.CheckDeepEqual(t, test.expected, layerFileContents(t, layer))
+			}
+			// The tarball is only kept if it has whiteouts, until the build is over.
+			util.RemoveTempFiles()
+			files, err := ioutil.ReadDir(kanikoDir)
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, 0, len(files))
+		})
+	}
+}
+
+func Test_writeConfigFile(t *testing.T) {
+	image, err := random.Image(1024, 1)
+	testutil.CheckNoError(t, err)
+	image, err = mutate.Config(image, v1.Config{Entrypoint: []string{"/app"}, User: "1000"})
+	testutil.CheckNoError(t, err)
+	out, err := ioutil.TempDir("", "config-file")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(out)
+	configFile := filepath.Join(out, "nested", "config.json")
+
+	testutil.CheckNoError(t, writeConfigFile(configFile, image))
+
+	written, err := ioutil.ReadFile(configFile)
+	testutil.CheckNoError(t, err)
+	raw, err := image.RawConfigFile()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, string(raw), string(written))
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/commands"
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// runCleanup runs the --cleanup-run command at the end of the final stage.
+// Only the files it deletes are kept, as whiteouts in a layer without any
+// file, so that removing the files added by earlier layers, such as package
+// caches, doesn't add anything to the image. initSnapshotTaken is true if the
+// snapshotter already knows the files of the filesystem.
+func (s *stageBuilder) runCleanup(initSnapshotTaken bool) error {
+	if !initSnapshotTaken {
+		if err := s.initSnapshotWithTimings(); err != nil {
+			return err
+		}
+	}
+	cmds, err := dockerfile.ParseCommands([]string{"RUN " + s.opts.CleanupRun})
+	if err != nil {
+		return errors.Wrap(err, "parsing cleanup command")
+	}
+	command, err := commands.GetCommand(cmds[0], s.fileContext, false, false, s.opts.CaptureOutputLines, s.opts.RunTimeout, s.opts.RunNetwork)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Running cleanup command %s", s.opts.CleanupRun)
+	// The config changes of the command, such as to the environment, aren't kept.
+	cfg := s.cf.Config.DeepCopy()
+	if err := command.ExecuteCommand(cfg, s.args); err != nil {
+		return newCommandFailedErr(command.String(), err)
+	}
+
+	tarPath, err := s.snapshotter.TakeSnapshotFS()
+	if err != nil {
+		return errors.Wrap(err, "failed to take snapshot")
+	}
+	whiteouts, err := whiteoutsOnly(tarPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to keep the deleted files")
+	}
+	if whiteouts == "" {
+		logrus.Info("No files were deleted by the cleanup command. No layer added to image.")
+		return nil
+	}
+	layer, err := tarball.LayerFromFile(whiteouts, tarball.WithCompressedCaching)
+	if err != nil {
+		return err
+	}
+	return s.saveLayerToImage(layer, "CLEANUP "+s.opts.CleanupRun, "")
+}
+
+// whiteoutsOnly writes the whiteouts of the layer tarball at tarPath to a new
+// tarball, and returns its path, or an empty string if there are none. The
+// tarball is kept until the build is over, as it's read when the image is pushed.
+func whiteoutsOnly(tarPath string) (string, error) {
+	if tarPath == "" {
+		return "", nil
+	}
+	in, err := os.Open(tarPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := util.TempFile(config.KanikoDir, "whiteouts")
+	if err != nil {
+		return "", err
+	}
+	whiteouts, err := writeWhiteouts(in, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || whiteouts == 0 {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// writeWhiteouts writes the whiteouts of the layer tarball in to out, and
+// returns their number.
+func writeWhiteouts(in io.Reader, out io.Writer) (int, error) {
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(out)
+	whiteouts := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !strings.HasPrefix(filepath.Base(hdr.Name), ".wh.") {
+			logrus.Debugf("Not adding %s, changed by the cleanup command, to the image", hdr.Name)
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return 0, err
+		}
+		whiteouts++
+	}
+	return whiteouts, tw.Close()
+}
@@ -20,11 +20,11 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/pkg/errors"
+	"github.com/spf13/afero"
 )
 
 // NewCompositeCache returns an initialized composite cache object.
@@ -57,7 +57,7 @@ func (s *CompositeCache) Hash() (string, error) {
 
 func (s *CompositeCache) AddPath(p string, context util.FileContext) error {
 	sha := sha256.New()
-	fi, err := os.Lstat(p)
+	fi, err := context.Lstat(p)
 	if err != nil {
 		return errors.Wrap(err, "could not add path")
 	}
@@ -79,7 +79,7 @@ func (s *CompositeCache) AddPath(p string, context util.FileContext) error {
 	if context.ExcludesFile(p) {
 		return nil
 	}
-	fh, err := util.CacheHasher()(p)
+	fh, err := util.FileContextHasher(context)(p)
 	if err != nil {
 		return err
 	}
@@ -95,7 +95,8 @@ func (s *CompositeCache) AddPath(p string, context util.FileContext) error {
 func hashDir(p string, context util.FileContext) (bool, string, error) {
 	sha := sha256.New()
 	empty := true
-	if err := filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+	hasher := util.FileContextHasher(context)
+	if err := afero.Walk(context.Filesystem(), p, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -104,7 +105,7 @@ func hashDir(p string, context util.FileContext) (bool, string, error) {
 			return nil
 		}
 
-		fileHash, err := util.CacheHasher()(path)
+		fileHash, err := hasher(path)
 		if err != nil {
 			return err
 		}
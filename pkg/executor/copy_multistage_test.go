@@ -25,6 +25,7 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
 func TestCopyCommand_Multistage(t *testing.T) {
@@ -185,3 +186,38 @@ func setupMultistageTests(t *testing.T) (string, func()) {
 		config.IgnoreListPath = constants.IgnoreListPath
 	}
 }
+
+// buildDockerfile builds dockerfile with opts in testDir, the root dir set up
+// by setupMultistageTests. The Dockerfile is written to the build context,
+// which is the workspace of testDir unless opts.SrcContext is set, and the
+// whole filesystem is snapshotted.
+func buildDockerfile(t *testing.T, testDir, dockerfile string, opts *config.KanikoOptions) (v1.Image, error) {
+	t.Helper()
+	if opts.SrcContext == "" {
+		opts.SrcContext = filepath.Join(testDir, "workspace")
+	}
+	opts.DockerfilePath = filepath.Join(opts.SrcContext, "Dockerfile")
+	if opts.SnapshotMode == "" {
+		opts.SnapshotMode = constants.SnapshotModeFull
+	}
+	if err := ioutil.WriteFile(opts.DockerfilePath, []byte(dockerfile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return DoBuild(opts)
+}
+
+// contextOutsideRoot returns a build context with files, outside of the root
+// dir, which is cleaned between stages: the files of the context under it
+// would be gone when the later stages copy them.
+func contextOutsideRoot(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := testutil.SetupFiles(dir, files); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/image/remote"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// destinationMetadata is the metadata of the build the placeholders of the
+// templates given with --destination-template are resolved from.
+type destinationMetadata struct {
+	// OS, Arch and Variant are the platform the image is built for.
+	OS      string
+	Arch    string
+	Variant string
+	// Timestamp is the time the build started, in seconds since the epoch.
+	Timestamp int64
+	// Env are the environment variables of kaniko.
+	Env map[string]string
+	// BuildArgs are the build args given with --build-arg.
+	BuildArgs map[string]string
+
+	context string
+	commit  string
+}
+
+// newDestinationMetadata returns the metadata of the build of opts, with the
+// environment variables env, started at now.
+func newDestinationMetadata(opts *config.KanikoOptions, env []string, now time.Time) (*destinationMetadata, error) {
+	platform := v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if opts.CustomPlatform != "" {
+		var err error
+		if platform, err = remote.ParsePlatform(opts.CustomPlatform); err != nil {
+			return nil, err
+		}
+	}
+	return &destinationMetadata{
+		OS:        platform.OS,
+		Arch:      platform.Architecture,
+		Variant:   platform.Variant,
+		Timestamp: now.Unix(),
+		Env:       keyValues(env),
+		BuildArgs: keyValues(opts.BuildArgs),
+		context:   opts.SrcContext,
+	}, nil
+}
+
+// GitSha returns the commit checked out in the build context, which must be a
+// git repository.
+func (m *destinationMetadata) GitSha() (string, error) {
+	if m.commit != "" {
+		return m.commit, nil
+	}
+	r, err := git.PlainOpenWithOptions(m.context, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return "", errors.Wrapf(err, "the build context %s isn't a git repository", m.context)
+	}
+	head, err := r.Head()
+	if err != nil {
+		return "", errors.Wrapf(err, "getting the commit of %s", m.context)
+	}
+	m.commit = head.Hash().String()
+	return m.commit, nil
+}
+
+// GitShortSha returns the commit checked out in the build context, shortened
+// to 7 characters like git does.
+func (m *destinationMetadata) GitShortSha() (string, error) {
+	sha, err := m.GitSha()
+	if err != nil {
+		return "", err
+	}
+	return sha[:7], nil
+}
+
+// keyValues returns the key=value pairs of kvs by key.
+func keyValues(kvs []string) map[string]string {
+	m := map[string]string{}
+	for _, kv := range kvs {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			m[parts[0]] = parts[1]
+		}
+	}
+	return m
+}
+
+// ExpandDestinationTemplates returns the destinations the templates given
+// with --destination-template expand to, with the metadata of the build.
+func ExpandDestinationTemplates(opts *config.KanikoOptions) ([]string, error) {
+	if len(opts.DestinationTemplates) == 0 {
+		return nil, nil
+	}
+	metadata, err := newDestinationMetadata(opts, os.Environ(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var destinations []string
+	for _, text := range opts.DestinationTemplates {
+		destination, err := expandDestinationTemplate(text, metadata)
+		if err != nil {
+			return nil, errors.Wrapf(err, "expanding destination template %s", text)
+		}
+		destinations = append(destinations, destination)
+	}
+	return destinations, nil
+}
+
+// expandDestinationTemplate returns the destination text expands to with
+// metadata, which must be a valid image reference with a tag.
+func expandDestinationTemplate(text string, metadata *destinationMetadata) (string, error) {
+	tmpl, err := template.New("destination").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, metadata); err != nil {
+		return "", err
+	}
+	destination := b.String()
+	if _, err := util.ParseTag(destination); err != nil {
+		return "", errors.Wrapf(err, "invalid destination %s", destination)
+	}
+	return destination, nil
+}
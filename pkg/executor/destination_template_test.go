@@ -0,0 +1,129 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func Test_expandDestinationTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.SetupFiles(dir, map[string]string{"sub/Dockerfile": "FROM scratch"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("sub/Dockerfile"); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := w.Commit("add Dockerfile", &git.CommitOptions{
+		Author: &object.Signature{Name: "kaniko", Email: "kaniko@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notRepo, err := ioutil.TempDir("", "not-a-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(notRepo)
+
+	tests := []struct {
+		description string
+		template    string
+		opts        *config.KanikoOptions
+		expected    string
+		shouldErr   bool
+	}{
+		{
+			description: "platform",
+			template:    "gcr.io/app:{{.OS}}-{{.Arch}}{{with .Variant}}-{{.}}{{end}}",
+			opts:        &config.KanikoOptions{CustomPlatform: "linux/arm/v7"},
+			expected:    "gcr.io/app:linux-arm-v7",
+		},
+		{
+			description: "commit of the context",
+			template:    "gcr.io/app:{{.GitSha}}",
+			opts:        &config.KanikoOptions{SrcContext: dir},
+			expected:    "gcr.io/app:" + hash.String(),
+		},
+		{
+			description: "short commit of a sub directory of the context",
+			template:    "gcr.io/app:{{.Arch}}-{{.GitShortSha}}",
+			opts:        &config.KanikoOptions{SrcContext: filepath.Join(dir, "sub"), CustomPlatform: "linux/amd64"},
+			expected:    "gcr.io/app:amd64-" + hash.String()[:7],
+		},
+		{
+			description: "env and build args",
+			template:    "{{.Env.REGISTRY}}/app:{{.BuildArgs.VERSION}}-{{.Timestamp}}",
+			opts:        &config.KanikoOptions{BuildArgs: []string{"VERSION=1.2"}},
+			expected:    "registry.example.com/app:1.2-1600000000",
+		},
+		{
+			description: "missing env",
+			template:    "gcr.io/app:{{.Env.MISSING}}",
+			opts:        &config.KanikoOptions{},
+			shouldErr:   true,
+		},
+		{
+			description: "commit of a context which isn't a repository",
+			template:    "gcr.io/app:{{.GitSha}}",
+			opts:        &config.KanikoOptions{SrcContext: notRepo},
+			shouldErr:   true,
+		},
+		{
+			description: "invalid destination",
+			template:    "gcr.io/app:{{.BuildArgs.VERSION}}",
+			opts:        &config.KanikoOptions{BuildArgs: []string{"VERSION=feature/x"}},
+			shouldErr:   true,
+		},
+		{
+			description: "invalid template",
+			template:    "gcr.io/app:{{.Arch",
+			opts:        &config.KanikoOptions{},
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			metadata, err := newDestinationMetadata(test.opts, []string{"REGISTRY=registry.example.com"}, time.Unix(1600000000, 0))
+			testutil.CheckNoError(t, err)
+			destination, err := expandDestinationTemplate(test.template, metadata)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, destination)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// BaseImagePullErr is returned by DoBuild when the base image of a stage,
+// or an image used by COPY --from, can't be retrieved.
+type BaseImagePullErr struct {
+	Image string
+	Err   error
+}
+
+func (e BaseImagePullErr) Error() string {
+	return fmt.Sprintf("retrieving image %s: %s", e.Image, e.Err)
+}
+
+func (e BaseImagePullErr) Unwrap() error {
+	return e.Err
+}
+
+// CommandFailedErr is returned by DoBuild when a Dockerfile command fails.
+// ExitCode is the exit code of the process started by a RUN command,
+// or -1 if the command failed without one exiting.
+type CommandFailedErr struct {
+	Command  string
+	ExitCode int
+	Err      error
+}
+
+func (e CommandFailedErr) Error() string {
+	return fmt.Sprintf("failed to execute command %s: %s", e.Command, e.Err)
+}
+
+func (e CommandFailedErr) Unwrap() error {
+	return e.Err
+}
+
+func newCommandFailedErr(command string, err error) CommandFailedErr {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	return CommandFailedErr{Command: command, ExitCode: exitCode, Err: err}
+}
+
+// PushErr is returned by DoPush when the image can't be pushed to a destination.
+// The underlying registry error, including authentication failures, can be
+// retrieved with errors.As.
+type PushErr struct {
+	Destination string
+	Err         error
+}
+
+func (e PushErr) Error() string {
+	return fmt.Sprintf("failed to push to destination %s: %s", e.Destination, e.Err)
+}
+
+func (e PushErr) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// exportFSDiff writes the changes made to the filesystem of the base image by
+// img to a tarball at path, as a single layer: the layers of img after the
+// first baseLayers ones are merged, with the files they delete from the base
+// image marked by whiteouts. With reproducible, the modification times of the
+// files are set to the Unix epoch, like in the layers of the image.
+func exportFSDiff(path string, img v1.Image, baseLayers int, reproducible bool) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Exporting the filesystem changes of %d layers to %s", len(layers)-baseLayers, path)
+	// The merged layers are streamed, rather than written to a temporary file.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeMergedLayers(layers[baseLayers:], pw))
+	}()
+	defer pr.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "creating filesystem diff")
+	}
+	defer f.Close()
+	tr := tar.NewReader(pr)
+	tw := tar.NewWriter(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "merging layers")
+		}
+		if reproducible {
+			hdr.ModTime = time.Unix(0, 0)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "writing filesystem diff")
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrap(err, "writing filesystem diff")
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "writing filesystem diff")
+	}
+	return f.Close()
+}
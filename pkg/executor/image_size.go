@@ -0,0 +1,101 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// largestLayersReported is the number of layers listed when the image is over
+// --max-image-size.
+const largestLayersReported = 3
+
+// layerSize is the compressed size of a layer of an image, and the history
+// entry of the instruction that created it.
+type layerSize struct {
+	index     int
+	size      int64
+	createdBy string
+}
+
+// checkImageSize returns an error listing the largest layers of image if their
+// compressed sizes add up to more than maxSize bytes.
+func checkImageSize(image v1.Image, maxSize int64) error {
+	layers, err := image.Layers()
+	if err != nil {
+		return err
+	}
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return err
+	}
+	createdBy := layerCreatedBy(cf.History, len(layers))
+
+	var total int64
+	sizes := make([]layerSize, len(layers))
+	for i, l := range layers {
+		size, err := l.Size()
+		if err != nil {
+			return err
+		}
+		total += size
+		sizes[i] = layerSize{index: i, size: size, createdBy: createdBy[i]}
+	}
+	if total <= maxSize {
+		return nil
+	}
+
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].size > sizes[j].size
+	})
+	if len(sizes) > largestLayersReported {
+		sizes = sizes[:largestLayersReported]
+	}
+	var largest []string
+	for _, s := range sizes {
+		largest = append(largest, fmt.Sprintf("  layer %d, %s: %s", s.index, util.ByteSize(uint64(s.size)), s.createdBy))
+	}
+	return fmt.Errorf("the image is %s compressed, over the limit of %s set with --max-image-size. Its largest layers are:\n%s",
+		util.ByteSize(uint64(total)), util.ByteSize(uint64(maxSize)), strings.Join(largest, "\n"))
+}
+
+// layerCreatedBy returns the instructions that created each of the n layers
+// of an image with history. They're unknown if the history doesn't match the
+// layers, as base images may have been built without it.
+func layerCreatedBy(history []v1.History, n int) []string {
+	createdBy := make([]string, 0, n)
+	for _, h := range history {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+	if len(createdBy) != n {
+		createdBy = make([]string, n)
+	}
+	for i := range createdBy {
+		if createdBy[i] == "" {
+			createdBy[i] = "unknown instruction"
+		}
+	}
+	return createdBy
+}
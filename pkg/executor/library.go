@@ -0,0 +1,77 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// BuildRequest describes a build for Build, without referring to paths on disk.
+type BuildRequest struct {
+	// Dockerfile is read to get the Dockerfile to build.
+	Dockerfile io.Reader
+	// Context holds the build context, which is read directly rather than
+	// being written to disk. It may be nil if no files are needed.
+	Context afero.Fs
+	// BuildArgs are passed to the build, in the form key=value.
+	BuildArgs []string
+	// Options configure the build. DockerfilePath and BuildArgs are set from
+	// the request, and SrcContext is ignored.
+	Options config.KanikoOptions
+}
+
+// Build builds the image described by req and returns it.
+// The Dockerfile is written to a temporary file in the kaniko directory,
+// which is removed once the build is done.
+// The build is interrupted, killing any running RUN command, when ctx is done.
+func Build(ctx context.Context, req BuildRequest) (v1.Image, error) {
+	if req.Dockerfile == nil {
+		return nil, errors.New("a Dockerfile must be provided")
+	}
+	f, err := ioutil.TempFile(config.KanikoDir, "Dockerfile")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating Dockerfile")
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, req.Dockerfile)
+	f.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "writing Dockerfile")
+	}
+
+	contextFS := req.Context
+	if contextFS == nil {
+		contextFS = afero.NewMemMapFs()
+	}
+
+	opts := req.Options
+	opts.DockerfilePath = f.Name()
+	opts.BuildArgs = append(opts.BuildArgs[:0:0], req.BuildArgs...)
+	// Forget the warnings of the previous builds, so that they don't fail
+	// this one with --strict.
+	logging.SetStrict(opts.Strict)
+	return doBuild(ctx, &opts, contextFS)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/spf13/afero"
+)
+
+func TestBuild(t *testing.T) {
+	_, fn := setupMultistageTests(t)
+	defer fn()
+
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/src/foo.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	image, err := Build(context.Background(), BuildRequest{
+		Dockerfile: strings.NewReader("FROM scratch\nARG NAME\nCOPY src/foo.txt ${NAME}.txt"),
+		Context:    fs,
+		BuildArgs:  []string{"NAME=bar"},
+		Options:    config.KanikoOptions{SnapshotMode: constants.SnapshotModeFull},
+	})
+	testutil.CheckNoError(t, err)
+	layers, err := image.Layers()
+	testutil.CheckErrorAndDeepEqual(t, false, err, 1, len(layers))
+	testutil.CheckDeepEqual(t, map[string]string{"bar.txt": "hello"}, layerFileContents(t, layers[0]))
+}
+
+func TestBuild_ContextDirectory(t *testing.T) {
+	_, fn := setupMultistageTests(t)
+	defer fn()
+
+	fs := afero.NewMemMapFs()
+	for path, contents := range map[string]string{
+		"/src/a.txt":     "a",
+		"/src/b.txt":     "b",
+		"/.dockerignore": "src/b.txt",
+	} {
+		if err := afero.WriteFile(fs, path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image, err := Build(context.Background(), BuildRequest{
+		Dockerfile: strings.NewReader("FROM scratch\nCOPY src dir/"),
+		Context:    fs,
+		Options:    config.KanikoOptions{SnapshotMode: constants.SnapshotModeFull},
+	})
+	testutil.CheckNoError(t, err)
+	layers, err := image.Layers()
+	testutil.CheckErrorAndDeepEqual(t, false, err, 1, len(layers))
+	testutil.CheckDeepEqual(t, map[string]string{"dir/a.txt": "a"}, layerFileContents(t, layers[0]))
+}
+
+func TestBuild_StrictForgetsPreviousWarnings(t *testing.T) {
+	_, fn := setupMultistageTests(t)
+	defer fn()
+	defer logging.SetStrict(false)
+
+	logging.SetStrict(true)
+	logging.Warnf("a warning of a previous build")
+	_, err := Build(context.Background(), BuildRequest{
+		Dockerfile: strings.NewReader("FROM scratch"),
+		Options:    config.KanikoOptions{SnapshotMode: constants.SnapshotModeFull, Strict: true},
+	})
+	testutil.CheckNoError(t, err)
+}
+
+func TestBuildErrors(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		description string
+		ctx         context.Context
+		req         BuildRequest
+	}{
+		{
+			description: "no Dockerfile",
+			ctx:         context.Background(),
+			req:         BuildRequest{},
+		},
+		{
+			description: "cancelled context",
+			ctx:         cancelled,
+			req:         BuildRequest{Dockerfile: strings.NewReader("FROM scratch")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := Build(test.ctx, test.req)
+			testutil.CheckError(t, true, err)
+		})
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// limitLayers returns img with at most maxLayers layers. The first
+// maxLayers-1 layers, which include those of the base image, are kept as they
+// are and the remaining layers are merged into the last one. Their history
+// entries are merged too, so that the history still lines up with the layers.
+// The first baseLayers layers are never merged, even if the image is left with
+// more than maxLayers layers.
+func limitLayers(img v1.Image, maxLayers, baseLayers int) (v1.Image, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	if maxLayers <= 0 || len(layers) <= maxLayers {
+		return img, nil
+	}
+	numKeep := maxLayers - 1
+	if numKeep < baseLayers {
+		logging.Warnf("The %d layers of the base image are kept as they are, so the image has more than %d layers", baseLayers, maxLayers)
+		numKeep = baseLayers
+	}
+	if len(layers)-numKeep < 2 {
+		return img, nil
+	}
+	keep := layers[:numKeep]
+	logrus.Infof("Merging the last %d of %d layers to keep at most %d layers", len(layers)-len(keep), len(layers), maxLayers)
+	merged, err := mergeLayers(layers[len(keep):])
+	if err != nil {
+		return nil, errors.Wrap(err, "merging layers")
+	}
+	mergedDiffID, err := merged.DiffID()
+	if err != nil {
+		return nil, err
+	}
+
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	cf.RootFS.DiffIDs = append(cf.RootFS.DiffIDs[:len(keep)], mergedDiffID)
+	cf.History = mergeHistory(cf.History, len(keep))
+
+	limited, err := mutate.AppendLayers(empty.Image, append(keep[:len(keep):len(keep)], merged)...)
+	if err != nil {
+		return nil, err
+	}
+	return mutate.ConfigFile(limited, cf)
+}
+
+// mergeHistory returns history with the entries of the layers after the
+// first keep layers merged into a single entry, at the place of the last one.
+// Entries that didn't create a layer are kept.
+func mergeHistory(history []v1.History, keep int) []v1.History {
+	var createdBy []string
+	last := -1
+	layer := 0
+	for i, h := range history {
+		if h.EmptyLayer {
+			continue
+		}
+		if layer >= keep {
+			createdBy = append(createdBy, h.CreatedBy)
+			last = i
+		}
+		layer++
+	}
+	if last < 0 {
+		return history
+	}
+	merged := make([]v1.History, 0, len(history))
+	layer = 0
+	for i, h := range history {
+		if !h.EmptyLayer {
+			layer++
+			if layer > keep && i != last {
+				continue
+			}
+		}
+		if i == last {
+			h.CreatedBy = strings.Join(createdBy, " && ")
+			h.Comment = fmt.Sprintf("merged %d layers", len(createdBy))
+		}
+		merged = append(merged, h)
+	}
+	return merged
+}
+
+// mergeLayers merges layers into a single layer with the same effect when
+// applied on top of the layers below them. Each path is taken from the last
+// layer it is in and paths deleted by a later layer are left out. The
+// whiteouts are kept, as they still hide the files of the layers below, and
+// are written before the files as some tools apply entries in order. The
+// merged layer is kept in a file of the kaniko directory until the build is
+// over, as it's read when the image is pushed.
+func mergeLayers(layers []v1.Layer) (v1.Layer, error) {
+	f, err := util.TempFile(config.KanikoDir, "merged-layer")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeMergedLayers(layers, f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return tarball.LayerFromFile(f.Name(), tarball.WithCompressedCaching)
+}
+
+// writeMergedLayers writes the tarball of layers merged into a single layer to out.
+func writeMergedLayers(layers []v1.Layer, out io.Writer) error {
+	final := map[string]layerEntry{}
+	whiteouts := map[string]*tar.Header{}
+
+	// Find the entry of each path that ends up in the merged layer.
+	err := forEachEntry(layers, func(e layerEntry, hdr *tar.Header, _ io.Reader) error {
+		p := cleanTarPath(hdr.Name)
+		dir, base := path.Split(p)
+		dir = path.Clean(dir)
+		switch {
+		case base == opaqueWhiteout:
+			for q := range final {
+				if isBelow(q, dir) {
+					delete(final, q)
+				}
+			}
+			whiteouts[p] = hdr
+		case strings.HasPrefix(base, whiteoutPrefix):
+			deleted := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			delete(final, deleted)
+			for q := range final {
+				if isBelow(q, deleted) {
+					delete(final, q)
+				}
+			}
+			// The whiteout of deleted hides everything below it.
+			for q := range whiteouts {
+				if isBelow(q, deleted) {
+					delete(whiteouts, q)
+				}
+			}
+			whiteouts[p] = hdr
+		default:
+			final[p] = e
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w := tar.NewWriter(out)
+
+	paths := make([]string, 0, len(whiteouts))
+	for p := range whiteouts {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := w.WriteHeader(whiteouts[p]); err != nil {
+			return err
+		}
+	}
+
+	err = forEachEntry(layers, func(e layerEntry, hdr *tar.Header, r io.Reader) error {
+		if last, ok := final[cleanTarPath(hdr.Name)]; !ok || last != e {
+			return nil
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// layerEntry identifies an entry of one of the layers being merged.
+type layerEntry struct {
+	layer, entry int
+}
+
+// forEachEntry calls fn with each entry of the uncompressed layers, in order.
+func forEachEntry(layers []v1.Layer, fn func(e layerEntry, hdr *tar.Header, r io.Reader) error) error {
+	for i, l := range layers {
+		rc, err := l.Uncompressed()
+		if err != nil {
+			return err
+		}
+		tr := tar.NewReader(rc)
+		for j := 0; ; j++ {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				err = fn(layerEntry{layer: i, entry: j}, hdr, tr)
+			}
+			if err != nil {
+				rc.Close()
+				return errors.Wrapf(err, "reading layer %d", i)
+			}
+		}
+		rc.Close()
+	}
+	return nil
+}
+
+// cleanTarPath returns the name of a tar entry without leading or trailing slashes.
+func cleanTarPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// isBelow returns whether p is below the directory dir.
+func isBelow(p, dir string) bool {
+	if dir == "." {
+		return p != "."
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// testLayer returns a layer with entries, in the form name=contents for
+// files, or name/ for directories.
+func testLayer(t *testing.T, entries ...string) v1.Layer {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e, Typeflag: tar.TypeDir, Mode: 0755}
+		var contents string
+		if i := strings.Index(e, "="); i >= 0 {
+			contents = e[i+1:]
+			hdr = &tar.Header{Name: e[:i], Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}
+		}
+		testutil.CheckNoError(t, w.WriteHeader(hdr))
+		_, err := w.Write([]byte(contents))
+		testutil.CheckNoError(t, err)
+	}
+	testutil.CheckNoError(t, w.Close())
+	l, err := tarball.LayerFromReader(&buf)
+	testutil.CheckNoError(t, err)
+	return l
+}
+
+// applyLayers returns the files and directories resulting from applying
+// layers in order, handling whiteouts the way container runtimes do.
+func applyLayers(t *testing.T, layers []v1.Layer) map[string]string {
+	fs := map[string]string{}
+	for _, l := range layers {
+		// Whiteouts only hide the files of the layers below.
+		added := map[string]string{}
+		err := forEachEntry([]v1.Layer{l}, func(_ layerEntry, hdr *tar.Header, r io.Reader) error {
+			p := cleanTarPath(hdr.Name)
+			dir, base := path.Split(p)
+			dir = path.Clean(dir)
+			switch {
+			case base == opaqueWhiteout:
+				for q := range fs {
+					if isBelow(q, dir) {
+						delete(fs, q)
+					}
+				}
+			case strings.HasPrefix(base, whiteoutPrefix):
+				deleted := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+				for q := range fs {
+					if q == deleted || isBelow(q, deleted) {
+						delete(fs, q)
+					}
+				}
+			case hdr.Typeflag == tar.TypeDir:
+				added[p+"/"] = ""
+			default:
+				b, err := ioutil.ReadAll(r)
+				added[p] = string(b)
+				return err
+			}
+			return nil
+		})
+		testutil.CheckNoError(t, err)
+		for p, contents := range added {
+			fs[p] = contents
+		}
+	}
+	return fs
+}
+
+func Test_mergeLayers(t *testing.T) {
+	kanikoDir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(kanikoDir)
+	config.KanikoDir = kanikoDir
+	defer func() { config.KanikoDir = constants.KanikoDir }()
+
+	base := testLayer(t, "a/", "a/old=old", "b=b", "c/", "c/d=d", "e/", "e/f=f")
+	tests := []struct {
+		description string
+		layers      [][]string
+	}{
+		{
+			description: "file overwritten",
+			layers:      [][]string{{"b=1"}, {"b=2"}, {"g=g"}},
+		},
+		{
+			description: "file of the base deleted",
+			layers:      [][]string{{"g=g"}, {".wh.b"}},
+		},
+		{
+			description: "file added and deleted",
+			layers:      [][]string{{"g=g"}, {".wh.g", "h=h"}},
+		},
+		{
+			description: "file deleted and added again",
+			layers:      [][]string{{".wh.b"}, {"b=new"}},
+		},
+		{
+			description: "directory deleted and added again",
+			layers:      [][]string{{"a/new=new"}, {".wh.a"}, {"a/", "a/newer=newer"}},
+		},
+		{
+			description: "directory made opaque",
+			layers:      [][]string{{"c/", "c/.wh..wh..opq", "c/new=new"}, {"c/newer=newer"}},
+		},
+		{
+			description: "directory deleted after files were deleted in it",
+			layers:      [][]string{{"e/.wh.f"}, {"e/g=g"}, {".wh.e"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			layers := []v1.Layer{base}
+			for _, entries := range test.layers {
+				layers = append(layers, testLayer(t, entries...))
+			}
+			merged, err := mergeLayers(layers[1:])
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, applyLayers(t, layers), applyLayers(t, []v1.Layer{base, merged}))
+		})
+	}
+}
+
+func Test_limitLayers(t *testing.T) {
+	kanikoDir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(kanikoDir)
+	config.KanikoDir = kanikoDir
+	defer func() { config.KanikoDir = constants.KanikoDir }()
+
+	img := empty.Image
+	var layers []v1.Layer
+	for i := 0; i < 5; i++ {
+		l := testLayer(t, fmt.Sprintf("file%d=%d", i, i), ".wh.file0")
+		if i == 0 {
+			l = testLayer(t, "file0=0")
+		}
+		layers = append(layers, l)
+		img, err = mutate.Append(img, mutate.Addendum{
+			Layer:   l,
+			History: v1.History{CreatedBy: fmt.Sprintf("layer %d", i)},
+		})
+		testutil.CheckNoError(t, err)
+	}
+	cf, err := img.ConfigFile()
+	testutil.CheckNoError(t, err)
+	cf = cf.DeepCopy()
+	cf.History = append(cf.History, v1.History{CreatedBy: "ENV A=b", EmptyLayer: true})
+	img, err = mutate.ConfigFile(img, cf)
+	testutil.CheckNoError(t, err)
+
+	for _, maxLayers := range []int{1, 3, 5, 10} {
+		t.Run(fmt.Sprintf("%d layers", maxLayers), func(t *testing.T) {
+			limited, err := limitLayers(img, maxLayers, 0)
+			testutil.CheckNoError(t, err)
+			got, err := limited.Layers()
+			testutil.CheckNoError(t, err)
+			want := maxLayers
+			if want > len(layers) {
+				want = len(layers)
+			}
+			testutil.CheckDeepEqual(t, want, len(got))
+			testutil.CheckDeepEqual(t, applyLayers(t, layers), applyLayers(t, got))
+			for i := 0; i < want-1; i++ {
+				wantDigest, err := layers[i].Digest()
+				testutil.CheckNoError(t, err)
+				gotDigest, err := got[i].Digest()
+				testutil.CheckNoError(t, err)
+				testutil.CheckDeepEqual(t, wantDigest, gotDigest)
+			}
+
+			cf, err := limited.ConfigFile()
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, want, len(cf.RootFS.DiffIDs))
+			var createdBy []string
+			for _, h := range cf.History {
+				createdBy = append(createdBy, h.CreatedBy)
+			}
+			var wantCreatedBy []string
+			for i := 0; i < want-1; i++ {
+				wantCreatedBy = append(wantCreatedBy, fmt.Sprintf("layer %d", i))
+			}
+			var mergedCreatedBy []string
+			for i := want - 1; i < len(layers); i++ {
+				mergedCreatedBy = append(mergedCreatedBy, fmt.Sprintf("layer %d", i))
+			}
+			wantCreatedBy = append(wantCreatedBy, strings.Join(mergedCreatedBy, " && "), "ENV A=b")
+			testutil.CheckDeepEqual(t, wantCreatedBy, createdBy)
+		})
+	}
+
+	// The merged layers are removed once the image is no longer needed.
+	util.RemoveTempFiles()
+	files, err := ioutil.ReadDir(kanikoDir)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 0, len(files))
+}
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -32,17 +33,23 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/creds"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/GoogleContainerTools/kaniko/pkg/metrics"
+	"github.com/GoogleContainerTools/kaniko/pkg/signing"
 	"github.com/GoogleContainerTools/kaniko/pkg/timing"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/GoogleContainerTools/kaniko/pkg/version"
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
@@ -97,6 +104,8 @@ var (
 	fs                        = afero.NewOsFs()
 	execCommand               = exec.Command
 	checkRemotePushPermission = remote.CheckPushPermission
+	getKeychain               = creds.GetKeychain
+	newSigner                 = signing.NewKeySigner
 )
 
 // CheckPushPermissions checks that the configured credentials can be used to
@@ -113,7 +122,7 @@ func CheckPushPermissions(opts *config.KanikoOptions) error {
 	_, err := fs.Stat(DockerConfLocation())
 	dockerConfNotExists := os.IsNotExist(err)
 	for _, destination := range targets {
-		destRef, err := name.NewTag(destination, name.WeakValidation)
+		destRef, err := util.ParseTag(destination)
 		if err != nil {
 			return errors.Wrap(err, "getting tag for destination")
 		}
@@ -137,7 +146,7 @@ func CheckPushPermissions(opts *config.KanikoOptions) error {
 					return errors.Wrap(err, fmt.Sprintf("error while configuring docker-credential-gcr helper: %s : %s", cmd.String(), out.String()))
 				}
 			} else {
-				logrus.Warnf("\nSkip running docker-credential-gcr as user provided docker configuration exists at %s", DockerConfLocation())
+				logging.Warnf("\nSkip running docker-credential-gcr as user provided docker configuration exists at %s", DockerConfLocation())
 			}
 		}
 		if opts.Insecure || opts.InsecureRegistries.Contains(registryName) {
@@ -180,7 +189,7 @@ func writeDigestFile(path string, digestByteArray []byte) error {
 func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 	t := timing.Start("Total Push Time")
 	var digestByteArray []byte
-	var builder strings.Builder
+	var nameDigests, nameTagDigests strings.Builder
 	if opts.DigestFile != "" || opts.ImageNameDigestFile != "" || opts.ImageNameTagDigestFile != "" {
 		var err error
 		digestByteArray, err = getDigest(image)
@@ -206,33 +215,26 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 		}
 	}
 
+	destinations, err := withExtraTags(opts.Destinations, opts.AlsoTags)
+	if err != nil {
+		return err
+	}
 	destRefs := []name.Tag{}
-	for _, destination := range opts.Destinations {
-		destRef, err := name.NewTag(destination, name.WeakValidation)
-		if err != nil {
-			return errors.Wrap(err, "getting tag for destination")
-		}
-		if opts.ImageNameDigestFile != "" || opts.ImageNameTagDigestFile != "" {
-			tag := ""
-			if opts.ImageNameTagDigestFile != "" && destRef.TagStr() != "" {
-				tag = ":" + destRef.TagStr()
-			}
-			imageName := []byte(destRef.Repository.Name() + tag + "@")
-			builder.Write(append(imageName, digestByteArray...))
-			builder.WriteString("\n")
-		}
+	for _, destRef := range destinations {
+		fmt.Fprintf(&nameDigests, "%s@%s\n", destRef.Repository.Name(), digestByteArray)
+		fmt.Fprintf(&nameTagDigests, "%s:%s@%s\n", destRef.Repository.Name(), destRef.TagStr(), digestByteArray)
 		destRefs = append(destRefs, destRef)
 	}
 
 	if opts.ImageNameDigestFile != "" {
-		err := writeDigestFile(opts.ImageNameDigestFile, []byte(builder.String()))
+		err := writeDigestFile(opts.ImageNameDigestFile, []byte(nameDigests.String()))
 		if err != nil {
 			return errors.Wrap(err, "writing image name with digest to file failed")
 		}
 	}
 
 	if opts.ImageNameTagDigestFile != "" {
-		err := writeDigestFile(opts.ImageNameTagDigestFile, []byte(builder.String()))
+		err := writeDigestFile(opts.ImageNameTagDigestFile, []byte(nameTagDigests.String()))
 		if err != nil {
 			return errors.Wrap(err, "writing image name with image tag and digest to file failed")
 		}
@@ -245,8 +247,15 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 			return errors.New("must provide at least one destination when tarPath is specified")
 		}
 
+		tarImage := image
+		if opts.TarCompression == constants.TarCompressionNone {
+			var err error
+			if tarImage, err = uncompressedImage(image); err != nil {
+				return errors.Wrap(err, "uncompressing layers")
+			}
+		}
 		for _, destRef := range destRefs {
-			tagToImage[destRef] = image
+			tagToImage[destRef] = tarImage
 		}
 		err := tarball.MultiWriteToFile(opts.TarPath, tagToImage)
 		if err != nil {
@@ -259,6 +268,16 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 		return nil
 	}
 
+	var signer signing.Signer
+	if opts.SignKey != "" {
+		var err error
+		if signer, err = newSigner(opts.SignKey); err != nil {
+			return err
+		}
+	}
+	signed := map[string]bool{}
+	pushed := map[string]*pushedBlobs{}
+
 	// continue pushing unless an error occurs
 	for _, destRef := range destRefs {
 		registryName := destRef.Repository.Registry.Name()
@@ -270,7 +289,7 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 			destRef.Repository.Registry = newReg
 		}
 
-		pushAuth, err := creds.GetKeychain().Resolve(destRef.Context().Registry)
+		pushAuth, err := getKeychain().Resolve(destRef.Context().Registry)
 		if err != nil {
 			return errors.Wrap(err, "resolving pushAuth")
 		}
@@ -278,14 +297,53 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 		tr := newRetry(util.MakeTransport(opts.RegistryOptions, registryName))
 		rt := &withUserAgent{t: tr}
 
+		pushImage := image
+		if opts.Cache {
+			pushImage = mountCachedLayers(image, opts, destRef, pushAuth, rt)
+		}
+
 		logrus.Infof("Pushing image to %s", destRef.String())
 
+		// Tags of the same repository share the blobs pushed with the first one.
+		blobs, ok := pushed[destRef.Context().Name()]
+		if !ok {
+			blobs = newPushedBlobs(rt)
+			pushed[destRef.Context().Name()] = blobs
+		}
+		writeOptions := []remote.Option{remote.WithTransport(blobs)}
+		if opts.LayerPushParallelism > 0 {
+			writeOptions = append(writeOptions, remote.WithJobs(opts.LayerPushParallelism))
+		}
+		refreshedAuth := false
 		retryFunc := func() error {
-			return remote.Write(destRef, image, remote.WithAuth(pushAuth), remote.WithTransport(rt))
+			err := writeImage(destRef, pushImage, append(writeOptions, remote.WithAuth(pushAuth))...)
+			if refreshedAuth || !isUnauthorized(err) {
+				return err
+			}
+			// Short-lived registry tokens can expire during long pushes,
+			// so resolve the credentials again and retry once.
+			logging.Warnf("Push to %s was unauthorized, refreshing credentials", destRef.String())
+			refreshedAuth = true
+			pushAuth, err = getKeychain().Resolve(destRef.Context().Registry)
+			if err != nil {
+				return errors.Wrap(err, "refreshing pushAuth")
+			}
+			return writeImage(destRef, pushImage, append(writeOptions, remote.WithAuth(pushAuth))...)
 		}
 
+		pt := timing.Start("Pushing image to " + destRef.String())
 		if err := util.Retry(retryFunc, opts.PushRetry, 1000); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("failed to push to destination %s", destRef))
+			return PushErr{Destination: destRef.String(), Err: err}
+		}
+		logrus.Infof("Pushing image to %s took %s", destRef.String(), timing.DefaultRun.Stop(pt))
+		metrics.AddImageBytes(metrics.BytesPushed, image)
+
+		// Tags of the same repository share the signature of the digest.
+		if signer != nil && !signed[destRef.Context().Name()] {
+			if err := pushSignature(image, destRef, signer, opts.PushReferrers, remote.WithAuth(pushAuth), rt); err != nil {
+				return err
+			}
+			signed[destRef.Context().Name()] = true
 		}
 	}
 	timing.DefaultRun.Stop(t)
@@ -293,6 +351,274 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 	return writeImageOutputs(image, destRefs)
 }
 
+// writeImage pushes image to ref. Unlike remote.Write, which uploads every
+// layer at once, remote.MultiWrite uploads as many layers in parallel as set
+// with remote.WithJobs.
+func writeImage(ref name.Tag, image v1.Image, options ...remote.Option) error {
+	return remote.MultiWrite(map[name.Reference]remote.Taggable{ref: image}, options...)
+}
+
+// mountCachedLayers returns image with the layers that already exist in the
+// cache repository marked as mountable from it, so that pushing to destRef
+// mounts them instead of uploading them again. Layers are only mounted when
+// the cache repository is in the registry of destRef; if a mount fails, the
+// layer is uploaded as usual.
+func mountCachedLayers(image v1.Image, opts *config.KanikoOptions, destRef name.Tag, auth authn.Authenticator, rt http.RoundTripper) v1.Image {
+	cacheRepo, err := cache.Repository(opts)
+	if err != nil {
+		logrus.Debugf("Not mounting layers from the cache: %s", err)
+		return image
+	}
+	if cacheRepo.RegistryStr() != destRef.Context().RegistryStr() || cacheRepo.RepositoryStr() == destRef.Context().RepositoryStr() {
+		return image
+	}
+	cacheRepo.Registry = destRef.Context().Registry
+
+	layers, err := image.Layers()
+	if err != nil {
+		return image
+	}
+	tr, err := transport.New(cacheRepo.Registry, auth, rt, []string{cacheRepo.Scope(transport.PullScope)})
+	if err != nil {
+		logging.Warnf("Not mounting layers from cache repository %s: %s", cacheRepo, err)
+		return image
+	}
+	client := &http.Client{Transport: tr}
+
+	mountable := make([]v1.Layer, len(layers))
+	for i, l := range layers {
+		mountable[i] = l
+		if _, ok := l.(*remote.MountableLayer); ok {
+			continue
+		}
+		d, err := l.Digest()
+		if err != nil {
+			continue
+		}
+		if blobExists(client, cacheRepo, d) {
+			logrus.Debugf("Mounting layer %s from cache repository %s", d, cacheRepo)
+			mountable[i] = &remote.MountableLayer{Layer: l, Reference: cacheRepo.Digest(d.String())}
+		}
+	}
+	return &mountableImage{Image: image, layers: mountable}
+}
+
+// blobExists returns true if the blob with digest d is in repo.
+func blobExists(client *http.Client, repo name.Repository, d v1.Hash) bool {
+	u := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", repo.Registry.Scheme(), repo.RegistryStr(), repo.RepositoryStr(), d)
+	resp, err := client.Head(u)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// mountableImage is an image whose layers are replaced by mountable ones.
+type mountableImage struct {
+	v1.Image
+	layers []v1.Layer
+}
+
+func (i *mountableImage) Layers() ([]v1.Layer, error) {
+	return i.layers, nil
+}
+
+// uncompressedImage returns image with its layers uncompressed, so that
+// they're saved as is in a tarball. Each layer is uncompressed once, into a
+// temporary file, as its size must be known before it's written.
+func uncompressedImage(image v1.Image) (v1.Image, error) {
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	addenda := make([]mutate.Addendum, len(layers))
+	for i, l := range layers {
+		layer, err := uncompressedTempLayer(l)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading layer")
+		}
+		addenda[i] = mutate.Addendum{Layer: layer}
+	}
+	uncompressed, err := mutate.Append(empty.Image, addenda...)
+	if err != nil {
+		return nil, err
+	}
+	return mutate.ConfigFile(uncompressed, cf)
+}
+
+// uncompressedTempLayer uncompresses l to a temporary file, removed once the
+// image is pushed, and returns it as a layer whose blob is its uncompressed
+// content.
+func uncompressedTempLayer(l v1.Layer) (v1.Layer, error) {
+	diffID, err := l.DiffID()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	f, err := util.TempFile(config.KanikoDir, "uncompressed-layer")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(f, rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	layer, err := partial.UncompressedToLayer(&uncompressedFile{path: f.Name(), diffID: diffID})
+	if err != nil {
+		return nil, err
+	}
+	return &uncompressedLayer{Layer: layer, size: size}, nil
+}
+
+// uncompressedFileLayer returns the layer tarball at path as a layer whose blob
+// is its uncompressed content, without compressing it.
+func uncompressedFileLayer(path string) (v1.Layer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	diffID, size, err := v1.SHA256(f)
+	if err != nil {
+		return nil, err
+	}
+	layer, err := partial.UncompressedToLayer(&uncompressedFile{path: path, diffID: diffID})
+	if err != nil {
+		return nil, err
+	}
+	return &uncompressedLayer{Layer: layer, size: size}, nil
+}
+
+// uncompressedFile is the content of an uncompressed layer tarball.
+type uncompressedFile struct {
+	path   string
+	diffID v1.Hash
+}
+
+func (f *uncompressedFile) DiffID() (v1.Hash, error) {
+	return f.diffID, nil
+}
+
+func (f *uncompressedFile) Uncompressed() (io.ReadCloser, error) {
+	return os.Open(f.path)
+}
+
+func (f *uncompressedFile) MediaType() (types.MediaType, error) {
+	return types.DockerUncompressedLayer, nil
+}
+
+// uncompressedLayer is a layer whose blob is its uncompressed content.
+type uncompressedLayer struct {
+	v1.Layer
+	size int64
+}
+
+func (l *uncompressedLayer) Digest() (v1.Hash, error) {
+	return l.DiffID()
+}
+
+func (l *uncompressedLayer) Compressed() (io.ReadCloser, error) {
+	return l.Uncompressed()
+}
+
+func (l *uncompressedLayer) Size() (int64, error) {
+	return l.size, nil
+}
+
+func (l *uncompressedLayer) MediaType() (types.MediaType, error) {
+	return types.DockerUncompressedLayer, nil
+}
+
+// pushSignature signs the digest of image in the repository of destRef and
+// pushes the signature next to it, either to the cosign signature tag or as an
+// OCI referrer of image.
+func pushSignature(image v1.Image, destRef name.Tag, signer signing.Signer, referrer bool, auth remote.Option, rt http.RoundTripper) error {
+	d, err := image.Digest()
+	if err != nil {
+		return err
+	}
+	digest := destRef.Context().Digest(d.String())
+	if referrer {
+		sig, err := signing.SignatureImage(empty.Image, digest, signer)
+		if err != nil {
+			return err
+		}
+		desc, err := partial.Descriptor(image)
+		if err != nil {
+			return err
+		}
+		return pushReferrer(sig, signing.ArtifactType, digest, *desc, auth, rt)
+	}
+	// The signatures already pushed to the signature tag are kept, so that the
+	// image can be signed more than once, with different keys.
+	sigRef := signing.SignatureTag(digest)
+	base, err := remote.Image(sigRef, auth, remote.WithTransport(rt))
+	switch {
+	case isNotFound(err):
+		base = empty.Image
+	case err != nil:
+		return errors.Wrapf(err, "fetching the signatures at %s", sigRef)
+	}
+	sig, err := signing.SignatureImage(base, digest, signer)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Pushing signature of %s to %s", digest, sigRef)
+	if err := remote.Write(sigRef, sig, auth, remote.WithTransport(rt)); err != nil {
+		return errors.Wrapf(err, "pushing signature to %s", sigRef)
+	}
+	return nil
+}
+
+// withExtraTags parses destinations and adds each tag in extraTags to the
+// repository of every destination, skipping duplicates.
+func withExtraTags(destinations, extraTags []string) ([]name.Tag, error) {
+	refs := []name.Tag{}
+	seen := map[string]bool{}
+	add := func(ref name.Tag) {
+		if !seen[ref.Name()] {
+			seen[ref.Name()] = true
+			refs = append(refs, ref)
+		}
+	}
+	for _, destination := range destinations {
+		destRef, err := util.ParseTag(destination)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting tag for destination")
+		}
+		add(destRef)
+	}
+	for _, destRef := range append([]name.Tag{}, refs...) {
+		for _, tag := range extraTags {
+			extraRef, err := util.ParseTag(destRef.Context().String() + ":" + tag)
+			if err != nil {
+				return nil, errors.Wrapf(err, "getting extra tag %s for destination %s", tag, destRef)
+			}
+			add(extraRef)
+		}
+	}
+	return refs, nil
+}
+
+// isUnauthorized returns true if err is a registry response with status 401.
+func isUnauthorized(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusUnauthorized
+}
+
 func writeImageOutputs(image v1.Image, destRefs []name.Tag) error {
 	dir := os.Getenv("BUILDER_OUTPUT")
 	if dir == "" {
@@ -324,10 +650,61 @@ func writeImageOutputs(image v1.Image, destRefs []name.Tag) error {
 	return nil
 }
 
+// PushCache pushes image to the tag given with --cache-to, along with the
+// diffIDs of its layers keyed by cache key, so that later builds can import
+// the cache from it with --layer-cache-from.
+func PushCache(image v1.Image, opts *config.KanikoOptions) error {
+	if opts.CacheTo == "" {
+		return nil
+	}
+	image, err := cache.WithCacheMetadata(image)
+	if err != nil {
+		return errors.Wrap(err, "adding cache metadata")
+	}
+	logrus.Infof("Exporting the cache to %s", opts.CacheTo)
+	return DoPush(image, pushOnlyTo(opts.CacheTo, opts))
+}
+
+// pushStage pushes image, the image of an intermediate stage, to destination.
+// With --inline-cache, it's pushed with the cache metadata, like the built image.
+func pushStage(image v1.Image, destination string, opts *config.KanikoOptions) error {
+	if opts.InlineCache {
+		var err error
+		if image, err = cache.WithCacheMetadata(image); err != nil {
+			return errors.Wrap(err, "adding inline cache metadata")
+		}
+	}
+	logrus.Infof("Publishing stage to %s", destination)
+	return DoPush(image, pushOnlyTo(destination, opts))
+}
+
+// pushOnlyTo returns opts to push an image other than the one built to
+// destination, without the outputs and tags of the built image.
+func pushOnlyTo(destination string, opts *config.KanikoOptions) *config.KanikoOptions {
+	pushOpts := *opts
+	pushOpts.Destinations = []string{destination}
+	pushOpts.AlsoTags = nil
+	pushOpts.NoPush = false
+	pushOpts.TarPath = ""
+	pushOpts.OCILayoutPath = ""
+	pushOpts.DigestFile = ""
+	pushOpts.ImageNameDigestFile = ""
+	pushOpts.ImageNameTagDigestFile = ""
+	pushOpts.SignKey = ""
+	pushOpts.PushReferrers = false
+	return &pushOpts
+}
+
 // pushLayerToCache pushes layer (tagged with cacheKey) to opts.Cache
 // if opts.Cache doesn't exist, infer the cache from the given destination
 func pushLayerToCache(opts *config.KanikoOptions, cacheKey string, tarPath string, createdBy string) error {
-	layer, err := tarball.LayerFromFile(tarPath, tarball.WithCompressedCaching)
+	var layer v1.Layer
+	var err error
+	if opts.CacheCompression == constants.CacheCompressionNone {
+		layer, err = uncompressedFileLayer(tarPath)
+	} else {
+		layer, err = tarball.LayerFromFile(tarPath, tarball.WithCompressedCaching)
+	}
 	if err != nil {
 		return err
 	}
@@ -354,11 +731,8 @@ func pushLayerToCache(opts *config.KanikoOptions, cacheKey string, tarPath strin
 	if err != nil {
 		return errors.Wrap(err, "appending layer onto empty image")
 	}
-	cacheOpts := *opts
-	cacheOpts.TarPath = ""   // tarPath doesn't make sense for Docker layers
-	cacheOpts.NoPush = false // we want to push cached layers
-	cacheOpts.Destinations = []string{cache}
-	cacheOpts.InsecureRegistries = opts.InsecureRegistries
-	cacheOpts.SkipTLSVerifyRegistries = opts.SkipTLSVerifyRegistries
-	return DoPush(empty, &cacheOpts)
+	cacheOpts := pushOnlyTo(cache, opts)
+	cacheOpts.SkipTLSVerify = opts.SkipTLSVerifyCache
+	cacheOpts.Cache = false // layers pushed to the cache aren't mounted from it
+	return DoPush(empty, cacheOpts)
 }
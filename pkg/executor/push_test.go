@@ -17,22 +17,43 @@ limitations under the License.
 package executor
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/creds"
+	"github.com/GoogleContainerTools/kaniko/pkg/signing"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/GoogleContainerTools/kaniko/testutil"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 )
 
@@ -312,24 +333,73 @@ func TestImageNameDigestFile(t *testing.T) {
 		t.Fatalf("could not get image digest: %s", err)
 	}
 
+	tests := []struct {
+		description  string
+		destinations []string
+		want         string
+	}{
+		{
+			description:  "single destination",
+			destinations: []string{"gcr.io/foo/bar:latest"},
+			want:         "gcr.io/foo/bar@" + digest.String() + "\n",
+		},
+		{
+			description:  "multiple destinations",
+			destinations: []string{"gcr.io/foo/bar:latest", "bob/image"},
+			want:         "gcr.io/foo/bar@" + digest.String() + "\nindex.docker.io/bob/image@" + digest.String() + "\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			opts := config.KanikoOptions{
+				NoPush:              true,
+				Destinations:        test.destinations,
+				ImageNameDigestFile: "tmpFile",
+			}
+
+			defer os.Remove("tmpFile")
+
+			if err := DoPush(image, &opts); err != nil {
+				t.Fatalf("could not push image: %s", err)
+			}
+
+			got, err := ioutil.ReadFile("tmpFile")
+
+			testutil.CheckErrorAndDeepEqual(t, false, err, []byte(test.want), got)
+		})
+	}
+}
+
+func TestImageNameDigestFileWithTagDigestFile(t *testing.T) {
+	image, err := random.Image(1024, 4)
+	if err != nil {
+		t.Fatalf("could not create image: %s", err)
+	}
+
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatalf("could not get image digest: %s", err)
+	}
+
 	opts := config.KanikoOptions{
-		NoPush:              true,
-		Destinations:        []string{"gcr.io/foo/bar:latest", "bob/image"},
-		ImageNameDigestFile: "tmpFile",
+		NoPush:                 true,
+		Destinations:           []string{"gcr.io/foo/bar:123"},
+		ImageNameDigestFile:    "nameFile",
+		ImageNameTagDigestFile: "tagFile",
 	}
 
-	defer os.Remove("tmpFile")
+	defer os.Remove("nameFile")
+	defer os.Remove("tagFile")
 
 	if err := DoPush(image, &opts); err != nil {
 		t.Fatalf("could not push image: %s", err)
 	}
 
-	want := []byte("gcr.io/foo/bar@" + digest.String() + "\nindex.docker.io/bob/image@" + digest.String() + "\n")
-
-	got, err := ioutil.ReadFile("tmpFile")
-
-	testutil.CheckErrorAndDeepEqual(t, false, err, want, got)
+	got, err := ioutil.ReadFile("nameFile")
+	testutil.CheckErrorAndDeepEqual(t, false, err, []byte("gcr.io/foo/bar@"+digest.String()+"\n"), got)
 
+	got, err = ioutil.ReadFile("tagFile")
+	testutil.CheckErrorAndDeepEqual(t, false, err, []byte("gcr.io/foo/bar:123@"+digest.String()+"\n"), got)
 }
 
 func TestImageNameTagDigestFile(t *testing.T) {
@@ -474,3 +544,885 @@ func TestWriteDigestFile(t *testing.T) {
 		}
 	})
 }
+
+// expiringKeychain hands out an expired token first, and fresh ones afterwards.
+type expiringKeychain struct {
+	resolved int
+}
+
+func (k *expiringKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	k.resolved++
+	if k.resolved == 1 {
+		return &authn.Basic{Username: "user", Password: "expired"}, nil
+	}
+	return &authn.Basic{Username: "user", Password: "fresh"}, nil
+}
+
+func TestDoPushRefreshesExpiredCredentials(t *testing.T) {
+	manifests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if _, password, _ := r.BasicAuth(); password != "fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/"):
+			// Pretend every blob has already been uploaded.
+			w.Header().Set("Content-Length", "1")
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+			manifests++
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	keychain := &expiringKeychain{}
+	getKeychain = func() authn.Keychain { return keychain }
+	defer func() { getKeychain = creds.GetKeychain }()
+
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &config.KanikoOptions{
+		Destinations:    []string{strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"},
+		RegistryOptions: config.RegistryOptions{Insecure: true},
+	}
+	testutil.CheckNoError(t, DoPush(image, opts))
+	testutil.CheckDeepEqual(t, 2, keychain.resolved)
+	testutil.CheckDeepEqual(t, 1, manifests)
+}
+
+func TestDoPushUnauthorizedReturnsPushErr(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	keychain := &expiringKeychain{}
+	getKeychain = func() authn.Keychain { return keychain }
+	defer func() { getKeychain = creds.GetKeychain }()
+
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"
+	opts := &config.KanikoOptions{
+		Destinations:    []string{destination},
+		RegistryOptions: config.RegistryOptions{Insecure: true},
+	}
+	err = DoPush(image, opts)
+	var pushErr PushErr
+	if !errors.As(err, &pushErr) {
+		t.Fatalf("expected a PushErr, got %v", err)
+	}
+	testutil.CheckDeepEqual(t, destination, pushErr.Destination)
+	var terr *transport.Error
+	if !errors.As(err, &terr) || terr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected an unauthorized registry error, got %v", err)
+	}
+	var cmdErr CommandFailedErr
+	if errors.As(err, &cmdErr) {
+		t.Errorf("expected no CommandFailedErr, got %v", err)
+	}
+}
+
+// fakeRegistry accepts every push and records the digest of each manifest by path.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	manifests map[string]string
+}
+
+func newFakeRegistry() (*fakeRegistry, *httptest.Server) {
+	reg := &fakeRegistry{manifests: map[string]string{}}
+	return reg, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/"):
+			// Pretend every blob has already been uploaded.
+			w.Header().Set("Content-Length", "1")
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			reg.mu.Lock()
+			reg.manifests[r.URL.Path] = fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+			reg.mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestDoPushAlsoTags(t *testing.T) {
+	reg, server := newFakeRegistry()
+	defer server.Close()
+
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := strings.TrimPrefix(server.URL, "http://")
+	opts := &config.KanikoOptions{
+		Destinations:    []string{registry + "/test/image:latest", registry + "/other/image:1.0"},
+		AlsoTags:        []string{"stable", "latest"},
+		RegistryOptions: config.RegistryOptions{Insecure: true},
+	}
+	testutil.CheckNoError(t, DoPush(image, opts))
+
+	want := map[string]string{}
+	for _, p := range []string{
+		"/v2/test/image/manifests/latest",
+		"/v2/test/image/manifests/stable",
+		"/v2/other/image/manifests/1.0",
+		"/v2/other/image/manifests/stable",
+		"/v2/other/image/manifests/latest",
+	} {
+		want[p] = digest.String()
+	}
+	testutil.CheckDeepEqual(t, want, reg.manifests)
+}
+
+func TestDoPushResumesFailedPush(t *testing.T) {
+	var mu sync.Mutex
+	heads, commits := map[string]int{}, map[string]int{}
+	failed := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/"):
+			heads[path.Base(r.URL.Path)]++
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+			w.Header().Set("Location", "/upload")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPatch && r.URL.Path == "/upload":
+			ioutil.ReadAll(r.Body)
+			w.Header().Set("Location", "/upload")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && r.URL.Path == "/upload":
+			// Fail the push once, after two blobs were uploaded.
+			if len(commits) == 2 && failed == "" {
+				failed = r.URL.Query().Get("digest")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			commits[r.URL.Query().Get("digest")]++
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	image, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := strings.TrimPrefix(server.URL, "http://")
+	opts := &config.KanikoOptions{
+		Destinations:         []string{registry + "/test/image:latest"},
+		LayerPushParallelism: 1,
+		RegistryOptions:      config.RegistryOptions{Insecure: true, PushRetry: 1},
+	}
+	testutil.CheckNoError(t, DoPush(image, opts))
+
+	if failed == "" {
+		t.Fatal("expected the first push to fail")
+	}
+	// The layers and the config are each uploaded once, and only the blob
+	// which failed to upload is checked again.
+	if len(commits) != 4 {
+		t.Errorf("expected 4 blobs to be uploaded, got %v", commits)
+	}
+	for digest, n := range commits {
+		if digest == failed {
+			continue
+		}
+		if n != 1 || heads[digest] != 1 {
+			t.Errorf("expected blob %s to be checked and uploaded once, got %d checks and %d uploads", digest, heads[digest], n)
+		}
+	}
+}
+
+func TestDoPushTarCompression(t *testing.T) {
+	image, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalKanikoDir := config.KanikoDir
+	defer func() { config.KanikoDir = originalKanikoDir }()
+	config.KanikoDir = t.TempDir()
+	tests := []struct {
+		description string
+		compression string
+		gzipped     bool
+	}{
+		{
+			description: "default",
+			gzipped:     true,
+		},
+		{
+			description: "gzip",
+			compression: constants.TarCompressionGzip,
+			gzipped:     true,
+		},
+		{
+			description: "uncompressed",
+			compression: constants.TarCompressionNone,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tarPath := filepath.Join(t.TempDir(), "image.tar")
+			opts := &config.KanikoOptions{
+				Destinations:   []string{"gcr.io/foo/bar:latest"},
+				TarPath:        tarPath,
+				TarCompression: test.compression,
+				NoPush:         true,
+			}
+			testutil.CheckNoError(t, DoPush(image, opts))
+
+			// The layers are loaded back with the same content, compressed or not.
+			tag, err := name.NewTag("gcr.io/foo/bar:latest")
+			testutil.CheckNoError(t, err)
+			loaded, err := tarball.ImageFromPath(tarPath, &tag)
+			testutil.CheckNoError(t, err)
+			testutil.CheckNoError(t, validate.Image(loaded))
+			expected, err := image.Layers()
+			testutil.CheckNoError(t, err)
+			actual, err := loaded.Layers()
+			testutil.CheckNoError(t, err)
+			if len(actual) != len(expected) {
+				t.Fatalf("expected %d layers, got %d", len(expected), len(actual))
+			}
+			for i := range expected {
+				expectedDiffID, err := expected[i].DiffID()
+				testutil.CheckNoError(t, err)
+				actualDiffID, err := actual[i].DiffID()
+				testutil.CheckNoError(t, err)
+				testutil.CheckDeepEqual(t, expectedDiffID, actualDiffID)
+			}
+
+			f, err := os.Open(tarPath)
+			testutil.CheckNoError(t, err)
+			defer f.Close()
+			tr := tar.NewReader(f)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				testutil.CheckNoError(t, err)
+				if !strings.HasSuffix(hdr.Name, ".tar.gz") {
+					continue
+				}
+				magic := make([]byte, 2)
+				_, err = io.ReadFull(tr, magic)
+				testutil.CheckNoError(t, err)
+				gzipped := bytes.Equal(magic, []byte{0x1f, 0x8b})
+				if gzipped != test.gzipped {
+					t.Errorf("expected layer %s to be gzipped: %t", hdr.Name, test.gzipped)
+				}
+			}
+		})
+	}
+}
+
+// countingLayer counts how many times its content is uncompressed.
+type countingLayer struct {
+	v1.Layer
+	uncompressed int
+}
+
+func (l *countingLayer) Uncompressed() (io.ReadCloser, error) {
+	l.uncompressed++
+	return l.Layer.Uncompressed()
+}
+
+func Test_uncompressedImage(t *testing.T) {
+	originalKanikoDir := config.KanikoDir
+	defer func() { config.KanikoDir = originalKanikoDir }()
+	config.KanikoDir = t.TempDir()
+	defer util.RemoveTempFiles()
+
+	image, err := random.Image(1024, 2)
+	testutil.CheckNoError(t, err)
+	layers, err := image.Layers()
+	testutil.CheckNoError(t, err)
+	counting := make([]*countingLayer, len(layers))
+	addenda := make([]mutate.Addendum, len(layers))
+	for i, l := range layers {
+		counting[i] = &countingLayer{Layer: l}
+		addenda[i] = mutate.Addendum{Layer: counting[i]}
+	}
+	image, err = mutate.Append(empty.Image, addenda...)
+	testutil.CheckNoError(t, err)
+
+	uncompressed, err := uncompressedImage(image)
+	testutil.CheckNoError(t, err)
+	tag, err := name.NewTag("gcr.io/foo/bar:latest")
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, tarball.Write(tag, uncompressed, ioutil.Discard))
+
+	for i, l := range counting {
+		if l.uncompressed != 1 {
+			t.Errorf("expected layer %d to be uncompressed once, got %d", i, l.uncompressed)
+		}
+	}
+}
+
+func TestPushCache(t *testing.T) {
+	reg, server := newFakeRegistry()
+	defer server.Close()
+
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := strings.TrimPrefix(server.URL, "http://")
+	opts := &config.KanikoOptions{
+		Destinations:    []string{registry + "/test/image:latest"},
+		AlsoTags:        []string{"stable"},
+		NoPush:          true,
+		CacheTo:         registry + "/test/cache:main",
+		RegistryOptions: config.RegistryOptions{Insecure: true},
+	}
+	testutil.CheckNoError(t, PushCache(image, opts))
+
+	// Only the cache is pushed, along with its metadata.
+	exported, err := cache.WithCacheMetadata(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := exported.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckDeepEqual(t, map[string]string{"/v2/test/cache/manifests/main": digest.String()}, reg.manifests)
+}
+
+func TestDoPushUploadsLayersInParallel(t *testing.T) {
+	for _, parallelism := range []int{1, 3} {
+		t.Run(fmt.Sprintf("parallelism %d", parallelism), func(t *testing.T) {
+			var mu sync.Mutex
+			uploading, maxUploading := 0, 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/v2/":
+					w.WriteHeader(http.StatusOK)
+				case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+					w.Header().Set("Location", "/upload")
+					w.WriteHeader(http.StatusAccepted)
+				case r.Method == http.MethodPatch && r.URL.Path == "/upload":
+					mu.Lock()
+					uploading++
+					if uploading > maxUploading {
+						maxUploading = uploading
+					}
+					mu.Unlock()
+					// Keep the upload going long enough for the others to start.
+					time.Sleep(100 * time.Millisecond)
+					ioutil.ReadAll(r.Body)
+					mu.Lock()
+					uploading--
+					mu.Unlock()
+					w.Header().Set("Location", "/upload")
+					w.WriteHeader(http.StatusAccepted)
+				case r.Method == http.MethodPut && (r.URL.Path == "/upload" || strings.Contains(r.URL.Path, "/manifests/")):
+					w.WriteHeader(http.StatusCreated)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			image, err := random.Image(1024, 6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := &config.KanikoOptions{
+				Destinations:         []string{strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"},
+				RegistryOptions:      config.RegistryOptions{Insecure: true},
+				LayerPushParallelism: parallelism,
+			}
+			testutil.CheckNoError(t, DoPush(image, opts))
+			testutil.CheckDeepEqual(t, parallelism, maxUploading)
+		})
+	}
+}
+
+func TestWithExtraTags(t *testing.T) {
+	tests := []struct {
+		description  string
+		destinations []string
+		extraTags    []string
+		want         []string
+		shouldErr    bool
+	}{
+		{
+			description:  "no extra tags",
+			destinations: []string{"gcr.io/foo/bar:1.0"},
+			want:         []string{"gcr.io/foo/bar:1.0"},
+		},
+		{
+			description:  "extra tags for each destination",
+			destinations: []string{"gcr.io/foo/bar:1.0", "bob/image"},
+			extraTags:    []string{"stable"},
+			want:         []string{"gcr.io/foo/bar:1.0", "index.docker.io/bob/image:latest", "gcr.io/foo/bar:stable", "index.docker.io/bob/image:stable"},
+		},
+		{
+			description:  "duplicate tags are skipped",
+			destinations: []string{"gcr.io/foo/bar:1.0", "bob/image", "index.docker.io/bob/image:latest"},
+			extraTags:    []string{"1.0", "stable", "stable"},
+			want:         []string{"gcr.io/foo/bar:1.0", "index.docker.io/bob/image:latest", "gcr.io/foo/bar:stable", "index.docker.io/bob/image:1.0", "index.docker.io/bob/image:stable"},
+		},
+		{
+			description:  "registries with ports and nested repositories",
+			destinations: []string{"localhost:5000/a/b/c:1.0", "localhost/a/b", "registry.example.com:8443/team/app/api"},
+			extraTags:    []string{"stable"},
+			want:         []string{"localhost:5000/a/b/c:1.0", "localhost/a/b:latest", "registry.example.com:8443/team/app/api:latest", "localhost:5000/a/b/c:stable", "localhost/a/b:stable", "registry.example.com:8443/team/app/api:stable"},
+		},
+		{
+			description:  "invalid tag",
+			destinations: []string{"gcr.io/foo/bar:1.0"},
+			extraTags:    []string{"not/a/tag"},
+			shouldErr:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			refs, err := withExtraTags(test.destinations, test.extraTags)
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			got := []string{}
+			for _, ref := range refs {
+				got = append(got, ref.Name())
+			}
+			testutil.CheckDeepEqual(t, test.want, got)
+		})
+	}
+}
+
+type fakeSigner struct {
+	signed []string
+}
+
+func (f *fakeSigner) Sign(payload []byte) ([]byte, error) {
+	f.signed = append(f.signed, string(payload))
+	return []byte("signature"), nil
+}
+
+func TestDoPushSignsImage(t *testing.T) {
+	reg, server := newFakeRegistry()
+	defer server.Close()
+
+	signer := &fakeSigner{}
+	newSigner = func(path string) (signing.Signer, error) {
+		testutil.CheckDeepEqual(t, "key.pem", path)
+		return signer, nil
+	}
+	defer func() { newSigner = signing.NewKeySigner }()
+
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := strings.TrimPrefix(server.URL, "http://")
+	opts := &config.KanikoOptions{
+		Destinations:    []string{registry + "/test/image:latest"},
+		AlsoTags:        []string{"stable"},
+		SignKey:         "key.pem",
+		RegistryOptions: config.RegistryOptions{Insecure: true},
+	}
+	testutil.CheckNoError(t, DoPush(image, opts))
+
+	// The tags share a single signature of the digest.
+	if len(signer.signed) != 1 || !strings.Contains(signer.signed[0], digest.String()) {
+		t.Errorf("expected the digest %s to be signed once, got %v", digest, signer.signed)
+	}
+	sigPath := "/v2/test/image/manifests/" + strings.Replace(digest.String(), ":", "-", 1) + ".sig"
+	if _, ok := reg.manifests[sigPath]; !ok {
+		t.Errorf("expected a signature to be pushed to %s, got %v", sigPath, reg.manifests)
+	}
+}
+
+func TestDoPushSignsImageAsReferrer(t *testing.T) {
+	signer := &fakeSigner{}
+	newSigner = func(path string) (signing.Signer, error) {
+		return signer, nil
+	}
+	defer func() { newSigner = signing.NewKeySigner }()
+
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := image.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	referrersTagPath := "/v2/test/image/manifests/" + strings.Replace(digest.String(), ":", "-", 1)
+	existing := ociDescriptor{MediaType: types.OCIManifestSchema1, ArtifactType: "application/spdx+json", Size: 1, Digest: v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("0", 64)}}
+
+	tests := []struct {
+		description string
+		referrers   bool
+	}{
+		{
+			description: "registry with the referrers API",
+			referrers:   true,
+		},
+		{
+			description: "registry without the referrers API",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var mu sync.Mutex
+			manifests := map[string][]byte{}
+			// The referrers tag already lists another artifact.
+			manifests[referrersTagPath], _ = json.Marshal(referrersIndex{SchemaVersion: 2, MediaType: types.OCIImageIndex, Manifests: []ociDescriptor{existing}})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case r.URL.Path == "/v2/":
+					w.WriteHeader(http.StatusOK)
+				case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/"):
+					w.Header().Set("Content-Length", "1")
+					w.WriteHeader(http.StatusOK)
+				case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+					b, _ := ioutil.ReadAll(r.Body)
+					manifests[r.URL.Path] = b
+					if test.referrers && strings.Contains(string(b), `"subject"`) {
+						w.Header().Set("OCI-Subject", digest.String())
+					}
+					w.WriteHeader(http.StatusCreated)
+				case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/"):
+					b, ok := manifests[r.URL.Path]
+					if !ok || test.referrers {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					w.Header().Set("Content-Type", string(types.OCIImageIndex))
+					w.Write(b)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			registry := strings.TrimPrefix(server.URL, "http://")
+			opts := &config.KanikoOptions{
+				Destinations:    []string{registry + "/test/image:latest"},
+				SignKey:         "key.pem",
+				PushReferrers:   true,
+				RegistryOptions: config.RegistryOptions{Insecure: true},
+			}
+			testutil.CheckNoError(t, DoPush(image, opts))
+
+			sigPath := referrersTagPath + ".sig"
+			if _, ok := manifests[sigPath]; ok {
+				t.Errorf("expected no signature to be pushed to %s", sigPath)
+			}
+			var referrer referrerManifest
+			var referrerDigest v1.Hash
+			for p, b := range manifests {
+				if strings.Contains(p, "/manifests/sha256:") {
+					testutil.CheckNoError(t, json.Unmarshal(b, &referrer))
+					referrerDigest, _, _ = v1.SHA256(bytes.NewReader(b))
+				}
+			}
+			if referrer.Subject == nil {
+				t.Fatalf("expected a referrer to be pushed by digest, got %v", manifests)
+			}
+			testutil.CheckDeepEqual(t, ociDescriptor{MediaType: types.DockerManifestSchema2, Size: size, Digest: digest}, *referrer.Subject)
+			testutil.CheckDeepEqual(t, signing.ArtifactType, referrer.ArtifactType)
+			testutil.CheckDeepEqual(t, types.OCIManifestSchema1, referrer.MediaType)
+
+			var index referrersIndex
+			testutil.CheckNoError(t, json.Unmarshal(manifests[referrersTagPath], &index))
+			want := []ociDescriptor{existing}
+			if !test.referrers {
+				want = append(want, ociDescriptor{
+					MediaType:    types.OCIManifestSchema1,
+					ArtifactType: signing.ArtifactType,
+					Size:         int64(len(manifests["/v2/test/image/manifests/"+referrerDigest.String()])),
+					Digest:       referrerDigest,
+				})
+			}
+			testutil.CheckDeepEqual(t, want, index.Manifests)
+		})
+	}
+}
+
+func TestDoPushMountsCachedLayers(t *testing.T) {
+	image, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notCached, err := layers[1].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var mounted, uploaded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodHead && r.URL.Path == "/v2/test/cache/blobs/"+cached.String():
+			w.Header().Set("Content-Length", "1")
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost && r.URL.Path == "/v2/test/image/blobs/uploads/":
+			query := r.URL.Query()
+			if query.Get("from") == "test/cache" && query.Get("mount") == cached.String() {
+				mounted = append(mounted, query.Get("mount"))
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			w.Header().Set("Location", "/v2/test/image/blobs/uploads/upload")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPatch:
+			w.Header().Set("Location", r.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/"):
+			uploaded = append(uploaded, r.URL.Query().Get("digest"))
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	opts := &config.KanikoOptions{
+		Destinations:    []string{registry + "/test/image:latest"},
+		Cache:           true,
+		CacheRepo:       registry + "/test/cache",
+		RegistryOptions: config.RegistryOptions{Insecure: true},
+	}
+	testutil.CheckNoError(t, DoPush(image, opts))
+
+	testutil.CheckDeepEqual(t, []string{cached.String()}, mounted)
+	for _, d := range uploaded {
+		if d == cached.String() {
+			t.Errorf("expected layer %s to be mounted from the cache rather than uploaded", d)
+		}
+	}
+	found := false
+	for _, d := range uploaded {
+		found = found || d == notCached.String()
+	}
+	if !found {
+		t.Errorf("expected layer %s, which isn't cached, to be uploaded, got uploads %v", notCached, uploaded)
+	}
+}
+
+func TestPushLayerToCache_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-compression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	originalKanikoDir := config.KanikoDir
+	defer func() { config.KanikoDir = originalKanikoDir }()
+	config.KanikoDir = dir
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	testutil.CheckNoError(t, tw.WriteHeader(&tar.Header{Name: "foo", Mode: 0644, Size: 3, Typeflag: tar.TypeReg}))
+	tw.Write([]byte("bar"))
+	testutil.CheckNoError(t, tw.Close())
+	tarPath := filepath.Join(dir, "layer.tar")
+	testutil.CheckNoError(t, ioutil.WriteFile(tarPath, buf.Bytes(), 0644))
+	diffID, _, err := v1.SHA256(bytes.NewReader(buf.Bytes()))
+	testutil.CheckNoError(t, err)
+
+	tests := []struct {
+		compression     string
+		pushedMediaType types.MediaType
+	}{
+		{
+			compression:     constants.CacheCompressionGzip,
+			pushedMediaType: types.DockerLayer,
+		},
+		{
+			compression:     constants.CacheCompressionNone,
+			pushedMediaType: types.DockerUncompressedLayer,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.compression, func(t *testing.T) {
+			// A registry keeping the blobs and manifests pushed to it.
+			var mu sync.Mutex
+			blobs, manifests, uploads := map[string][]byte{}, map[string][]byte{}, map[string][]byte{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case r.URL.Path == "/v2/":
+					w.WriteHeader(http.StatusOK)
+				case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+					location := fmt.Sprintf("/upload/%d", len(uploads))
+					uploads[location] = nil
+					w.Header().Set("Location", location)
+					w.WriteHeader(http.StatusAccepted)
+				case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/upload/"):
+					b, _ := ioutil.ReadAll(r.Body)
+					uploads[r.URL.Path] = append(uploads[r.URL.Path], b...)
+					w.Header().Set("Location", r.URL.Path)
+					w.WriteHeader(http.StatusAccepted)
+				case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/upload/"):
+					b, _ := ioutil.ReadAll(r.Body)
+					blobs[r.URL.Query().Get("digest")] = append(uploads[r.URL.Path], b...)
+					w.WriteHeader(http.StatusCreated)
+				case strings.Contains(r.URL.Path, "/blobs/"):
+					b, ok := blobs[path.Base(r.URL.Path)]
+					if !ok {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+					if r.Method == http.MethodGet {
+						w.Write(b)
+					}
+				case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+					manifests[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+					w.WriteHeader(http.StatusCreated)
+				case strings.Contains(r.URL.Path, "/manifests/"):
+					b, ok := manifests[r.URL.Path]
+					if !ok {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					w.Header().Set("Content-Type", string(types.DockerManifestSchema2))
+					w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+					if r.Method == http.MethodGet {
+						w.Write(b)
+					}
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			opts := &config.KanikoOptions{
+				CacheRepo:        strings.TrimPrefix(server.URL, "http://") + "/cache",
+				CacheCompression: test.compression,
+				CacheOptions:     config.CacheOptions{CacheTTL: time.Hour},
+				RegistryOptions:  config.RegistryOptions{Insecure: true},
+			}
+			testutil.CheckNoError(t, pushLayerToCache(opts, "key", tarPath, "RUN foo"))
+
+			manifest, err := v1.ParseManifest(bytes.NewReader(manifests["/v2/cache/manifests/key"]))
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, test.pushedMediaType, manifest.Layers[0].MediaType)
+
+			img, err := (&cache.RegistryCache{Opts: opts}).RetrieveLayer("key")
+			testutil.CheckNoError(t, err)
+			layers, err := img.Layers()
+			testutil.CheckErrorAndDeepEqual(t, false, err, 1, len(layers))
+			// The layer retrieved is compressed either way, and extracts to the same files.
+			mt, err := layers[0].MediaType()
+			testutil.CheckErrorAndDeepEqual(t, false, err, types.DockerLayer, mt)
+			layerDiffID, err := layers[0].DiffID()
+			testutil.CheckErrorAndDeepEqual(t, false, err, diffID, layerDiffID)
+			testutil.CheckDeepEqual(t, map[string]string{"foo": "bar"}, layerFileContents(t, layers[0]))
+		})
+	}
+}
+
+func TestPushLayerToCache_OnlyToCache(t *testing.T) {
+	reg, server := newFakeRegistry()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cache-push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tarPath := filepath.Join(dir, "layer.tar")
+	var buf bytes.Buffer
+	testutil.CheckNoError(t, tar.NewWriter(&buf).Close())
+	testutil.CheckNoError(t, ioutil.WriteFile(tarPath, buf.Bytes(), 0644))
+
+	newSigner = func(path string) (signing.Signer, error) {
+		t.Errorf("expected the cached layer not to be signed with %s", path)
+		return &fakeSigner{}, nil
+	}
+	defer func() { newSigner = signing.NewKeySigner }()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	digestFile := filepath.Join(dir, "digest")
+	opts := &config.KanikoOptions{
+		Destinations:    []string{registry + "/test/image:latest"},
+		AlsoTags:        []string{"stable"},
+		DigestFile:      digestFile,
+		SignKey:         "key.pem",
+		PushReferrers:   true,
+		CacheRepo:       registry + "/cache",
+		RegistryOptions: config.RegistryOptions{Insecure: true},
+	}
+	testutil.CheckNoError(t, pushLayerToCache(opts, "key", tarPath, "RUN foo"))
+
+	// The tags, outputs and signature of the built image aren't used for the cached layer.
+	var pushed []string
+	for p := range reg.manifests {
+		pushed = append(pushed, p)
+	}
+	testutil.CheckDeepEqual(t, []string{"/v2/cache/manifests/key"}, pushed)
+	if _, err := os.Stat(digestFile); !os.IsNotExist(err) {
+		t.Errorf("expected no digest file to be written for the cached layer, got %v", err)
+	}
+}
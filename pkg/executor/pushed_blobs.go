@@ -0,0 +1,97 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pushedBlobs is a transport recording the blobs confirmed to be in a
+// repository, because they already were, or were uploaded or mounted. When a
+// push is retried, the existence checks of these blobs are answered without
+// asking the registry, so that they aren't checked or uploaded again.
+type pushedBlobs struct {
+	t       http.RoundTripper
+	mu      sync.Mutex
+	digests map[string]bool
+}
+
+func newPushedBlobs(t http.RoundTripper) *pushedBlobs {
+	return &pushedBlobs{t: t, digests: map[string]bool{}}
+}
+
+func (p *pushedBlobs) RoundTrip(r *http.Request) (*http.Response, error) {
+	digest, isBlob := blobDigest(r.URL.Path)
+	if r.Method == http.MethodHead && isBlob && p.pushed(digest) {
+		logrus.Debugf("Blob %s was already pushed", digest)
+		return &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Proto:      r.Proto,
+			ProtoMajor: r.ProtoMajor,
+			ProtoMinor: r.ProtoMinor,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+			Request:    r,
+		}, nil
+	}
+	resp, err := p.t.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+	switch {
+	case r.Method == http.MethodHead && isBlob && resp.StatusCode == http.StatusOK:
+		p.record(digest)
+	case r.Method == http.MethodPut && resp.StatusCode == http.StatusCreated:
+		// The upload of a blob is committed with its digest.
+		p.record(r.URL.Query().Get("digest"))
+	case r.Method == http.MethodPost && resp.StatusCode == http.StatusCreated:
+		// The blob was mounted from another repository.
+		p.record(r.URL.Query().Get("mount"))
+	}
+	return resp, nil
+}
+
+func (p *pushedBlobs) pushed(digest string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.digests[digest]
+}
+
+func (p *pushedBlobs) record(digest string) {
+	if digest == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.digests[digest] = true
+}
+
+// blobDigest returns the digest of the blob at urlPath, and false if urlPath
+// isn't the path of a blob.
+func blobDigest(urlPath string) (string, bool) {
+	dir, digest := path.Split(urlPath)
+	if !strings.HasPrefix(urlPath, "/v2/") || !strings.HasSuffix(dir, "/blobs/") {
+		return "", false
+	}
+	return digest, true
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ociSubjectHeader is set by registries supporting the referrers API in
+// response to manifests pushed with a subject.
+const ociSubjectHeader = "OCI-Subject"
+
+// ociDescriptor is a descriptor with the artifactType field of version 1.1 of
+// the OCI image spec, which go-containerregistry doesn't support yet.
+type ociDescriptor struct {
+	MediaType    types.MediaType   `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Size         int64             `json:"size"`
+	Digest       v1.Hash           `json:"digest"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// referrerManifest is an OCI image manifest pointing at the manifest it refers
+// to with its subject.
+type referrerManifest struct {
+	SchemaVersion int64             `json:"schemaVersion"`
+	MediaType     types.MediaType   `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        v1.Descriptor     `json:"config"`
+	Layers        []v1.Descriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	Subject       *ociDescriptor    `json:"subject,omitempty"`
+}
+
+// referrersIndex is the image index the referrers of a manifest are listed in
+// by registries without the referrers API.
+type referrersIndex struct {
+	SchemaVersion int64           `json:"schemaVersion"`
+	MediaType     types.MediaType `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// referrerImage is an image whose manifest refers to subject.
+type referrerImage struct {
+	v1.Image
+	manifest []byte
+}
+
+// newReferrerImage returns image as an OCI artifact of artifactType referring
+// to subject.
+func newReferrerImage(image v1.Image, artifactType string, subject v1.Descriptor) (*referrerImage, error) {
+	m, err := image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	config := m.Config
+	config.MediaType = types.OCIConfigJSON
+	b, err := json.Marshal(referrerManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		ArtifactType:  artifactType,
+		Config:        config,
+		Layers:        m.Layers,
+		Annotations:   m.Annotations,
+		Subject: &ociDescriptor{
+			MediaType: subject.MediaType,
+			Size:      subject.Size,
+			Digest:    subject.Digest,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &referrerImage{Image: image, manifest: b}, nil
+}
+
+func (i *referrerImage) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+func (i *referrerImage) RawManifest() ([]byte, error) {
+	return i.manifest, nil
+}
+
+func (i *referrerImage) Manifest() (*v1.Manifest, error) {
+	return v1.ParseManifest(bytes.NewReader(i.manifest))
+}
+
+func (i *referrerImage) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(i.manifest))
+	return h, err
+}
+
+func (i *referrerImage) Size() (int64, error) {
+	return int64(len(i.manifest)), nil
+}
+
+// subjectRecorder records whether the registry acknowledged the subject of
+// the manifests pushed through it.
+type subjectRecorder struct {
+	rt http.RoundTripper
+
+	mu        sync.Mutex
+	supported bool
+}
+
+func (s *subjectRecorder) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := s.rt.RoundTrip(r)
+	if err == nil && r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") && resp.Header.Get(ociSubjectHeader) != "" {
+		s.mu.Lock()
+		s.supported = true
+		s.mu.Unlock()
+	}
+	return resp, err
+}
+
+// referrersTag returns the tag the referrers of digest are listed at by
+// registries without the referrers API.
+func referrersTag(digest name.Digest) name.Tag {
+	return digest.Context().Tag(strings.Replace(digest.DigestStr(), ":", "-", 1))
+}
+
+// pushReferrer pushes image to the repository of subject as an artifact of
+// artifactType referring to it. If the registry doesn't support the referrers
+// API, the artifact is added to the index at referrersTag(subject) instead, so
+// that clients following the OCI distribution spec can still find it.
+func pushReferrer(image v1.Image, artifactType string, subject name.Digest, desc v1.Descriptor, auth remote.Option, rt http.RoundTripper) error {
+	referrer, err := newReferrerImage(image, artifactType, desc)
+	if err != nil {
+		return err
+	}
+	d, err := referrer.Digest()
+	if err != nil {
+		return err
+	}
+	ref := subject.Context().Digest(d.String())
+	recorder := &subjectRecorder{rt: rt}
+	logrus.Infof("Pushing %s referring to %s to %s", artifactType, subject, ref)
+	if err := remote.Write(ref, referrer, auth, remote.WithTransport(recorder)); err != nil {
+		return errors.Wrapf(err, "pushing referrer to %s", ref)
+	}
+	if recorder.supported {
+		return nil
+	}
+
+	tag := referrersTag(subject)
+	logrus.Infof("%s doesn't support the referrers API, adding %s to %s", subject.RegistryStr(), ref, tag)
+	index := referrersIndex{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	existing, err := remote.Get(tag, auth, remote.WithTransport(rt))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(existing.Manifest, &index); err != nil {
+			return errors.Wrapf(err, "parsing referrers index %s", tag)
+		}
+	case !isNotFound(err):
+		return errors.Wrapf(err, "fetching referrers index %s", tag)
+	}
+	for _, m := range index.Manifests {
+		if m.Digest == d {
+			return nil
+		}
+	}
+	size, err := referrer.Size()
+	if err != nil {
+		return err
+	}
+	index.Manifests = append(index.Manifests, ociDescriptor{
+		MediaType:    types.OCIManifestSchema1,
+		ArtifactType: artifactType,
+		Size:         size,
+		Digest:       d,
+	})
+	if err := remote.Tag(tag, &rawIndex{index: index}, auth, remote.WithTransport(rt)); err != nil {
+		return errors.Wrapf(err, "pushing referrers index to %s", tag)
+	}
+	return nil
+}
+
+// rawIndex is the referrers index to tag.
+type rawIndex struct {
+	index referrersIndex
+}
+
+func (i *rawIndex) RawManifest() ([]byte, error) {
+	return json.Marshal(i.index)
+}
+
+func (i *rawIndex) MediaType() (types.MediaType, error) {
+	return types.OCIImageIndex, nil
+}
+
+// isNotFound returns true if err is a registry response with status 404.
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/commands"
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	image_util "github.com/GoogleContainerTools/kaniko/pkg/image"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// ResolveDockerfile returns the Dockerfile kaniko builds with opts: the base
+// images are pinned to their digest, the ONBUILD triggers of the base images
+// are inserted at the start of the stages built from them, and the ARG and ENV
+// variables are substituted the way they are during the build. Variables are
+// left to the shell in RUN, CMD, ENTRYPOINT and HEALTHCHECK instructions. The
+// values of sensitive build args are masked.
+func ResolveDockerfile(opts *config.KanikoOptions) (string, error) {
+	stages, metaArgs, err := dockerfile.ParseStages(opts)
+	if err != nil {
+		return "", err
+	}
+	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	if err != nil {
+		return "", err
+	}
+	stageNameToIdx := ResolveCrossStageInstructions(kanikoStages)
+
+	var configs []*v1.ConfigFile
+	for i, s := range kanikoStages {
+		var cfg *v1.ConfigFile
+		if s.BaseImageStoredLocally {
+			cfg = configs[s.BaseImageIndex].DeepCopy()
+		} else {
+			image := empty.Image
+			if s.BaseName != constants.NoBaseImage {
+				image, err = image_util.RetrieveSourceImage(s, opts)
+				if err != nil {
+					return "", BaseImagePullErr{Image: s.BaseName, Err: err}
+				}
+				if s.BaseName, err = pinnedBaseName(s.BaseName, image); err != nil {
+					return "", err
+				}
+			}
+			if cfg, err = initializeConfig(image, opts); err != nil {
+				return "", err
+			}
+		}
+
+		cmds, err := dockerfile.GetOnBuildInstructions(&cfg.Config, stageNameToIdx)
+		if err != nil {
+			return "", err
+		}
+		s.Commands = append(cmds, s.Commands...)
+		// Triggers only fire once, stages built from this one only see its own ONBUILD instructions.
+		cfg.Config.OnBuild = nil
+
+		ba := dockerfile.NewBuildArgs(opts.BuildArgs)
+		ba.AddMetaArgs(s.MetaArgs)
+		for _, c := range s.Commands {
+			if err := substituteVariables(c, &cfg.Config, ba); err != nil {
+				return "", err
+			}
+		}
+		configs = append(configs, cfg)
+		kanikoStages[i] = s
+	}
+	sensitive := dockerfile.SensitiveBuildArgs(opts.BuildArgs, opts.SecretBuildArgs)
+	return dockerfile.MaskSensitiveValues(dockerfile.Render(kanikoStages), sensitive), nil
+}
+
+// substituteVariables substitutes the variables in the arguments of cmd, and
+// updates cfg and ba with the variables it sets.
+func substituteVariables(cmd instructions.Command, cfg *v1.Config, ba *dockerfile.BuildArgs) error {
+	replacementEnvs := ba.ReplacementEnvs(cfg.Env)
+	switch c := cmd.(type) {
+	case *instructions.ArgCommand:
+		key, value, err := commands.ParseArg(c.Key, c.Value, cfg.Env, ba)
+		if err != nil {
+			return err
+		}
+		ba.AddArg(key, value)
+		c.Key, c.Value = key, value
+		return nil
+	case *instructions.EnvCommand:
+		if err := util.UpdateConfigEnv(c.Env, cfg, replacementEnvs); err != nil {
+			return err
+		}
+	case *instructions.OnbuildCommand:
+		cfg.OnBuild = append(cfg.OnBuild, c.Expression)
+	}
+	if e, ok := cmd.(instructions.SupportsSingleWordExpansion); ok {
+		return e.Expand(func(word string) (string, error) {
+			return util.ResolveEnvironmentReplacement(word, replacementEnvs, false)
+		})
+	}
+	return nil
+}
+
+// pinnedBaseName returns baseName pinned to the digest of image.
+func pinnedBaseName(baseName string, image v1.Image) (string, error) {
+	ref, err := name.ParseReference(baseName, name.WeakValidation)
+	if err != nil {
+		return "", err
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		return "", err
+	}
+	return ref.Context().Digest(digest.String()).String(), nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	image_util "github.com/GoogleContainerTools/kaniko/pkg/image"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestResolveDockerfile(t *testing.T) {
+	base, err := random.Image(1024, 1)
+	testutil.CheckNoError(t, err)
+	base, err = mutate.Config(base, v1.Config{
+		Env:     []string{"PATH=/bin"},
+		OnBuild: []string{"COPY trigger.txt $PATH/"},
+	})
+	testutil.CheckNoError(t, err)
+	digest, err := base.Digest()
+	testutil.CheckNoError(t, err)
+	original := image_util.RetrieveRemoteImage
+	image_util.RetrieveRemoteImage = func(string, config.RegistryOptions, string) (v1.Image, error) {
+		return base, nil
+	}
+	defer func() { image_util.RetrieveRemoteImage = original }()
+
+	dir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+	dockerfilePath := filepath.Join(dir, "Dockerfile")
+	dockerfile := `ARG BASE=gcr.io/foo/base
+ARG VERSION=1.0
+FROM $BASE AS builder
+ARG VERSION
+ENV APP=/app/$VERSION
+LABEL description="app $VERSION"
+WORKDIR $APP
+RUN echo $VERSION
+ONBUILD COPY . $APP
+
+FROM builder
+COPY --from=builder $APP /out
+`
+	testutil.CheckNoError(t, ioutil.WriteFile(dockerfilePath, []byte(dockerfile), 0644))
+
+	resolved, err := ResolveDockerfile(&config.KanikoOptions{
+		DockerfilePath: dockerfilePath,
+		BuildArgs:      []string{"VERSION=2.0"},
+	})
+	testutil.CheckNoError(t, err)
+	expected := `FROM gcr.io/foo/base@` + digest.String() + ` AS builder
+COPY trigger.txt /bin/
+ARG VERSION=2.0
+ENV APP=/app/2.0
+LABEL description="app 2.0"
+WORKDIR /app/2.0
+RUN echo $VERSION
+ONBUILD COPY . $APP
+
+FROM builder
+COPY . /app/2.0
+COPY --from=0 /app/2.0 /out
+`
+	testutil.CheckDeepEqual(t, expected, resolved)
+}
@@ -19,8 +19,10 @@ package filesystem
 import (
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -31,8 +33,8 @@ import (
 // File paths are resolved according to the following rules:
 // * If path is in ignorelist, skip it.
 // * If path is a symlink, resolve it's ancestor link and add it to the output set.
-// * If path is a symlink, resolve it's target. If the target is not ignored add it to the
-// output set.
+// * If path is a symlink, resolve it's target. If the target is not ignored, is in the root
+// directory and isn't part of a symlink cycle add it to the output set.
 // * Add all ancestors of each path to the output set.
 func ResolvePaths(paths []string, wl []util.IgnoreListEntry) (pathsToAdd []string, err error) {
 	logrus.Tracef("Resolving paths %s", paths)
@@ -67,14 +69,22 @@ func ResolvePaths(paths []string, wl []util.IgnoreListEntry) (pathsToAdd []strin
 		evaled, e = filepath.EvalSymlinks(f)
 		if e != nil {
 			if !os.IsNotExist(e) {
-				logrus.Errorf("couldn't eval %s with link %s", f, link)
-				return
+				// Symlink cycles, such as a link to itself, can't be resolved.
+				logging.Warnf("couldn't eval %s with link %s, only adding the link: %s", f, link, e)
+				continue
 			}
 
 			logrus.Debugf("symlink path %s, target does not exist", f)
 			continue
 		}
 
+		// Symlinks pointing out of the root directory aren't followed, as
+		// their targets aren't part of the filesystem being snapshotted.
+		if !isInRoot(evaled) {
+			logrus.Debugf("path %s points to %s, out of the root directory, ignoring it", f, evaled)
+			continue
+		}
+
 		// If the given path is a symlink and the target is part of the ignorelist
 		// ignore the target
 		if util.IsInProvidedIgnoreList(evaled, wl) {
@@ -93,6 +103,13 @@ func ResolvePaths(paths []string, wl []util.IgnoreListEntry) (pathsToAdd []strin
 	return
 }
 
+// isInRoot returns whether path is the root directory or below it.
+func isInRoot(path string) bool {
+	root := filepath.Clean(config.RootDir)
+	path = filepath.Clean(path)
+	return root == "/" || path == root || strings.HasPrefix(path, root+"/")
+}
+
 // filesWithParentDirs returns every ancestor path for each provided file path.
 // I.E. /foo/bar/baz/boom.txt => [/, /foo, /foo/bar, /foo/bar/baz, /foo/bar/baz/boom.txt]
 func filesWithParentDirs(files []string) []string {
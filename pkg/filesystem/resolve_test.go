@@ -25,6 +25,7 @@ import (
 	"sort"
 	"testing"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 )
 
@@ -398,3 +399,61 @@ func Test_resolveSymlinkAncestor(t *testing.T) {
 		}
 	})
 }
+
+func Test_ResolvePaths_SymlinkCycles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := config.RootDir
+	config.RootDir = dir
+	defer func() { config.RootDir = original }()
+
+	if err := os.MkdirAll(filepath.Join(dir, "a"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "file"), []byte{}, 0777); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"self":    "self",
+		"loop1":   "loop2",
+		"loop2":   "loop1",
+		"a/up":    "..",
+		"a/out":   "/",
+		"a/alias": "file",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inputFiles := []string{}
+	for link := range links {
+		inputFiles = append(inputFiles, filepath.Join(dir, link))
+	}
+	// The files after a symlink cycle are still resolved.
+	inputFiles = append(inputFiles, filepath.Join(dir, "a", "file"))
+	files, err := ResolvePaths(inputFiles, []util.IgnoreListEntry{})
+	if err != nil {
+		t.Fatalf("expected err to be nil but was %s", err)
+	}
+
+	// The targets of the symlinks that are in the root directory are added,
+	// and the symlinks themselves.
+	expectedFiles := []string{dir, filepath.Join(dir, "a"), filepath.Join(dir, "a", "file")}
+	for link := range links {
+		expectedFiles = append(expectedFiles, filepath.Join(dir, link))
+	}
+	sort.Strings(files)
+	sort.Strings(expectedFiles)
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("expected files to equal %s but was %s", expectedFiles, files)
+	}
+}
@@ -86,11 +86,19 @@ func RetrieveSourceImage(stage config.KanikoStage, opts *config.KanikoOptions) (
 	}
 
 	// Otherwise, initialize image as usual
-	return RetrieveRemoteImage(currentBaseName, opts.RegistryOptions, opts.CustomPlatform)
+	img, err := RetrieveRemoteImage(currentBaseName, opts.RegistryOptions, opts.CustomPlatform)
+	if err != nil || img == nil {
+		return img, err
+	}
+	// Read the layers that were cached by the warmer from the local cache
+	if opts.Cache && opts.CacheDir != "" {
+		return cache.CachedLayers(&opts.CacheOptions, img)
+	}
+	return img, nil
 }
 
 func tarballImage(index int) (v1.Image, error) {
-	tarPath := filepath.Join(constants.KanikoIntermediateStagesDir, strconv.Itoa(index))
+	tarPath := filepath.Join(config.KanikoDir, constants.KanikoIntermediateStagesDir, strconv.Itoa(index))
 	logrus.Infof("Base image from previous stage %d found, using saved tar at path %s", index, tarPath)
 	return tarball.ImageFromPath(tarPath, nil)
 }
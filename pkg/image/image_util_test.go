@@ -18,13 +18,20 @@ package image
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/testutil"
 )
@@ -123,3 +130,115 @@ func parse(s string) ([]instructions.Stage, error) {
 	}
 	return stages, err
 }
+
+// unreachableLayersImage is an image whose layers can't be downloaded.
+type unreachableLayersImage struct {
+	v1.Image
+}
+
+func (i unreachableLayersImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for j, l := range layers {
+		layers[j] = unreachableLayer{l}
+	}
+	return layers, nil
+}
+
+type unreachableLayer struct {
+	v1.Layer
+}
+
+func (unreachableLayer) Compressed() (io.ReadCloser, error) {
+	return nil, errors.New("layer can't be downloaded")
+}
+
+func (unreachableLayer) Uncompressed() (io.ReadCloser, error) {
+	return nil, errors.New("layer can't be downloaded")
+}
+
+func Test_WarmedLayers(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	// Warm the layers of the image, without the image itself.
+	cw := &cache.Warmer{
+		Remote: func(string, config.RegistryOptions, string) (v1.Image, error) {
+			return img, nil
+		},
+		Local: func(*config.CacheOptions, string) (v1.Image, error) {
+			return nil, cache.NotFoundErr{}
+		},
+		TarWriter:      ioutil.Discard,
+		ManifestWriter: ioutil.Discard,
+	}
+	warmerOpts := &config.WarmerOptions{
+		CacheOptions: config.CacheOptions{CacheDir: cacheDir, CacheTTL: time.Hour},
+		CacheLayers:  true,
+	}
+	_, err = cw.Warm("gcr.io/foo/bar:latest", warmerOpts)
+	testutil.CheckNoError(t, err)
+
+	original := RetrieveRemoteImage
+	defer func() {
+		RetrieveRemoteImage = original
+	}()
+	RetrieveRemoteImage = func(string, config.RegistryOptions, string) (v1.Image, error) {
+		return unreachableLayersImage{img}, nil
+	}
+	stages, err := parse("FROM gcr.io/foo/bar@" + digest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := RetrieveSourceImage(config.KanikoStage{Stage: stages[0]}, &config.KanikoOptions{
+		Cache:        true,
+		CacheOptions: config.CacheOptions{CacheDir: cacheDir, CacheTTL: time.Hour},
+	})
+	testutil.CheckNoError(t, err)
+
+	expectedLayers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := actual.Layers()
+	testutil.CheckErrorAndDeepEqual(t, false, err, len(expectedLayers), len(layers))
+	for i, l := range layers {
+		rc, err := l.Uncompressed()
+		if err != nil {
+			t.Fatalf("expected layer %d to be read from the cache: %v", i, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		testutil.CheckNoError(t, err)
+		expected := readUncompressed(t, expectedLayers[i])
+		if !bytes.Equal(expected, got) {
+			t.Errorf("expected cached layer %d to have the contents of the image layer", i)
+		}
+	}
+}
+
+func readUncompressed(t *testing.T, l v1.Layer) []byte {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
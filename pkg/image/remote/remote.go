@@ -17,11 +17,13 @@ limitations under the License.
 package remote
 
 import (
+	"fmt"
 	"runtime"
 	"strings"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/creds"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 
 	"github.com/google/go-containerregistry/pkg/name"
@@ -33,6 +35,8 @@ import (
 
 var (
 	manifestCache = make(map[string]v1.Image)
+	// for testing
+	retryDelayMilliseconds = 1000
 )
 
 // RetrieveRemoteImage retrieves the manifest for the specified image from the specified registry
@@ -45,6 +49,11 @@ func RetrieveRemoteImage(image string, opts config.RegistryOptions, customPlatfo
 		return cachedRemoteImage, nil
 	}
 
+	platform, err := currentPlatform(customPlatform)
+	if err != nil {
+		return nil, err
+	}
+
 	ref, err := name.ParseReference(image, name.WeakValidation)
 	if err != nil {
 		return nil, err
@@ -69,9 +78,9 @@ func RetrieveRemoteImage(image string, opts config.RegistryOptions, customPlatfo
 			ref := setNewRegistry(ref, newReg)
 
 			logrus.Infof("Retrieving image %s from registry mirror %s", ref, registryMirror)
-			remoteImage, err := remote.Image(ref, remoteOptions(registryMirror, opts, customPlatform)...)
+			remoteImage, err := retrieveImage(ref, opts.ImageDownloadRetry, remoteOptions(registryMirror, opts, platform)...)
 			if err != nil {
-				logrus.Warnf("Failed to retrieve image %s from registry mirror %s: %s. Will try with the next mirror, or fallback to the default registry.", ref, registryMirror, err)
+				logging.Warnf("Failed to retrieve image %s from registry mirror %s: %s. Will try with the next mirror, or fallback to the default registry.", ref, registryMirror, err)
 				continue
 			}
 
@@ -92,7 +101,7 @@ func RetrieveRemoteImage(image string, opts config.RegistryOptions, customPlatfo
 
 	logrus.Infof("Retrieving image %s from registry %s", ref, registryName)
 
-	remoteImage, err := remote.Image(ref, remoteOptions(registryName, opts, customPlatform)...)
+	remoteImage, err := retrieveImage(ref, opts.ImageDownloadRetry, remoteOptions(registryName, opts, platform)...)
 
 	if remoteImage != nil {
 		manifestCache[image] = remoteImage
@@ -101,6 +110,17 @@ func RetrieveRemoteImage(image string, opts config.RegistryOptions, customPlatfo
 	return remoteImage, err
 }
 
+// retrieveImage retrieves the image at ref, retrying transient errors up to retryCount times.
+func retrieveImage(ref name.Reference, retryCount int, options ...remote.Option) (v1.Image, error) {
+	var img v1.Image
+	err := util.RetryIf(func() error {
+		var err error
+		img, err = remote.Image(ref, options...)
+		return err
+	}, retryCount, retryDelayMilliseconds, util.IsTransientError)
+	return img, err
+}
+
 // normalizeReference adds the library/ prefix to images without it.
 //
 // It is mostly useful when using a registry mirror that is not able to perform
@@ -126,25 +146,44 @@ func setNewRegistry(ref name.Reference, newReg name.Registry) name.Reference {
 	}
 }
 
-func remoteOptions(registryName string, opts config.RegistryOptions, customPlatform string) []remote.Option {
+func remoteOptions(registryName string, opts config.RegistryOptions, platform v1.Platform) []remote.Option {
+	// Pulls skip TLS verification only when requested for pulls, not for pushes.
+	opts.SkipTLSVerify = opts.SkipTLSVerifyPull
 	tr := util.MakeTransport(opts, registryName)
 
-	// on which v1.Platform is this currently running?
-	platform := currentPlatform(customPlatform)
-
 	return []remote.Option{remote.WithTransport(tr), remote.WithAuthFromKeychain(creds.GetKeychain()), remote.WithPlatform(platform)}
 }
 
-// CurrentPlatform returns the v1.Platform on which the code runs
-func currentPlatform(customPlatform string) v1.Platform {
+// currentPlatform returns the v1.Platform to pull images for, which is the
+// custom platform if one is set, or else the platform the code runs on
+func currentPlatform(customPlatform string) (v1.Platform, error) {
 	if customPlatform != "" {
-		return v1.Platform{
-			OS:           strings.Split(customPlatform, "/")[0],
-			Architecture: strings.Split(customPlatform, "/")[1],
-		}
+		return ParsePlatform(customPlatform)
 	}
 	return v1.Platform{
 		OS:           runtime.GOOS,
 		Architecture: runtime.GOARCH,
+	}, nil
+}
+
+// ParsePlatform parses a platform in the form os/arch or os/arch/variant,
+// such as linux/arm64 or linux/arm/v7
+func ParsePlatform(platform string) (v1.Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return v1.Platform{}, fmt.Errorf("invalid platform %q, expected os/arch or os/arch/variant", platform)
+	}
+	for _, p := range parts {
+		if p == "" {
+			return v1.Platform{}, fmt.Errorf("invalid platform %q, expected os/arch or os/arch/variant", platform)
+		}
+	}
+	p := v1.Platform{
+		OS:           parts[0],
+		Architecture: parts[1],
+	}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
 	}
+	return p, nil
 }
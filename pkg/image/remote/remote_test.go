@@ -17,11 +17,18 @@ limitations under the License.
 package remote
 
 import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/testutil"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
@@ -108,3 +115,247 @@ func Test_RetrieveRemoteImage_manifestCache(t *testing.T) {
 		t.Fatal("Expected call to succeed because there is a manifest for this image in the cache.")
 	}
 }
+
+func Test_ParsePlatform(t *testing.T) {
+	tests := []struct {
+		platform  string
+		expected  v1.Platform
+		shouldErr bool
+	}{
+		{platform: "linux/amd64", expected: v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{platform: "linux/arm/v7", expected: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{platform: "linux", shouldErr: true},
+		{platform: "linux/", shouldErr: true},
+		{platform: "linux/arm/v7/extra", shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.platform, func(t *testing.T) {
+			platform, err := ParsePlatform(test.platform)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, platform)
+		})
+	}
+}
+
+func Test_RetrieveRemoteImage_CustomPlatform(t *testing.T) {
+	platforms := []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+	}
+	// Serve a manifest list with one image per platform.
+	manifests := map[string][]byte{}
+	digests := []v1.Hash{}
+	index := v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	for i := range platforms {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := img.RawManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, err := img.MediaType()
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests[digest.String()] = raw
+		digests = append(digests, digest)
+		index.Manifests = append(index.Manifests, v1.Descriptor{
+			MediaType: mediaType,
+			Size:      int64(len(raw)),
+			Digest:    digest,
+			Platform:  &platforms[i],
+		})
+	}
+	rawIndex, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ref := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case ref == "latest":
+			w.Header().Set("Content-Type", string(types.OCIImageIndex))
+			w.Write(rawIndex)
+		case manifests[ref] != nil:
+			w.Header().Set("Content-Type", string(types.DockerManifestSchema2))
+			w.Write(manifests[ref])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"
+
+	tests := []struct {
+		platform  string
+		expected  v1.Hash
+		shouldErr bool
+	}{
+		{platform: "linux/arm64/v8", expected: digests[1]},
+		{platform: "linux/arm/v7", expected: digests[2]},
+		{platform: "linux/amd64", expected: digests[0]},
+		{platform: "linux/s390x", shouldErr: true},
+		{platform: "linux/arm/v6", shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.platform, func(t *testing.T) {
+			defer delete(manifestCache, image)
+			img, err := RetrieveRemoteImage(image, config.RegistryOptions{InsecurePull: true}, test.platform)
+			if test.shouldErr {
+				testutil.CheckError(t, true, err)
+				return
+			}
+			testutil.CheckNoError(t, err)
+			digest, err := img.Digest()
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expected, digest)
+		})
+	}
+}
+
+func Test_RetrieveRemoteImage_Retry(t *testing.T) {
+	original := retryDelayMilliseconds
+	defer func() { retryDelayMilliseconds = original }()
+	retryDelayMilliseconds = 1
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description      string
+		failures         int
+		status           int
+		retries          int
+		expectedRequests int
+		shouldErr        bool
+	}{
+		{
+			description:      "succeeds after server errors",
+			failures:         2,
+			status:           http.StatusServiceUnavailable,
+			retries:          2,
+			expectedRequests: 3,
+		},
+		{
+			description:      "succeeds after too many requests",
+			failures:         1,
+			status:           http.StatusTooManyRequests,
+			retries:          1,
+			expectedRequests: 2,
+		},
+		{
+			description:      "gives up after retries",
+			failures:         3,
+			status:           http.StatusServiceUnavailable,
+			retries:          2,
+			expectedRequests: 3,
+			shouldErr:        true,
+		},
+		{
+			description:      "doesn't retry client errors",
+			failures:         1,
+			status:           http.StatusNotFound,
+			retries:          3,
+			expectedRequests: 1,
+			shouldErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/" {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				requests++
+				if requests <= test.failures {
+					w.WriteHeader(test.status)
+					return
+				}
+				w.Header().Set("Content-Type", string(types.DockerManifestSchema2))
+				w.Write(raw)
+			}))
+			defer server.Close()
+			image := strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"
+			defer delete(manifestCache, image)
+
+			_, err := RetrieveRemoteImage(image, config.RegistryOptions{InsecurePull: true, ImageDownloadRetry: test.retries}, "")
+			testutil.CheckError(t, test.shouldErr, err)
+			testutil.CheckDeepEqual(t, test.expectedRequests, requests)
+		})
+	}
+}
+
+func Test_RetrieveRemoteImage_SkipTLSVerifyPull(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Type", string(types.DockerManifestSchema2))
+		w.Write(raw)
+	}))
+	// Registries on 127.0.0.1 are accessed over plain HTTP, so listen on
+	// another loopback address to be accessed over HTTPS.
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("can't listen on 127.0.0.2: %v", err)
+	}
+	server.Listener = l
+	server.StartTLS()
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "https://") + "/test/image:latest"
+
+	tests := []struct {
+		description string
+		opts        config.RegistryOptions
+		shouldErr   bool
+	}{
+		{
+			description: "skip TLS verify for pulls",
+			opts:        config.RegistryOptions{SkipTLSVerifyPull: true},
+		},
+		{
+			description: "skip TLS verify for the registry",
+			opts:        config.RegistryOptions{SkipTLSVerifyRegistries: []string{l.Addr().String()}},
+		},
+		{
+			description: "skip TLS verify for pushes",
+			opts:        config.RegistryOptions{SkipTLSVerify: true},
+			shouldErr:   true,
+		},
+		{
+			description: "verify TLS",
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			defer delete(manifestCache, image)
+			_, err := RetrieveRemoteImage(image, test.opts, "")
+			testutil.CheckError(t, test.shouldErr, err)
+		})
+	}
+}
@@ -18,6 +18,8 @@ package logging
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -66,3 +68,48 @@ func Configure(level, format string, logTimestamp bool) error {
 
 	return nil
 }
+
+// MaskValues replaces values with **** in the logs. It must be called after
+// Configure, as it wraps the formatter set by Configure.
+func MaskValues(values []string) {
+	var oldnew []string
+	sorted := append([]string{}, values...)
+	// Longer values come first, in case they contain shorter ones.
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, v := range sorted {
+		if v != "" {
+			oldnew = append(oldnew, v, "****")
+		}
+	}
+	if len(oldnew) == 0 {
+		return
+	}
+	logrus.SetFormatter(&maskingFormatter{
+		Formatter: logrus.StandardLogger().Formatter,
+		replacer:  strings.NewReplacer(oldnew...),
+	})
+}
+
+// maskingFormatter masks values in the message and the fields of log entries
+// before formatting them.
+type maskingFormatter struct {
+	logrus.Formatter
+	replacer *strings.Replacer
+}
+
+func (f *maskingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	masked := *entry
+	masked.Message = f.replacer.Replace(entry.Message)
+	masked.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			masked.Data[k] = f.replacer.Replace(v)
+		case error:
+			masked.Data[k] = f.replacer.Replace(v.Error())
+		default:
+			masked.Data[k] = v
+		}
+	}
+	return f.Formatter.Format(&masked)
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMaskValues(t *testing.T) {
+	for _, format := range []string{FormatText, FormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			out, formatter := logrus.StandardLogger().Out, logrus.StandardLogger().Formatter
+			defer func() {
+				logrus.SetOutput(out)
+				logrus.SetFormatter(formatter)
+			}()
+			if err := Configure("info", format, false); err != nil {
+				t.Fatal(err)
+			}
+			logrus.SetOutput(&buf)
+			MaskValues([]string{"s3cr3t", ""})
+
+			logrus.WithField("arg", "TOKEN=s3cr3t").WithError(errors.New("bad s3cr3t")).Info("running echo s3cr3t")
+			if strings.Contains(buf.String(), "s3cr3t") {
+				t.Errorf("expected the logs not to contain the value, got %s", buf.String())
+			}
+			if !strings.Contains(buf.String(), "running echo ****") {
+				t.Errorf("expected the value to be masked, got %s", buf.String())
+			}
+		})
+	}
+}
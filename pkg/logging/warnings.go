@@ -0,0 +1,76 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var warnings = &collector{}
+
+// collector keeps the warnings logged with Warnf.
+type collector struct {
+	mu       sync.Mutex
+	strict   bool
+	warnings []string
+}
+
+// SetStrict sets whether the warnings logged with Warnf fail the build, and
+// forgets the ones logged so far.
+func SetStrict(strict bool) {
+	warnings.mu.Lock()
+	defer warnings.mu.Unlock()
+	warnings.strict = strict
+	warnings.warnings = nil
+}
+
+// Warnf logs a warning about the build, such as a likely mistake in the
+// Dockerfile or in the flags. In strict mode, the warning also fails the build
+// once it's done, see Warnings.
+func Warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logrus.Warn(msg)
+	warnings.mu.Lock()
+	defer warnings.mu.Unlock()
+	warnings.warnings = append(warnings.warnings, msg)
+}
+
+// Warnings returns an error listing the warnings logged with Warnf in strict
+// mode, or nil if there were none.
+func Warnings() error {
+	warnings.mu.Lock()
+	defer warnings.mu.Unlock()
+	if !warnings.strict || len(warnings.warnings) == 0 {
+		return nil
+	}
+	return fmt.Errorf("the build had warnings, which fail it with --strict:\n%s", strings.Join(warnings.warnings, "\n"))
+}
+
+// LogSummary logs the warnings logged with Warnf so far again, so that they
+// aren't lost among the output of the build and of the push.
+func LogSummary() {
+	warnings.mu.Lock()
+	defer warnings.mu.Unlock()
+	if len(warnings.warnings) == 0 {
+		return
+	}
+	logrus.Warnf("kaniko had %d warnings:\n%s", len(warnings.warnings), strings.Join(warnings.warnings, "\n"))
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func TestWarnings(t *testing.T) {
+	tests := []struct {
+		description string
+		strict      bool
+		expected    string
+	}{
+		{
+			description: "warnings are only logged",
+		},
+		{
+			description: "warnings are collected with --strict",
+			strict:      true,
+			expected:    "the build had warnings, which fail it with --strict:\nfirst 1\nsecond 2",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var buf bytes.Buffer
+			logrus.SetOutput(&buf)
+			defer logrus.SetOutput(os.Stderr)
+			SetStrict(test.strict)
+			defer SetStrict(false)
+
+			Warnf("first %d", 1)
+			Warnf("second %d", 2)
+			err := Warnings()
+			if test.strict {
+				testutil.CheckErrorAndDeepEqual(t, true, err, test.expected, fmt.Sprint(err))
+			} else {
+				testutil.CheckNoError(t, err)
+			}
+			if !strings.Contains(buf.String(), "first 1") || !strings.Contains(buf.String(), "second 2") {
+				t.Errorf("expected the warnings to be logged, got %q", buf.String())
+			}
+		})
+	}
+}
+
+func TestLogSummary(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+	SetStrict(false)
+
+	LogSummary()
+	testutil.CheckDeepEqual(t, "", buf.String())
+
+	Warnf("first %d", 1)
+	Warnf("second %d", 2)
+	buf.Reset()
+	LogSummary()
+	if !strings.Contains(buf.String(), `kaniko had 2 warnings:\nfirst 1\nsecond 2`) {
+		t.Errorf("expected the warnings to be listed, got %q", buf.String())
+	}
+	SetStrict(false)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const namespace = "kaniko"
+
+// Registry holds every kaniko metric. It is kept separate from the prometheus
+// default registry so only kaniko metrics are exposed.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// BuildsTotal counts the builds kaniko has run, by result.
+	BuildsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "builds_total",
+		Help:      "Number of builds run, partitioned by result.",
+	}, []string{"result"})
+
+	// BuildDuration observes how long builds take.
+	BuildDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "build_duration_seconds",
+		Help:      "Duration of builds in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	// CacheHits counts layers and images found in the cache.
+	CacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hits_total",
+		Help:      "Number of cache lookups that found a cached layer or image.",
+	})
+
+	// CacheMisses counts layers and images missing from the cache.
+	CacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_misses_total",
+		Help:      "Number of cache lookups that did not find a cached layer or image.",
+	})
+
+	// BytesPushed counts the compressed layer bytes of pushed images.
+	BytesPushed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pushed_bytes_total",
+		Help:      "Compressed layer bytes of images pushed to registries.",
+	})
+
+	// BytesPulled counts the compressed layer bytes of pulled images.
+	BytesPulled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pulled_bytes_total",
+		Help:      "Compressed layer bytes of images pulled from registries or the cache.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(BuildsTotal, BuildDuration, CacheHits, CacheMisses, BytesPushed, BytesPulled)
+}
+
+// ObserveBuild records a finished build that started at start.
+func ObserveBuild(start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	BuildsTotal.WithLabelValues(result).Inc()
+	BuildDuration.Observe(time.Since(start).Seconds())
+}
+
+// AddImageBytes adds the compressed size of every layer in img to c.
+func AddImageBytes(c prometheus.Counter, img v1.Image) {
+	layers, err := img.Layers()
+	if err != nil {
+		logrus.Debugf("Unable to get layers for metrics: %s", err)
+		return
+	}
+	for _, l := range layers {
+		size, err := l.Size()
+		if err != nil {
+			logrus.Debugf("Unable to get layer size for metrics: %s", err)
+			continue
+		}
+		c.Add(float64(size))
+	}
+}
+
+// Handler returns an http.Handler exposing the kaniko metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Listen serves the kaniko metrics at /metrics on addr in the background.
+// The returned listener can be closed to stop serving.
+func Listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			logrus.Debugf("Metrics server stopped: %s", err)
+		}
+	}()
+	logrus.Infof("Serving metrics on %s/metrics", l.Addr())
+	return l, nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestListen(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	testutil.CheckNoError(t, err)
+	defer l.Close()
+
+	// Simulate a build that misses the cache once, hits it once and pushes an image.
+	img, err := random.Image(1024, 2)
+	testutil.CheckNoError(t, err)
+	CacheMisses.Inc()
+	CacheHits.Inc()
+	AddImageBytes(BytesPulled, img)
+	AddImageBytes(BytesPushed, img)
+	ObserveBuild(time.Now().Add(-3*time.Second), nil)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	testutil.CheckNoError(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	testutil.CheckNoError(t, err)
+	body := string(b)
+
+	for _, metric := range []string{
+		`kaniko_builds_total{result="success"} 1`,
+		"kaniko_build_duration_seconds_count 1",
+		"kaniko_cache_hits_total 1",
+		"kaniko_cache_misses_total 1",
+		"kaniko_pushed_bytes_total ",
+		"kaniko_pulled_bytes_total ",
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", metric, body)
+		}
+	}
+	if strings.Contains(body, "kaniko_pushed_bytes_total 0\n") {
+		t.Errorf("expected pushed bytes to be counted, got:\n%s", body)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package signing creates signatures of pushed images in the format used by
+// cosign, so they can be verified with `cosign verify`. Images are signed with
+// a key only, with the standard library: keyless signing, with a certificate
+// from the sigstore Fulcio CA, would need the sigstore libraries and isn't
+// supported.
+package signing
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SignatureAnnotation holds the base64 encoded signature of the payload layer.
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// PayloadMediaType is the media type of the payload layer.
+	PayloadMediaType types.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// ArtifactType is the artifact type of signatures attached as OCI referrers.
+	ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+)
+
+// Signer signs payloads.
+type Signer interface {
+	// Sign returns the signature of payload.
+	Sign(payload []byte) ([]byte, error)
+}
+
+// keySigner signs payloads with an ECDSA private key.
+type keySigner struct {
+	key *ecdsa.PrivateKey
+}
+
+// NewKeySigner returns a Signer using the unencrypted PEM encoded ECDSA
+// private key at path.
+func NewKeySigner(path string) (Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading signing key")
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.Errorf("%s doesn't contain a PEM encoded key", path)
+	}
+	if strings.Contains(block.Type, "ENCRYPTED") {
+		return nil, errors.Errorf("%s is encrypted, only unencrypted keys are supported", path)
+	}
+	var key interface{}
+	if block.Type == "EC PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing signing key %s", path)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("%s is not an ECDSA private key", path)
+	}
+	return &keySigner{key: ecKey}, nil
+}
+
+// Sign returns the ASN.1 encoded ECDSA signature of the SHA-256 hash of payload.
+func (s *keySigner) Sign(payload []byte) ([]byte, error) {
+	h := sha256.Sum256(payload)
+	r, ss, err := ecdsa.Sign(rand.Reader, s.key, h[:])
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct{ R, S *big.Int }{r, ss})
+}
+
+// SignatureTag returns the tag the signature of digest is pushed to.
+func SignatureTag(digest name.Digest) name.Tag {
+	return digest.Context().Tag(strings.Replace(digest.DigestStr(), ":", "-", 1) + ".sig")
+}
+
+// Payload returns the payload signed for digest, which identifies the image.
+func Payload(digest name.Digest) ([]byte, error) {
+	type critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	}
+	var payload struct {
+		Critical critical          `json:"critical"`
+		Optional map[string]string `json:"optional"`
+	}
+	payload.Critical.Identity.DockerReference = digest.Context().Name()
+	payload.Critical.Image.DockerManifestDigest = digest.DigestStr()
+	payload.Critical.Type = "cosign container image signature"
+	return json.Marshal(payload)
+}
+
+// SignatureImage signs digest with signer and returns the image to push to
+// SignatureTag(digest): base, which holds the signatures already pushed there,
+// with the payload appended as a layer annotated with the signature. base is
+// empty.Image for the first signature.
+func SignatureImage(base v1.Image, digest name.Digest, signer Signer) (v1.Image, error) {
+	payload, err := Payload(digest)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signer.Sign(payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "signing %s", digest)
+	}
+	return mutate.Append(base, mutate.Addendum{
+		Layer: &payloadLayer{payload: payload},
+		Annotations: map[string]string{
+			SignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+		},
+		MediaType: PayloadMediaType,
+	})
+}
+
+// payloadLayer is a layer whose contents are the payload, which isn't compressed.
+type payloadLayer struct {
+	payload []byte
+}
+
+func (l *payloadLayer) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(l.payload))
+	return h, err
+}
+
+func (l *payloadLayer) DiffID() (v1.Hash, error) {
+	return l.Digest()
+}
+
+func (l *payloadLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.payload)), nil
+}
+
+func (l *payloadLayer) Uncompressed() (io.ReadCloser, error) {
+	return l.Compressed()
+}
+
+func (l *payloadLayer) Size() (int64, error) {
+	return int64(len(l.payload)), nil
+}
+
+func (l *payloadLayer) MediaType() (types.MediaType, error) {
+	return PayloadMediaType, nil
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+)
+
+const testDigest = "gcr.io/foo/bar@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+type fakeSigner struct{}
+
+func (fakeSigner) Sign(payload []byte) ([]byte, error) {
+	return []byte("signature"), nil
+}
+
+func TestSignatureImage(t *testing.T) {
+	digest, err := name.NewDigest(testDigest)
+	testutil.CheckNoError(t, err)
+
+	testutil.CheckDeepEqual(t, "gcr.io/foo/bar:sha256-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.sig", SignatureTag(digest).String())
+
+	img, err := SignatureImage(empty.Image, digest, fakeSigner{})
+	testutil.CheckNoError(t, err)
+	m, err := img.Manifest()
+	testutil.CheckNoError(t, err)
+	if len(m.Layers) != 1 {
+		t.Fatalf("expected a single payload layer, got %d", len(m.Layers))
+	}
+	testutil.CheckDeepEqual(t, PayloadMediaType, m.Layers[0].MediaType)
+	testutil.CheckDeepEqual(t, base64.StdEncoding.EncodeToString([]byte("signature")), m.Layers[0].Annotations[SignatureAnnotation])
+
+	layers, err := img.Layers()
+	testutil.CheckNoError(t, err)
+	rc, err := layers[0].Uncompressed()
+	testutil.CheckNoError(t, err)
+	defer rc.Close()
+	var payload struct {
+		Critical struct {
+			Identity struct {
+				DockerReference string `json:"docker-reference"`
+			} `json:"identity"`
+			Image struct {
+				DockerManifestDigest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+			Type string `json:"type"`
+		} `json:"critical"`
+	}
+	testutil.CheckNoError(t, json.NewDecoder(rc).Decode(&payload))
+	testutil.CheckDeepEqual(t, "gcr.io/foo/bar", payload.Critical.Identity.DockerReference)
+	testutil.CheckDeepEqual(t, digest.DigestStr(), payload.Critical.Image.DockerManifestDigest)
+	testutil.CheckDeepEqual(t, "cosign container image signature", payload.Critical.Type)
+}
+
+type otherSigner struct{}
+
+func (otherSigner) Sign(payload []byte) ([]byte, error) {
+	return []byte("other signature"), nil
+}
+
+func TestSignatureImage_KeepsExistingSignatures(t *testing.T) {
+	digest, err := name.NewDigest(testDigest)
+	testutil.CheckNoError(t, err)
+
+	img, err := SignatureImage(empty.Image, digest, fakeSigner{})
+	testutil.CheckNoError(t, err)
+	img, err = SignatureImage(img, digest, otherSigner{})
+	testutil.CheckNoError(t, err)
+	m, err := img.Manifest()
+	testutil.CheckNoError(t, err)
+	var sigs []string
+	for _, l := range m.Layers {
+		sigs = append(sigs, l.Annotations[SignatureAnnotation])
+	}
+	expected := []string{
+		base64.StdEncoding.EncodeToString([]byte("signature")),
+		base64.StdEncoding.EncodeToString([]byte("other signature")),
+	}
+	testutil.CheckDeepEqual(t, expected, sigs)
+}
+
+func TestNewKeySigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.CheckNoError(t, err)
+	ecBytes, err := x509.MarshalECPrivateKey(key)
+	testutil.CheckNoError(t, err)
+	pkcs8Bytes, err := x509.MarshalPKCS8PrivateKey(key)
+	testutil.CheckNoError(t, err)
+
+	dir, err := ioutil.TempDir("", "signing")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		description string
+		contents    []byte
+		shouldErr   bool
+	}{
+		{
+			description: "EC private key",
+			contents:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecBytes}),
+		},
+		{
+			description: "PKCS8 private key",
+			contents:    pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Bytes}),
+		},
+		{
+			description: "encrypted key",
+			contents:    pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED COSIGN PRIVATE KEY", Bytes: []byte("secret")}),
+			shouldErr:   true,
+		},
+		{
+			description: "not a PEM file",
+			contents:    []byte("key"),
+			shouldErr:   true,
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i)))
+			testutil.CheckNoError(t, ioutil.WriteFile(path, test.contents, 0600))
+			signer, err := NewKeySigner(path)
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			sig, err := signer.Sign([]byte("payload"))
+			testutil.CheckNoError(t, err)
+			var rs struct{ R, S *big.Int }
+			_, err = asn1.Unmarshal(sig, &rs)
+			testutil.CheckNoError(t, err)
+			h := sha256.Sum256([]byte("payload"))
+			if !ecdsa.Verify(&key.PublicKey, h[:], rs.R, rs.S) {
+				t.Error("expected the signature to be verified with the public key")
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// indexEntry is the hash of a file found by the initial snapshot, along with
+// the file attributes that must be unchanged for the hash to be reused.
+type indexEntry struct {
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"modTime"`
+	Mode    os.FileMode `json:"mode"`
+	UID     uint32      `json:"uid"`
+	GID     uint32      `json:"gid"`
+	Hash    string      `json:"hash"`
+}
+
+func newIndexEntry(path, hash string) (indexEntry, bool) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return indexEntry{}, false
+	}
+	e := indexEntry{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Mode:    fi.Mode(),
+		Hash:    hash,
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		e.UID, e.GID = stat.Uid, stat.Gid
+	}
+	return e, true
+}
+
+// matches returns whether the file at path still has the attributes of e.
+func (e indexEntry) matches(path string) bool {
+	current, ok := newIndexEntry(path, e.Hash)
+	return ok && current == e
+}
+
+// SetIndex makes the initial snapshot reuse the hashes persisted at path by a
+// previous build, for the files whose size, modification time, mode and owner
+// are unchanged. The hashes of the files found by the initial snapshot are then
+// persisted at path. As only file attributes are compared, path should be
+// specific to the base image the filesystem was extracted from.
+func (s *Snapshotter) SetIndex(path string) {
+	s.indexPath = path
+}
+
+// initWithIndex takes the initial snapshot, reusing the hashes of the index.
+func (s *Snapshotter) initWithIndex() error {
+	index := readIndex(s.indexPath)
+	hasher := s.l.hasher
+	defer func() { s.l.hasher = hasher }()
+	reused, hashed := 0, 0
+	s.l.hasher = func(path string) (string, error) {
+		if e, ok := index[path]; ok && e.matches(path) {
+			reused++
+			return e.Hash, nil
+		}
+		hashed++
+		return hasher(path)
+	}
+	if _, _, err := s.scanFullFilesystem(); err != nil {
+		return err
+	}
+	logrus.Infof("Reused the hashes of %d files from the snapshot index, hashed %d files", reused, hashed)
+
+	index = map[string]indexEntry{}
+	for path, hash := range s.l.layers[len(s.l.layers)-1] {
+		if e, ok := newIndexEntry(path, hash); ok {
+			index[path] = e
+		}
+	}
+	if err := writeIndex(s.indexPath, index); err != nil {
+		logging.Warnf("Unable to write snapshot index %s: %s", s.indexPath, err)
+	}
+	return nil
+}
+
+// readIndex returns the index persisted at path, or an empty index if there
+// is none or it can't be read.
+func readIndex(path string) map[string]indexEntry {
+	index := map[string]indexEntry{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		logrus.Debugf("No snapshot index at %s", path)
+		return index
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &index)
+	}
+	if err != nil {
+		logging.Warnf("Ignoring snapshot index %s: %s", path, err)
+		return map[string]indexEntry{}
+	}
+	return index
+}
+
+func writeIndex(path string, index map[string]indexEntry) error {
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "index")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestInitWithIndex(t *testing.T) {
+	testDir, cleanup, err := setUpTestDir()
+	testutil.CheckNoError(t, err)
+	defer cleanup()
+	indexDir, err := ioutil.TempDir("", "index")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(indexDir)
+	indexPath := filepath.Join(indexDir, "base-full.json")
+
+	// initSnapshot takes the initial snapshot with the index at path, and
+	// returns the number of files hashed and the snapshotted files.
+	initSnapshot := func(path string) (int, map[string]string) {
+		hashed := 0
+		hasher := util.Hasher()
+		l := NewLayeredMap(func(p string) (string, error) {
+			hashed++
+			return hasher(p)
+		}, util.CacheHasher())
+		s := NewSnapshotter(l, testDir)
+		s.SetIndex(path)
+		testutil.CheckNoError(t, s.Init())
+		return hashed, l.layers[0]
+	}
+
+	hashed, files := initSnapshot(indexPath)
+	if hashed == 0 || hashed != len(files) {
+		t.Fatalf("expected the %d files to be hashed without an index, got %d", len(files), hashed)
+	}
+	if _, err := os.Stat(indexPath); err != nil {
+		t.Fatalf("expected the index to be written: %s", err)
+	}
+
+	t.Run("index is reused", func(t *testing.T) {
+		hashed, reused := initSnapshot(indexPath)
+		testutil.CheckDeepEqual(t, 0, hashed)
+		testutil.CheckDeepEqual(t, files, reused)
+	})
+
+	t.Run("changed files are hashed again", func(t *testing.T) {
+		foo := filepath.Join(testDir, "foo")
+		testutil.CheckNoError(t, ioutil.WriteFile(foo, []byte("changed"), 0644))
+		hashed, changed := initSnapshot(indexPath)
+		testutil.CheckDeepEqual(t, 1, hashed)
+		if changed[foo] == files[foo] {
+			t.Errorf("expected the hash of %s to change", foo)
+		}
+		// The index is updated with the new hash.
+		hashed, reused := initSnapshot(indexPath)
+		testutil.CheckDeepEqual(t, 0, hashed)
+		testutil.CheckDeepEqual(t, changed, reused)
+	})
+
+	t.Run("index of another base image", func(t *testing.T) {
+		hashed, other := initSnapshot(filepath.Join(indexDir, "other-full.json"))
+		testutil.CheckDeepEqual(t, len(other), hashed)
+	})
+
+	t.Run("invalid index is ignored", func(t *testing.T) {
+		invalid := filepath.Join(indexDir, "invalid-full.json")
+		testutil.CheckNoError(t, ioutil.WriteFile(invalid, []byte("{"), 0644))
+		hashed, other := initSnapshot(invalid)
+		testutil.CheckDeepEqual(t, len(other), hashed)
+	})
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// for testing
+var mountInfoPath = "/proc/self/mountinfo"
+
+// unreachableUpperDir warns once that the upper directory isn't accessible,
+// as a ChangeJournal is looked for in each stage.
+var unreachableUpperDir sync.Once
+
+// ChangeJournal reports which paths may have changed in a directory,
+// so a snapshot can be taken without walking the whole directory.
+type ChangeJournal interface {
+	// Changes returns the paths that may have been added or modified, and the
+	// paths under which files may have been deleted.
+	Changes() (changed []string, deleted []string, err error)
+}
+
+// NewChangeJournal returns a ChangeJournal for directory if one is available.
+// Currently this is the case when directory is on an overlay mount whose
+// upper directory is accessible.
+func NewChangeJournal(directory string) (ChangeJournal, bool) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		logrus.Debugf("Unable to read %s: %s", mountInfoPath, err)
+		return nil, false
+	}
+	defer f.Close()
+
+	mountPoint, upperDir, ok := overlayUpperDir(f, directory)
+	if !ok {
+		logrus.Debugf("%s is not on an overlay mount", directory)
+		return nil, false
+	}
+	if _, err := os.Stat(upperDir); err != nil {
+		// The upper directory is a path on the host, which is only accessible
+		// if it's mounted at the same path in the container.
+		unreachableUpperDir.Do(func() {
+			logging.Warnf("--snapshotMode=changed: the upper directory %s of the overlay mount of %s is not accessible: %s. The whole filesystem will be walked when snapshotting, mount the upper directory at the same path to avoid it", upperDir, mountPoint, err)
+		})
+		return nil, false
+	}
+	return &overlayJournal{
+		directory:  directory,
+		mountPoint: mountPoint,
+		upperDir:   upperDir,
+	}, true
+}
+
+// overlayJournal reads changes from the upper directory of an overlay mount,
+// which only contains the files written since the mount was created.
+type overlayJournal struct {
+	directory  string
+	mountPoint string
+	upperDir   string
+}
+
+// Changes walks the upper directory. Whiteout devices and opaque directories
+// mark paths under which files were deleted.
+func (o *overlayJournal) Changes() ([]string, []string, error) {
+	changed := []string{}
+	deleted := []string{}
+	err := filepath.Walk(o.upperDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(o.upperDir, path)
+		if err != nil {
+			return err
+		}
+		p := filepath.Join(o.mountPoint, rel)
+		if !containsPath(o.directory, p) {
+			return nil
+		}
+		if isOverlayWhiteout(info) {
+			deleted = append(deleted, p)
+			return nil
+		}
+		if info.IsDir() && isOpaqueDir(path) {
+			deleted = append(deleted, p)
+		}
+		changed = append(changed, p)
+		return nil
+	})
+	return changed, deleted, err
+}
+
+// isOverlayWhiteout returns true if info describes an overlay whiteout, a character device with number 0/0.
+func isOverlayWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// overlayUpperDir parses mountinfo and returns the mount point and upper
+// directory of the overlay mount containing directory.
+func overlayUpperDir(mountinfo io.Reader, directory string) (string, string, bool) {
+	var mountPoint, upperDir, fsType string
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+4 {
+			continue
+		}
+		mp := unescapeMountInfo(fields[4])
+		if !containsPath(mp, directory) || len(mp) < len(mountPoint) {
+			continue
+		}
+		mountPoint, fsType, upperDir = mp, fields[sep+1], ""
+		for _, opt := range strings.Split(fields[sep+3], ",") {
+			if strings.HasPrefix(opt, "upperdir=") {
+				upperDir = unescapeMountInfo(strings.TrimPrefix(opt, "upperdir="))
+			}
+		}
+	}
+	if fsType != "overlay" || upperDir == "" {
+		return "", "", false
+	}
+	return mountPoint, upperDir, true
+}
+
+// containsPath returns true if path is dir or is under dir.
+func containsPath(dir, path string) bool {
+	if dir == "/" || dir == path {
+		return true
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// unescapeMountInfo decodes the octal escapes the kernel uses for whitespace
+// and backslashes in mountinfo fields.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,27 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import "syscall"
+
+// isOpaqueDir returns true if the directory at path is marked opaque in an
+// overlay upper directory, hiding the contents of the lower directories.
+func isOpaqueDir(path string) bool {
+	dest := make([]byte, 1)
+	n, err := syscall.Getxattr(path, "trusted.overlay.opaque", dest)
+	return err == nil && n == 1 && dest[0] == 'y'
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+const testMountInfo = `1200 1100 0:52 / / rw,relatime master:1 - overlay overlay rw,lowerdir=/var/lib/l1:/var/lib/l2,upperdir=/var/lib/upper,workdir=/var/lib/work
+1201 1200 0:55 / /proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+1202 1200 8:1 /volumes/data /workspace rw,relatime - ext4 /dev/sda1 rw
+1203 1200 0:60 / /with\040space rw,relatime - overlay overlay rw,lowerdir=/l,upperdir=/upper\040dir,workdir=/w
+`
+
+func Test_overlayUpperDir(t *testing.T) {
+	tests := []struct {
+		description string
+		directory   string
+		mountPoint  string
+		upperDir    string
+		ok          bool
+	}{
+		{
+			description: "root overlay",
+			directory:   "/",
+			mountPoint:  "/",
+			upperDir:    "/var/lib/upper",
+			ok:          true,
+		},
+		{
+			description: "directory under root overlay",
+			directory:   "/usr/lib",
+			mountPoint:  "/",
+			upperDir:    "/var/lib/upper",
+			ok:          true,
+		},
+		{
+			description: "directory on a non overlay mount",
+			directory:   "/workspace/src",
+			ok:          false,
+		},
+		{
+			description: "escaped mount point and upper dir",
+			directory:   "/with space/foo",
+			mountPoint:  "/with space",
+			upperDir:    "/upper dir",
+			ok:          true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			mountPoint, upperDir, ok := overlayUpperDir(strings.NewReader(testMountInfo), test.directory)
+			testutil.CheckDeepEqual(t, test.ok, ok)
+			testutil.CheckDeepEqual(t, test.mountPoint, mountPoint)
+			testutil.CheckDeepEqual(t, test.upperDir, upperDir)
+		})
+	}
+}
+
+func TestNewChangeJournal(t *testing.T) {
+	upperDir := t.TempDir()
+	tests := []struct {
+		description string
+		upperDir    string
+		ok          bool
+		warning     string
+	}{
+		{
+			description: "accessible upper dir",
+			upperDir:    upperDir,
+			ok:          true,
+		},
+		{
+			description: "upper dir on the host falls back to a full walk",
+			upperDir:    "/var/lib/docker/overlay2/abc/diff",
+			warning:     "the upper directory /var/lib/docker/overlay2/abc/diff of the overlay mount of / is not accessible",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			original := mountInfoPath
+			defer func() { mountInfoPath = original }()
+			mountInfoPath = filepath.Join(t.TempDir(), "mountinfo")
+			mountInfo := fmt.Sprintf("1200 1100 0:52 / / rw - overlay overlay rw,lowerdir=/l,upperdir=%s,workdir=/w\n", test.upperDir)
+			if err := ioutil.WriteFile(mountInfoPath, []byte(mountInfo), 0644); err != nil {
+				t.Fatal(err)
+			}
+			unreachableUpperDir = sync.Once{}
+			logging.SetStrict(true)
+			defer logging.SetStrict(false)
+
+			_, ok := NewChangeJournal("/")
+			testutil.CheckDeepEqual(t, test.ok, ok)
+			err := logging.Warnings()
+			if test.warning == "" {
+				testutil.CheckNoError(t, err)
+			} else if err == nil || !strings.Contains(err.Error(), test.warning) {
+				t.Errorf("expected a warning containing %q, got %v", test.warning, err)
+			}
+		})
+	}
+}
@@ -114,7 +114,7 @@ func (l *LayeredMap) Add(s string) error {
 		return l.hasher(s)
 	}(s)
 	if err != nil {
-		return fmt.Errorf("error creating hash for %s: %v", s, err)
+		return fmt.Errorf("error creating hash for %s: %w", s, err)
 	}
 	l.layers[len(l.layers)-1][s] = newV
 	return nil
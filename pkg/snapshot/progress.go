@@ -0,0 +1,80 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// for testing
+var (
+	progressInterval = 30 * time.Second
+	now              = time.Now
+)
+
+// SetWarnAfter makes snapshots log a warning once they took longer than d.
+// Zero disables the warning.
+func (s *Snapshotter) SetWarnAfter(d time.Duration) {
+	s.warnAfter = d
+}
+
+// scanProgress logs the number of files scanned by a snapshot periodically,
+// and warns once the snapshot takes longer than warnAfter, so that slow
+// snapshots of large filesystems don't go unnoticed.
+type scanProgress struct {
+	warnAfter time.Duration
+	start     time.Time
+	logged    time.Time
+	warned    bool
+	files     int
+}
+
+func newScanProgress(warnAfter time.Duration) *scanProgress {
+	t := now()
+	return &scanProgress{warnAfter: warnAfter, start: t, logged: t}
+}
+
+// counting returns f, counting the files it's called with.
+func (p *scanProgress) counting(f func(string) (bool, error)) func(string) (bool, error) {
+	return func(path string) (bool, error) {
+		p.files++
+		p.check(false)
+		return f(path)
+	}
+}
+
+// done logs the final count, if progress was logged, and warns if the
+// snapshot was slow.
+func (p *scanProgress) done() {
+	p.check(true)
+}
+
+func (p *scanProgress) check(done bool) {
+	t := now()
+	elapsed := t.Sub(p.start)
+	if t.Sub(p.logged) >= progressInterval || (done && p.logged != p.start) {
+		p.logged = t
+		logrus.Infof("Scanned %d files in %s", p.files, elapsed.Round(time.Millisecond))
+	}
+	if p.warnAfter > 0 && elapsed > p.warnAfter && !p.warned {
+		p.warned = true
+		logging.Warnf("Snapshotting the filesystem has taken more than %s, after scanning %d files. Large directories can be ignored with --ignore-path, and --snapshotMode=changed avoids walking the whole filesystem.", p.warnAfter, p.files)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSnapshotFSWarnsWhenSlow(t *testing.T) {
+	tests := []struct {
+		description string
+		warnAfter   time.Duration
+		shouldWarn  bool
+	}{
+		{
+			description: "no warning by default",
+		},
+		{
+			description: "snapshot faster than the threshold",
+			warnAfter:   time.Hour,
+		},
+		{
+			description: "snapshot slower than the threshold",
+			warnAfter:   5 * time.Minute,
+			shouldWarn:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			testDir, snapshotter, cleanup, err := setUpTest()
+			defer cleanup()
+			testutil.CheckNoError(t, err)
+			testutil.CheckNoError(t, testutil.SetupFiles(testDir, map[string]string{"new": "file"}))
+
+			// Each call to the clock takes a minute.
+			clock := time.Unix(0, 0)
+			originalNow := now
+			now = func() time.Time {
+				clock = clock.Add(time.Minute)
+				return clock
+			}
+			defer func() { now = originalNow }()
+			var buf bytes.Buffer
+			logrus.SetOutput(&buf)
+			defer logrus.SetOutput(os.Stderr)
+
+			snapshotter.SetWarnAfter(test.warnAfter)
+			_, err = snapshotter.TakeSnapshotFS()
+			testutil.CheckNoError(t, err)
+			if !strings.Contains(buf.String(), "Scanned ") {
+				t.Errorf("expected the progress of the scan to be logged, got %q", buf.String())
+			}
+			warned := strings.Contains(buf.String(), "Snapshotting the filesystem has taken more than")
+			testutil.CheckDeepEqual(t, test.shouldWarn, warned)
+			if strings.Count(buf.String(), "has taken more than") > 1 {
+				t.Errorf("expected the warning to be logged once, got %q", buf.String())
+			}
+		})
+	}
+}
@@ -23,9 +23,11 @@ import (
 	"path/filepath"
 	"sort"
 	"syscall"
+	"time"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
 	"github.com/GoogleContainerTools/kaniko/pkg/timing"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 
@@ -40,6 +42,9 @@ type Snapshotter struct {
 	l          *LayeredMap
 	directory  string
 	ignorelist []util.IgnoreListEntry
+	journal    ChangeJournal
+	indexPath  string
+	warnAfter  time.Duration
 }
 
 // NewSnapshotter creates a new snapshotter rooted at d
@@ -47,8 +52,17 @@ func NewSnapshotter(l *LayeredMap, d string) *Snapshotter {
 	return &Snapshotter{l: l, directory: d, ignorelist: util.IgnoreList()}
 }
 
+// SetChangeJournal makes filesystem snapshots only consider the paths reported
+// by j instead of walking the whole directory.
+func (s *Snapshotter) SetChangeJournal(j ChangeJournal) {
+	s.journal = j
+}
+
 // Init initializes a new snapshotter
 func (s *Snapshotter) Init() error {
+	if s.indexPath != "" {
+		return s.initWithIndex()
+	}
 	_, _, err := s.scanFullFilesystem()
 	return err
 }
@@ -84,18 +98,20 @@ func (s *Snapshotter) TakeSnapshot(files []string, shdCheckDelete bool) (string,
 	sort.Strings(filesToAdd)
 
 	// Add files to the layered map
-	for _, file := range filesToAdd {
-		if err := s.l.Add(file); err != nil {
-			return "", fmt.Errorf("unable to add file %s to layered map: %s", file, err)
-		}
+	filesToAdd, err = s.addToLayeredMap(filesToAdd)
+	if err != nil {
+		return "", err
 	}
 
 	// Get whiteout paths
 	filesToWhiteout := []string{}
 	if shdCheckDelete {
-		_, deletedFiles := util.WalkFS(s.directory, s.l.getFlattenedPathsForWhiteOut(), func(s string) (bool, error) {
+		_, deletedFiles, err := util.WalkFS(s.directory, s.l.getFlattenedPathsForWhiteOut(), func(s string) (bool, error) {
 			return true, nil
 		})
+		if err != nil {
+			return "", err
+		}
 		// The paths left here are the ones that have been deleted in this layer.
 		for path := range deletedFiles {
 			// Only add the whiteout if the directory for the file still exists.
@@ -130,7 +146,12 @@ func (s *Snapshotter) TakeSnapshotFS() (string, error) {
 	t := util.NewTar(f)
 	defer t.Close()
 
-	filesToAdd, filesToWhiteOut, err := s.scanFullFilesystem()
+	var filesToAdd, filesToWhiteOut []string
+	if s.journal != nil {
+		filesToAdd, filesToWhiteOut, err = s.scanChangedFiles()
+	} else {
+		filesToAdd, filesToWhiteOut, err = s.scanFullFilesystem()
+	}
 	if err != nil {
 		return "", err
 	}
@@ -159,7 +180,67 @@ func (s *Snapshotter) scanFullFilesystem() ([]string, []string, error) {
 
 	s.l.Snapshot()
 
-	changedPaths, deletedPaths := util.WalkFS(s.directory, s.l.getFlattenedPathsForWhiteOut(), s.l.CheckFileChange)
+	progress := newScanProgress(s.warnAfter)
+	changedPaths, deletedPaths, err := util.WalkFS(s.directory, s.l.getFlattenedPathsForWhiteOut(), progress.counting(s.l.CheckFileChange))
+	if err != nil {
+		return nil, nil, err
+	}
+	progress.done()
+	return s.processChanges(changedPaths, deletedPaths)
+}
+
+// scanChangedFiles is like scanFullFilesystem, but only looks at the paths
+// reported by the change journal. It falls back to a full scan if the
+// journal fails.
+func (s *Snapshotter) scanChangedFiles() ([]string, []string, error) {
+	candidates, deletedDirs, err := s.journal.Changes()
+	if err != nil {
+		logging.Warnf("Unable to read change journal, falling back to a full filesystem scan: %s", err)
+		return s.scanFullFilesystem()
+	}
+	logrus.Info("Taking snapshot of changed files...")
+	syscall.Sync()
+
+	s.l.Snapshot()
+
+	progress := newScanProgress(s.warnAfter)
+	checkFileChange := progress.counting(s.l.CheckFileChange)
+	changedPaths := []string{}
+	for _, path := range candidates {
+		if util.IsInIgnoreList(path) {
+			continue
+		}
+		changed, err := checkFileChange(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if changed {
+			changedPaths = append(changedPaths, path)
+		}
+	}
+
+	// Any known path under a deleted directory that no longer exists was deleted.
+	deletedPaths := map[string]struct{}{}
+	if len(deletedDirs) > 0 {
+		for path := range s.l.getFlattenedPathsForWhiteOut() {
+			for _, dir := range deletedDirs {
+				if !containsPath(dir, path) {
+					continue
+				}
+				if _, err := os.Lstat(path); os.IsNotExist(err) {
+					deletedPaths[path] = struct{}{}
+				}
+				break
+			}
+		}
+	}
+	progress.done()
+	return s.processChanges(changedPaths, deletedPaths)
+}
+
+// processChanges resolves the changed paths and whiteouts of a scan and adds
+// them to the layered map.
+func (s *Snapshotter) processChanges(changedPaths []string, deletedPaths map[string]struct{}) ([]string, []string, error) {
 	timer := timing.Start("Resolving Paths")
 
 	filesToAdd := []string{}
@@ -193,12 +274,27 @@ func (s *Snapshotter) scanFullFilesystem() ([]string, []string, error) {
 	sort.Strings(filesToWhiteOut)
 
 	// Add files to the layered map
-	for _, file := range filesToAdd {
+	filesToAdd, err = s.addToLayeredMap(filesToAdd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return filesToAdd, filesToWhiteOut, nil
+}
+
+// addToLayeredMap adds files to the layered map, and returns the ones that
+// are added, leaving out the ones that can't be read without root.
+func (s *Snapshotter) addToLayeredMap(files []string) ([]string, error) {
+	added := make([]string, 0, len(files))
+	for _, file := range files {
 		if err := s.l.Add(file); err != nil {
-			return nil, nil, fmt.Errorf("unable to add file %s to layered map: %s", file, err)
+			if util.SkipUnreadable(file, err) {
+				continue
+			}
+			return nil, fmt.Errorf("unable to add file %s to layered map: %s", file, err)
 		}
+		added = append(added, file)
 	}
-	return filesToAdd, filesToWhiteOut, nil
+	return added, nil
 }
 
 func writeToTar(t util.Tar, files, whiteouts []string) error {
@@ -17,12 +17,14 @@ package snapshot
 
 import (
 	"archive/tar"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
@@ -506,6 +508,71 @@ func TestSnapshotOmitsUnameGname(t *testing.T) {
 
 }
 
+func TestSnapshotFSIgnoreListChanges(t *testing.T) {
+	testDir, cleanup, err := setUpTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	snapshotPath, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(snapshotPath)
+	snapshotPathPrefix = snapshotPath
+	originalKanikoDir := config.KanikoDir
+	config.KanikoDir = snapshotPath
+	defer func() { config.KanikoDir = originalKanikoDir }()
+
+	// unignored stands for a path ignored by default, which is removed from the ignore list.
+	ignored := filepath.Join(testDir, "ignored")
+	unignored := filepath.Join(testDir, "unignored")
+	util.AddToBaseIgnoreList(util.IgnoreListEntry{Path: unignored})
+	util.AddToBaseIgnoreList(util.IgnoreListEntry{Path: ignored})
+	testutil.CheckNoError(t, util.RemoveFromBaseIgnoreList(unignored))
+	mountInfo := filepath.Join(snapshotPath, "mountinfo")
+	testutil.CheckNoError(t, ioutil.WriteFile(mountInfo, []byte{}, 0644))
+	testutil.CheckNoError(t, util.DetectFilesystemIgnoreList(mountInfo))
+	defer func() {
+		util.RemoveFromBaseIgnoreList(ignored)
+		util.DetectFilesystemIgnoreList(config.IgnoreListPath)
+	}()
+
+	snapshotter := NewSnapshotter(NewLayeredMap(util.Hasher(), util.CacheHasher()), testDir)
+	testutil.CheckNoError(t, snapshotter.Init())
+	testutil.CheckNoError(t, testutil.SetupFiles(testDir, map[string]string{
+		"ignored/file":   "ignored",
+		"unignored/file": "unignored",
+	}))
+	tarPath, err := snapshotter.TakeSnapshotFS()
+	testutil.CheckNoError(t, err)
+
+	f, err := os.Open(tarPath)
+	testutil.CheckNoError(t, err)
+	defer f.Close()
+	files := map[string]bool{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		testutil.CheckNoError(t, err)
+		files[strings.TrimSuffix(hdr.Name, "/")] = true
+	}
+	testDirWithoutLeadingSlash := strings.TrimLeft(testDir, "/")
+	for path, expected := range map[string]bool{
+		"unignored":      true,
+		"unignored/file": true,
+		"ignored":        false,
+		"ignored/file":   false,
+	} {
+		if files[filepath.Join(testDirWithoutLeadingSlash, path)] != expected {
+			t.Errorf("expected %s to be in the snapshot: %v, got %v", path, expected, files)
+		}
+	}
+}
+
 func setupSymlink(dir string, link string, target string) error {
 	return os.Symlink(target, filepath.Join(dir, link))
 }
@@ -572,3 +639,203 @@ func setUpTest() (string, *Snapshotter, func(), error) {
 
 	return testDir, snapshotter, cleanup, nil
 }
+
+func TestSnapshotFSChangeJournalMatchesFullWalk(t *testing.T) {
+	testDir, cleanup, err := setUpTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	upperDir, err := ioutil.TempDir("", "upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(upperDir)
+	snapshotPath, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(snapshotPath)
+	snapshotPathPrefix = snapshotPath
+
+	full := NewSnapshotter(NewLayeredMap(util.Hasher(), util.CacheHasher()), testDir)
+	journaled := NewSnapshotter(NewLayeredMap(util.Hasher(), util.CacheHasher()), testDir)
+	journaled.SetChangeJournal(&overlayJournal{directory: testDir, mountPoint: testDir, upperDir: upperDir})
+	for _, s := range []*Snapshotter{full, journaled} {
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Change the filesystem, and record the changes in the upper directory as overlayfs would.
+	newFiles := map[string]string{
+		"foo":          "newbaz1",
+		"bar/bat2":     "baz3",
+		"newdir/file":  "new",
+		"newdir/file2": "new",
+	}
+	for _, dir := range []string{testDir, upperDir} {
+		if err := testutil.SetupFiles(dir, newFiles); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, deleted := range []string{"bar/bat", "baz"} {
+		if err := os.RemoveAll(filepath.Join(testDir, deleted)); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Mknod(filepath.Join(upperDir, deleted), syscall.S_IFCHR, 0); err != nil {
+			t.Skipf("unable to create whiteout device: %s", err)
+		}
+	}
+
+	tarContents := func(s *Snapshotter) []string {
+		tarPath, err := s.TakeSnapshotFS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(tarPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		contents := []string{}
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(tr)
+			contents = append(contents, fmt.Sprintf("%s %c %s", hdr.Name, hdr.Typeflag, b))
+		}
+		sort.Strings(contents)
+		return contents
+	}
+
+	expected := tarContents(full)
+	actual := tarContents(journaled)
+	testutil.CheckDeepEqual(t, expected, actual)
+	for _, whiteout := range []string{"bar/.wh.bat", ".wh.baz"} {
+		found := false
+		for _, c := range actual {
+			found = found || strings.HasSuffix(strings.Fields(c)[0], whiteout)
+		}
+		if !found {
+			t.Errorf("expected whiteout %s in snapshot, got %v", whiteout, actual)
+		}
+	}
+}
+
+func TestSnapshotFSSymlinkCycles(t *testing.T) {
+	testDir, snapshotter, cleanup, err := setUpTest()
+	testutil.CheckNoError(t, err)
+	defer cleanup()
+	originalRootDir := config.RootDir
+	config.RootDir = testDir
+	defer func() { config.RootDir = originalRootDir }()
+
+	links := map[string]string{
+		"self":      "self",
+		"bar/up":    "..",
+		"bar/loop1": "loop2",
+		"bar/loop2": "loop1",
+		"bar/out":   "/",
+	}
+	for link, target := range links {
+		testutil.CheckNoError(t, setupSymlink(testDir, link, target))
+	}
+	tarPath, err := snapshotter.TakeSnapshotFS()
+	testutil.CheckNoError(t, err)
+
+	f, err := os.Open(tarPath)
+	testutil.CheckNoError(t, err)
+	defer f.Close()
+	// The symlinks are added as symlinks, and the paths they point to aren't
+	// followed out of the root directory.
+	symlinks := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		testutil.CheckNoError(t, err)
+		if hdr.Typeflag == tar.TypeSymlink {
+			symlinks[hdr.Name] = hdr.Linkname
+		}
+		if hdr.Name != "/" && !util.FilepathExists(filepath.Join(testDir, hdr.Name)) {
+			t.Errorf("unexpected file %s out of the root directory in the snapshot", hdr.Name)
+		}
+	}
+	testutil.CheckDeepEqual(t, links, symlinks)
+}
+
+func TestSnapshotFSRootless(t *testing.T) {
+	defer util.ConfigureRootless(false, false)
+	tests := []struct {
+		description      string
+		failOnUnreadable bool
+		shouldErr        bool
+	}{
+		{
+			description: "unreadable files are skipped",
+		},
+		{
+			description:      "unreadable files fail the snapshot",
+			failOnUnreadable: true,
+			shouldErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			testDir, cleanup, err := setUpTestDir()
+			testutil.CheckNoError(t, err)
+			defer cleanup()
+			snapshotPath, err := ioutil.TempDir("", "")
+			testutil.CheckNoError(t, err)
+			defer os.RemoveAll(snapshotPath)
+			snapshotPathPrefix = snapshotPath
+			util.ConfigureRootless(true, test.failOnUnreadable)
+
+			// Reading unreadable fails as it would without root.
+			unreadable := filepath.Join(testDir, "bar", "unreadable")
+			hasher := util.Hasher()
+			l := NewLayeredMap(func(p string) (string, error) {
+				if p == unreadable {
+					return "", &os.PathError{Op: "open", Path: p, Err: syscall.EACCES}
+				}
+				return hasher(p)
+			}, util.CacheHasher())
+			snapshotter := NewSnapshotter(l, testDir)
+			testutil.CheckNoError(t, snapshotter.Init())
+			testutil.CheckNoError(t, testutil.SetupFiles(testDir, map[string]string{
+				"bar/unreadable": "unreadable",
+				"bar/readable":   "readable",
+			}))
+
+			tarPath, err := snapshotter.TakeSnapshotFS()
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			f, err := os.Open(tarPath)
+			testutil.CheckNoError(t, err)
+			defer f.Close()
+			files := map[string]bool{}
+			tr := tar.NewReader(f)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				testutil.CheckNoError(t, err)
+				files["/"+hdr.Name] = true
+			}
+			testutil.CheckDeepEqual(t, true, files[filepath.Join(testDir, "bar", "readable")])
+			testutil.CheckDeepEqual(t, false, files[unreadable])
+		})
+	}
+}
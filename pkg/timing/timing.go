@@ -34,17 +34,42 @@ var DefaultRun = NewTimedRun()
 type TimedRun struct {
 	cl         sync.Mutex
 	categories map[string]time.Duration // protected by cl
+	entries    []Entry                  // protected by cl
 }
 
-// Stop stops the specified timer and increments the time spent in that category.
-func (tr *TimedRun) Stop(t *Timer) {
+// Entry records a single stopped timer, in the order the timers were stopped.
+type Entry struct {
+	Category string        `json:"category"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Stop stops the specified timer, increments the time spent in that category
+// and returns the time elapsed since the timer was started.
+func (tr *TimedRun) Stop(t *Timer) time.Duration {
 	stop := currentTimeFunc()
+	elapsed := stop.Sub(t.startTime)
 	tr.cl.Lock()
 	defer tr.cl.Unlock()
 	if _, ok := tr.categories[t.category]; !ok {
 		tr.categories[t.category] = 0
 	}
-	tr.categories[t.category] += stop.Sub(t.startTime)
+	tr.categories[t.category] += elapsed
+	tr.entries = append(tr.entries, Entry{
+		Category: t.category,
+		Start:    t.startTime,
+		Duration: elapsed,
+	})
+	return elapsed
+}
+
+// Entries returns every stopped timer of the TimedRun in the order they were stopped.
+func (tr *TimedRun) Entries() []Entry {
+	tr.cl.Lock()
+	defer tr.cl.Unlock()
+	entries := make([]Entry, len(tr.entries))
+	copy(entries, tr.entries)
+	return entries
 }
 
 // Start starts a new Timer and returns it.
@@ -82,6 +107,11 @@ func JSON() (string, error) {
 	return DefaultRun.JSON()
 }
 
+// EntriesJSON outputs the entries of the DefaultTimedRun as JSON.
+func EntriesJSON() (string, error) {
+	return DefaultRun.EntriesJSON()
+}
+
 // Summary outputs a summary of the specified TimedRun.
 func (tr *TimedRun) Summary() string {
 	b := bytes.Buffer{}
@@ -99,3 +129,21 @@ func (tr *TimedRun) JSON() (string, error) {
 	}
 	return string(b), nil
 }
+
+// EntriesJSON outputs the entries of the specified TimedRun as JSON, along with
+// the total time spent in each category.
+func (tr *TimedRun) EntriesJSON() (string, error) {
+	tr.cl.Lock()
+	defer tr.cl.Unlock()
+	b, err := json.Marshal(struct {
+		Entries []Entry                  `json:"entries"`
+		Totals  map[string]time.Duration `json:"totals"`
+	}{
+		Entries: tr.entries,
+		Totals:  tr.categories,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -16,6 +16,8 @@ limitations under the License.
 package timing
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -137,3 +139,46 @@ func TestTimedRun_Summary(t *testing.T) {
 		})
 	}
 }
+
+func TestTimedRun_Entries(t *testing.T) {
+	tr := NewTimedRun()
+	start := time.Time{}
+	for i, category := range []string{"foo", "bar", "foo"} {
+		timer := Timer{
+			category:  category,
+			startTime: start,
+		}
+		restore := patchTime(mockTimeFunc(start.Add(time.Duration(i+1) * time.Second)))
+		if got := tr.Stop(&timer); got != time.Duration(i+1)*time.Second {
+			t.Errorf("Expected Stop to return %s, got %s", time.Duration(i+1)*time.Second, got)
+		}
+		restore()
+	}
+
+	want := []Entry{
+		{Category: "foo", Start: start, Duration: 1 * time.Second},
+		{Category: "bar", Start: start, Duration: 2 * time.Second},
+		{Category: "foo", Start: start, Duration: 3 * time.Second},
+	}
+	if got := tr.Entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("TimedRun.Entries() = %v, want %v", got, want)
+	}
+	if got := tr.categories["foo"]; got != 4*time.Second {
+		t.Errorf("Expected foo to total %s, got %s", 4*time.Second, got)
+	}
+
+	s, err := tr.EntriesJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Entries []Entry                  `json:"entries"`
+		Totals  map[string]time.Duration `json:"totals"`
+	}
+	if err := json.Unmarshal([]byte(s), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Entries) != 3 || decoded.Totals["bar"] != 2*time.Second {
+		t.Errorf("TimedRun.EntriesJSON() = %s", s)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// for testing
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuArchitectures maps GOARCH values to the names of the QEMU binfmt_misc handlers.
+var qemuArchitectures = map[string]string{
+	"386":      "i386",
+	"amd64":    "x86_64",
+	"arm":      "arm",
+	"arm64":    "aarch64",
+	"mips64":   "mips64",
+	"mips64le": "mips64el",
+	"ppc64le":  "ppc64le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// NeedsEmulation returns true if binaries for arch can't be run natively on the host.
+func NeedsEmulation(arch string) bool {
+	return needsEmulation(runtime.GOARCH, arch)
+}
+
+func needsEmulation(host, arch string) bool {
+	if host == arch {
+		return false
+	}
+	// 32-bit binaries usually run natively on their 64-bit counterpart.
+	return !(host == "amd64" && arch == "386") && !(host == "arm64" && arch == "arm")
+}
+
+// CheckEmulation returns an error if no QEMU binfmt_misc handler is enabled to
+// run binaries for arch.
+func CheckEmulation(arch string) error {
+	name, ok := qemuArchitectures[arch]
+	if !ok {
+		return fmt.Errorf("running %s binaries under emulation is not supported", arch)
+	}
+	handler := filepath.Join(binfmtMiscDir, "qemu-"+name)
+	b, err := ioutil.ReadFile(handler)
+	if err != nil {
+		return fmt.Errorf("no binfmt_misc handler is registered to run %s binaries, expected one at %s. "+
+			"Register the QEMU handlers on the host first, for example with: docker run --privileged --rm tonistiigi/binfmt --install %s", arch, handler, arch)
+	}
+
+	enabled, flags := false, ""
+	for _, line := range strings.Split(string(b), "\n") {
+		switch {
+		case line == "enabled":
+			enabled = true
+		case strings.HasPrefix(line, "flags:"):
+			flags = strings.TrimSpace(strings.TrimPrefix(line, "flags:"))
+		}
+	}
+	if !enabled {
+		return fmt.Errorf("the binfmt_misc handler %s to run %s binaries is disabled", handler, arch)
+	}
+	if !strings.Contains(flags, "F") {
+		logging.Warnf("The binfmt_misc handler %s wasn't registered with the F flag, so its interpreter must exist in the image being built", handler)
+	}
+	logrus.Infof("Running %s binaries with the binfmt_misc handler %s", arch, handler)
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func Test_needsEmulation(t *testing.T) {
+	tests := []struct {
+		host     string
+		arch     string
+		expected bool
+	}{
+		{host: "amd64", arch: "amd64", expected: false},
+		{host: "amd64", arch: "386", expected: false},
+		{host: "arm64", arch: "arm", expected: false},
+		{host: "amd64", arch: "arm64", expected: true},
+		{host: "arm64", arch: "amd64", expected: true},
+		{host: "386", arch: "amd64", expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.host+" to "+test.arch, func(t *testing.T) {
+			testutil.CheckDeepEqual(t, test.expected, needsEmulation(test.host, test.arch))
+		})
+	}
+}
+
+func TestCheckEmulation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binfmt_misc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	original := binfmtMiscDir
+	defer func() { binfmtMiscDir = original }()
+	binfmtMiscDir = dir
+
+	if err := testutil.SetupFiles(dir, map[string]string{
+		"qemu-aarch64": "enabled\ninterpreter /usr/bin/qemu-aarch64\nflags: OCF\noffset 0\n",
+		"qemu-arm":     "enabled\ninterpreter /usr/bin/qemu-arm\nflags: \noffset 0\n",
+		"qemu-s390x":   "disabled\ninterpreter /usr/bin/qemu-s390x\nflags: F\noffset 0\n",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		arch      string
+		shouldErr bool
+	}{
+		{arch: "arm64"},
+		{arch: "arm"},
+		{arch: "s390x", shouldErr: true},
+		{arch: "ppc64le", shouldErr: true},
+		{arch: "wasm", shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.arch, func(t *testing.T) {
+			testutil.CheckError(t, test.shouldErr, CheckEmulation(test.arch))
+		})
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// checksumAlgorithms are the algorithms checksums can be computed with.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// ValidateChecksum returns an error if checksum isn't of the form
+// <algorithm>:<hex>, with one of the supported algorithms.
+func ValidateChecksum(checksum string) error {
+	_, err := newChecksumVerifier(checksum)
+	return err
+}
+
+// checksumVerifier computes the digest of what's written to it, to compare it
+// with the checksum it must have.
+type checksumVerifier struct {
+	expected string
+	hash     hash.Hash
+}
+
+func newChecksumVerifier(checksum string) (*checksumVerifier, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	newHash, ok := checksumAlgorithms[parts[0]]
+	if len(parts) != 2 || !ok {
+		return nil, fmt.Errorf("invalid checksum %q, expected sha256:<hex>, sha384:<hex> or sha512:<hex>", checksum)
+	}
+	h := newHash()
+	if b, err := hex.DecodeString(parts[1]); err != nil || len(b) != h.Size() {
+		return nil, fmt.Errorf("invalid checksum %q, expected %d hex encoded bytes", checksum, h.Size())
+	}
+	return &checksumVerifier{expected: strings.ToLower(checksum), hash: h}, nil
+}
+
+func (v *checksumVerifier) Write(p []byte) (int, error) {
+	return v.hash.Write(p)
+}
+
+// verify returns an error if the digest of what was written differs from
+// the checksum of name.
+func (v *checksumVerifier) verify(name string) error {
+	algorithm := strings.SplitN(v.expected, ":", 2)[0]
+	if actual := algorithm + ":" + hex.EncodeToString(v.hash.Sum(nil)); actual != v.expected {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, v.expected, actual)
+	}
+	return nil
+}
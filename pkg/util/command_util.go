@@ -21,7 +21,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/user"
 	"path/filepath"
 	reflect "reflect"
 	"strconv"
@@ -33,6 +32,7 @@ import (
 	"github.com/moby/buildkit/frontend/dockerfile/shell"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 )
@@ -97,7 +97,7 @@ func ResolveEnvAndWildcards(sd instructions.SourcesAndDest, fileContext FileCont
 	}
 	dest := resolvedEnvs[len(resolvedEnvs)-1]
 	// Resolve wildcards and get a list of resolved sources
-	srcs, err := ResolveSources(resolvedEnvs[0:len(resolvedEnvs)-1], fileContext.Root)
+	srcs, err := resolveSources(resolvedEnvs[0:len(resolvedEnvs)-1], fileContext.Filesystem(), fileContext.Root)
 	if err != nil {
 		return nil, "", errors.Wrap(err, "failed to resolve sources")
 	}
@@ -118,12 +118,16 @@ func ContainsWildcards(paths []string) bool {
 // ResolveSources resolves the given sources if the sources contains wildcards
 // It returns a list of resolved sources
 func ResolveSources(srcs []string, root string) ([]string, error) {
+	return resolveSources(srcs, afero.NewOsFs(), root)
+}
+
+func resolveSources(srcs []string, fs afero.Fs, root string) ([]string, error) {
 	// If sources contain wildcards, we first need to resolve them to actual paths
 	if !ContainsWildcards(srcs) {
 		return srcs, nil
 	}
 	logrus.Infof("Resolving srcs %v...", srcs)
-	files, err := RelativeFiles("", root)
+	files, err := relativeFiles(fs, "", root)
 	if err != nil {
 		return nil, errors.Wrap(err, "resolving sources")
 	}
@@ -244,7 +248,7 @@ func IsSrcsValid(srcsAndDest instructions.SourcesAndDest, resolvedSources []stri
 			return nil
 		}
 		path := filepath.Join(fileContext.Root, resolvedSources[0])
-		fi, err := os.Lstat(path)
+		fi, err := fileContext.Lstat(path)
 		if err != nil {
 			return errors.Wrap(err, fmt.Sprintf("failed to get fileinfo for %v", path))
 		}
@@ -260,7 +264,7 @@ func IsSrcsValid(srcsAndDest instructions.SourcesAndDest, resolvedSources []stri
 			continue
 		}
 		src = filepath.Clean(src)
-		files, err := RelativeFiles(src, fileContext.Root)
+		files, err := relativeFiles(fileContext.Filesystem(), src, fileContext.Root)
 		if err != nil {
 			return errors.Wrap(err, "failed to get relative files")
 		}
@@ -394,55 +398,25 @@ func GetUIDAndGIDFromString(userGroupString string, fallbackToUID bool) (uint32,
 	return uint32(uid64), uint32(gid64), nil
 }
 
+// GetUserFromUsername returns the uid and gid of userStr and groupStr, which
+// are names or ids, from /etc/passwd and /etc/group. If groupStr is empty, the
+// gid is the primary group of the user if fallbackToUID is set, zero otherwise.
 func GetUserFromUsername(userStr string, groupStr string, fallbackToUID bool) (string, string, error) {
-	// Lookup by username
-	userObj, err := Lookup(userStr)
+	uid, primaryGID, err := lookupUserIDs(userStr)
 	if err != nil {
 		return "", "", err
 	}
 
-	// Same dance with groups
-	var group *user.Group
-	if groupStr != "" {
-		group, err = user.LookupGroup(groupStr)
-		if err != nil {
-			if _, ok := err.(user.UnknownGroupError); !ok {
-				return "", "", err
-			}
-			group, err = user.LookupGroupId(groupStr)
-			if err != nil {
-				return "", "", err
-			}
-		}
-	}
-
-	uid := userObj.Uid
 	gid := "0"
 	if fallbackToUID {
-		gid = userObj.Gid
-	}
-	if group != nil {
-		gid = group.Gid
+		gid = primaryGID
 	}
-
-	return uid, gid, nil
-}
-
-func Lookup(userStr string) (*user.User, error) {
-	userObj, err := user.Lookup(userStr)
-	if err != nil {
-		if _, ok := err.(user.UnknownUserError); !ok {
-			return nil, err
-		}
-
-		// Lookup by id
-		u, e := user.LookupId(userStr)
-		if e != nil {
-			return nil, err
+	if groupStr != "" {
+		gid, err = lookupGroupID(groupStr)
+		if err != nil {
+			return "", "", err
 		}
-
-		userObj = u
 	}
 
-	return userObj, nil
+	return uid, gid, nil
 }
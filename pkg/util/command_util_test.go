@@ -18,7 +18,10 @@ package util
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/user"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
@@ -683,3 +686,74 @@ func Test_GetUIDAndGIDFromString(t *testing.T) {
 		}
 	}
 }
+
+// setUpEtcFiles makes users and groups be looked up in fixture /etc/passwd
+// and /etc/group files, until the returned function is called.
+func setUpEtcFiles(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "etc")
+	testutil.CheckNoError(t, err)
+	passwd := `root:x:0:0:root:/root:/bin/sh
+# comment
+app:x:1000:1000::/home/app:/bin/sh
+web:x:1001:2000::/home/web:/bin/sh
+`
+	group := `root:x:0:
+app:x:1000:
+staff:x:2000:web
+docker:x:3000:app,web
+`
+	originalPasswd, originalGroup := passwdFile, groupFile
+	passwdFile, groupFile = filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+	testutil.CheckNoError(t, ioutil.WriteFile(passwdFile, []byte(passwd), 0644))
+	testutil.CheckNoError(t, ioutil.WriteFile(groupFile, []byte(group), 0644))
+	return func() {
+		passwdFile, groupFile = originalPasswd, originalGroup
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetUIDAndGIDFromString_EtcFiles(t *testing.T) {
+	defer setUpEtcFiles(t)()
+
+	tests := []struct {
+		chown       string
+		expectedUID uint32
+		expectedGID uint32
+		shdErr      bool
+	}{
+		{chown: "app", expectedUID: 1000, expectedGID: 1000},
+		{chown: "app:docker", expectedUID: 1000, expectedGID: 3000},
+		{chown: "app:3000", expectedUID: 1000, expectedGID: 3000},
+		{chown: "1000:docker", expectedUID: 1000, expectedGID: 3000},
+		{chown: "web", expectedUID: 1001, expectedGID: 2000},
+		{chown: "1001", expectedUID: 1001, expectedGID: 2000},
+		{chown: "web:staff", expectedUID: 1001, expectedGID: 2000},
+		{chown: "web:app", expectedUID: 1001, expectedGID: 1000},
+		{chown: "1234", expectedUID: 1234, expectedGID: 1234},
+		{chown: "1234:5678", expectedUID: 1234, expectedGID: 5678},
+		{chown: "missing", shdErr: true},
+		{chown: "app:missing", shdErr: true},
+		{chown: "missing:root", shdErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.chown, func(t *testing.T) {
+			uid, gid, err := GetUIDAndGIDFromString(test.chown, true)
+			testutil.CheckError(t, test.shdErr, err)
+			if !test.shdErr {
+				testutil.CheckDeepEqual(t, test.expectedUID, uid)
+				testutil.CheckDeepEqual(t, test.expectedGID, gid)
+			}
+		})
+	}
+
+	t.Run("missing files", func(t *testing.T) {
+		dir := filepath.Dir(passwdFile)
+		passwdFile, groupFile = filepath.Join(dir, "nopasswd"), filepath.Join(dir, "nogroup")
+		uid, gid, err := GetUIDAndGIDFromString("1000:2000", true)
+		testutil.CheckNoError(t, err)
+		testutil.CheckDeepEqual(t, uint32(1000), uid)
+		testutil.CheckDeepEqual(t, uint32(2000), gid)
+		_, _, err = GetUIDAndGIDFromString("app", true)
+		testutil.CheckError(t, true, err)
+	})
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// for testing
+var statfs = syscall.Statfs
+
+// AvailableDiskSpace returns the number of bytes available to kaniko on the
+// filesystem of path.
+func AvailableDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// CheckDiskSpace returns an error if the filesystem of path has less than
+// required bytes available. The space isn't checked if it can't be told.
+func CheckDiskSpace(path string, required uint64) error {
+	available, err := AvailableDiskSpace(path)
+	if err != nil {
+		logrus.Debugf("Unable to check the disk space available in %s: %s", path, err)
+		return nil
+	}
+	logrus.Debugf("%s available in %s, %s required", ByteSize(available), path, ByteSize(required))
+	if available < required {
+		return fmt.Errorf("not enough disk space in %s: %s available, at least %s required", path, ByteSize(available), ByteSize(required))
+	}
+	return nil
+}
+
+// MonitorDiskSpace warns every interval when the filesystem of one of paths
+// has less than low bytes available, until the returned function is called.
+func MonitorDiskSpace(paths []string, low uint64, interval time.Duration) func() {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for _, path := range paths {
+				available, err := AvailableDiskSpace(path)
+				if err == nil && available < low {
+					logging.Warnf("Low disk space in %s: %s available, the build may fail", path, ByteSize(available))
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+// ByteSize returns b as a human-readable size, in binary units.
+func ByteSize(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
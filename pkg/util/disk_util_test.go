@@ -0,0 +1,111 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeStatfs reports available bytes for the filesystems of paths, and fails
+// for the others.
+func fakeStatfs(available map[string]uint64) func(string, *syscall.Statfs_t) error {
+	return func(path string, stat *syscall.Statfs_t) error {
+		a, ok := available[path]
+		if !ok {
+			return errors.New("no such filesystem")
+		}
+		stat.Bsize = 1024
+		stat.Bavail = a / 1024
+		return nil
+	}
+}
+
+func Test_CheckDiskSpace(t *testing.T) {
+	original := statfs
+	defer func() { statfs = original }()
+	statfs = fakeStatfs(map[string]uint64{"/small": 100 << 20})
+
+	tests := []struct {
+		description string
+		path        string
+		required    uint64
+		expectedErr string
+	}{
+		{
+			description: "enough space",
+			path:        "/small",
+			required:    50 << 20,
+		},
+		{
+			description: "not enough space",
+			path:        "/small",
+			required:    2 << 30,
+			expectedErr: "not enough disk space in /small: 100.0 MiB available, at least 2.0 GiB required",
+		},
+		{
+			description: "space can't be told",
+			path:        "/unknown",
+			required:    2 << 30,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := CheckDiskSpace(test.path, test.required)
+			if test.expectedErr == "" {
+				testutil.CheckNoError(t, err)
+				return
+			}
+			testutil.CheckError(t, true, err)
+			testutil.CheckDeepEqual(t, test.expectedErr, err.Error())
+		})
+	}
+}
+
+func Test_MonitorDiskSpace(t *testing.T) {
+	original := statfs
+	defer func() { statfs = original }()
+	statfs = fakeStatfs(map[string]uint64{"/small": 100 << 20, "/large": 100 << 30})
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+
+	stop := MonitorDiskSpace([]string{"/small", "/large", "/unknown"}, 1<<30, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	stop()
+
+	logs := buf.String()
+	if !strings.Contains(logs, "Low disk space in /small: 100.0 MiB available") {
+		t.Errorf("expected a low disk space warning for /small, got %q", logs)
+	}
+	if strings.Contains(logs, "/large") || strings.Contains(logs, "/unknown") {
+		t.Errorf("expected no warning for /large nor /unknown, got %q", logs)
+	}
+	// No warning is logged once the monitor is stopped.
+	buf.Reset()
+	time.Sleep(5 * time.Millisecond)
+	testutil.CheckDeepEqual(t, "", buf.String())
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io"
+	"sync"
+)
+
+// DefaultExtractBufferSize is the size of the buffer the content of files is
+// copied through when layers are extracted, the same as the one of io.Copy.
+const DefaultExtractBufferSize = 32 * 1024
+
+var extractBuffers = newBufferPool(DefaultExtractBufferSize)
+
+// ConfigureExtractBufferSize sets the size of the buffer the content of files
+// is copied through when layers are extracted. Files are streamed to disk, so
+// there is a single buffer per layer being extracted, whatever the size of
+// the files.
+func ConfigureExtractBufferSize(size int) {
+	extractBuffers = newBufferPool(size)
+}
+
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		},
+	}
+}
+
+// copyFileContent copies the content of a file being extracted from r to w.
+func copyFileContent(w io.Writer, r io.Reader) error {
+	buf := extractBuffers.Get().(*[]byte)
+	defer extractBuffers.Put(buf)
+	// Hiding the ReadFrom method of files makes io.CopyBuffer use buf, instead
+	// of allocating a buffer for each file.
+	_, err := io.CopyBuffer(struct{ io.Writer }{w}, r, *buf)
+	return err
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// readSizeRecorder reads size bytes, and records the largest read.
+type readSizeRecorder struct {
+	size    int
+	maxRead int
+}
+
+func (r *readSizeRecorder) Read(p []byte) (int, error) {
+	if len(p) > r.maxRead {
+		r.maxRead = len(p)
+	}
+	if r.size == 0 {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if n > r.size {
+		n = r.size
+	}
+	r.size -= n
+	return n, nil
+}
+
+func Test_copyFileContent_BufferSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract-buffer")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "file"))
+	testutil.CheckNoError(t, err)
+	defer f.Close()
+
+	ConfigureExtractBufferSize(4096)
+	defer ConfigureExtractBufferSize(DefaultExtractBufferSize)
+	r := &readSizeRecorder{size: 1 << 20}
+	testutil.CheckNoError(t, copyFileContent(f, r))
+
+	// Files would otherwise read through a buffer of io.Copy, of 32KiB.
+	testutil.CheckDeepEqual(t, 4096, r.maxRead)
+	fi, err := f.Stat()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, int64(1<<20), fi.Size())
+}
+
+func TestExtractFile_ReusesBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract-buffer")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const files = 100
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for i := 0; i < files; i++ {
+		content := []byte("content")
+		testutil.CheckNoError(t, tw.WriteHeader(&tar.Header{Name: fmt.Sprint(i), Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(content)
+		testutil.CheckNoError(t, err)
+	}
+	testutil.CheckNoError(t, tw.Close())
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	tr := tar.NewReader(&layer)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		testutil.CheckNoError(t, ExtractFile(dir, hdr, tr))
+	}
+	runtime.ReadMemStats(&after)
+
+	// Copying each file through a buffer of its own would allocate one per file.
+	if perFile := (after.TotalAlloc - before.TotalAlloc) / files; perFile >= DefaultExtractBufferSize {
+		t.Errorf("expected the buffer to be reused across files, but %d bytes were allocated per file", perFile)
+	}
+}
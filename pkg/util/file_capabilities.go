@@ -0,0 +1,95 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"syscall"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	capabilityXattr = "security.capability"
+	// paxCapabilityRecord is the PAX record the capabilities of files are kept
+	// in, in the format of GNU tar.
+	paxCapabilityRecord = "SCHILY.xattr." + capabilityXattr
+)
+
+var preserveFileCapabilities = true
+
+// for testing
+var setCapabilities = setCapabilityXattr
+
+// ConfigurePreserveFileCapabilities sets whether the capabilities of files,
+// as set by setcap, are restored when extracting them and kept when adding
+// them to snapshots.
+func ConfigurePreserveFileCapabilities(preserve bool) {
+	preserveFileCapabilities = preserve
+}
+
+// restoreFileCapabilities sets the capabilities of the file at path to the
+// ones kept in the PAX records of hdr, if there are any. It must be called
+// after the file is chowned, as chown clears them. The capabilities are left
+// out with a warning if they can't be set without privileges or aren't
+// supported by the filesystem.
+func restoreFileCapabilities(path string, hdr *tar.Header) error {
+	if !preserveFileCapabilities {
+		return nil
+	}
+	caps, ok := hdr.PAXRecords[paxCapabilityRecord]
+	if !ok {
+		return nil
+	}
+	err := setCapabilities(path, []byte(caps))
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.ENOTSUP), errors.Is(err, syscall.EOPNOTSUPP):
+		logging.Warnf("Not restoring the capabilities of %s: %s", path, err)
+		return nil
+	default:
+		return errors.Wrapf(err, "restoring the capabilities of %s, set --preserve-file-capabilities=false if the filesystem doesn't support them", path)
+	}
+}
+
+// fileCapabilities returns the capabilities of the file at path, or an empty
+// string if it has none or they can't be read.
+func fileCapabilities(path string) string {
+	if !preserveFileCapabilities {
+		return ""
+	}
+	caps, err := getCapabilityXattr(path)
+	if err != nil {
+		return ""
+	}
+	return string(caps)
+}
+
+// addFileCapabilities keeps the capabilities of the file at path in the PAX
+// records of hdr.
+func addFileCapabilities(path string, hdr *tar.Header) {
+	caps := fileCapabilities(path)
+	if caps == "" {
+		return
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = map[string]string{}
+	}
+	hdr.PAXRecords[paxCapabilityRecord] = caps
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import "syscall"
+
+// setCapabilityXattr sets the capabilities of the file at path to caps.
+func setCapabilityXattr(path string, caps []byte) error {
+	return syscall.Setxattr(path, capabilityXattr, caps, 0)
+}
+
+// getCapabilityXattr returns the capabilities of the file at path.
+func getCapabilityXattr(path string) ([]byte, error) {
+	// Capabilities are at most 24 bytes long, in version 3.
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(path, capabilityXattr, buf)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, syscall.ENODATA
+	}
+	return buf[:n], nil
+}
@@ -22,7 +22,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math"
 	"net/http"
 	"os"
@@ -34,12 +33,14 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/timing"
 	"github.com/docker/docker/builder/dockerignore"
+	"github.com/docker/docker/pkg/symlink"
 	"github.com/docker/docker/pkg/fileutils"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/karrick/godirwalk"
 	otiai10Cpy "github.com/otiai10/copy"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
 )
 
 const DoNotChangeUID = -1
@@ -77,18 +78,26 @@ var defaultIgnoreList = []IgnoreListEntry{
 var baseIgnoreList = defaultIgnoreList
 var ignorelist = baseIgnoreList
 
+// unignoredPaths are the paths removed from the ignore list, which are
+// snapshotted even if they are mount points.
+var unignoredPaths = map[string]struct{}{}
+
 var volumes = []string{}
 
 type FileContext struct {
 	Root          string
 	ExcludedFiles []string
+	// FS is the filesystem the context is read from. If nil, the context is
+	// read from the host filesystem.
+	FS afero.Fs
 }
 
 type ExtractFunction func(string, *tar.Header, io.Reader) error
 
 type FSConfig struct {
-	includeWhiteout bool
-	extractFunc     ExtractFunction
+	includeWhiteout  bool
+	extractFunc      ExtractFunction
+	fetchParallelism int
 }
 
 type FSOpt func(*FSConfig)
@@ -102,9 +111,31 @@ func AddToIgnoreList(entry IgnoreListEntry) {
 }
 
 func AddToBaseIgnoreList(entry IgnoreListEntry) {
+	delete(unignoredPaths, filepath.Clean(entry.Path))
 	baseIgnoreList = append(baseIgnoreList, entry)
 }
 
+// RemoveFromBaseIgnoreList makes path be snapshotted, even though it is in the
+// default ignore list, was added to it, or is a mount point. Only the entry of
+// path itself is removed: paths below it that are ignored stay ignored.
+// The kaniko directory can't be removed.
+func RemoveFromBaseIgnoreList(path string) error {
+	path = filepath.Clean(path)
+	if path == filepath.Clean(config.KanikoDir) {
+		return fmt.Errorf("%s can't be removed from the ignore list", path)
+	}
+	unignoredPaths[path] = struct{}{}
+	// Build a new list, as the base list shares its array with the default one.
+	list := []IgnoreListEntry{}
+	for _, entry := range baseIgnoreList {
+		if filepath.Clean(entry.Path) != path {
+			list = append(list, entry)
+		}
+	}
+	baseIgnoreList = list
+	return nil
+}
+
 func IncludeWhiteout() FSOpt {
 	return func(opts *FSConfig) {
 		opts.includeWhiteout = true
@@ -117,9 +148,17 @@ func ExtractFunc(extractFunc ExtractFunction) FSOpt {
 	}
 }
 
+// FetchParallelism makes up to n layers be downloaded in parallel, ahead of
+// their extraction. Layers are still extracted one at a time, in order.
+func FetchParallelism(n int) FSOpt {
+	return func(opts *FSConfig) {
+		opts.fetchParallelism = n
+	}
+}
+
 // GetFSFromImage extracts the layers of img to root
 // It returns a list of all files extracted
-func GetFSFromImage(root string, img v1.Image, extract ExtractFunction) ([]string, error) {
+func GetFSFromImage(root string, img v1.Image, extract ExtractFunction, opts ...FSOpt) ([]string, error) {
 	if img == nil {
 		return nil, errors.New("image cannot be nil")
 	}
@@ -129,7 +168,7 @@ func GetFSFromImage(root string, img v1.Image, extract ExtractFunction) ([]strin
 		return nil, err
 	}
 
-	return GetFSFromLayers(root, layers, ExtractFunc(extract))
+	return GetFSFromLayers(root, layers, append([]FSOpt{ExtractFunc(extract)}, opts...)...)
 }
 
 func GetFSFromLayers(root string, layers []v1.Layer, opts ...FSOpt) ([]string, error) {
@@ -149,56 +188,79 @@ func GetFSFromLayers(root string, layers []v1.Layer, opts ...FSOpt) ([]string, e
 
 	logrus.Debugf("Mounted directories: %v", ignorelist)
 
+	if cfg.fetchParallelism > 1 && len(layers) > 1 {
+		var cleanup func()
+		layers, cleanup = prefetchLayers(layers, cfg.fetchParallelism)
+		defer cleanup()
+	}
+
 	extractedFiles := []string{}
 	for i, l := range layers {
-		if mediaType, err := l.MediaType(); err == nil {
-			logrus.Tracef("Extracting layer %d of media type %s", i, mediaType)
-		} else {
-			logrus.Tracef("Extracting layer %d", i)
-		}
-
-		r, err := l.Uncompressed()
+		files, err := extractLayer(root, i, l, cfg)
 		if err != nil {
 			return nil, err
 		}
-		defer r.Close()
+		extractedFiles = append(extractedFiles, files...)
+	}
+	return extractedFiles, nil
+}
 
-		tr := tar.NewReader(r)
-		for {
-			hdr, err := tr.Next()
-			if err == io.EOF {
-				break
-			}
+// extractLayer extracts the layer l, the i-th layer of an image, to root.
+// It returns a list of all files extracted.
+func extractLayer(root string, i int, l v1.Layer, cfg *FSConfig) ([]string, error) {
+	if mediaType, err := l.MediaType(); err == nil {
+		logrus.Tracef("Extracting layer %d of media type %s", i, mediaType)
+	} else {
+		logrus.Tracef("Extracting layer %d", i)
+	}
 
-			if err != nil {
-				return nil, errors.Wrap(err, fmt.Sprintf("error reading tar %d", i))
-			}
+	r, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
 
-			path := filepath.Join(root, filepath.Clean(hdr.Name))
-			base := filepath.Base(path)
-			dir := filepath.Dir(path)
+	extractedFiles := []string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
 
-			if strings.HasPrefix(base, ".wh.") {
-				logrus.Debugf("Whiting out %s", path)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("error reading tar %d", i))
+		}
 
-				name := strings.TrimPrefix(base, ".wh.")
-				if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
-					return nil, errors.Wrapf(err, "removing whiteout %s", hdr.Name)
-				}
+		path, err := extractionPath(root, hdr.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "extracting layer %d", i)
+		}
+		base := filepath.Base(path)
+		dir := filepath.Dir(path)
 
-				if !cfg.includeWhiteout {
-					logrus.Debug("not including whiteout files")
-					continue
-				}
+		if strings.HasPrefix(base, ".wh.") {
+			logrus.Debugf("Whiting out %s", path)
 
+			name := filepath.Join(dir, strings.TrimPrefix(base, ".wh."))
+			if CheckIgnoreList(name) && !checkIgnoreListRoot(root) {
+				logrus.Debugf("Not whiting out %s because it is ignored", name)
+			} else if err := os.RemoveAll(name); err != nil {
+				return nil, errors.Wrapf(err, "removing whiteout %s", hdr.Name)
 			}
 
-			if err := cfg.extractFunc(root, hdr, tr); err != nil {
-				return nil, err
+			if !cfg.includeWhiteout {
+				logrus.Debug("not including whiteout files")
+				continue
 			}
 
-			extractedFiles = append(extractedFiles, filepath.Join(root, filepath.Clean(hdr.Name)))
 		}
+
+		if err := cfg.extractFunc(root, hdr, tr); err != nil {
+			return nil, err
+		}
+
+		extractedFiles = append(extractedFiles, path)
 	}
 	return extractedFiles, nil
 }
@@ -267,13 +329,43 @@ func unTar(r io.Reader, dest string) ([]string, error) {
 		if err := ExtractFile(dest, hdr, tr); err != nil {
 			return nil, err
 		}
-		extractedFiles = append(extractedFiles, filepath.Join(dest, filepath.Clean(hdr.Name)))
+		path, err := extractionPath(dest, hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		extractedFiles = append(extractedFiles, path)
 	}
 	return extractedFiles, nil
 }
 
+// extractionPath returns the path the tar entry name is extracted to in dest.
+// Like with Docker, absolute names are extracted below dest, and names leading
+// outside of dest with .. are rejected. The symlinks of the parent directories
+// are resolved within dest, so that an entry can't be written outside of it
+// through a symlink extracted before it.
+func extractionPath(dest, name string) (string, error) {
+	dest = filepath.Clean(dest)
+	path := filepath.Join(dest, filepath.Clean(name))
+	// Nothing leads outside of /, and symlinks are already resolved within it
+	// by the kernel.
+	if dest == "/" || path == dest {
+		return path, nil
+	}
+	if !HasFilepathPrefix(path, dest, false) {
+		return "", fmt.Errorf("tar entry %s leads outside of %s", name, dest)
+	}
+	dir, err := symlink.FollowSymlinkInScope(filepath.Dir(path), dest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
 func ExtractFile(dest string, hdr *tar.Header, tr io.Reader) error {
-	path := filepath.Join(dest, filepath.Clean(hdr.Name))
+	path, err := extractionPath(dest, hdr.Name)
+	if err != nil {
+		return err
+	}
 	base := filepath.Base(path)
 	dir := filepath.Dir(path)
 	mode := hdr.FileInfo().Mode()
@@ -317,7 +409,7 @@ func ExtractFile(dest string, hdr *tar.Header, tr io.Reader) error {
 			return err
 		}
 
-		if _, err = io.Copy(currFile, tr); err != nil {
+		if err = copyFileContent(currFile, tr); err != nil {
 			return err
 		}
 
@@ -325,6 +417,10 @@ func ExtractFile(dest string, hdr *tar.Header, tr io.Reader) error {
 			return err
 		}
 
+		if err = restoreFileCapabilities(path, hdr); err != nil {
+			return err
+		}
+
 		if err = setFileTimes(path, hdr.AccessTime, hdr.ModTime); err != nil {
 			return err
 		}
@@ -357,7 +453,10 @@ func ExtractFile(dest string, hdr *tar.Header, tr io.Reader) error {
 				return errors.Wrapf(err, "error removing %s to make way for new link", hdr.Name)
 			}
 		}
-		link := filepath.Clean(filepath.Join(dest, hdr.Linkname))
+		link, err := extractionPath(dest, hdr.Linkname)
+		if err != nil {
+			return err
+		}
 		if err := os.Link(link, path); err != nil {
 			return err
 		}
@@ -395,13 +494,19 @@ func IsInProvidedIgnoreList(path string, wl []IgnoreListEntry) bool {
 	return false
 }
 
+// CheckIgnoreList returns whether path is ignored, or is below an ignored
+// directory.
 func CheckIgnoreList(path string) bool {
-	for _, wl := range ignorelist {
-		if HasFilepathPrefix(path, wl.Path, wl.PrefixMatchOnly) {
+	return isBelowIgnoreList(path, ignorelist)
+}
+
+// isBelowIgnoreList returns whether path is or is below an entry of list.
+func isBelowIgnoreList(path string, list []IgnoreListEntry) bool {
+	for _, entry := range list {
+		if HasFilepathPrefix(path, entry.Path, entry.PrefixMatchOnly) {
 			return true
 		}
 	}
-
 	return false
 }
 
@@ -441,7 +546,9 @@ func DetectFilesystemIgnoreList(path string) error {
 			}
 			continue
 		}
-		if lineArr[4] != config.RootDir {
+		if _, ok := unignoredPaths[filepath.Clean(lineArr[4])]; ok {
+			logrus.Debugf("Not ignoring mount point %s, as it was removed from the ignore list", lineArr[4])
+		} else if lineArr[4] != config.RootDir {
 			logrus.Tracef("Appending %s from line: %s", lineArr[4], line)
 			ignorelist = append(ignorelist, IgnoreListEntry{
 				Path:            lineArr[4],
@@ -453,15 +560,43 @@ func DetectFilesystemIgnoreList(path string) error {
 			break
 		}
 	}
+	ignorelist = append(ignorelist, resolvedIgnoreList(ignorelist)...)
 	return nil
 }
 
+// resolvedIgnoreList returns the entries of list that are symlinks, such as
+// /var/run when it points to /run, with the symlinks resolved. The paths they
+// point to are ignored too, as they are the same directories.
+func resolvedIgnoreList(list []IgnoreListEntry) []IgnoreListEntry {
+	resolved := []IgnoreListEntry{}
+	for _, entry := range list {
+		if entry.PrefixMatchOnly {
+			continue
+		}
+		// EvalSymlinks fails on symlink loops.
+		target, err := filepath.EvalSymlinks(entry.Path)
+		if err != nil || target == entry.Path || target == config.RootDir || target == "/" {
+			continue
+		}
+		if _, ok := unignoredPaths[target]; ok || isBelowIgnoreList(target, list) || isBelowIgnoreList(target, resolved) {
+			continue
+		}
+		logrus.Debugf("Ignoring %s, as %s points to it", target, entry.Path)
+		resolved = append(resolved, IgnoreListEntry{Path: target})
+	}
+	return resolved
+}
+
 // RelativeFiles returns a list of all files at the filepath relative to root
 func RelativeFiles(fp string, root string) ([]string, error) {
+	return relativeFiles(afero.NewOsFs(), fp, root)
+}
+
+func relativeFiles(fs afero.Fs, fp string, root string) ([]string, error) {
 	var files []string
 	fullPath := filepath.Join(root, fp)
 	logrus.Debugf("Getting files and contents at root %s for %s", root, fullPath)
-	err := filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+	err := afero.Walk(fs, fullPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -554,7 +689,16 @@ func AddVolumePathToIgnoreList(path string) {
 // 	1. If <src> is a remote file URL:
 // 		- destination will have permissions of 0600
 // 		- If remote file has HTTP Last-Modified header, we set the mtime of the file to that timestamp
-func DownloadFileToDest(rawurl, dest string, uid, gid int64) error {
+// If checksum isn't empty, the file is removed and an error returned if its
+// contents don't have it.
+func DownloadFileToDest(rawurl, dest string, uid, gid int64, checksum string) error {
+	var verifier *checksumVerifier
+	if checksum != "" {
+		var err error
+		if verifier, err = newChecksumVerifier(checksum); err != nil {
+			return err
+		}
+	}
 	resp, err := http.Get(rawurl)
 	if err != nil {
 		return err
@@ -565,9 +709,19 @@ func DownloadFileToDest(rawurl, dest string, uid, gid int64) error {
 		return fmt.Errorf("invalid response status %d", resp.StatusCode)
 	}
 
-	if err := CreateFile(dest, resp.Body, 0600, uint32(uid), uint32(gid)); err != nil {
+	var body io.Reader = resp.Body
+	if verifier != nil {
+		body = io.TeeReader(resp.Body, verifier)
+	}
+	if err := CreateFile(dest, body, 0600, uint32(uid), uint32(gid)); err != nil {
 		return err
 	}
+	if verifier != nil {
+		if err := verifier.verify(rawurl); err != nil {
+			os.Remove(dest)
+			return err
+		}
+	}
 	mTime := time.Time{}
 	lastMod := resp.Header.Get("Last-Modified")
 	if lastMod != "" {
@@ -580,27 +734,52 @@ func DownloadFileToDest(rawurl, dest string, uid, gid int64) error {
 
 // DetermineTargetFileOwnership returns the user provided uid/gid combination.
 // If they are set to -1, the uid/gid from the original file is used.
+// Files without ownership information, such as those from an in-memory context,
+// are owned by root.
 func DetermineTargetFileOwnership(fi os.FileInfo, uid, gid int64) (int64, int64) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
 	if uid <= DoNotChangeUID {
-		uid = int64(fi.Sys().(*syscall.Stat_t).Uid)
+		uid = 0
+		if ok {
+			uid = int64(stat.Uid)
+		}
 	}
 	if gid <= DoNotChangeGID {
-		gid = int64(fi.Sys().(*syscall.Stat_t).Gid)
+		gid = 0
+		if ok {
+			gid = int64(stat.Gid)
+		}
 	}
 	return uid, gid
 }
 
 // CopyDir copies the file or directory at src to dest
 // It returns a list of files it copied over
+// Like with Docker, the copies keep the modification times of the sources.
 func CopyDir(src, dest string, context FileContext, uid, gid int64) ([]string, error) {
-	files, err := RelativeFiles("", src)
+	files, err := relativeFiles(context.Filesystem(), "", src)
 	if err != nil {
 		return nil, errors.Wrap(err, "copying dir")
 	}
 	var copiedFiles []string
+	dirTimes := map[string]time.Time{}
+	// Each destination directory is resolved once, and its files are copied
+	// into the resolved directory.
+	resolvedDirs := map[string]string{}
+	resolveDir := func(dir string) (string, error) {
+		if resolved, ok := resolvedDirs[dir]; ok {
+			return resolved, nil
+		}
+		resolved, err := ResolveDestination(dir)
+		if err != nil {
+			return "", err
+		}
+		resolvedDirs[dir] = resolved
+		return resolved, nil
+	}
 	for _, file := range files {
 		fullPath := filepath.Join(src, file)
-		fi, err := os.Lstat(fullPath)
+		fi, err := context.Lstat(fullPath)
 		if err != nil {
 			return nil, errors.Wrap(err, "copying dir")
 		}
@@ -608,7 +787,20 @@ func CopyDir(src, dest string, context FileContext, uid, gid int64) ([]string, e
 			logrus.Debugf("%s found in .dockerignore, ignoring", src)
 			continue
 		}
+		// Symlinks in the destination directories are followed within the
+		// image, while files and symlinks being copied replace the file at
+		// their destination, even if it's a symlink, like with Docker.
 		destPath := filepath.Join(dest, file)
+		if fi.IsDir() {
+			destPath, err = resolveDir(destPath)
+		} else {
+			var dir string
+			dir, err = resolveDir(filepath.Dir(destPath))
+			destPath = filepath.Join(dir, filepath.Base(destPath))
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "copying dir")
+		}
 		if fi.IsDir() {
 			logrus.Tracef("Creating directory %s", destPath)
 
@@ -617,6 +809,7 @@ func CopyDir(src, dest string, context FileContext, uid, gid int64) ([]string, e
 			if err := mkdirAllWithPermissions(destPath, mode, uid, gid); err != nil {
 				return nil, err
 			}
+			dirTimes[destPath] = fi.ModTime()
 		} else if IsSymlink(fi) {
 			// If file is a symlink, we want to create the same relative symlink
 			if _, err := CopySymlink(fullPath, destPath, context); err != nil {
@@ -624,15 +817,48 @@ func CopyDir(src, dest string, context FileContext, uid, gid int64) ([]string, e
 			}
 		} else {
 			// ... Else, we want to copy over a file
+			if dfi, err := os.Lstat(destPath); err == nil && IsSymlink(dfi) {
+				if err := os.Remove(destPath); err != nil {
+					return nil, errors.Wrap(err, "copying dir")
+				}
+			}
 			if _, err := CopyFile(fullPath, destPath, context, uid, gid); err != nil {
 				return nil, err
 			}
 		}
 		copiedFiles = append(copiedFiles, destPath)
 	}
+	// Copying files into a directory changes its modification time, so it's
+	// only set once all of them are copied.
+	for dir, mTime := range dirTimes {
+		if err := setFileTimes(dir, mTime, mTime); err != nil {
+			return nil, errors.Wrap(err, "copying dir")
+		}
+	}
 	return copiedFiles, nil
 }
 
+// ResolveDestination returns path with its symlinks resolved the way they are
+// in the image: absolute symlinks and .. are resolved from config.RootDir, so
+// that following them never leads outside of the filesystem of the image, like
+// with Docker. It's an error for path to lead to a path kaniko ignores through
+// a symlink, such as the kaniko directory, as files must not be copied there.
+// Paths which aren't below config.RootDir are resolved from /.
+func ResolveDestination(path string) (string, error) {
+	root := config.RootDir
+	if !HasFilepathPrefix(path, root, false) {
+		root = "/"
+	}
+	resolved, err := symlink.FollowSymlinkInScope(path, root)
+	if err != nil {
+		return "", err
+	}
+	if resolved != filepath.Clean(path) && isBelowIgnoreList(resolved, ignorelist) && !isBelowIgnoreList(path, ignorelist) {
+		return "", fmt.Errorf("%s leads to %s through a symlink, which kaniko can't write to", path, resolved)
+	}
+	return resolved, nil
+}
+
 // CopySymlink copies the symlink at src to dest.
 func CopySymlink(src, dest string, context FileContext) (bool, error) {
 	if context.ExcludesFile(src) {
@@ -647,14 +873,14 @@ func CopySymlink(src, dest string, context FileContext) (bool, error) {
 	if err := createParentDirectory(dest); err != nil {
 		return false, err
 	}
-	link, err := os.Readlink(src)
+	link, err := context.readlink(src)
 	if err != nil {
 		logrus.Debugf("could not read link for %s", src)
 	}
 	return false, os.Symlink(link, dest)
 }
 
-// CopyFile copies the file at src to dest
+// CopyFile copies the file at src to dest, keeping its modification time
 func CopyFile(src, dest string, context FileContext, uid, gid int64) (bool, error) {
 	if context.ExcludesFile(src) {
 		logrus.Debugf("%s found in .dockerignore, ignoring", src)
@@ -666,23 +892,36 @@ func CopyFile(src, dest string, context FileContext, uid, gid int64) (bool, erro
 		// See iusse #904 for an example.
 		return false, nil
 	}
-	fi, err := os.Stat(src)
+	fs := context.Filesystem()
+	fi, err := fs.Stat(src)
 	if err != nil {
 		return false, err
 	}
 	logrus.Debugf("Copying file %s to %s", src, dest)
-	srcFile, err := os.Open(src)
+	srcFile, err := fs.Open(src)
 	if err != nil {
 		return false, err
 	}
 	defer srcFile.Close()
 	uid, gid = DetermineTargetFileOwnership(fi, uid, gid)
-	return false, CreateFile(dest, srcFile, fi.Mode(), uint32(uid), uint32(gid))
+	if err := CreateFile(dest, srcFile, fi.Mode(), uint32(uid), uint32(gid)); err != nil {
+		return false, err
+	}
+	return false, setFileTimes(dest, fi.ModTime(), fi.ModTime())
 }
 
 func NewFileContextFromDockerfile(dockerfilePath, buildcontext string) (FileContext, error) {
-	fileContext := FileContext{Root: buildcontext}
-	excludedFiles, err := getExcludedFiles(dockerfilePath, buildcontext)
+	return newFileContext(dockerfilePath, FileContext{Root: buildcontext})
+}
+
+// NewFileContextFromFS returns a FileContext reading the build context from the
+// root of fs, rather than from the host filesystem.
+func NewFileContextFromFS(dockerfilePath string, fs afero.Fs) (FileContext, error) {
+	return newFileContext(dockerfilePath, FileContext{Root: "/", FS: fs})
+}
+
+func newFileContext(dockerfilePath string, fileContext FileContext) (FileContext, error) {
+	excludedFiles, err := getExcludedFiles(dockerfilePath, fileContext)
 	if err != nil {
 		return fileContext, err
 	}
@@ -691,16 +930,19 @@ func NewFileContextFromDockerfile(dockerfilePath, buildcontext string) (FileCont
 }
 
 // getExcludedFiles returns a list of files to exclude from the .dockerignore
-func getExcludedFiles(dockerfilePath, buildcontext string) ([]string, error) {
+// next to the Dockerfile, or else from the .dockerignore in the build context
+func getExcludedFiles(dockerfilePath string, fileContext FileContext) ([]string, error) {
+	fs := afero.NewOsFs()
 	path := dockerfilePath + ".dockerignore"
 	if !FilepathExists(path) {
-		path = filepath.Join(buildcontext, ".dockerignore")
+		fs = fileContext.Filesystem()
+		path = filepath.Join(fileContext.Root, ".dockerignore")
 	}
-	if !FilepathExists(path) {
+	if _, err := fs.Stat(path); err != nil {
 		return nil, nil
 	}
 	logrus.Infof("Using dockerignore file: %v", path)
-	contents, err := ioutil.ReadFile(path)
+	contents, err := afero.ReadFile(fs, path)
 	if err != nil {
 		return nil, errors.Wrap(err, "parsing .dockerignore")
 	}
@@ -708,10 +950,37 @@ func getExcludedFiles(dockerfilePath, buildcontext string) ([]string, error) {
 	return dockerignore.ReadAll(reader)
 }
 
+// Filesystem returns the filesystem the context is read from.
+func (c FileContext) Filesystem() afero.Fs {
+	if c.FS == nil {
+		return afero.NewOsFs()
+	}
+	return c.FS
+}
+
+// Lstat returns the FileInfo for path in the context, without following
+// symlinks if the context's filesystem supports them.
+func (c FileContext) Lstat(path string) (os.FileInfo, error) {
+	fs := c.Filesystem()
+	if lstater, ok := fs.(afero.Lstater); ok {
+		fi, _, err := lstater.LstatIfPossible(path)
+		return fi, err
+	}
+	return fs.Stat(path)
+}
+
+func (c FileContext) readlink(path string) (string, error) {
+	if _, ok := c.Filesystem().(*afero.OsFs); !ok {
+		return "", fmt.Errorf("reading symlink %s is not supported by the build context", path)
+	}
+	return os.Readlink(path)
+}
+
 // ExcludesFile returns true if the file context specified this file should be ignored.
 // Usually this is specified via .dockerignore
 func (c FileContext) ExcludesFile(path string) bool {
-	if HasFilepathPrefix(path, c.Root, false) {
+	// HasFilepathPrefix never matches a root of "/", which contexts read from a filesystem use.
+	if (c.Root == "/" && filepath.IsAbs(path)) || HasFilepathPrefix(path, c.Root, false) {
 		var err error
 		path, err = filepath.Rel(c.Root, path)
 		if err != nil {
@@ -916,6 +1185,7 @@ func UpdateInitialIgnoreList(ignoreVarRun bool) {
 type walkFSResult struct {
 	filesAdded    []string
 	existingPaths map[string]struct{}
+	err           error
 }
 
 // WalkFS given a directory and list of existing files,
@@ -923,7 +1193,9 @@ type walkFSResult struct {
 // of deleted files.
 // It timesout after 90 mins. Can be configured via setting an environment variable
 // SNAPSHOT_TIMEOUT in the kaniko pod definition.
-func WalkFS(dir string, existingPaths map[string]struct{}, changeFunc func(string) (bool, error)) ([]string, map[string]struct{}) {
+// It returns an error if a file can't be read without root, unless it is
+// skipped, see ConfigureRootless.
+func WalkFS(dir string, existingPaths map[string]struct{}, changeFunc func(string) (bool, error)) ([]string, map[string]struct{}, error) {
 	timeOutStr := os.Getenv(snapshotTimeout)
 	if timeOutStr == "" {
 		logrus.Tracef("%s environment not set. Using default snapshot timeout %s", snapshotTimeout, defaultTimeout)
@@ -944,16 +1216,17 @@ func WalkFS(dir string, existingPaths map[string]struct{}, changeFunc func(strin
 	select {
 	case res := <-ch:
 		timing.DefaultRun.Stop(timer)
-		return res.filesAdded, res.existingPaths
+		return res.filesAdded, res.existingPaths, res.err
 	case <-time.After(timeOut):
 		timing.DefaultRun.Stop(timer)
 		logrus.Fatalf("timed out snapshotting FS in %s", timeOutStr)
-		return nil, nil
+		return nil, nil, nil
 	}
 }
 
 func gowalkDir(dir string, existingPaths map[string]struct{}, changeFunc func(string) (bool, error)) walkFSResult {
 	foundPaths := make([]string, 0)
+	var unreadableErr error
 	godirwalk.Walk(dir, &godirwalk.Options{
 		Callback: func(path string, ent *godirwalk.Dirent) error {
 			logrus.Tracef("Analyzing path %s", path)
@@ -972,10 +1245,20 @@ func gowalkDir(dir string, existingPaths map[string]struct{}, changeFunc func(st
 			}
 			return nil
 		},
+		ErrorCallback: func(path string, err error) godirwalk.ErrorAction {
+			if !errors.Is(err, os.ErrPermission) {
+				return godirwalk.Halt
+			}
+			if SkipUnreadable(path, err) {
+				return godirwalk.SkipNode
+			}
+			unreadableErr = errors.Wrapf(err, "reading %s", path)
+			return godirwalk.Halt
+		},
 		Unsorted: true,
 	},
 	)
-	return walkFSResult{foundPaths, existingPaths}
+	return walkFSResult{foundPaths, existingPaths, unreadableErr}
 }
 
 // GetFSInfoMap given a directory gets a map of FileInfo for all files
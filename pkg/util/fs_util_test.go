@@ -25,8 +25,10 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -36,6 +38,7 @@ import (
 	"github.com/golang/mock/gomock"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/spf13/afero"
 )
 
 func Test_DetectFilesystemSkiplist(t *testing.T) {
@@ -104,6 +107,54 @@ func Test_AddToBaseIgnoreList(t *testing.T) {
 	}
 }
 
+func Test_RemoveFromBaseIgnoreList(t *testing.T) {
+	t.Cleanup(func() {
+		baseIgnoreList = defaultIgnoreList
+		ignorelist = baseIgnoreList
+		unignoredPaths = map[string]struct{}{}
+	})
+	testDir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(testDir)
+	mountInfo := filepath.Join(testDir, "mountinfo")
+	testutil.CheckNoError(t, ioutil.WriteFile(mountInfo, []byte(`229 228 0:98 / /proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+230 228 0:99 / /var/run rw,nosuid - tmpfs tmpfs rw,size=65536k,mode=755
+231 230 0:100 / /var/run/docker.sock rw,nosuid,noexec,relatime - tmpfs tmpfs rw
+`), 0644))
+
+	UpdateInitialIgnoreList(true)
+	AddToBaseIgnoreList(IgnoreListEntry{Path: "/added"})
+	testutil.CheckNoError(t, RemoveFromBaseIgnoreList("/etc/mtab"))
+	testutil.CheckNoError(t, RemoveFromBaseIgnoreList("/var/run/"))
+	testutil.CheckError(t, true, RemoveFromBaseIgnoreList(config.KanikoDir))
+	testutil.CheckNoError(t, DetectFilesystemIgnoreList(mountInfo))
+
+	for path, ignored := range map[string]bool{
+		"/etc/mtab":            false,
+		"/var/run":             false,
+		"/var/run/foo":         false,
+		"/var/run/docker.sock": true,
+		"/proc":                true,
+		"/added":               true,
+		"/kaniko":              true,
+	} {
+		if got := CheckIgnoreList(path); got != ignored {
+			t.Errorf("CheckIgnoreList(%s) = %v, want %v", path, got, ignored)
+		}
+	}
+	// The default ignore list is unchanged.
+	if !IsInProvidedIgnoreList("/etc/mtab", defaultIgnoreList) {
+		t.Errorf("expected /etc/mtab to still be in the default ignore list")
+	}
+
+	// Paths added back are ignored again.
+	AddToBaseIgnoreList(IgnoreListEntry{Path: "/var/run"})
+	testutil.CheckNoError(t, DetectFilesystemIgnoreList(mountInfo))
+	if !CheckIgnoreList("/var/run") {
+		t.Errorf("expected /var/run to be ignored once added back")
+	}
+}
+
 var tests = []struct {
 	files         map[string]string
 	directory     string
@@ -343,6 +394,59 @@ func Test_CheckIgnoreList(t *testing.T) {
 	}
 }
 
+func Test_CheckIgnoreList_Symlinks(t *testing.T) {
+	original := ignorelist
+	defer func() { ignorelist = original }()
+	testDir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(testDir)
+	testDir, err = filepath.EvalSymlinks(testDir)
+	testutil.CheckNoError(t, err)
+
+	// ignored is an ignored directory, link points to it, var/run points to
+	// run, as in many images, and loop1 and loop2 point to each other.
+	for _, dir := range []string{"ignored", "run", "var"} {
+		testutil.CheckNoError(t, os.Mkdir(filepath.Join(testDir, dir), 0755))
+	}
+	for link, target := range map[string]string{
+		"link":    filepath.Join(testDir, "ignored"),
+		"var/run": "../run",
+		"loop1":   filepath.Join(testDir, "loop2"),
+		"loop2":   filepath.Join(testDir, "loop1"),
+	} {
+		testutil.CheckNoError(t, os.Symlink(target, filepath.Join(testDir, link)))
+	}
+	mountInfo := filepath.Join(testDir, "mountinfo")
+	testutil.CheckNoError(t, ioutil.WriteFile(mountInfo, []byte(fmt.Sprintf(
+		"229 228 0:98 / %s rw - tmpfs tmpfs rw\n230 228 0:99 / %s rw - tmpfs tmpfs rw\n231 228 0:100 / %s rw - tmpfs tmpfs rw\n",
+		filepath.Join(testDir, "ignored"), filepath.Join(testDir, "var/run"), filepath.Join(testDir, "loop1"))), 0644))
+	testutil.CheckNoError(t, DetectFilesystemIgnoreList(mountInfo))
+
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{path: "ignored/file", ignored: true},
+		// Only the ignored paths are resolved, not every path checked.
+		{path: "link", ignored: false},
+		{path: "link/file", ignored: false},
+		{path: "var/run/file", ignored: true},
+		// run is the directory var/run points to.
+		{path: "run", ignored: true},
+		{path: "run/file", ignored: true},
+		{path: "var", ignored: false},
+		{path: "loop1/file", ignored: true},
+		{path: "loop2/file", ignored: false},
+		{path: "file", ignored: false},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			testutil.CheckDeepEqual(t, test.ignored, CheckIgnoreList(filepath.Join(testDir, test.path)))
+		})
+	}
+	testutil.CheckDeepEqual(t, true, IsInIgnoreList(filepath.Join(testDir, "run")))
+}
+
 func TestHasFilepathPrefix(t *testing.T) {
 	type args struct {
 		path            string
@@ -1002,6 +1106,113 @@ func Test_correctDockerignoreFileIsUsed(t *testing.T) {
 	}
 }
 
+func Test_CopyDir_FromFS(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	for path, contents := range map[string]string{
+		"/src/foo":       "foo",
+		"/src/sub/bar":   "bar",
+		"/src/ignored":   "ignored",
+		"/.dockerignore": "src/ignored",
+	} {
+		if err := afero.WriteFile(fs, path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileContext, err := NewFileContextFromFS("", fs)
+	testutil.CheckNoError(t, err)
+
+	srcs, _, err := ResolveEnvAndWildcards([]string{"src/*", "dest/"}, fileContext, nil)
+	testutil.CheckErrorAndDeepEqual(t, false, err, []string{"src/foo", "src/ignored", "src/sub"}, srcs)
+
+	dest, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	_, err = CopyDir("/src", dest, fileContext, DoNotChangeUID, DoNotChangeGID)
+	testutil.CheckNoError(t, err)
+
+	copied, err := RelativeFiles("", dest)
+	testutil.CheckErrorAndDeepEqual(t, false, err, []string{".", "foo", "sub", "sub/bar"}, copied)
+	b, err := ioutil.ReadFile(filepath.Join(dest, "sub/bar"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "bar", string(b))
+}
+
+func Test_CopyDir_KeepsModTimes(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	testutil.CheckNoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	testutil.CheckNoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("file"), 0644))
+	testutil.CheckNoError(t, ioutil.WriteFile(filepath.Join(src, "top"), []byte("top"), 0644))
+	modTimes := map[string]time.Time{
+		"sub/file": time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+		"sub":      time.Date(2002, 2, 2, 0, 0, 0, 0, time.UTC),
+		"top":      time.Date(2003, 3, 3, 0, 0, 0, 0, time.UTC),
+		".":        time.Date(2004, 4, 4, 0, 0, 0, 0, time.UTC),
+	}
+	// Directories are set last, as writing into them changes their time.
+	for _, path := range []string{"sub/file", "top", "sub", "."} {
+		testutil.CheckNoError(t, os.Chtimes(filepath.Join(src, path), modTimes[path], modTimes[path]))
+	}
+
+	_, err = CopyDir(src, filepath.Join(dest, "copy"), FileContext{}, DoNotChangeUID, DoNotChangeGID)
+	testutil.CheckNoError(t, err)
+	for path, expected := range modTimes {
+		fi, err := os.Stat(filepath.Join(dest, "copy", path))
+		testutil.CheckNoError(t, err)
+		if !fi.ModTime().Equal(expected) {
+			t.Errorf("expected the modification time of %s to be %s, got %s", path, expected, fi.ModTime())
+		}
+	}
+}
+
+func Test_CopyDir_Symlinks(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	testutil.CheckNoError(t, os.MkdirAll(filepath.Join(src, "dir"), 0755))
+	testutil.CheckNoError(t, ioutil.WriteFile(filepath.Join(src, "dir", "file"), []byte("dir file"), 0644))
+	testutil.CheckNoError(t, ioutil.WriteFile(filepath.Join(src, "link"), []byte("new"), 0644))
+	// dir points to a directory, which files are copied into, and link points
+	// to a file, which the copied file replaces.
+	testutil.CheckNoError(t, os.MkdirAll(filepath.Join(dest, "real"), 0755))
+	testutil.CheckNoError(t, os.Symlink(filepath.Join(dest, "real"), filepath.Join(dest, "dir")))
+	testutil.CheckNoError(t, ioutil.WriteFile(filepath.Join(dest, "target"), []byte("target"), 0644))
+	testutil.CheckNoError(t, os.Symlink(filepath.Join(dest, "target"), filepath.Join(dest, "link")))
+
+	_, err = CopyDir(src, dest, FileContext{}, DoNotChangeUID, DoNotChangeGID)
+	testutil.CheckNoError(t, err)
+
+	b, err := ioutil.ReadFile(filepath.Join(dest, "real", "file"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "dir file", string(b))
+	fi, err := os.Lstat(filepath.Join(dest, "link"))
+	testutil.CheckNoError(t, err)
+	if IsSymlink(fi) {
+		t.Errorf("expected %s to be replaced by the copied file", filepath.Join(dest, "link"))
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dest, "link"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "new", string(b))
+	b, err = ioutil.ReadFile(filepath.Join(dest, "target"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "target", string(b))
+}
+
 func Test_CopyFile_skips_self(t *testing.T) {
 	t.Parallel()
 	tempDir, err := ioutil.TempDir("", "kaniko_test")
@@ -1457,3 +1668,343 @@ func Test_setFileTimes(t *testing.T) {
 		})
 	}
 }
+
+func TestExtractFile_Capabilities(t *testing.T) {
+	// cap_net_bind_service=ep, in version 2.
+	caps := string([]byte{1, 0, 0, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	// The layer is written and read back, so that the PAX records go through tar.
+	var layer bytes.Buffer
+	w := tar.NewWriter(&layer)
+	hdr := fileHeader("ping", "ping", 0755, time.Now())
+	hdr.PAXRecords = map[string]string{paxCapabilityRecord: caps}
+	testutil.CheckNoError(t, w.WriteHeader(hdr))
+	_, err := w.Write([]byte("ping"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, w.Close())
+
+	for _, preserve := range []bool{true, false} {
+		t.Run(fmt.Sprintf("preserve %t", preserve), func(t *testing.T) {
+			defer ConfigurePreserveFileCapabilities(true)
+			ConfigurePreserveFileCapabilities(preserve)
+			dir, err := ioutil.TempDir("", "")
+			testutil.CheckNoError(t, err)
+			defer os.RemoveAll(dir)
+			probe := filepath.Join(dir, "probe")
+			testutil.CheckNoError(t, ioutil.WriteFile(probe, nil, 0644))
+			if err := setCapabilityXattr(probe, []byte(caps)); err != nil {
+				t.Skipf("file capabilities can't be set: %s", err)
+			}
+
+			tr := tar.NewReader(bytes.NewReader(layer.Bytes()))
+			hdr, err := tr.Next()
+			testutil.CheckNoError(t, err)
+			testutil.CheckNoError(t, ExtractFile(dir, hdr, tr))
+			path := filepath.Join(dir, "ping")
+			expected := ""
+			if preserve {
+				expected = caps
+			}
+			testutil.CheckDeepEqual(t, expected, fileCapabilities(path))
+
+			// The capabilities are kept when the file is added to a snapshot.
+			var snapshot bytes.Buffer
+			st := NewTar(&snapshot)
+			testutil.CheckNoError(t, st.AddFileToTar(path))
+			st.Close()
+			hdr, err = tar.NewReader(&snapshot).Next()
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, expected, hdr.PAXRecords[paxCapabilityRecord])
+		})
+	}
+}
+
+func TestExtractFile_CapabilitiesUnsupported(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		shouldErr bool
+	}{
+		{name: "without privileges", err: syscall.EPERM},
+		{name: "unsupported by the filesystem", err: syscall.EOPNOTSUPP},
+		{name: "other error", err: syscall.EIO, shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			original := setCapabilities
+			defer func() { setCapabilities = original }()
+			setCapabilities = func(string, []byte) error { return test.err }
+			dir, err := ioutil.TempDir("", "")
+			testutil.CheckNoError(t, err)
+			defer os.RemoveAll(dir)
+
+			hdr := fileHeader("ping", "ping", 0755, time.Now())
+			hdr.PAXRecords = map[string]string{paxCapabilityRecord: "caps"}
+			err = ExtractFile(dir, hdr, bytes.NewReader([]byte("ping")))
+			testutil.CheckError(t, test.shouldErr, err)
+		})
+	}
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func Test_GetFSFromLayers_LargeFileBoundedMemory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	root, err := ioutil.TempDir("", "layers-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// The layer is generated as it's read, so that only extracting it could
+	// use memory in proportion to the size of the file.
+	const size = 64 << 20
+	var header bytes.Buffer
+	tw := tar.NewWriter(&header)
+	if err := tw.WriteHeader(&tar.Header{Name: "large", Mode: 0644, Size: size, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	layer := io.MultiReader(&header, io.LimitReader(zeroReader{}, size), bytes.NewReader(make([]byte, 1024)))
+	mockLayer := mockv1.NewMockLayer(ctrl)
+	mockLayer.EXPECT().MediaType().Return(types.OCILayer, nil)
+	mockLayer.EXPECT().Uncompressed().Return(ioutil.NopCloser(layer), nil)
+
+	ConfigureExtractBufferSize(64 * 1024)
+	defer ConfigureExtractBufferSize(DefaultExtractBufferSize)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, err = GetFSFromLayers(root, []v1.Layer{mockLayer}, ExtractFunc(ExtractFile))
+	runtime.ReadMemStats(&after)
+	testutil.CheckNoError(t, err)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Errorf("expected the file to be streamed to disk, but %d bytes were allocated to extract %d bytes", allocated, size)
+	}
+	fi, err := os.Stat(filepath.Join(root, "large"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, int64(size), fi.Size())
+}
+
+func Test_ResolveDestination(t *testing.T) {
+	root, err := ioutil.TempDir("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	originalRoot := config.RootDir
+	defer func() { config.RootDir = originalRoot }()
+	config.RootDir = root
+	original := ignorelist
+	defer func() { ignorelist = original }()
+	ignorelist = append(ignorelist, IgnoreListEntry{Path: filepath.Join(root, "kaniko")})
+
+	for link, target := range map[string]string{
+		"absolute": "/data",
+		"relative": "../../../../etc",
+		"outside":  "/tmp/outside",
+		"ignored":  "/kaniko",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		description string
+		path        string
+		expected    string
+		shouldErr   bool
+	}{
+		{
+			description: "no symlink",
+			path:        "/app/file",
+			expected:    "/app/file",
+		},
+		{
+			description: "absolute symlink",
+			path:        "/absolute/file",
+			expected:    "/data/file",
+		},
+		{
+			description: "relative symlink can't leave the root",
+			path:        "/relative/file",
+			expected:    "/etc/file",
+		},
+		{
+			description: "absolute symlink can't leave the root",
+			path:        "/outside/file",
+			expected:    "/tmp/outside/file",
+		},
+		{
+			description: "symlink to an ignored path",
+			path:        "/ignored/file",
+			shouldErr:   true,
+		},
+		{
+			description: "ignored path",
+			path:        "/kaniko/file",
+			expected:    "/kaniko/file",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			resolved, err := ResolveDestination(filepath.Join(root, test.path))
+			testutil.CheckError(t, test.shouldErr, err)
+			if !test.shouldErr {
+				testutil.CheckDeepEqual(t, filepath.Join(root, test.expected), resolved)
+			}
+		})
+	}
+}
+
+func Test_GetFSFromLayers_PathTraversal(t *testing.T) {
+	tests := []struct {
+		description string
+		headers     []*tar.Header
+		expected    string
+		shouldErr   bool
+	}{
+		{
+			description: "relative path leading outside of the root",
+			headers:     []*tar.Header{{Name: "../../etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}},
+			shouldErr:   true,
+		},
+		{
+			description: "absolute path",
+			headers:     []*tar.Header{{Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}},
+			expected:    "etc/passwd",
+		},
+		{
+			description: "path through a symlink leading outside of the root",
+			headers: []*tar.Header{
+				{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "../../../../", Mode: 0777},
+				{Name: "escape/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			expected: "etc/passwd",
+		},
+		{
+			description: "hard link leading outside of the root",
+			headers:     []*tar.Header{{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd", Mode: 0644}},
+			shouldErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "layers-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(parent)
+			root := filepath.Join(parent, "root", "fs")
+			if err := os.MkdirAll(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Join(parent, "etc"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(parent, "etc", "passwd"), []byte("host"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := new(bytes.Buffer)
+			tw := tar.NewWriter(buf)
+			for _, hdr := range test.headers {
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			ctrl := gomock.NewController(t)
+			mockLayer := mockv1.NewMockLayer(ctrl)
+			mockLayer.EXPECT().MediaType().Return(types.OCILayer, nil)
+			mockLayer.EXPECT().Uncompressed().Return(ioutil.NopCloser(buf), nil)
+
+			_, err = GetFSFromLayers(root, []v1.Layer{mockLayer}, ExtractFunc(ExtractFile))
+			testutil.CheckError(t, test.shouldErr, err)
+			if !test.shouldErr {
+				if _, err := os.Stat(filepath.Join(root, test.expected)); err != nil {
+					t.Errorf("expected the entry to be extracted to %s: %v", test.expected, err)
+				}
+			}
+			host, err := ioutil.ReadFile(filepath.Join(parent, "etc", "passwd"))
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, "host", string(host))
+			if _, err := os.Stat(filepath.Join(root, "passwd")); err == nil {
+				t.Errorf("expected no link to the file outside of the root")
+			}
+		})
+	}
+}
+
+func Test_GetFSFromLayers_WhiteoutOfIgnoredPath(t *testing.T) {
+	tests := []struct {
+		description string
+		// ignoreRoot extracts to a directory which is itself ignored, like
+		// the dependency directories of COPY --from in the kaniko directory.
+		ignoreRoot bool
+		kept       bool
+	}{
+		{
+			description: "ignored path is kept",
+			kept:        true,
+		},
+		{
+			description: "ignored root",
+			ignoreRoot:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			dir, err := ioutil.TempDir("", "layers-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			originalRoot := config.RootDir
+			defer func() { config.RootDir = originalRoot }()
+			config.RootDir = dir
+			// The ignore list is detected again from the base one on extraction.
+			originalBase, original := baseIgnoreList, ignorelist
+			defer func() { baseIgnoreList, ignorelist = originalBase, original }()
+
+			root := dir
+			if test.ignoreRoot {
+				root = filepath.Join(dir, "kaniko", "stage")
+				baseIgnoreList = append(baseIgnoreList, IgnoreListEntry{Path: filepath.Join(dir, "kaniko")})
+			} else {
+				baseIgnoreList = append(baseIgnoreList, IgnoreListEntry{Path: filepath.Join(root, "mounted")})
+			}
+			testutil.CheckNoError(t, testutil.SetupFiles(root, map[string]string{
+				"mounted/secret": "secret",
+				"other":          "other",
+			}))
+
+			buf := new(bytes.Buffer)
+			tw := tar.NewWriter(buf)
+			for _, name := range []string{".wh.mounted", ".wh.other"} {
+				testutil.CheckNoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}))
+			}
+			testutil.CheckNoError(t, tw.Close())
+			mockLayer := mockv1.NewMockLayer(ctrl)
+			mockLayer.EXPECT().MediaType().Return(types.OCILayer, nil)
+			mockLayer.EXPECT().Uncompressed().Return(ioutil.NopCloser(buf), nil)
+
+			_, err = GetFSFromLayers(root, []v1.Layer{mockLayer}, ExtractFunc(fakeExtract))
+			testutil.CheckNoError(t, err)
+
+			testutil.CheckDeepEqual(t, test.kept, FilepathExists(filepath.Join(root, "mounted", "secret")))
+			testutil.CheckDeepEqual(t, false, FilepathExists(filepath.Join(root, "other")))
+		})
+	}
+}
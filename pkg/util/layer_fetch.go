@@ -0,0 +1,163 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// prefetchLayers returns layers whose compressed contents are downloaded in
+// the background to the kaniko directory, up to n at a time, in order. Another
+// layer is only downloaded once one is extracted, so that at most n downloaded
+// layers are on disk at once. The returned function must be called once the
+// layers are extracted, to wait for the downloads and remove their files.
+func prefetchLayers(layers []v1.Layer, n int) ([]v1.Layer, func()) {
+	slots := make(chan struct{}, n)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	prefetched := make([]*prefetchedLayer, len(layers))
+	for i, l := range layers {
+		prefetched[i] = &prefetchedLayer{Layer: l, done: make(chan struct{})}
+		prefetched[i].release = func() { <-slots }
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, p := range prefetched {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Add(1)
+			go func(i int, p *prefetchedLayer) {
+				defer wg.Done()
+				defer close(p.done)
+				logrus.Debugf("Downloading layer %d", i)
+				p.path, p.err = fetchLayer(p.Layer)
+			}(i, p)
+		}
+	}()
+
+	result := make([]v1.Layer, len(prefetched))
+	for i, p := range prefetched {
+		result[i] = p
+	}
+	return result, func() {
+		close(stop)
+		wg.Wait()
+		for _, p := range prefetched {
+			if p.path != "" {
+				os.Remove(p.path)
+			}
+		}
+	}
+}
+
+// fetchLayer writes the compressed contents of l to a file in the kaniko
+// directory and returns its path.
+func fetchLayer(l v1.Layer) (string, error) {
+	rc, err := l.Compressed()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	f, err := ioutil.TempFile(config.KanikoDir, "layer")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, rc); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// prefetchedLayer is a layer whose contents are read from the file it was
+// downloaded to, once the download is done.
+type prefetchedLayer struct {
+	v1.Layer
+	done    chan struct{}
+	path    string
+	err     error
+	release func()
+	once    sync.Once
+}
+
+func (p *prefetchedLayer) Uncompressed() (io.ReadCloser, error) {
+	<-p.done
+	if p.err != nil {
+		p.close()
+		return nil, p.err
+	}
+	f, err := os.Open(p.path)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	r := &prefetchedReader{f: f, layer: p}
+	br := bufio.NewReader(f)
+	// Layers may also be uncompressed, which is told by the gzip magic number.
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		if r.zr, err = gzip.NewReader(br); err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.Reader = r.zr
+	} else {
+		r.Reader = br
+	}
+	return r, nil
+}
+
+// close removes the file of the layer and lets another layer be downloaded.
+func (p *prefetchedLayer) close() {
+	p.once.Do(func() {
+		if p.path != "" {
+			os.Remove(p.path)
+		}
+		p.release()
+	})
+}
+
+type prefetchedReader struct {
+	io.Reader
+	f     *os.File
+	zr    *gzip.Reader
+	layer *prefetchedLayer
+}
+
+func (r *prefetchedReader) Close() error {
+	if r.zr != nil {
+		r.zr.Close()
+	}
+	err := r.f.Close()
+	r.layer.close()
+	return err
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+// fetchCounter counts the layers being downloaded at once.
+type fetchCounter struct {
+	mu        sync.Mutex
+	active    int
+	maxActive int
+	// started is closed once waitFor downloads are running at once.
+	started chan struct{}
+	waitFor int
+}
+
+func (c *fetchCounter) add(delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active += delta
+	if c.active > c.maxActive {
+		c.maxActive = c.active
+		if c.maxActive == c.waitFor {
+			close(c.started)
+		}
+	}
+}
+
+// countedLayer is a layer whose downloads are counted. The first downloads
+// wait for the others to start, so that they run at once if they can.
+type countedLayer struct {
+	v1.Layer
+	counter      *fetchCounter
+	wait         bool
+	uncompressed bool
+	err          error
+}
+
+func (l *countedLayer) Compressed() (io.ReadCloser, error) {
+	l.counter.add(1)
+	defer l.counter.add(-1)
+	if l.err != nil {
+		return nil, l.err
+	}
+	if l.wait {
+		select {
+		case <-l.counter.started:
+		case <-time.After(5 * time.Second):
+		}
+	}
+	rc, err := l.Layer.Compressed()
+	if l.uncompressed {
+		rc, err = l.Layer.Uncompressed()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Read the layer before returning, as it's downloaded when Compressed is called.
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	return ioutil.NopCloser(bytes.NewReader(b)), err
+}
+
+func testTarLayer(t *testing.T, i int) v1.Layer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	files := map[string]string{
+		fmt.Sprintf("layer%d", i): fmt.Sprintf("contents of layer %d", i),
+		"shared":                  fmt.Sprintf("shared in layer %d", i),
+	}
+	for _, name := range []string{fmt.Sprintf("layer%d", i), "shared"} {
+		testutil.CheckNoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))}))
+		_, err := tw.Write([]byte(files[name]))
+		testutil.CheckNoError(t, err)
+	}
+	testutil.CheckNoError(t, tw.Close())
+	l, err := tarball.LayerFromReader(buf)
+	testutil.CheckNoError(t, err)
+	return l
+}
+
+func Test_GetFSFromLayers_FetchParallelism(t *testing.T) {
+	kanikoDir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(kanikoDir)
+	config.KanikoDir = kanikoDir
+	defer func() { config.KanikoDir = constants.KanikoDir }()
+
+	const numLayers = 6
+	tests := []struct {
+		description   string
+		parallelism   int
+		failingLayer  int
+		shouldErr     bool
+		expectedFetch int
+	}{
+		{
+			description:  "sequential",
+			parallelism:  1,
+			failingLayer: -1,
+		},
+		{
+			description:   "3 layers in parallel",
+			parallelism:   3,
+			failingLayer:  -1,
+			expectedFetch: 3,
+		},
+		{
+			description:   "more parallelism than layers",
+			parallelism:   10,
+			failingLayer:  -1,
+			expectedFetch: numLayers,
+		},
+		{
+			description:   "download fails",
+			parallelism:   3,
+			failingLayer:  4,
+			shouldErr:     true,
+			expectedFetch: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			counter := &fetchCounter{started: make(chan struct{}), waitFor: test.expectedFetch}
+			var layers []v1.Layer
+			for i := 0; i < numLayers; i++ {
+				l := &countedLayer{
+					Layer:        testTarLayer(t, i),
+					counter:      counter,
+					wait:         i < test.expectedFetch,
+					uncompressed: i%2 == 1,
+				}
+				if i == test.failingLayer {
+					l.err = errors.New("download failed")
+				}
+				layers = append(layers, l)
+			}
+
+			root, err := ioutil.TempDir("", "")
+			testutil.CheckNoError(t, err)
+			defer os.RemoveAll(root)
+			// Each file is expected to have the contents of the last layer it's in.
+			contents := map[string]string{}
+			extract := func(dest string, hdr *tar.Header, r io.Reader) error {
+				b, err := ioutil.ReadAll(r)
+				contents[hdr.Name] = string(b)
+				return err
+			}
+			extracted, err := GetFSFromLayers(root, layers, ExtractFunc(extract), FetchParallelism(test.parallelism))
+			testutil.CheckError(t, test.shouldErr, err)
+			// Layers aren't downloaded ahead of their extraction when they
+			// are extracted sequentially.
+			testutil.CheckDeepEqual(t, test.expectedFetch, counter.maxActive)
+
+			// Downloaded layers are removed once they are extracted.
+			files, err := ioutil.ReadDir(kanikoDir)
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, 0, len(files))
+			if test.shouldErr {
+				return
+			}
+
+			expectedContents := map[string]string{"shared": fmt.Sprintf("shared in layer %d", numLayers-1)}
+			var expectedFiles []string
+			for i := 0; i < numLayers; i++ {
+				expectedContents[fmt.Sprintf("layer%d", i)] = fmt.Sprintf("contents of layer %d", i)
+				expectedFiles = append(expectedFiles, filepath.Join(root, fmt.Sprintf("layer%d", i)), filepath.Join(root, "shared"))
+			}
+			testutil.CheckDeepEqual(t, expectedContents, contents)
+			testutil.CheckDeepEqual(t, expectedFiles, extracted)
+		})
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// for testing
+var (
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+)
+
+type passwd struct {
+	name string // user name
+	uid  string // user ID
+	gid  string // primary group ID
+}
+
+type group struct {
+	id      string   // group ID
+	name    string   // group name
+	members []string // secondary group ids
+}
+
+// lookupUser returns the /etc/passwd entry of userStr, a user name or uid.
+// A uid without an entry has no entry, and nil is returned.
+func lookupUser(userStr string) (*passwd, error) {
+	var users []*passwd
+	f, err := os.Open(passwdFile)
+	if err == nil {
+		defer f.Close()
+		users = localUsers(f)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.name == userStr {
+			return u, nil
+		}
+	}
+	for _, u := range users {
+		if u.uid == userStr {
+			return u, nil
+		}
+	}
+	if !isNumeric(userStr) {
+		return nil, fmt.Errorf("unable to find user %s in %s", userStr, passwdFile)
+	}
+	return nil, nil
+}
+
+// lookupUserIDs returns the uid and primary gid of userStr, a user name or
+// uid, from /etc/passwd. A uid without an entry is used as is, along with a
+// primary gid equal to it.
+func lookupUserIDs(userStr string) (string, string, error) {
+	u, err := lookupUser(userStr)
+	if err != nil {
+		return "", "", err
+	}
+	if u == nil {
+		return userStr, userStr, nil
+	}
+	return u.uid, u.gid, nil
+}
+
+// supplementaryGroupIDs returns the ids of the groups username is a member of
+// in /etc/group.
+func supplementaryGroupIDs(username string) ([]string, error) {
+	f, err := os.Open(groupFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var gids []string
+	for _, g := range localGroups(f) {
+		for _, m := range g.members {
+			if m == username {
+				gids = append(gids, g.id)
+			}
+		}
+	}
+	return gids, nil
+}
+
+// lookupGroupID returns the gid of groupStr, a group name or gid, from
+// /etc/group. A gid without an entry is used as is.
+func lookupGroupID(groupStr string) (string, error) {
+	var groups []*group
+	f, err := os.Open(groupFile)
+	if err == nil {
+		defer f.Close()
+		groups = localGroups(f)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, g := range groups {
+		if g.name == groupStr {
+			return g.id, nil
+		}
+	}
+	if !isNumeric(groupStr) {
+		return "", fmt.Errorf("unable to find group %s in %s", groupStr, groupFile)
+	}
+	return groupStr, nil
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
+
+// localUsers parses a reader in /etc/passwd form, returning parsed user data
+func localUsers(r io.Reader) []*passwd {
+	var users []*passwd
+	forEachLocalLine(r, func(line string) {
+		// root:x:0:0:root:/root:/bin/sh
+		parts := strings.SplitN(line, ":", 5)
+		if len(parts) < 4 || !isNumeric(parts[2]) || !isNumeric(parts[3]) {
+			return
+		}
+		users = append(users, &passwd{name: parts[0], uid: parts[2], gid: parts[3]})
+	})
+	return users
+}
+
+// localGroups parses a reader in /etc/group form, returning parsed group data
+// based on src/os/user/lookup_unix.go - but extended to include secondary groups
+func localGroups(r io.Reader) []*group {
+	var groups []*group
+	forEachLocalLine(r, func(line string) {
+		// wheel:*:0:root,anotherGrp
+		parts := strings.SplitN(line, ":", 4)
+		if len(parts) < 4 || !isNumeric(parts[2]) {
+			return
+		}
+		groups = append(groups, &group{name: parts[0], id: parts[2], members: strings.Split(parts[3], ",")})
+	})
+	return groups
+}
+
+func forEachLocalLine(r io.Reader, f func(string)) {
+	bs := bufio.NewScanner(r)
+	for bs.Scan() {
+		line := bs.Bytes()
+
+		// There's no spec for /etc/passwd or /etc/group, but we try to follow
+		// the same rules as the glibc parser, which allows comments and blank
+		// space at the beginning of a line.
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		f(string(line))
+	}
+}
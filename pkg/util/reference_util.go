@@ -0,0 +1,85 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	localhost = "localhost"
+	// localhostPlaceholder stands for localhost while parsing references, as
+	// name.NewTag takes a first path component of localhost without a port for
+	// a Docker Hub namespace.
+	localhostPlaceholder = "localhost.invalid"
+)
+
+// ParseTag parses ref, the tag or repository an image is pushed to, with
+// the latest tag by default. Registries with ports and repositories with any
+// number of path components are supported, and, like for docker, a first
+// path component of localhost is the registry rather than a namespace.
+func ParseTag(ref string) (name.Tag, error) {
+	if rest := strings.TrimPrefix(ref, localhost+"/"); rest != ref {
+		tag, err := name.NewTag(localhostPlaceholder+"/"+rest, name.WeakValidation)
+		if err != nil {
+			return name.Tag{}, err
+		}
+		tag.Repository.Registry, err = name.NewRegistry(localhost, name.WeakValidation, name.Insecure)
+		return tag, err
+	}
+	return name.NewTag(ref, name.WeakValidation)
+}
+
+// ParseReference parses ref, a tag or a digest, the way ParseTag parses tags.
+func ParseReference(ref string) (name.Reference, error) {
+	if strings.Contains(ref, "@") {
+		if rest := strings.TrimPrefix(ref, localhost+"/"); rest != ref {
+			digest, err := name.NewDigest(localhostPlaceholder+"/"+rest, name.WeakValidation)
+			if err != nil {
+				return nil, err
+			}
+			digest.Repository.Registry, err = name.NewRegistry(localhost, name.WeakValidation, name.Insecure)
+			return digest, err
+		}
+		return name.NewDigest(ref, name.WeakValidation)
+	}
+	return ParseTag(ref)
+}
+
+// ParseRepository parses repo, a repository without a tag, the way ParseTag
+// parses references.
+func ParseRepository(repo string) (name.Repository, error) {
+	if rest := strings.TrimPrefix(repo, localhost+"/"); rest != repo {
+		r, err := ParseRepository(localhostPlaceholder + "/" + rest)
+		if err != nil {
+			return name.Repository{}, err
+		}
+		r.Registry, err = name.NewRegistry(localhost, name.WeakValidation, name.Insecure)
+		return r, err
+	}
+	r, err := name.NewRepository(repo, name.WeakValidation)
+	if err != nil {
+		if _, tagErr := name.NewTag(repo, name.WeakValidation); tagErr == nil {
+			return name.Repository{}, fmt.Errorf("%s must be a repository, without a tag", repo)
+		}
+		return name.Repository{}, err
+	}
+	return r, nil
+}
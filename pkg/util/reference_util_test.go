@@ -0,0 +1,98 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestParseTag(t *testing.T) {
+	tests := []struct {
+		ref        string
+		registry   string
+		repository string
+		tag        string
+		scheme     string
+		shouldErr  bool
+	}{
+		{ref: "localhost:5000/a/b/c:tag", registry: "localhost:5000", repository: "a/b/c", tag: "tag", scheme: "http"},
+		{ref: "localhost:5000/a/b/c", registry: "localhost:5000", repository: "a/b/c", tag: "latest", scheme: "http"},
+		{ref: "localhost/a/b:tag", registry: "localhost", repository: "a/b", tag: "tag", scheme: "http"},
+		{ref: "registry.example.com:8443/team/app/api:1.0", registry: "registry.example.com:8443", repository: "team/app/api", tag: "1.0", scheme: "https"},
+		{ref: "bob/image", registry: "index.docker.io", repository: "bob/image", tag: "latest", scheme: "https"},
+		{ref: "localhost:5000/a/b@sha256:0000000000000000000000000000000000000000000000000000000000000000", shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			tag, err := ParseTag(test.ref)
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			testutil.CheckDeepEqual(t, test.registry, tag.RegistryStr())
+			testutil.CheckDeepEqual(t, test.repository, tag.RepositoryStr())
+			testutil.CheckDeepEqual(t, test.tag, tag.TagStr())
+			testutil.CheckDeepEqual(t, test.scheme, tag.Registry.Scheme())
+		})
+	}
+}
+
+func TestParseRepository(t *testing.T) {
+	tests := []struct {
+		repo      string
+		expected  string
+		shouldErr bool
+	}{
+		{repo: "localhost:5000/a/b/cache", expected: "localhost:5000/a/b/cache"},
+		{repo: "localhost/a/cache", expected: "localhost/a/cache"},
+		{repo: "gcr.io/foo/cache", expected: "gcr.io/foo/cache"},
+		{repo: "localhost:5000/a/cache:tag", shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.repo, func(t *testing.T) {
+			repo, err := ParseRepository(test.repo)
+			testutil.CheckError(t, test.shouldErr, err)
+			if !test.shouldErr {
+				testutil.CheckDeepEqual(t, test.expected, repo.String())
+			}
+		})
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		ref       string
+		expected  string
+		shouldErr bool
+	}{
+		{ref: "localhost:5000/a/b:tag", expected: "localhost:5000/a/b"},
+		{ref: "localhost/a/b@sha256:0000000000000000000000000000000000000000000000000000000000000000", expected: "localhost/a/b"},
+		{ref: "gcr.io/foo/bar@sha256:0000000000000000000000000000000000000000000000000000000000000000", expected: "gcr.io/foo/bar"},
+		{ref: "gcr.io/foo/bar@sha256:invalid", shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			ref, err := ParseReference(test.ref)
+			testutil.CheckError(t, test.shouldErr, err)
+			if !test.shouldErr {
+				testutil.CheckDeepEqual(t, test.expected, ref.Context().String())
+			}
+		})
+	}
+}
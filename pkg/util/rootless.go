@@ -0,0 +1,57 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+var rootless struct {
+	enabled          bool
+	failOnUnreadable bool
+}
+
+// ConfigureRootless sets whether kaniko runs without root. Snapshots then skip
+// the files kaniko isn't allowed to read with a warning, unless
+// failOnUnreadable is set, and the files they contain are owned by the user
+// running kaniko, as it can't change the ownership of files.
+func ConfigureRootless(enabled, failOnUnreadable bool) {
+	rootless.enabled = enabled
+	rootless.failOnUnreadable = failOnUnreadable
+}
+
+// SkipUnreadable returns whether the file at path, which couldn't be read
+// because of err, should be left out of the snapshot.
+func SkipUnreadable(path string, err error) bool {
+	if !rootless.enabled || rootless.failOnUnreadable || !errors.Is(err, os.ErrPermission) {
+		return false
+	}
+	logging.Warnf("Not adding %s to the snapshot, as it can't be read without root: %s", path, err)
+	return true
+}
+
+// rootlessOwner returns the owner of the files added to snapshots, and whether
+// it replaces the owner of the files.
+func rootlessOwner() (int, int, bool) {
+	if !rootless.enabled {
+		return 0, 0, false
+	}
+	return os.Getuid(), os.Getgid(), true
+}
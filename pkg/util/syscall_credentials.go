@@ -18,43 +18,60 @@ package util
 
 import (
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
+// SyscallCredentials returns the credentials to run a command as userStr,
+// formatted as user or user:group with names or ids, from /etc/passwd and
+// /etc/group. The command is also run with the groups the user is a member of.
+// A uid without an entry in /etc/passwd is run with the root group, unless a
+// group is given.
 func SyscallCredentials(userStr string) (*syscall.Credential, error) {
-	uid, gid, err := GetUIDAndGIDFromString(userStr, true)
-	if err != nil {
-		return nil, errors.Wrap(err, "get uid/gid")
-	}
-
-	u, err := Lookup(userStr)
+	userAndGroup := strings.SplitN(userStr, ":", 2)
+	u, err := lookupUser(userAndGroup[0])
 	if err != nil {
 		return nil, errors.Wrap(err, "lookup")
 	}
-	logrus.Infof("util.Lookup returned: %+v", u)
-
-	var groups []uint32
+	uidStr, gidStr := userAndGroup[0], "0"
+	var gidStrs []string
+	if u != nil {
+		uidStr, gidStr = u.uid, u.gid
+		gidStrs, err = supplementaryGroupIDs(u.name)
+		if err != nil {
+			return nil, errors.Wrap(err, "group ids for user")
+		}
+	}
+	if len(userAndGroup) > 1 && userAndGroup[1] != "" {
+		gidStr, err = lookupGroupID(userAndGroup[1])
+		if err != nil {
+			return nil, errors.Wrap(err, "lookup")
+		}
+	}
 
-	gidStr, err := groupIDs(u)
+	uid, err := strconv.ParseUint(uidStr, 10, 32)
 	if err != nil {
-		return nil, errors.Wrap(err, "group ids for user")
+		return nil, errors.Wrap(err, "parseuint")
 	}
-
-	for _, g := range gidStr {
+	var groups []uint32
+	seen := map[string]bool{}
+	for _, g := range append([]string{gidStr}, gidStrs...) {
+		if seen[g] {
+			continue
+		}
+		seen[g] = true
 		i, err := strconv.ParseUint(g, 10, 32)
 		if err != nil {
 			return nil, errors.Wrap(err, "parseuint")
 		}
-
 		groups = append(groups, uint32(i))
 	}
 
 	return &syscall.Credential{
-		Uid:    uid,
-		Gid:    gid,
+		Uid:    uint32(uid),
+		Gid:    groups[0],
 		Groups: groups,
 	}, nil
 }
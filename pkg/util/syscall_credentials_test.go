@@ -0,0 +1,50 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestSyscallCredentials(t *testing.T) {
+	defer setUpEtcFiles(t)()
+
+	tests := []struct {
+		user     string
+		expected *syscall.Credential
+		shdErr   bool
+	}{
+		{user: "app", expected: &syscall.Credential{Uid: 1000, Gid: 1000, Groups: []uint32{1000, 3000}}},
+		{user: "1000", expected: &syscall.Credential{Uid: 1000, Gid: 1000, Groups: []uint32{1000, 3000}}},
+		{user: "web", expected: &syscall.Credential{Uid: 1001, Gid: 2000, Groups: []uint32{2000, 3000}}},
+		{user: "app:staff", expected: &syscall.Credential{Uid: 1000, Gid: 2000, Groups: []uint32{2000, 3000}}},
+		{user: "app:4000", expected: &syscall.Credential{Uid: 1000, Gid: 4000, Groups: []uint32{4000, 3000}}},
+		{user: "1234", expected: &syscall.Credential{Uid: 1234, Gid: 0, Groups: []uint32{0}}},
+		{user: "1234:docker", expected: &syscall.Credential{Uid: 1234, Gid: 3000, Groups: []uint32{3000}}},
+		{user: "missing", shdErr: true},
+		{user: "app:missing", shdErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.user, func(t *testing.T) {
+			credentials, err := SyscallCredentials(test.user)
+			testutil.CheckErrorAndDeepEqual(t, test.shdErr, err, test.expected, credentials)
+		})
+	}
+}
@@ -34,6 +34,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// for testing
+var openFile = os.Open
+
 // Tar knows how to write files to a tar file.
 type Tar struct {
 	hardlinks map[uint64]string
@@ -72,10 +75,25 @@ func (t *Tar) AddFileToTar(p string) error {
 		logrus.Infof("ignoring socket %s, not adding to tar", i.Name())
 		return nil
 	}
+	// The file is opened before its header is written, so that it can be left
+	// out if it can't be read.
+	var r *os.File
+	if i.Mode().IsRegular() {
+		if r, err = openFile(p); err != nil {
+			if SkipUnreadable(p, err) {
+				return nil
+			}
+			return err
+		}
+		defer r.Close()
+	}
 	hdr, err := tar.FileInfoHeader(i, linkDst)
 	if err != nil {
 		return err
 	}
+	if uid, gid, ok := rootlessOwner(); ok {
+		hdr.Uid, hdr.Gid = uid, gid
+	}
 
 	if p == config.RootDir {
 		// allow entry for / to preserve permission changes etc. (currently ignored anyway by Docker runtime)
@@ -98,6 +116,8 @@ func (t *Tar) AddFileToTar(p string) error {
 		hdr.Linkname = linkDst
 		hdr.Typeflag = tar.TypeLink
 		hdr.Size = 0
+	} else if i.Mode().IsRegular() {
+		addFileCapabilities(p, hdr)
 	}
 	if err := t.w.WriteHeader(hdr); err != nil {
 		return err
@@ -105,11 +125,6 @@ func (t *Tar) AddFileToTar(p string) error {
 	if !(i.Mode().IsRegular()) || hardlink {
 		return nil
 	}
-	r, err := os.Open(p)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
 	if _, err := io.Copy(t.w, r); err != nil {
 		return err
 	}
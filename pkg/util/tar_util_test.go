@@ -17,11 +17,14 @@ limitations under the License.
 package util
 
 import (
+	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 
 	"github.com/GoogleContainerTools/kaniko/testutil"
@@ -101,3 +104,81 @@ func createTar(testdir string, writer io.Writer) error {
 	}
 	return nil
 }
+
+func Test_AddFileToTar_Rootless(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(testDir)
+	if err := testutil.SetupFiles(testDir, map[string]string{"readable": "readable", "unreadable": "unreadable"}); err != nil {
+		t.Fatal(err)
+	}
+	// The files of others are owned by the user running kaniko in the snapshot.
+	testutil.CheckNoError(t, os.Lchown(filepath.Join(testDir, "readable"), 1234, 1234))
+	unreadable := filepath.Join(testDir, "unreadable")
+	original := openFile
+	defer func() { openFile = original }()
+	openFile = func(p string) (*os.File, error) {
+		if p == unreadable {
+			return nil, &os.PathError{Op: "open", Path: p, Err: syscall.EACCES}
+		}
+		return os.Open(p)
+	}
+	defer ConfigureRootless(false, false)
+
+	tests := []struct {
+		description      string
+		rootless         bool
+		failOnUnreadable bool
+		shouldErr        bool
+		expectedFiles    []string
+		expectedUID      int
+	}{
+		{
+			description: "not rootless",
+			shouldErr:   true,
+		},
+		{
+			description:   "rootless",
+			rootless:      true,
+			expectedFiles: []string{"readable"},
+			expectedUID:   os.Getuid(),
+		},
+		{
+			description:      "rootless failing on unreadable files",
+			rootless:         true,
+			failOnUnreadable: true,
+			shouldErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			ConfigureRootless(test.rootless, test.failOnUnreadable)
+			var buf bytes.Buffer
+			tw := NewTar(&buf)
+			var err error
+			for _, name := range []string{"readable", "unreadable"} {
+				if err = tw.AddFileToTar(filepath.Join(testDir, name)); err != nil {
+					break
+				}
+			}
+			tw.Close()
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			var files []string
+			tr := tar.NewReader(&buf)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				testutil.CheckNoError(t, err)
+				files = append(files, filepath.Base(hdr.Name))
+				testutil.CheckDeepEqual(t, test.expectedUID, hdr.Uid)
+				testutil.CheckDeepEqual(t, test.expectedUID, hdr.Gid)
+			}
+			testutil.CheckDeepEqual(t, test.expectedFiles, files)
+		})
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+)
+
+var (
+	tempFilesMu sync.Mutex
+	tempFiles   []string
+)
+
+// TempFile creates a new temporary file in dir, like ioutil.TempFile, for a
+// layer the built image is made of. As the layer is only read once the image
+// is pushed, the file is kept until RemoveTempFiles is called.
+func TempFile(dir, pattern string) (*os.File, error) {
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	tempFilesMu.Lock()
+	defer tempFilesMu.Unlock()
+	tempFiles = append(tempFiles, f.Name())
+	return f, nil
+}
+
+// RemoveTempFiles removes the files created with TempFile, once the built image
+// has been pushed or the build has failed.
+func RemoveTempFiles() {
+	tempFilesMu.Lock()
+	defer tempFilesMu.Unlock()
+	for _, name := range tempFiles {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logging.Warnf("Failed to remove %s: %s", name, err)
+		}
+	}
+	tempFiles = nil
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestRemoveTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "temp-files")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var names []string
+	for i := 0; i < 2; i++ {
+		f, err := TempFile(dir, "layer")
+		testutil.CheckNoError(t, err)
+		testutil.CheckNoError(t, f.Close())
+		names = append(names, f.Name())
+	}
+	// A file removed by its user isn't an error.
+	testutil.CheckNoError(t, os.Remove(names[0]))
+	RemoveTempFiles()
+	for _, name := range names {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+}
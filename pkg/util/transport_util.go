@@ -21,10 +21,16 @@ import (
 	"crypto/x509"
 
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
 )
 
 type CertPool interface {
@@ -54,7 +60,7 @@ var systemCertLoader CertPool
 func init() {
 	systemCertPool, err := x509.SystemCertPool()
 	if err != nil {
-		logrus.Warn("Failed to load system cert pool. Loading empty one instead.")
+		logging.Warnf("Failed to load system cert pool. Loading empty one instead.")
 		systemCertPool = x509.NewCertPool()
 	}
 	systemCertLoader = &X509CertPool{
@@ -65,6 +71,7 @@ func init() {
 func MakeTransport(opts config.RegistryOptions, registryName string) http.RoundTripper {
 	// Create a transport to set our user-agent.
 	var tr http.RoundTripper = http.DefaultTransport.(*http.Transport).Clone()
+	tr.(*http.Transport).Proxy = proxyFunc(opts)
 	if opts.SkipTLSVerify || opts.SkipTLSVerifyRegistries.Contains(registryName) {
 		tr.(*http.Transport).TLSClientConfig = &tls.Config{
 			InsecureSkipVerify: true,
@@ -80,3 +87,33 @@ func MakeTransport(opts config.RegistryOptions, registryName string) http.RoundT
 	}
 	return tr
 }
+
+// proxyFunc returns the proxy function of the transport. Proxies are read from
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY, unless they are set in opts.
+func proxyFunc(opts config.RegistryOptions) func(*http.Request) (*url.URL, error) {
+	cfg := httpproxy.FromEnvironment()
+	if opts.HTTPProxy != "" {
+		cfg.HTTPProxy = opts.HTTPProxy
+	}
+	if opts.HTTPSProxy != "" {
+		cfg.HTTPSProxy = opts.HTTPSProxy
+	}
+	if opts.NoProxy != "" {
+		cfg.NoProxy = opts.NoProxy
+	}
+	proxy := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// IsTransientError returns true if err is a network error, or a registry
+// response that may succeed when retried: a server error or too many requests.
+func IsTransientError(err error) bool {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode >= http.StatusInternalServerError || terr.StatusCode == http.StatusTooManyRequests
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
@@ -21,9 +21,14 @@ import (
 	"crypto/x509"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/config"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
 )
 
 type mockedCertPool struct {
@@ -108,3 +113,143 @@ func Test_makeTransport(t *testing.T) {
 
 	}
 }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_IsTransientError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "server error", err: &transport.Error{StatusCode: http.StatusBadGateway}, expected: true},
+		{name: "too many requests", err: &transport.Error{StatusCode: http.StatusTooManyRequests}, expected: true},
+		{name: "not found", err: &transport.Error{StatusCode: http.StatusNotFound}},
+		{name: "unauthorized", err: &transport.Error{StatusCode: http.StatusUnauthorized}},
+		{name: "wrapped network error", err: errors.Wrap(timeoutError{}, "fetching manifest"), expected: true},
+		{name: "other error", err: errors.New("invalid reference")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransientError(tt.err); got != tt.expected {
+				t.Errorf("IsTransientError(%v) = %v, expected %v", tt.err, got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_MakeTransport_Proxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	tr := MakeTransport(config.RegistryOptions{HTTPProxy: proxy.URL}, "registry.example.com")
+	resp, err := (&http.Client{Transport: tr}).Get("http://registry.example.com/v2/")
+	if err != nil {
+		t.Fatalf("expected the request to be sent to the proxy: %v", err)
+	}
+	resp.Body.Close()
+	if got := <-proxied; got != "http://registry.example.com/v2/" {
+		t.Errorf("expected the proxy to receive http://registry.example.com/v2/, got %s", got)
+	}
+}
+
+func Test_MakeTransport_ProxySettings(t *testing.T) {
+	for key, value := range map[string]string{
+		"HTTP_PROXY":  "http://env-proxy:3128",
+		"HTTPS_PROXY": "http://env-proxy:3128",
+		"NO_PROXY":    "internal.example.com",
+	} {
+		original, ok := os.LookupEnv(key)
+		os.Setenv(key, value)
+		defer func(key string) {
+			if ok {
+				os.Setenv(key, original)
+			} else {
+				os.Unsetenv(key)
+			}
+		}(key)
+		// http.ProxyFromEnvironment also reads the lowercase variables.
+		lower := strings.ToLower(key)
+		originalLower, okLower := os.LookupEnv(lower)
+		os.Unsetenv(lower)
+		defer func() {
+			if okLower {
+				os.Setenv(lower, originalLower)
+			}
+		}()
+	}
+
+	tests := []struct {
+		name     string
+		opts     config.RegistryOptions
+		url      string
+		expected string
+	}{
+		{
+			name:     "proxy from environment",
+			url:      "https://gcr.io/v2/",
+			expected: "http://env-proxy:3128",
+		},
+		{
+			name: "no proxy from environment",
+			url:  "https://internal.example.com/v2/",
+		},
+		{
+			name:     "https proxy overrides environment",
+			opts:     config.RegistryOptions{HTTPSProxy: "http://flag-proxy:8080"},
+			url:      "https://gcr.io/v2/",
+			expected: "http://flag-proxy:8080",
+		},
+		{
+			name:     "http proxy overrides environment",
+			opts:     config.RegistryOptions{HTTPProxy: "http://flag-proxy:8080"},
+			url:      "http://insecure.example.com/v2/",
+			expected: "http://flag-proxy:8080",
+		},
+		{
+			name:     "http proxy isn't used for https",
+			opts:     config.RegistryOptions{HTTPProxy: "http://flag-proxy:8080"},
+			url:      "https://gcr.io/v2/",
+			expected: "http://env-proxy:3128",
+		},
+		{
+			name:     "no proxy overrides environment",
+			opts:     config.RegistryOptions{NoProxy: "gcr.io"},
+			url:      "https://internal.example.com/v2/",
+			expected: "http://env-proxy:3128",
+		},
+		{
+			name: "no proxy excludes registry",
+			opts: config.RegistryOptions{HTTPSProxy: "http://flag-proxy:8080", NoProxy: ".example.com"},
+			url:  "https://registry.example.com/v2/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := MakeTransport(tt.opts, req.URL.Host)
+			proxyURL, err := tr.(*http.Transport).Proxy(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if proxyURL != nil {
+				got = proxyURL.String()
+			}
+			if got != tt.expected {
+				t.Errorf("expected proxy %q for %s, got %q", tt.expected, tt.url, got)
+			}
+		})
+	}
+}
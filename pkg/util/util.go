@@ -29,8 +29,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/logging"
 	"github.com/minio/highwayhash"
-	"github.com/sirupsen/logrus"
 )
 
 // Hasher returns a hash function, used in snapshotting to determine if a file has changed
@@ -56,6 +56,9 @@ func Hasher() func(string) (string, error) {
 		h.Write([]byte(strconv.FormatUint(uint64(fi.Sys().(*syscall.Stat_t).Gid), 36)))
 
 		if fi.Mode().IsRegular() {
+			if caps := fileCapabilities(p); caps != "" {
+				h.Write([]byte(caps))
+			}
 			f, err := os.Open(p)
 			if err != nil {
 				return "", err
@@ -75,20 +78,31 @@ func Hasher() func(string) (string, error) {
 
 // CacheHasher takes into account everything the regular hasher does except for mtime
 func CacheHasher() func(string) (string, error) {
+	return FileContextHasher(FileContext{})
+}
+
+// FileContextHasher returns a hash function like CacheHasher, which reads files
+// from the filesystem of context.
+func FileContextHasher(context FileContext) func(string) (string, error) {
+	fs := context.Filesystem()
 	hasher := func(p string) (string, error) {
 		h := md5.New()
-		fi, err := os.Lstat(p)
+		fi, err := context.Lstat(p)
 		if err != nil {
 			return "", err
 		}
 		h.Write([]byte(fi.Mode().String()))
 
-		h.Write([]byte(strconv.FormatUint(uint64(fi.Sys().(*syscall.Stat_t).Uid), 36)))
+		var uid, gid uint32
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			uid, gid = stat.Uid, stat.Gid
+		}
+		h.Write([]byte(strconv.FormatUint(uint64(uid), 36)))
 		h.Write([]byte(","))
-		h.Write([]byte(strconv.FormatUint(uint64(fi.Sys().(*syscall.Stat_t).Gid), 36)))
+		h.Write([]byte(strconv.FormatUint(uint64(gid), 36)))
 
 		if fi.Mode().IsRegular() {
-			f, err := os.Open(p)
+			f, err := fs.Open(p)
 			if err != nil {
 				return "", err
 			}
@@ -139,6 +153,72 @@ func RedoHasher() func(string) (string, error) {
 	return hasher
 }
 
+// for testing
+var racyHashWindow = time.Second
+
+// fileStamp holds the attributes of a file that change whenever the file is
+// written to, which tell whether its hash has to be computed again.
+type fileStamp struct {
+	dev, ino     uint64
+	size         int64
+	mode         os.FileMode
+	uid, gid     uint32
+	mtime, ctime int64
+}
+
+// MemoizedHasher returns hasher with the hashes it computes kept in memory, so
+// that the files that are unchanged when they are hashed again, such as in
+// later snapshots of a stage, aren't read again. A file is told unchanged if
+// its inode, size, mode, owner, modification and change times are.
+func MemoizedHasher(hasher func(string) (string, error)) func(string) (string, error) {
+	type memo struct {
+		stamp fileStamp
+		hash  string
+	}
+	var mu sync.Mutex
+	memos := map[string]memo{}
+	return func(p string) (string, error) {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return hasher(p)
+		}
+		stamp := fileStamp{
+			dev:   uint64(stat.Dev),
+			ino:   stat.Ino,
+			size:  fi.Size(),
+			mode:  fi.Mode(),
+			uid:   stat.Uid,
+			gid:   stat.Gid,
+			mtime: fi.ModTime().UnixNano(),
+			ctime: statCtime(stat),
+		}
+		mu.Lock()
+		m, ok := memos[p]
+		mu.Unlock()
+		if ok && m.stamp == stamp {
+			return m.hash, nil
+		}
+
+		start := time.Now()
+		hash, err := hasher(p)
+		if err != nil {
+			return "", err
+		}
+		// A file changed right before it is hashed may change again without
+		// its times changing, as they are only as precise as the filesystem.
+		if stamp.ctime < start.Add(-racyHashWindow).UnixNano() {
+			mu.Lock()
+			memos[p] = memo{stamp: stamp, hash: hash}
+			mu.Unlock()
+		}
+		return hash, nil
+	}
+}
+
 // SHA256 returns the shasum of the contents of r
 func SHA256(r io.Reader) (string, error) {
 	hasher := sha256.New()
@@ -162,10 +242,15 @@ type retryFunc func() error
 
 // Retry retries an operation
 func Retry(operation retryFunc, retryCount int, initialDelayMilliseconds int) error {
+	return RetryIf(operation, retryCount, initialDelayMilliseconds, func(error) bool { return true })
+}
+
+// RetryIf is like Retry, but stops retrying once shouldRetry returns false for an error.
+func RetryIf(operation retryFunc, retryCount int, initialDelayMilliseconds int, shouldRetry func(error) bool) error {
 	err := operation()
-	for i := 0; err != nil && i < retryCount; i++ {
+	for i := 0; err != nil && shouldRetry(err) && i < retryCount; i++ {
 		sleepDuration := time.Millisecond * time.Duration(int(math.Pow(2, float64(i)))*initialDelayMilliseconds)
-		logrus.Warnf("Retrying operation after %s due to %v", sleepDuration, err)
+		logging.Warnf("Retrying operation after %s due to %v", sleepDuration, err)
 		time.Sleep(sleepDuration)
 		err = operation()
 	}
@@ -1,6 +1,3 @@
-// +build linux darwin
-// +build cgo
-
 /*
 Copyright 2020 Google LLC
 
@@ -20,10 +17,11 @@ limitations under the License.
 package util
 
 import (
-	"os/user"
+	"syscall"
+	"time"
 )
 
-// groupIDs returns all of the group ID's a user is a member of
-func groupIDs(u *user.User) ([]string, error) {
-	return u.GroupIds()
+// statCtime returns the change time of stat in nanoseconds.
+func statCtime(stat *syscall.Stat_t) int64 {
+	return time.Unix(stat.Ctimespec.Unix()).UnixNano()
 }
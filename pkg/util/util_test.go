@@ -20,7 +20,11 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/GoogleContainerTools/kaniko/testutil"
 )
@@ -64,3 +68,62 @@ func TestRetry(t *testing.T) {
 		t.Fatalf("Not expecting error: %v", err)
 	}
 }
+
+func TestMemoizedHasher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	testutil.CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	other := filepath.Join(dir, "other")
+	testutil.CheckNoError(t, ioutil.WriteFile(file, []byte("a"), 0644))
+	testutil.CheckNoError(t, ioutil.WriteFile(other, []byte("a"), 0644))
+
+	original := racyHashWindow
+	defer func() { racyHashWindow = original }()
+	racyHashWindow = 0
+
+	hashed := map[string]int{}
+	inner := Hasher()
+	hasher := MemoizedHasher(func(p string) (string, error) {
+		hashed[p]++
+		return inner(p)
+	})
+	// hash checks the hash of path is the one of the inner hasher, and
+	// returns the number of times path was hashed by it.
+	hash := func(path string) int {
+		got, err := hasher(path)
+		testutil.CheckNoError(t, err)
+		expected, err := inner(path)
+		testutil.CheckNoError(t, err)
+		testutil.CheckDeepEqual(t, expected, got)
+		return hashed[path]
+	}
+
+	testutil.CheckDeepEqual(t, 1, hash(file))
+	testutil.CheckDeepEqual(t, 1, hash(file))
+	testutil.CheckDeepEqual(t, 1, hash(other))
+
+	// Files with the same size and modification time are hashed again when
+	// their contents change.
+	fi, err := os.Stat(file)
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, ioutil.WriteFile(file, []byte("b"), 0644))
+	testutil.CheckNoError(t, os.Chtimes(file, fi.ModTime(), fi.ModTime()))
+	testutil.CheckDeepEqual(t, 2, hash(file))
+	testutil.CheckDeepEqual(t, 2, hash(file))
+
+	testutil.CheckNoError(t, os.Chmod(file, 0600))
+	testutil.CheckDeepEqual(t, 3, hash(file))
+	testutil.CheckDeepEqual(t, 1, hash(other))
+
+	// Files changed right before they are hashed are hashed again.
+	racyHashWindow = time.Hour
+	testutil.CheckNoError(t, ioutil.WriteFile(file, []byte("c"), 0644))
+	testutil.CheckDeepEqual(t, 4, hash(file))
+	testutil.CheckDeepEqual(t, 5, hash(file))
+
+	// Missing files aren't hashed.
+	testutil.CheckNoError(t, os.Remove(file))
+	_, err = hasher(file)
+	testutil.CheckError(t, true, err)
+}